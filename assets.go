@@ -0,0 +1,236 @@
+package sitehit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// assetKinds are the subresource types --warm-assets understands.
+var assetKinds = []string{"css", "js", "img"}
+
+// assetBodyLimit is how much of an HTML page is parsed for assets.
+const assetBodyLimit = 2 << 20
+
+// Asset is a same-host subresource of a page, requested by --warm-assets.
+type Asset struct {
+	URL        string
+	Kind       string // "css", "js" or "img"
+	StatusCode int
+	Bytes      int64
+	Duration   time.Duration
+	Error      error
+
+	wireBytes int64 // of the body before gzip decoding, for the egress
+}
+
+// assetCache makes sure every asset is requested only once per run, however
+// many pages reference it.
+type assetCache struct {
+	mu      sync.Mutex
+	entries map[string]*assetEntry
+}
+
+type assetEntry struct {
+	once  sync.Once
+	asset Asset
+}
+
+func newAssetCache() *assetCache {
+	return &assetCache{entries: make(map[string]*assetEntry)}
+}
+
+// warm requests the assets referenced by an HTML page and returns their
+// results. Assets already requested by another page are not fetched again.
+func (c *assetCache) warm(ctx context.Context, resp *http.Response, body []byte, opts Options) []Asset {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil
+	}
+
+	var assets []Asset
+	for _, ref := range findAssets(resp.Request.URL, body, opts.WarmAssets) {
+		c.mu.Lock()
+		entry, ok := c.entries[ref.URL]
+		if !ok {
+			entry = &assetEntry{}
+			c.entries[ref.URL] = entry
+		}
+		c.mu.Unlock()
+
+		entry.once.Do(func() {
+			entry.asset = fetchAsset(ctx, ref, opts)
+		})
+		assets = append(assets, entry.asset)
+	}
+	return assets
+}
+
+func fetchAsset(ctx context.Context, asset Asset, opts Options) Asset {
+	log := opts.logger()
+	opts.rate.wait(ctx)
+	start := time.Now()
+	// Ask for gzip ourselves, as for pages, to count the bytes on the wire
+	header := http.Header{"Accept-Encoding": {"gzip"}}
+	resp, err := fetch(ctx, http.MethodGet, asset.URL, nil, 1, header, opts)
+	if err != nil {
+		asset.Duration = time.Since(start)
+		asset.Error = err
+		log.Error(fmt.Sprintf("  Asset: Error visiting %s: %v", asset.URL, err),
+			"event", "asset", "url", asset.URL, "kind", asset.Kind, "error", err.Error())
+		return asset
+	}
+	var body io.Reader = resp.Body
+	var gz *gzipBody
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz = newGzipBody(body)
+		body = gz
+	}
+	asset.Bytes, _ = io.Copy(io.Discard, body)
+	asset.wireBytes = asset.Bytes
+	if gz != nil {
+		asset.wireBytes = gz.wire.n
+	}
+	resp.Body.Close()
+	asset.Duration = time.Since(start)
+	asset.StatusCode = resp.StatusCode
+
+	text := fmt.Sprintf("  Asset: Visited %s - Status: %d, Time: %v", asset.URL, asset.StatusCode, asset.Duration)
+	attrs := []any{"event", "asset", "url", asset.URL, "kind", asset.Kind, "status", asset.StatusCode, "duration_ms", asset.Duration.Milliseconds()}
+	if asset.StatusCode == http.StatusOK {
+		log.Info(text, attrs...)
+	} else {
+		log.Error(text, attrs...)
+	}
+	return asset
+}
+
+// findAssets returns the assets of the given kinds referenced by an HTML
+// page at base, limited to the page's own host and without duplicates.
+func findAssets(base *url.URL, body []byte, kinds []string) []Asset {
+	want := make(map[string]bool, len(kinds))
+	for _, kind := range kinds {
+		want[kind] = true
+	}
+
+	var assets []Asset
+	seen := make(map[string]bool)
+	add := func(kind, ref string) {
+		if !want[kind] || ref == "" {
+			return
+		}
+		u, err := base.Parse(strings.TrimSpace(ref))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || !strings.EqualFold(u.Host, base.Host) {
+			return
+		}
+		u.Fragment = ""
+		if s := u.String(); !seen[s] {
+			seen[s] = true
+			assets = append(assets, Asset{URL: s, Kind: kind})
+		}
+	}
+
+	z := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return assets
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tag := z.Token()
+			attrs := make(map[string]string, len(tag.Attr))
+			for _, attr := range tag.Attr {
+				attrs[attr.Key] = attr.Val
+			}
+			switch tag.Data {
+			case "link":
+				if rels := strings.Fields(strings.ToLower(attrs["rel"])); slices.Contains(rels, "stylesheet") {
+					add("css", attrs["href"])
+				}
+			case "script":
+				add("js", attrs["src"])
+			case "img":
+				add("img", attrs["src"])
+			}
+		}
+	}
+}
+
+// weightBudget is the repeatable --weight-budget flag: the most a page with
+// --warm-assets may weigh, its own body and assets together under "total",
+// or the most its assets of one kind may.
+type weightBudget map[string]byteSize
+
+func (w *weightBudget) String() string {
+	if w == nil {
+		return ""
+	}
+	var parts []string
+	for _, kind := range slices.Sorted(maps.Keys(*w)) {
+		parts = append(parts, kind+"="+(*w)[kind].String())
+	}
+	return strings.Join(parts, ",")
+}
+
+func (w *weightBudget) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		kind, size, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			kind, size = "total", kind
+		}
+		if kind != "total" && !slices.Contains(assetKinds, kind) {
+			return fmt.Errorf("%q: must be a size, or KIND=SIZE for total, %s", part, strings.Join(assetKinds, ", "))
+		}
+		var b byteSize
+		if err := b.Set(size); err != nil {
+			return err
+		}
+		if *w == nil {
+			*w = weightBudget{}
+		}
+		(*w)[kind] = b
+	}
+	return nil
+}
+
+// weighPage sets the weight of the page of result, its body and assets
+// together, counts its failed assets and names the budgets it exceeds,
+// logging them.
+func weighPage(result *Result, opts Options) {
+	weights := map[string]int64{}
+	result.PageWeight = result.BytesRead
+	for _, asset := range result.Assets {
+		result.PageWeight += asset.Bytes
+		weights[asset.Kind] += asset.Bytes
+		if asset.StatusCode != http.StatusOK {
+			result.AssetsFailed++
+		}
+	}
+	weights["total"] = result.PageWeight
+
+	log := opts.logger()
+	log.Info(fmt.Sprintf("  Page weight: %s with %d assets (%d failed)", formatBytes(result.PageWeight), len(result.Assets), result.AssetsFailed),
+		"event", "page_weight", "url", result.URL, "page_weight", result.PageWeight, "assets", len(result.Assets), "assets_failed", result.AssetsFailed)
+
+	var over []string
+	for _, kind := range slices.Sorted(maps.Keys(opts.weightBudget)) {
+		if budget := int64(opts.weightBudget[kind]); weights[kind] > budget {
+			result.OverBudget = append(result.OverBudget, kind)
+			over = append(over, fmt.Sprintf("%s %s of %s", kind, formatBytes(weights[kind]), formatBytes(budget)))
+		}
+	}
+	if len(over) > 0 {
+		log.Warn(fmt.Sprintf("  Over weight budget: %s", strings.Join(over, ", ")),
+			"event", "weight_budget", "url", result.URL, "over_budget", result.OverBudget)
+	}
+}
@@ -0,0 +1,160 @@
+package sitehit
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"time"
+)
+
+// Thresholds for --canary-host to recommend a rollback: an error rate this
+// far above the primary's, or a median or p95 latency this many times it
+// and slower by at least the margin, so jitter on fast pages doesn't count.
+const (
+	canaryErrorMargin   = 0.01
+	canaryLatencyFactor = 1.25
+	canaryLatencyMargin = 50 * time.Millisecond
+)
+
+// routeCanary points percent of urls at the canary host, returning the new
+// list and which of its URLs go to the canary. The split is by a hash of the
+// URL, so a page goes to the same side in every run.
+func routeCanary(urls []string, host string, percent float64) ([]string, map[string]bool) {
+	routed := make([]string, len(urls))
+	canary := make(map[string]bool)
+	for i, url := range urls {
+		routed[i] = url
+		h := fnv.New32a()
+		h.Write([]byte(url))
+		if float64(h.Sum32()%10000) >= percent*100 {
+			continue
+		}
+		target, err := rebase(url, host)
+		if err != nil {
+			continue
+		}
+		routed[i] = target
+		canary[target] = true
+	}
+	return routed, canary
+}
+
+// canarySide is how the URLs sent to one side of a canary run fared.
+type canarySide struct {
+	URLs          int
+	Failed        int
+	ErrorRate     float64
+	P50, P95, P99 time.Duration
+}
+
+// MarshalJSON encodes the side with its latencies in milliseconds.
+func (s canarySide) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		URLs      int     `json:"urls"`
+		Failed    int     `json:"failed"`
+		ErrorRate float64 `json:"error_rate"`
+		P50Ms     int64   `json:"p50_ms"`
+		P95Ms     int64   `json:"p95_ms"`
+		P99Ms     int64   `json:"p99_ms"`
+	}{s.URLs, s.Failed, s.ErrorRate, s.P50.Milliseconds(), s.P95.Milliseconds(), s.P99.Milliseconds()})
+}
+
+// canaryReport compares the canary with the primary and recommends whether
+// to promote it.
+type canaryReport struct {
+	Host           string     `json:"host"`
+	Primary        canarySide `json:"primary"`
+	Canary         canarySide `json:"canary"`
+	Recommendation string     `json:"recommendation"` // "promote", "rollback" or "inconclusive"
+	Reasons        []string   `json:"reasons"`
+}
+
+func compareCanary(host string, resultsList []Result, canary map[string]bool) canaryReport {
+	var primary, routed []Result
+	for _, result := range resultsList {
+		if result.Skipped {
+			continue
+		}
+		if canary[result.URL] {
+			routed = append(routed, result)
+		} else {
+			primary = append(primary, result)
+		}
+	}
+	rep := canaryReport{Host: host, Primary: measureSide(primary), Canary: measureSide(routed), Reasons: []string{}}
+	p, c := rep.Primary, rep.Canary
+
+	switch {
+	case p.URLs == 0 || c.URLs == 0:
+		rep.Recommendation = "inconclusive"
+		rep.Reasons = append(rep.Reasons, "no URLs visited on one of the sides")
+		return rep
+	case c.ErrorRate > p.ErrorRate+canaryErrorMargin:
+		rep.Reasons = append(rep.Reasons, fmt.Sprintf("error rate %.1f%% vs %.1f%%", c.ErrorRate*100, p.ErrorRate*100))
+	}
+	if slower(c.P50, p.P50) {
+		rep.Reasons = append(rep.Reasons, fmt.Sprintf("median latency %v vs %v", c.P50.Round(time.Millisecond), p.P50.Round(time.Millisecond)))
+	}
+	if slower(c.P95, p.P95) {
+		rep.Reasons = append(rep.Reasons, fmt.Sprintf("p95 latency %v vs %v", c.P95.Round(time.Millisecond), p.P95.Round(time.Millisecond)))
+	}
+	rep.Recommendation = "promote"
+	if len(rep.Reasons) > 0 {
+		rep.Recommendation = "rollback"
+	}
+	return rep
+}
+
+// slower reports whether the canary latency c is significantly above p.
+func slower(c, p time.Duration) bool {
+	return float64(c) > float64(p)*canaryLatencyFactor && c-p >= canaryLatencyMargin
+}
+
+func measureSide(resultsList []Result) canarySide {
+	side := canarySide{URLs: len(resultsList)}
+	durations := make([]time.Duration, len(resultsList))
+	for i, result := range resultsList {
+		if !result.Success && !result.Ignored {
+			side.Failed++
+		}
+		durations[i] = result.Duration
+	}
+	if side.URLs == 0 {
+		return side
+	}
+	side.ErrorRate = float64(side.Failed) / float64(side.URLs)
+	slices.Sort(durations)
+	at := func(q float64) time.Duration {
+		return durations[min(int(q*float64(len(durations))), len(durations)-1)]
+	}
+	side.P50, side.P95, side.P99 = at(0.5), at(0.95), at(0.99)
+	return side
+}
+
+func printCanary(rep canaryReport) {
+	if console.structured() {
+		console.Info("Canary", "event", "canary", "canary", rep)
+		return
+	}
+	fmt.Printf("\nCanary (%s):\n", rep.Host)
+	fmt.Printf("%-10s %8s %8s %10s %10s %10s\n", "", "URLs", "Errors", "p50", "p95", "p99")
+	for _, row := range []struct {
+		name string
+		side canarySide
+	}{{"Primary", rep.Primary}, {"Canary", rep.Canary}} {
+		fmt.Printf("%-10s %8d %7.1f%% %10v %10v %10v\n", row.name, row.side.URLs, row.side.ErrorRate*100,
+			row.side.P50.Round(time.Millisecond), row.side.P95.Round(time.Millisecond), row.side.P99.Round(time.Millisecond))
+	}
+	switch rep.Recommendation {
+	case "rollback":
+		fmt.Println("\033[31mRecommendation: rollback\033[0m")
+	case "inconclusive":
+		fmt.Println("\033[33mRecommendation: inconclusive\033[0m")
+	default:
+		fmt.Println("Recommendation: promote")
+	}
+	for _, reason := range rep.Reasons {
+		fmt.Printf("  %s\n", reason)
+	}
+}
@@ -0,0 +1,245 @@
+package sitehit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cdnDebugRequest are the request headers that make CDNs add debugging
+// headers to their responses. Cloudflare always sends its own.
+var cdnDebugRequest = http.Header{
+	"Fastly-Debug": {"1"},
+	"Pragma": {strings.Join([]string{
+		"akamai-x-cache-on",
+		"akamai-x-cache-remote-on",
+		"akamai-x-check-cacheable",
+		"akamai-x-get-cache-key",
+		"akamai-x-get-true-cache-key",
+		"akamai-x-get-request-id",
+	}, ", ")},
+}
+
+// cdnDebugResponse are the response headers recorded with --cdn-debug.
+var cdnDebugResponse = []string{
+	// Fastly
+	"Fastly-Debug-Path", "Fastly-Debug-TTL", "Fastly-Debug-Digest", "X-Served-By", "X-Cache", "X-Cache-Hits", "X-Timer",
+	// Cloudflare
+	"CF-Cache-Status", "CF-Ray",
+	// Akamai
+	"X-Cache-Remote", "X-Check-Cacheable", "X-Cache-Key", "X-True-Cache-Key", "X-Akamai-Request-ID",
+	// CloudFront
+	"X-Amz-Cf-Id", "X-Amz-Cf-Pop",
+	// Any CDN or proxy
+	"Age", "Via",
+}
+
+// recordedHeaders returns the values of the headers to keep from resp:
+// those given with --record-header and, with --cdn-debug, the CDN debugging
+// headers. It returns nil when none of them are present.
+func recordedHeaders(resp *http.Response, opts Options) map[string]string {
+	names := opts.RecordHeaders
+	if opts.CDNDebug {
+		names = slices.Concat(cdnDebugResponse, names)
+	}
+
+	var recorded map[string]string
+	for _, name := range names {
+		values := resp.Header.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		if recorded == nil {
+			recorded = make(map[string]string)
+		}
+		recorded[http.CanonicalHeaderKey(name)] = strings.Join(values, ", ")
+	}
+	return recorded
+}
+
+// cacheStatus tells from the response headers whether a CDN served it from
+// cache: "hit", "miss", or "" when no CDN says.
+func cacheStatus(header http.Header) string {
+	if status := header.Get("CF-Cache-Status"); status != "" {
+		switch strings.ToUpper(status) {
+		case "HIT", "STALE", "UPDATING", "REVALIDATED":
+			return "hit"
+		default:
+			return "miss"
+		}
+	}
+
+	// X-Cache is "HIT", "Hit from cloudfront", "TCP_MISS from a1.akamai" or,
+	// on Fastly, one value per cache with the one closest to us last
+	for _, name := range []string{"X-Cache", "X-Cache-Remote"} {
+		values := strings.Split(header.Get(name), ",")
+		last := strings.ToUpper(values[len(values)-1])
+		switch {
+		case strings.Contains(last, "HIT"):
+			return "hit"
+		case strings.Contains(last, "MISS"):
+			return "miss"
+		}
+	}
+
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		return "hit"
+	}
+	return ""
+}
+
+// freshness returns how much longer a shared cache may serve the response
+// with header: s-maxage, or else max-age, or else Expires minus Date, less
+// the Age it has already spent in a cache. Responses that may not be cached
+// get 0; it returns -1 when the headers don't say.
+func freshness(header http.Header) time.Duration {
+	lifetime := time.Duration(-1)
+	directives := map[string]string{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+	for _, name := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[name]; ok {
+			return 0
+		}
+	}
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if arg, ok := directives[name]; ok {
+			if seconds, err := strconv.ParseInt(arg, 10, 64); err == nil {
+				lifetime = time.Duration(max(seconds, 0)) * time.Second
+				break
+			}
+		}
+	}
+	if lifetime < 0 && header.Get("Expires") != "" {
+		expires, err := http.ParseTime(header.Get("Expires"))
+		if err != nil {
+			return 0 // invalid dates mean already expired
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		lifetime = max(expires.Sub(date), 0)
+	}
+	if lifetime < 0 {
+		return -1
+	}
+	if age, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && age > 0 {
+		lifetime -= time.Duration(age) * time.Second
+	}
+	return max(lifetime, 0)
+}
+
+// ttlBuckets are the upper bounds by which the summary groups freshness
+// lifetimes; the last group holds everything longer.
+var ttlBuckets = []time.Duration{time.Minute, 10 * time.Minute, time.Hour, 24 * time.Hour}
+
+// ttlSummary is the distribution of the freshness lifetimes of the
+// successful responses of a run: how long the warm cache will last.
+type ttlSummary struct {
+	Unknown     int   // no caching headers
+	Uncacheable int   // no-store, no-cache, private or already expired
+	Buckets     []int // cacheable responses by ttlBuckets
+	Min, Max    time.Duration
+}
+
+// add counts a successful response that may be cached for ttl.
+func (t *ttlSummary) add(ttl time.Duration) {
+	switch {
+	case ttl < 0:
+		t.Unknown++
+		return
+	case ttl == 0:
+		t.Uncacheable++
+		return
+	}
+	if t.Buckets == nil {
+		t.Buckets = make([]int, len(ttlBuckets)+1)
+	}
+	i := 0
+	for i < len(ttlBuckets) && ttl >= ttlBuckets[i] {
+		i++
+	}
+	t.Buckets[i]++
+	if t.cacheable() == 1 || ttl < t.Min {
+		t.Min = ttl
+	}
+	t.Max = max(t.Max, ttl)
+}
+
+func (t *ttlSummary) merge(o ttlSummary) {
+	if o.cacheable() > 0 {
+		if t.cacheable() == 0 || o.Min < t.Min {
+			t.Min = o.Min
+		}
+		t.Max = max(t.Max, o.Max)
+		if t.Buckets == nil {
+			t.Buckets = make([]int, len(ttlBuckets)+1)
+		}
+		for i, n := range o.Buckets {
+			t.Buckets[i] += n
+		}
+	}
+	t.Unknown += o.Unknown
+	t.Uncacheable += o.Uncacheable
+}
+
+// cacheable counts the responses with a positive lifetime.
+func (t ttlSummary) cacheable() int {
+	n := 0
+	for _, count := range t.Buckets {
+		n += count
+	}
+	return n
+}
+
+// ttlLabels name the groups of ttlBuckets.
+var ttlLabels = []string{"under_1m", "under_10m", "under_1h", "under_1d", "over_1d"}
+
+// MarshalJSON encodes the groups by name and the lifetimes in seconds.
+func (t ttlSummary) MarshalJSON() ([]byte, error) {
+	groups := make(map[string]int, len(ttlLabels))
+	for i, label := range ttlLabels {
+		if i < len(t.Buckets) {
+			groups[label] = t.Buckets[i]
+		} else {
+			groups[label] = 0
+		}
+	}
+	return json.Marshal(struct {
+		Unknown     int            `json:"unknown"`
+		Uncacheable int            `json:"uncacheable"`
+		Cacheable   map[string]int `json:"cacheable"`
+		MinSeconds  int64          `json:"min_s"`
+		MaxSeconds  int64          `json:"max_s"`
+	}{t.Unknown, t.Uncacheable, groups, int64(t.Min.Seconds()), int64(t.Max.Seconds())})
+}
+
+// String describes the distribution on one line of the text summary.
+func (t ttlSummary) String() string {
+	names := []string{"< 1m", "1m-10m", "10m-1h", "1h-1d", "> 1d"}
+	var parts []string
+	if n := t.cacheable(); n > 0 {
+		parts = append(parts, fmt.Sprintf("shortest %v, longest %v", t.Min, t.Max))
+		for i, count := range t.Buckets {
+			if count > 0 {
+				parts = append(parts, fmt.Sprintf("%s: %d", names[i], count))
+			}
+		}
+	}
+	if t.Uncacheable > 0 {
+		parts = append(parts, fmt.Sprintf("uncacheable: %d", t.Uncacheable))
+	}
+	if t.Unknown > 0 {
+		parts = append(parts, fmt.Sprintf("no caching headers: %d", t.Unknown))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,490 @@
+package sitehit
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// checkInput is the response a check looks at.
+type checkInput struct {
+	url      string
+	resp     *http.Response
+	body     []byte // the first bodyLimit bytes
+	bytes    int64
+	duration time.Duration
+	ttfb     time.Duration
+}
+
+// checker is one kind of assertion about a response. It returns false when
+// it doesn't apply to the URL at all.
+type checker interface {
+	check(in checkInput) (bool, error)
+}
+
+// checkKinds are the kinds of checks a bundle can mix, in the order they
+// run. A status check runs first and decides whether the others run.
+var checkKinds = []string{"status", "header", "body", "size", "timing", "language", "charset", "keywords", "redirect"}
+
+// checkBundle is a named set of checks for the URLs matching a pattern.
+type checkBundle struct {
+	name   string
+	urls   *regexp.Regexp // nil matches every URL
+	checks map[string]checker
+}
+
+// checkBundles are all the bundles of a run: those from the "checks" section
+// of the config file and those the --expect-* flags make up.
+type checkBundles []checkBundle
+
+// CheckResult is the outcome of one check of a bundle on a URL.
+type CheckResult struct {
+	Bundle string
+	Kind   string
+	Error  error
+
+	// Found and Missing are the keywords of a keywords check.
+	Found   []string
+	Missing []string
+}
+
+// checkError is a check failing a URL.
+type checkError struct {
+	bundle, kind string
+	err          error
+}
+
+func (e *checkError) Error() string {
+	return fmt.Sprintf("%s %s check: %v", e.bundle, e.kind, e.err)
+}
+
+func (e *checkError) Unwrap() error {
+	return e.err
+}
+
+// MarshalJSON encodes the check result with its error as a string.
+func (c CheckResult) MarshalJSON() ([]byte, error) {
+	var errText string
+	if c.Error != nil {
+		errText = c.Error.Error()
+	}
+	return json.Marshal(struct {
+		Bundle  string   `json:"bundle"`
+		Kind    string   `json:"kind"`
+		Passed  bool     `json:"passed"`
+		Error   string   `json:"error,omitempty"`
+		Found   []string `json:"found,omitempty"`
+		Missing []string `json:"missing,omitempty"`
+	}{c.Bundle, c.Kind, c.Error == nil, errText, c.Found, c.Missing})
+}
+
+// run applies every bundle matching the URL. Status checks decide success
+// when overrideStatus is set, in place of the default "status == 200"; the
+// other checks only run on a successful response and fail it when they
+// don't pass.
+func (b checkBundles) run(in checkInput, success, overrideStatus bool) ([]CheckResult, bool) {
+	var results []CheckResult
+	apply := func(kinds []string) (passed, applied bool) {
+		passed = true
+		for _, bundle := range b {
+			if bundle.urls != nil && !bundle.urls.MatchString(in.url) {
+				continue
+			}
+			for _, kind := range kinds {
+				c, ok := bundle.checks[kind]
+				if !ok {
+					continue
+				}
+				ok, err := c.check(in)
+				if !ok {
+					continue
+				}
+				applied = true
+				passed = passed && err == nil
+				result := CheckResult{Bundle: bundle.name, Kind: kind, Error: err}
+				if keywords, ok := c.(keywordCheck); ok {
+					result.Found, result.Missing = keywords.split(err)
+				}
+				results = append(results, result)
+			}
+		}
+		return passed, applied
+	}
+
+	statusPassed, statusApplied := apply(checkKinds[:1])
+	if overrideStatus && statusApplied {
+		success = statusPassed
+	} else {
+		success = success && statusPassed
+	}
+	if success {
+		success, _ = apply(checkKinds[1:])
+	}
+	return results, success
+}
+
+// bodyLimit is how much of each body the checks need to see.
+func (b checkBundles) bodyLimit() int {
+	limit := 0
+	for _, bundle := range b {
+		for _, kind := range []string{"body", "keywords"} {
+			if _, ok := bundle.checks[kind]; ok {
+				return checkBodyLimit
+			}
+		}
+		for _, kind := range []string{"language", "charset"} {
+			if _, ok := bundle.checks[kind]; ok {
+				limit = bodyPrefixLimit
+			}
+		}
+	}
+	return limit
+}
+
+// checkBodyLimit is how much of a body a body or keywords check searches.
+const checkBodyLimit = 2 << 20
+
+// checkSpec is a bundle as written in the config file:
+//
+//	"checks": [
+//	  {"name": "product-pages", "urls": "/product/",
+//	   "status": [200, "3xx"],
+//	   "header": {"Cache-Control": "max-age=\\d+", "X-Frame-Options": ""},
+//	   "body": {"contains": ["Add to cart"], "excludes": ["Exception"]},
+//	   "size": {"min": "1KB", "max": "2MB"},
+//	   "timing": {"max": "800ms", "ttfb": "300ms"},
+//	   "language": "nl", "charset": "utf-8",
+//	   "keywords": ["Add to cart", "In stock"]}
+//	]
+//
+// Header values are regexps and an empty one only requires the header.
+// Keywords must appear in the visible text of the page, in any case.
+type checkSpec struct {
+	Name     string            `json:"name"`
+	URLs     string            `json:"urls"`
+	Status   []any             `json:"status"`
+	Header   map[string]string `json:"header"`
+	Body     *bodySpec         `json:"body"`
+	Size     *sizeSpec         `json:"size"`
+	Timing   *timingSpec       `json:"timing"`
+	Language string            `json:"language"`
+	Charset  string            `json:"charset"`
+	Keywords []string          `json:"keywords"`
+}
+
+type bodySpec struct {
+	Contains []string `json:"contains"`
+	Excludes []string `json:"excludes"`
+}
+
+type sizeSpec struct {
+	Min string `json:"min"`
+	Max string `json:"max"`
+}
+
+type timingSpec struct {
+	Max  string `json:"max"`
+	TTFB string `json:"ttfb"`
+}
+
+// compileChecks turns the bundles of the config file into checks.
+func compileChecks(specs []checkSpec) (checkBundles, error) {
+	var bundles checkBundles
+	for i, spec := range specs {
+		if spec.Name == "" {
+			spec.Name = fmt.Sprintf("check %d", i+1)
+		}
+		bundle, err := spec.compile()
+		if err != nil {
+			return nil, fmt.Errorf("check %q: %w", spec.Name, err)
+		}
+		bundles = append(bundles, bundle)
+	}
+	return bundles, nil
+}
+
+func (spec checkSpec) compile() (checkBundle, error) {
+	bundle := checkBundle{name: spec.Name, checks: make(map[string]checker)}
+	if spec.URLs != "" {
+		urls, err := regexp.Compile(spec.URLs)
+		if err != nil {
+			return bundle, fmt.Errorf("urls: %w", err)
+		}
+		bundle.urls = urls
+	}
+
+	if len(spec.Status) > 0 {
+		c := statusCheck{}
+		for _, v := range spec.Status {
+			switch v := v.(type) {
+			case float64:
+				c = append(c, fmt.Sprint(int(v)))
+			case string:
+				if !validRetryStatus(strings.ToLower(v)) || v == "error" {
+					return bundle, fmt.Errorf("status: %q is not a code or class like 2xx", v)
+				}
+				c = append(c, strings.ToLower(v))
+			default:
+				return bundle, fmt.Errorf("status: %v is not a code or class like 2xx", v)
+			}
+		}
+		bundle.checks["status"] = c
+	}
+	if len(spec.Header) > 0 {
+		c := headerCheck{}
+		for name, pattern := range spec.Header {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return bundle, fmt.Errorf("header %s: %w", name, err)
+			}
+			c[http.CanonicalHeaderKey(name)] = re
+		}
+		bundle.checks["header"] = c
+	}
+	if spec.Body != nil {
+		bundle.checks["body"] = bodyCheck(*spec.Body)
+	}
+	if spec.Size != nil {
+		var c sizeCheck
+		if spec.Size.Min != "" {
+			if err := c.min.Set(spec.Size.Min); err != nil {
+				return bundle, fmt.Errorf("size: %w", err)
+			}
+		}
+		if spec.Size.Max != "" {
+			if err := c.max.Set(spec.Size.Max); err != nil {
+				return bundle, fmt.Errorf("size: %w", err)
+			}
+		}
+		bundle.checks["size"] = c
+	}
+	if spec.Timing != nil {
+		var c timingCheck
+		var err error
+		if spec.Timing.Max != "" {
+			if c.max, err = time.ParseDuration(spec.Timing.Max); err != nil {
+				return bundle, fmt.Errorf("timing: %w", err)
+			}
+		}
+		if spec.Timing.TTFB != "" {
+			if c.ttfb, err = time.ParseDuration(spec.Timing.TTFB); err != nil {
+				return bundle, fmt.Errorf("timing: %w", err)
+			}
+		}
+		bundle.checks["timing"] = c
+	}
+	if spec.Language != "" {
+		bundle.checks["language"] = languageCheck{{pattern: everyURL, value: spec.Language}}
+	}
+	if spec.Charset != "" {
+		bundle.checks["charset"] = charsetCheck{{pattern: everyURL, value: spec.Charset}}
+	}
+	if len(spec.Keywords) > 0 {
+		bundle.checks["keywords"] = keywordCheck(spec.Keywords)
+	}
+	if len(bundle.checks) == 0 {
+		return bundle, fmt.Errorf("no checks, want any of %s", strings.Join(checkKinds[:len(checkKinds)-1], ", "))
+	}
+	return bundle, nil
+}
+
+// flagChecks turns the --expect-* flags into bundles named after them, so
+// they are reported like the bundles of the config file.
+func flagChecks(opts Options) checkBundles {
+	var bundles checkBundles
+	if len(opts.expectHeader) > 0 {
+		bundles = append(bundles, checkBundle{name: "expect-header", checks: map[string]checker{"header": opts.expectHeader}})
+	}
+	if len(opts.expectLanguage) > 0 {
+		bundles = append(bundles, checkBundle{name: "expect-language", checks: map[string]checker{"language": languageCheck(opts.expectLanguage)}})
+	}
+	if len(opts.expectCharset) > 0 {
+		bundles = append(bundles, checkBundle{name: "expect-charset", checks: map[string]checker{"charset": charsetCheck(opts.expectCharset)}})
+	}
+	if len(opts.expectRedirect) > 0 {
+		bundles = append(bundles, checkBundle{name: "expect-redirect", checks: map[string]checker{"redirect": redirectCheck(opts.expectRedirect)}})
+	}
+	return append(bundles, keywordBundles(opts.expectKeywords)...)
+}
+
+// statusCheck allows the listed codes and classes such as "2xx".
+type statusCheck []string
+
+func (c statusCheck) check(in checkInput) (bool, error) {
+	code := fmt.Sprint(in.resp.StatusCode)
+	for _, allowed := range c {
+		if allowed == code || allowed == code[:1]+"xx" {
+			return true, nil
+		}
+	}
+	return true, fmt.Errorf("status %s, want %s", code, strings.Join(c, " or "))
+}
+
+// headerCheck requires each header to be present and match its regexp.
+type headerCheck map[string]*regexp.Regexp
+
+// String and Set make headerCheck the repeatable --expect-header flag, of
+// "NAME: REGEXP" values.
+func (c *headerCheck) String() string {
+	if c == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(*c))
+	for _, name := range slices.Sorted(maps.Keys(*c)) {
+		parts = append(parts, name+": "+(*c)[name].String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (c *headerCheck) Set(s string) error {
+	name, pattern, ok := strings.Cut(s, ":")
+	if name = strings.TrimSpace(name); !ok || name == "" {
+		return fmt.Errorf("%q: want NAME: REGEXP", s)
+	}
+	re, err := regexp.Compile(strings.TrimSpace(pattern))
+	if err != nil {
+		return err
+	}
+	if *c == nil {
+		*c = headerCheck{}
+	}
+	(*c)[http.CanonicalHeaderKey(name)] = re
+	return nil
+}
+
+func (c headerCheck) check(in checkInput) (bool, error) {
+	for _, name := range slices.Sorted(maps.Keys(c)) {
+		values := in.resp.Header.Values(name)
+		if len(values) == 0 {
+			return true, fmt.Errorf("no %s header", name)
+		}
+		if value := strings.Join(values, ", "); !c[name].MatchString(value) {
+			return true, fmt.Errorf("header %s is %q, want a match for %q", name, value, c[name])
+		}
+	}
+	return true, nil
+}
+
+// bodyCheck requires the body to contain or leave out strings.
+type bodyCheck bodySpec
+
+func (c bodyCheck) check(in checkInput) (bool, error) {
+	for _, s := range c.Contains {
+		if !bytes.Contains(in.body, []byte(s)) {
+			return true, fmt.Errorf("body doesn't contain %q", s)
+		}
+	}
+	for _, s := range c.Excludes {
+		if bytes.Contains(in.body, []byte(s)) {
+			return true, fmt.Errorf("body contains %q", s)
+		}
+	}
+	return true, nil
+}
+
+// sizeCheck bounds the number of body bytes received.
+type sizeCheck struct {
+	min, max byteSize
+}
+
+func (c sizeCheck) check(in checkInput) (bool, error) {
+	if c.min > 0 && in.bytes < int64(c.min) {
+		return true, fmt.Errorf("body is %s, want at least %v", formatBytes(in.bytes), c.min)
+	}
+	if c.max > 0 && in.bytes > int64(c.max) {
+		return true, fmt.Errorf("body is %s, want at most %v", formatBytes(in.bytes), c.max)
+	}
+	return true, nil
+}
+
+// timingCheck bounds the duration of the request and its time to first byte.
+type timingCheck struct {
+	max, ttfb time.Duration
+}
+
+func (c timingCheck) check(in checkInput) (bool, error) {
+	if c.max > 0 && in.duration > c.max {
+		return true, fmt.Errorf("took %v, want at most %v", in.duration.Round(time.Millisecond), c.max)
+	}
+	if c.ttfb > 0 && in.ttfb > c.ttfb {
+		return true, fmt.Errorf("first byte after %v, want at most %v", in.ttfb.Round(time.Millisecond), c.ttfb)
+	}
+	return true, nil
+}
+
+// everyURL is the pattern of the language and charset of a bundle, which
+// already selects the URLs.
+var everyURL = regexp.MustCompile("")
+
+// languageCheck requires the language of the first matching rule.
+type languageCheck patternRules
+
+func (c languageCheck) check(in checkInput) (bool, error) {
+	want, ok := patternRules(c).lookup(in.url)
+	if !ok {
+		return false, nil
+	}
+	return true, checkLanguage(in.resp, in.body, want)
+}
+
+// charsetCheck is like languageCheck, for the charset.
+type charsetCheck patternRules
+
+func (c charsetCheck) check(in checkInput) (bool, error) {
+	want, ok := patternRules(c).lookup(in.url)
+	if !ok {
+		return false, nil
+	}
+	return true, checkCharset(in.resp, in.body, want)
+}
+
+// redirectCheck requires the redirect target of the first matching rule.
+type redirectCheck redirectRules
+
+func (c redirectCheck) check(in checkInput) (bool, error) {
+	want, ok, err := redirectRules(c).expected(in.url)
+	if err != nil || !ok {
+		return err != nil, err
+	}
+	return true, checkRedirectTarget(in.url, in.resp, want)
+}
+
+// checkTally counts how one check of a bundle did across a run.
+type checkTally struct {
+	Bundle string `json:"bundle"`
+	Kind   string `json:"kind"`
+	Passed int    `json:"passed"`
+	Failed int    `json:"failed"`
+}
+
+// countChecks adds the outcomes of the final attempt of a URL to tallies,
+// by bundle and kind.
+func countChecks(tallies map[[2]string]checkTally, result Result) {
+	for _, c := range result.Checks {
+		key := [2]string{c.Bundle, c.Kind}
+		t := tallies[key]
+		t.Bundle, t.Kind = c.Bundle, c.Kind
+		if c.Error == nil {
+			t.Passed++
+		} else {
+			t.Failed++
+		}
+		tallies[key] = t
+	}
+}
+
+// sortTallies returns the tallies ordered by bundle, then kind.
+func sortTallies(tallies map[[2]string]checkTally) []checkTally {
+	sorted := slices.Collect(maps.Values(tallies))
+	slices.SortFunc(sorted, func(a, b checkTally) int {
+		return cmp.Or(cmp.Compare(a.Bundle, b.Bundle), cmp.Compare(slices.Index(checkKinds, a.Kind), slices.Index(checkKinds, b.Kind)))
+	})
+	return sorted
+}
@@ -0,0 +1,9 @@
+// Command sitehit rebuilds the cache of a site by visiting every URL found
+// in its sitemap.
+package main
+
+import "github.com/jeroensmink98/sitehit"
+
+func main() {
+	sitehit.Main()
+}
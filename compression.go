@@ -0,0 +1,166 @@
+package sitehit
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	// poorCompression is the share of its decoded size above which a
+	// compressed text body counts as poorly compressed.
+	poorCompression = 0.8
+
+	// minCompressible is the decoded size below which text bodies aren't
+	// judged: compressing them hardly saves anything.
+	minCompressible = 1 << 10
+
+	// largeUncompressed is the size from which a text body that wasn't
+	// compressed is reported.
+	largeUncompressed = 10 << 10
+)
+
+// compressible reports whether contentType is text that is worth
+// compressing.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "application/manifest+json", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// gzipBody decodes a gzip-encoded body, counting the compressed bytes that
+// came over the wire. The gzip header is only read with the first Read, so
+// an empty body ends cleanly instead of failing.
+type gzipBody struct {
+	wire countingReader
+	gz   *gzip.Reader
+}
+
+func newGzipBody(r io.Reader) *gzipBody {
+	return &gzipBody{wire: countingReader{r: r}}
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	if b.gz == nil {
+		gz, err := gzip.NewReader(&b.wire)
+		if err != nil {
+			return 0, err
+		}
+		b.gz = gz
+	}
+	return b.gz.Read(p)
+}
+
+// rateCompression judges how the body of resp was compressed, from its
+// decoded size and, when gzip-encoded, its size on the wire: "ok", "poor"
+// when it's still more than 80% of the decoded size, or "none" for a large
+// text body that wasn't compressed at all. It's empty for small bodies and
+// those that aren't text.
+func rateCompression(resp *http.Response, decoded, wire int64) string {
+	if !compressible(resp.Header.Get("Content-Type")) || decoded < minCompressible {
+		return ""
+	}
+	switch {
+	case resp.Header.Get("Content-Encoding") == "":
+		if decoded >= largeUncompressed {
+			return "none"
+		}
+		return ""
+	case wire > 0 && float64(wire) > poorCompression*float64(decoded):
+		return "poor"
+	}
+	return "ok"
+}
+
+// compressionSummary tells how well the text bodies of a run were
+// compressed.
+type compressionSummary struct {
+	Compressed   int   // text bodies that were
+	Poor         int   // of those, compressed to more than 80% of their size
+	Uncompressed int   // large text bodies that weren't
+	WireBytes    int64 // gzip-encoded bytes of the compressed bodies
+	DecodedBytes int64 // and what they decoded to
+}
+
+func (c *compressionSummary) add(result Result) {
+	switch result.Compression {
+	case "ok", "poor":
+		c.Compressed++
+		if result.Compression == "poor" {
+			c.Poor++
+		}
+		if result.CompressedBytes > 0 {
+			c.WireBytes += result.CompressedBytes
+			c.DecodedBytes += result.BytesRead
+		}
+	case "none":
+		c.Uncompressed++
+	}
+}
+
+func (c *compressionSummary) merge(o compressionSummary) {
+	c.Compressed += o.Compressed
+	c.Poor += o.Poor
+	c.Uncompressed += o.Uncompressed
+	c.WireBytes += o.WireBytes
+	c.DecodedBytes += o.DecodedBytes
+}
+
+// ratio is the share of their decoded size the compressed bodies took on
+// the wire, or 0 when none were measured.
+func (c compressionSummary) ratio() float64 {
+	if c.DecodedBytes == 0 {
+		return 0
+	}
+	return float64(c.WireBytes) / float64(c.DecodedBytes)
+}
+
+func (c compressionSummary) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Compressed   int     `json:"compressed"`
+		Poor         int     `json:"poor"`
+		Uncompressed int     `json:"uncompressed"`
+		Ratio        float64 `json:"ratio"`
+	}{c.Compressed, c.Poor, c.Uncompressed, c.ratio()})
+}
+
+func (c compressionSummary) String() string {
+	s := fmt.Sprintf("%d text responses compressed", c.Compressed)
+	if c.DecodedBytes > 0 {
+		s += fmt.Sprintf(" to %.0f%% of their size", 100*c.ratio())
+	}
+	if c.Poor > 0 {
+		s += fmt.Sprintf(", poorly compressed: %d", c.Poor)
+	}
+	if c.Uncompressed > 0 {
+		s += fmt.Sprintf(", large and uncompressed: %d", c.Uncompressed)
+	}
+	return s
+}
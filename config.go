@@ -0,0 +1,141 @@
+package sitehit
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Config is the JSON file passed with --config. Its sections map flag names
+// (without dashes) to values, so anything that can be set on the command line
+// can also be bundled in a profile:
+//
+//	{
+//	  "defaults": {"batch": 5},
+//	  "profiles": {
+//	    "prod-warm": {"sitemap": "https://www.site.nl/sitemap.xml", "batch": 20},
+//	    "staging-smoke": {"sitemap": "https://staging.site.nl/sitemap.xml", "recheck-failures": "1m"}
+//	  }
+//	}
+//
+// The "sitemap" key is used when no sitemap is given on the command line.
+//
+// Without a sitemap, every entry of "sites" is run in one invocation. Each
+// site has a "name", a "sitemap" and its own flag values on top of the
+// profile and defaults:
+//
+//	"sites": [
+//	  {"name": "shop", "sitemap": "https://shop.site.nl/sitemap.xml", "batch": 10},
+//	  {"name": "blog", "sitemap": "https://blog.site.nl/sitemap.xml"}
+//	]
+//
+// "checks" holds assertion bundles for the URLs matching a pattern; see
+// checkSpec.
+type Config struct {
+	Defaults map[string]any            `json:"defaults"`
+	Profiles map[string]map[string]any `json:"profiles"`
+	Sites    []map[string]any          `json:"sites"`
+	Checks   []checkSpec               `json:"checks"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// apply sets the flags of fs from site (if not nil), the named profile and
+// then the defaults, never overriding a flag that was given explicitly. It
+// returns the first sitemap those sections name, if any.
+func (cfg *Config) apply(fs *flag.FlagSet, profile string, site map[string]any) (string, error) {
+	var sections []map[string]any
+	if site != nil {
+		sections = append(sections, site)
+	}
+	if profile != "" {
+		values, ok := cfg.Profiles[profile]
+		if !ok {
+			return "", fmt.Errorf("unknown profile %q (available: %s)", profile, strings.Join(cfg.profileNames(), ", "))
+		}
+		sections = append(sections, values)
+	}
+	sections = append(sections, cfg.Defaults)
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var sitemap string
+	for _, values := range sections {
+		for name, value := range values {
+			switch name {
+			case "sitemap":
+				if s, ok := value.(string); ok && sitemap == "" {
+					sitemap = s
+				}
+				continue
+			case "name":
+				continue
+			}
+			if set[name] {
+				continue
+			}
+			if fs.Lookup(name) == nil {
+				return "", fmt.Errorf("unknown flag %q", name)
+			}
+			if err := setFlag(fs, name, value); err != nil {
+				return "", err
+			}
+			set[name] = true
+		}
+	}
+	return sitemap, nil
+}
+
+// setFlag sets a flag from a decoded JSON value. Arrays set a repeatable
+// flag once per element.
+func setFlag(fs *flag.FlagSet, name string, value any) error {
+	var values []any
+	if list, ok := value.([]any); ok {
+		values = list
+	} else {
+		values = []any{value}
+	}
+
+	for _, v := range values {
+		var s string
+		switch v := v.(type) {
+		case string:
+			s = v
+		case bool:
+			s = strconv.FormatBool(v)
+		case float64:
+			s = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return fmt.Errorf("flag %q: unsupported value %v", name, v)
+		}
+		if err := fs.Set(name, s); err != nil {
+			return fmt.Errorf("flag %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// profileNames lists the profiles defined in cfg, sorted.
+func (cfg *Config) profileNames() []string {
+	names := make([]string, 0, len(cfg.Profiles))
+	for name := range cfg.Profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
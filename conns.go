@@ -0,0 +1,82 @@
+package sitehit
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+	"sync"
+)
+
+// connStats collects how requests were spread over hosts and connections,
+// to help explain runs that are slower than expected.
+type connStats struct {
+	mu            sync.Mutex
+	hosts         map[string]struct{}
+	ips           map[string]struct{}
+	requests      int
+	reused        int
+	tlsHandshakes int
+	tlsResumed    int
+}
+
+func newConnStats() *connStats {
+	return &connStats{hosts: make(map[string]struct{}), ips: make(map[string]struct{})}
+}
+
+// withTrace returns ctx with a client trace that records into c for a
+// request to host.
+func (c *connStats) withTrace(ctx context.Context, host string) context.Context {
+	if c == nil {
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.hosts[host] = struct{}{}
+			if addr := info.Conn.RemoteAddr(); addr != nil {
+				c.ips[addr.String()] = struct{}{}
+			}
+			c.requests++
+			if info.Reused {
+				c.reused++
+			}
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				return
+			}
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.tlsHandshakes++
+			if state.DidResume {
+				c.tlsResumed++
+			}
+		},
+	})
+}
+
+func (c *connStats) print() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	opened := c.requests - c.reused
+	reuse := 0.0
+	if c.requests > 0 {
+		reuse = float64(c.reused) / float64(c.requests)
+	}
+
+	if console.structured() {
+		console.Info("Connections", "event", "connections", "hosts", len(c.hosts), "ips", len(c.ips),
+			"requests", c.requests, "connections_opened", opened, "reused", c.reused, "reuse_ratio", reuse,
+			"tls_handshakes", c.tlsHandshakes, "tls_resumed", c.tlsResumed)
+		return
+	}
+	fmt.Println("\nConnections:")
+	fmt.Printf("Unique hosts: %d\n", len(c.hosts))
+	fmt.Printf("Unique IPs: %d\n", len(c.ips))
+	fmt.Printf("Connections opened: %d\n", opened)
+	fmt.Printf("Requests on reused connections: %d of %d (%.1f%%)\n", c.reused, c.requests, reuse*100)
+	fmt.Printf("TLS handshakes: %d (%d resumed sessions)\n", c.tlsHandshakes, c.tlsResumed)
+}
@@ -0,0 +1,71 @@
+package sitehit
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Exit codes used in --cronjob mode.
+const (
+	exitOK          = 0
+	exitUsage       = 1 // invalid flags or config
+	exitSelfCheck   = 2 // the sitemap could not be fetched, parsed, or was empty
+	exitURLFailures = 3 // at least one URL failed after all attempts
+	exitInterrupted = 4 // stopped by SIGTERM/SIGINT before every URL was visited
+	exitDeadline    = 5 // --max-duration passed before every URL was visited
+)
+
+// runCronJob runs a single sitemap the way a Kubernetes CronJob expects: it
+// checks the sitemap before starting, stops cleanly on SIGTERM with a partial
+// summary, and returns an exit code describing the outcome.
+func runCronJob(sources []string, s *settings) int {
+	ctx, cancel := s.runContext()
+	defer cancel()
+	sitemapURL := sitemapKey(sources)
+	sm, err := fetchSitemaps(ctx, sources, s.opts)
+	if err == nil && len(sm.URLs) == 0 {
+		err = fmt.Errorf("sitemap contains no URLs")
+	}
+	if err == nil {
+		err = checkSitemap(sm, s.opts)
+	}
+	if err != nil {
+		console.Error("Sitemap self-check failed", "event", "self_check", "sitemap", sitemapURL, "error", err.Error())
+		return exitSelfCheck
+	}
+	console.Info("Sitemap self-check passed", "event", "self_check", "sitemap", sitemapURL, "urls", len(sm.URLs))
+
+	stop := make(chan struct{})
+	s.opts.Stop = stop
+
+	// Stop dispatching on the first signal and abort what is still in
+	// flight once the grace period is over, so there's time left to report.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case sig := <-signals:
+			console.Warn(fmt.Sprintf("Received %v, stopping", sig), "event", "shutdown", "signal", sig.String(), "grace", s.shutdownGrace.String())
+			close(stop)
+			time.AfterFunc(s.shutdownGrace, cancel)
+		case <-ctx.Done():
+		}
+	}()
+
+	_, t := runEntries(ctx, sitemapURL, sm.URLs, "", s)
+
+	switch {
+	case stopped(stop):
+		return exitInterrupted
+	case deadlineReached(ctx):
+		return exitDeadline
+	case t.summary().Failed > 0:
+		return exitURLFailures
+	default:
+		return exitOK
+	}
+}
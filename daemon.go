@@ -0,0 +1,233 @@
+package sitehit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// urlState is what the daemon remembers about a URL between runs.
+type urlState struct {
+	success bool
+	slow    bool
+}
+
+// statusChange is a URL whose state changed from one run to the next.
+type statusChange struct {
+	At         time.Time
+	URL        string
+	Kind       string // "failing", "recovered" or "slow"
+	StatusCode int
+	Duration   time.Duration
+	Error      string
+}
+
+func (c statusChange) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		At         time.Time `json:"at"`
+		URL        string    `json:"url"`
+		Kind       string    `json:"kind"`
+		StatusCode int       `json:"status_code"`
+		DurationMs int64     `json:"duration_ms"`
+		Error      string    `json:"error,omitempty"`
+	}{c.At, c.URL, c.Kind, c.StatusCode, c.Duration.Milliseconds(), c.Error})
+}
+
+// daemon runs a sitemap over and over with --daemon, notifying about URLs
+// that start failing, recover or become slow.
+type daemon struct {
+	s          *settings
+	sources    []string
+	sitemapURL string // identifies the sitemaps in the history
+	notifier   *notifier
+	slo        *sloBurn // nil without --slo
+
+	runs       int
+	previous   map[string]urlState
+	pending    []statusChange
+	lastDigest time.Time
+}
+
+// runDaemon runs the sitemap every s.daemonEvery until interrupted.
+func runDaemon(sources []string, s *settings) {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer cancel()
+
+	d := &daemon{
+		s:          s,
+		sources:    sources,
+		sitemapURL: sitemapKey(sources),
+		notifier:   newNotifier(s.notifyWebhook),
+		lastDigest: time.Now(),
+	}
+	if s.slo.target > 0 {
+		d.slo = &sloBurn{spec: s.slo, window: s.sloWindow, threshold: s.sloBurn}
+	}
+
+	for {
+		if start := s.schedule.next(time.Now()); start.After(time.Now()) {
+			console.Info(fmt.Sprintf("\nOutside the run windows, waiting until %s", start.In(s.schedule.loc).Format(time.DateTime)), "event", "waiting", "until", start)
+			if !sleep(ctx, time.Until(start), nil) {
+				break
+			}
+		}
+
+		started := time.Now()
+		d.cycle(ctx)
+
+		next := s.schedule.next(started.Add(s.daemonEvery))
+		console.Info(fmt.Sprintf("\nNext run at %s", next.Format(time.DateTime)), "event", "next_run", "at", next)
+		if !sleep(ctx, time.Until(next), nil) {
+			break
+		}
+	}
+
+	// Don't lose the changes collected since the last digest
+	d.sendDigest()
+}
+
+// cycle runs the sitemap once and records how its URLs changed. A run still
+// going when the run windows close is stopped there.
+func (d *daemon) cycle(ctx context.Context) {
+	if closes := d.s.schedule.closes(time.Now()); d.s.schedule.restricted() && !closes.IsZero() {
+		stop := make(chan struct{})
+		timer := time.AfterFunc(time.Until(closes), func() {
+			console.Warn(fmt.Sprintf("\nRun window closed at %s, stopping the run", closes.In(d.s.schedule.loc).Format(time.TimeOnly)), "event", "window_closed", "at", closes)
+			close(stop)
+		})
+		d.s.opts.Stop = stop
+		defer func() {
+			timer.Stop()
+			d.s.opts.Stop = nil
+		}()
+	}
+	d.s.retryFirst = d.failing()
+	resultsList, _, err := runSitemap(ctx, d.sources, "", d.s)
+	if err != nil {
+		console.Error(fmt.Sprintf("Error %v", err), "event", "run_failed", "error", err.Error())
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	d.runs++
+
+	current := make(map[string]urlState, len(resultsList))
+	for _, result := range resultsList {
+		state := urlState{
+			success: result.Success || result.Ignored,
+			slow:    result.Success && d.s.slowThreshold > 0 && result.Duration > d.s.slowThreshold,
+		}
+		current[result.URL] = state
+		if change, ok := d.compare(result, state); ok {
+			d.pending = append(d.pending, change)
+		}
+	}
+	if stopped(d.s.opts.Stop) {
+		// Remember the URLs the stopped run didn't get to
+		for url, state := range d.previous {
+			if _, ok := current[url]; !ok {
+				current[url] = state
+			}
+		}
+	}
+	d.previous = current
+	d.checkSLO(resultsList)
+
+	if d.s.digestInterval == 0 || time.Since(d.lastDigest) >= d.s.digestInterval {
+		d.sendDigest()
+	}
+}
+
+// failing returns the URLs that failed in the previous run, to be visited
+// first in the next. Before the first run they come from the history, if
+// any, so they survive a restart.
+func (d *daemon) failing() map[string]bool {
+	if d.previous == nil {
+		if d.s.history == nil {
+			return nil
+		}
+		failing, err := d.s.history.failingURLs(d.sitemapURL)
+		if err != nil {
+			console.Error(fmt.Sprintf("Error reading history: %v", err), "event", "history", "error", err.Error())
+		}
+		return failing
+	}
+	failing := make(map[string]bool)
+	for url, state := range d.previous {
+		if !state.success {
+			failing[url] = true
+		}
+	}
+	return failing
+}
+
+// compare reports how result changed since the previous run. URLs that fail
+// on the first run count as newly failing.
+func (d *daemon) compare(result Result, state urlState) (statusChange, bool) {
+	change := statusChange{At: time.Now(), URL: result.URL, StatusCode: result.StatusCode, Duration: result.Duration}
+	if result.Error != nil {
+		change.Error = result.Error.Error()
+	}
+
+	before, known := d.previous[result.URL]
+	switch {
+	case !state.success && (!known || before.success):
+		change.Kind = "failing"
+	case state.success && known && !before.success:
+		change.Kind = "recovered"
+	case state.slow && (!known || !before.slow):
+		change.Kind = "slow"
+	default:
+		return change, false
+	}
+	return change, true
+}
+
+// maxDigestLines caps the number of URLs listed in a digest's text.
+const maxDigestLines = 50
+
+// sendDigest notifies about the changes collected since the last digest.
+func (d *daemon) sendDigest() {
+	d.lastDigest = time.Now()
+	if len(d.pending) == 0 {
+		return
+	}
+	changes := d.pending
+	d.pending = nil
+
+	counts := make(map[string]int)
+	for _, change := range changes {
+		counts[change.Kind]++
+	}
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "sitehit: %s: %d newly failing, %d recovered, %d newly slow (%d runs)",
+		d.sitemapURL, counts["failing"], counts["recovered"], counts["slow"], d.runs)
+	for i, change := range changes {
+		if i == maxDigestLines {
+			fmt.Fprintf(&text, "\n…and %d more", len(changes)-i)
+			break
+		}
+		fmt.Fprintf(&text, "\n%s %s", strings.ToUpper(change.Kind), change.URL)
+		switch {
+		case change.Kind == "slow":
+			fmt.Fprintf(&text, " (%v)", change.Duration.Round(time.Millisecond))
+		case change.Error != "":
+			fmt.Fprintf(&text, " (%s)", change.Error)
+		case change.StatusCode != 0:
+			fmt.Fprintf(&text, " (%d)", change.StatusCode)
+		}
+	}
+	d.runs = 0
+
+	console.Warn("\n"+text.String(), "event", "digest", "changes", changes)
+	if err := d.notifier.Send(text.String(), map[string]any{"sitemap": d.sitemapURL, "changes": changes}); err != nil {
+		console.Error(fmt.Sprintf("Error %v", err), "event", "notify_failed", "error", err.Error())
+	}
+}
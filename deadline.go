@@ -0,0 +1,29 @@
+package sitehit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// runContext returns the context of an invocation, which ends once
+// --max-duration has passed: no new URLs are dispatched, the requests in
+// flight are aborted and a partial summary is printed.
+func (s *settings) runContext() (context.Context, context.CancelFunc) {
+	if s.maxDuration <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.maxDuration)
+	context.AfterFunc(ctx, func() {
+		if deadlineReached(ctx) {
+			console.Warn(fmt.Sprintf("\nMax duration of %v reached, stopping the run", s.maxDuration),
+				"event", "deadline", "max_duration_ms", s.maxDuration.Milliseconds())
+		}
+	})
+	return ctx, cancel
+}
+
+// deadlineReached reports whether ctx ended because --max-duration passed.
+func deadlineReached(ctx context.Context) bool {
+	return errors.Is(ctx.Err(), context.DeadlineExceeded)
+}
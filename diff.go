@@ -0,0 +1,252 @@
+package sitehit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// defaultDiffHeaders are compared by --diff-hosts unless --diff-header
+// lists others.
+var defaultDiffHeaders = []string{"Content-Type", "Location", "Cache-Control"}
+
+// envResponse is what one environment answered for a URL.
+type envResponse struct {
+	status  int
+	headers http.Header
+	hash    string // SHA-256 of the body
+	err     error
+}
+
+// difference is a field on which the two environments disagree.
+type difference struct {
+	Field string `json:"field"`
+	A     string `json:"a"`
+	B     string `json:"b"`
+}
+
+// urlDiff holds the differences found for a URL, none if it's ready.
+type urlDiff struct {
+	URL         string       `json:"url"`
+	Differences []difference `json:"differences"`
+}
+
+// rebase points rawURL at base, a host or a scheme://host URL. Only the
+// scheme and host change.
+func rebase(rawURL, base string) (string, error) {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if scheme, host, ok := strings.Cut(base, "://"); ok {
+		u.Scheme, u.Host = scheme, strings.TrimSuffix(host, "/")
+	} else {
+		u.Host = base
+	}
+	return u.String(), nil
+}
+
+// requestEnv fetches url from base without following redirects, so where
+// each environment redirects to is compared too.
+func requestEnv(ctx context.Context, url, base string, opts Options) envResponse {
+	target, err := rebase(url, base)
+	if err != nil {
+		return envResponse{err: err}
+	}
+	var client http.Client
+	if opts.Client != nil {
+		client = *opts.Client
+	}
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	opts.Client = &client
+
+	resp, err := fetch(ctx, http.MethodGet, target, nil, 1, http.Header{}, opts)
+	if err != nil {
+		return envResponse{err: err}
+	}
+	defer resp.Body.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, resp.Body); err != nil {
+		return envResponse{status: resp.StatusCode, err: err}
+	}
+	return envResponse{status: resp.StatusCode, headers: resp.Header, hash: hex.EncodeToString(hash.Sum(nil))}
+}
+
+// diffURL requests url from both bases and compares the status, the given
+// headers and the body. A Location pointing at its own environment is
+// compared without the host, so redirects within each environment match.
+func diffURL(ctx context.Context, url string, bases, headers []string, opts Options) urlDiff {
+	var a, b envResponse
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); a = requestEnv(ctx, url, bases[0], opts) }()
+	go func() { defer wg.Done(); b = requestEnv(ctx, url, bases[1], opts) }()
+	wg.Wait()
+
+	diff := urlDiff{URL: url, Differences: []difference{}}
+	add := func(field, x, y string) {
+		if x != y {
+			diff.Differences = append(diff.Differences, difference{Field: field, A: x, B: y})
+		}
+	}
+	if a.err != nil || b.err != nil {
+		add("error", errorText(a.err), errorText(b.err))
+		if a.err != nil && b.err != nil {
+			return diff
+		}
+	}
+	add("status", fmt.Sprint(a.status), fmt.Sprint(b.status))
+	for _, name := range headers {
+		x, y := a.headers.Get(name), b.headers.Get(name)
+		if strings.EqualFold(name, "Location") {
+			x, y = relativeTo(x, bases[0]), relativeTo(y, bases[1])
+		}
+		add("header "+http.CanonicalHeaderKey(name), x, y)
+	}
+	add("body sha256", a.hash, b.hash)
+	return diff
+}
+
+// relativeTo strips base's host from location.
+func relativeTo(location, base string) string {
+	u, err := neturl.Parse(location)
+	if err != nil || u.Host == "" {
+		return location
+	}
+	_, host, ok := strings.Cut(base, "://")
+	if !ok {
+		host = base
+	}
+	if strings.EqualFold(u.Host, strings.TrimSuffix(host, "/")) {
+		u.Scheme, u.Host = "", ""
+	}
+	return u.String()
+}
+
+func errorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// runDiff compares every URL of the sitemaps between the two --diff-hosts
+// with up to --batch URLs at a time, and reports whether the second is
+// ready to replace the first. It returns the exit code: 1 if any URL
+// differs.
+func runDiff(ctx context.Context, sources []string, s *settings) int {
+	sm, err := fetchSitemaps(ctx, sources, s.opts)
+	if err != nil {
+		fmt.Printf("Error %v\n", err)
+		return 1
+	}
+	urls := sitemapURLs(uniqueEntries(s.localeRule.expand(sm.URLs)), s.opts)
+	bases, headers := s.diffHosts, []string(s.diffHeaders)
+	if len(headers) == 0 {
+		headers = defaultDiffHeaders
+	}
+	console.Info(fmt.Sprintf("Comparing %d URLs between %s and %s with %d workers...", len(urls), bases[0], bases[1], s.opts.BatchSize),
+		"urls", len(urls), "a", bases[0], "b", bases[1], "workers", s.opts.BatchSize)
+
+	diffs := make([]urlDiff, len(urls))
+	sem := make(chan struct{}, s.opts.BatchSize)
+	var wg sync.WaitGroup
+	for i, url := range urls {
+		if stopped(s.opts.Stop) || ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			diffs[i] = diffURL(ctx, url, bases, headers, s.opts)
+			printDiff(diffs[i])
+		}()
+	}
+	wg.Wait()
+
+	ready, compared := 0, 0
+	var differing []urlDiff
+	for _, diff := range diffs {
+		if diff.URL == "" {
+			continue // not compared, the run was stopped
+		}
+		compared++
+		if len(diff.Differences) == 0 {
+			ready++
+		} else {
+			differing = append(differing, diff)
+		}
+	}
+	printReadiness(bases, compared, ready, differing)
+	if ready < len(urls) {
+		return 1
+	}
+	return 0
+}
+
+func printDiff(diff urlDiff) {
+	if len(diff.Differences) == 0 {
+		console.Info(fmt.Sprintf("Same: %s", diff.URL), "event", "diff", "url", diff.URL, "differences", diff.Differences)
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Differs: %s", diff.URL)
+	for _, d := range diff.Differences {
+		fmt.Fprintf(&b, "\n  %s: %q vs %q", d.Field, d.A, d.B)
+	}
+	console.Error(b.String(), "event", "diff", "url", diff.URL, "differences", diff.Differences)
+}
+
+// printReadiness prints the migration readiness report: how many URLs the
+// environments agree on and, grouped by field, where they don't.
+func printReadiness(bases []string, compared, ready int, differing []urlDiff) {
+	byField := map[string]int{}
+	var fields []string
+	for _, diff := range differing {
+		for _, d := range diff.Differences {
+			if byField[d.Field] == 0 {
+				fields = append(fields, d.Field)
+			}
+			byField[d.Field]++
+		}
+	}
+	slices.SortStableFunc(fields, func(a, b string) int { return byField[b] - byField[a] })
+	percent := 100.0
+	if compared > 0 {
+		percent = float64(ready) * 100 / float64(compared)
+	}
+
+	if console.structured() {
+		console.Info("Migration readiness", "event", "readiness", "a", bases[0], "b", bases[1],
+			"compared", compared, "ready", ready, "differing", differing, "by_field", byField)
+		return
+	}
+	fmt.Printf("\nMigration readiness (%s vs %s):\n", bases[0], bases[1])
+	fmt.Printf("Identical: %d of %d URLs (%.1f%%)\n", ready, compared, percent)
+	for _, field := range fields {
+		fmt.Printf("\033[31m  %-28s differs on %d URLs\033[0m\n", field, byField[field])
+	}
+}
+
+// validDiffHosts checks the --diff-hosts value: two hosts, or scheme://host
+// base URLs.
+func validDiffHosts(hosts []string) error {
+	if len(hosts) != 2 {
+		return errors.New("--diff-hosts takes two hosts, e.g. www.example.com,staging.example.com")
+	}
+	for _, host := range hosts {
+		if scheme, _, ok := strings.Cut(host, "://"); ok && scheme != "http" && scheme != "https" {
+			return fmt.Errorf("invalid --diff-hosts base %q: must be a host or an http(s) URL", host)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package sitehit
+
+import (
+	"fmt"
+	"time"
+)
+
+// printEgress reports what the bytes of a run cost at costPerGB and, for a
+// run repeated every interval in --daemon mode, what that adds up to in a
+// 30-day month.
+func printEgress(summary Summary, costPerGB float64, every time.Duration) {
+	cost := float64(summary.Bytes) / 1e9 * costPerGB
+	var runsPerMonth, monthly float64
+	if every > 0 {
+		runsPerMonth = float64(30*24*time.Hour) / float64(every)
+		monthly = cost * runsPerMonth
+	}
+
+	if console.structured() {
+		attrs := []any{"event", "egress", "bytes", summary.Bytes, "cost_per_gb", costPerGB, "cost", cost}
+		if every > 0 {
+			attrs = append(attrs, "runs_per_month", runsPerMonth, "monthly_cost", monthly)
+		}
+		console.Info("Egress", attrs...)
+		return
+	}
+	fmt.Println("\nEgress:")
+	fmt.Printf("This run: about $%.4f for %s at $%g/GB\n", cost, formatBytes(summary.Bytes), costPerGB)
+	if every > 0 {
+		fmt.Printf("Every %v: %.0f runs a month, about $%.2f\n", every, runsPerMonth, monthly)
+	}
+}
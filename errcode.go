@@ -0,0 +1,113 @@
+package sitehit
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// errorCodes are the machine-readable codes of failures in the JSON output.
+// They are part of the schema: existing codes keep their meaning.
+var errorCodes = []string{
+	"DNS_FAILURE", "CONNECTION_REFUSED", "CONNECTION_RESET", "HOST_UNREACHABLE", "CONNECTION_FAILED", "TIMEOUT", "STALLED", "TLS_HANDSHAKE", "TLS_CERTIFICATE",
+	"TLS_CLIENT_CERTIFICATE",
+	"HTTP2_PROTOCOL", "HTTP_VERSION", "TOO_MANY_REDIRECTS", "OFF_SITE_REDIRECT", "HTTP_3XX", "HTTP_4XX", "HTTP_5XX", "HTTP_STATUS",
+	"HEADER_ASSERTION_FAILED", "BODY_ASSERTION_FAILED", "SIZE_ASSERTION_FAILED", "TIMING_ASSERTION_FAILED",
+	"LANGUAGE_ASSERTION_FAILED", "CHARSET_ASSERTION_FAILED", "KEYWORDS_ASSERTION_FAILED", "REDIRECT_ASSERTION_FAILED",
+	"GRPC_NOT_SERVING", "GRPC_REFLECTION", "GRPC_STATUS", "SCRIPT_ERROR", "CANCELED", "UNKNOWN",
+}
+
+// errorCode returns the code of a failure with err and status, the status
+// code being 0 without a response. The more specific cause wins: a failed
+// check over the status it came with, and a TLS problem over the connection
+// error it surfaced as.
+func errorCode(err error, status int) string {
+	var checkErr *checkError
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var hostnameErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var statusErr *grpcStatusError
+	var netErr net.Error
+	var opErr *net.OpError
+
+	switch {
+	case err == nil:
+		return statusCode(status)
+	case errors.As(err, &checkErr):
+		if checkErr.kind == "status" {
+			return statusCode(status)
+		}
+		return strings.ToUpper(checkErr.kind) + "_ASSERTION_FAILED"
+	case errors.Is(err, errScript):
+		return "SCRIPT_ERROR"
+	case errors.Is(err, errNotServing):
+		return "GRPC_NOT_SERVING"
+	case errors.Is(err, errReflection):
+		return "GRPC_REFLECTION"
+	case errors.As(err, &statusErr):
+		return "GRPC_STATUS"
+	case errors.Is(err, errHTTPVersion):
+		return "HTTP_VERSION"
+	case errors.Is(err, errTooManyRedirects):
+		return "TOO_MANY_REDIRECTS"
+	case errors.Is(err, errOffSiteRedirect):
+		return "OFF_SITE_REDIRECT"
+	case errors.Is(err, errStalled):
+		return "STALLED"
+	case errors.Is(err, context.Canceled):
+		return "CANCELED"
+	case errors.As(err, &dnsErr):
+		return "DNS_FAILURE"
+	case errors.As(err, &certErr), errors.As(err, &hostnameErr), errors.As(err, &authorityErr), errors.As(err, &invalidErr):
+		return "TLS_CERTIFICATE"
+	case strings.Contains(err.Error(), "remote error: tls:") && strings.Contains(err.Error(), "certificate"):
+		// The site refused the client certificate of --client-cert, or
+		// wanted one
+		return "TLS_CLIENT_CERTIFICATE"
+	case errors.As(err, &recordErr), errors.As(err, &alertErr):
+		return "TLS_HANDSHAKE"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "TIMEOUT"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "CONNECTION_REFUSED"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "CONNECTION_RESET"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "HOST_UNREACHABLE"
+	case strings.Contains(err.Error(), "http2:") || strings.Contains(err.Error(), "stream error"):
+		return "HTTP2_PROTOCOL"
+	case strings.Contains(err.Error(), "tls:"), strings.Contains(err.Error(), "HTTP response to HTTPS client"):
+		// Handshake failures reported without a type
+		return "TLS_HANDSHAKE"
+	case errors.As(err, &opErr):
+		return "CONNECTION_FAILED"
+	}
+	if status != 0 {
+		return statusCode(status)
+	}
+	return "UNKNOWN"
+}
+
+// statusCode returns the code of a response that wasn't accepted because of
+// its status.
+func statusCode(status int) string {
+	switch {
+	case status >= 300 && status < 400:
+		return "HTTP_3XX"
+	case status >= 400 && status < 500:
+		return "HTTP_4XX"
+	case status >= 500 && status < 600:
+		return "HTTP_5XX"
+	}
+	return "HTTP_STATUS"
+}
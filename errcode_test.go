@@ -0,0 +1,99 @@
+package sitehit
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"syscall"
+	"testing"
+)
+
+// timeoutError is a net.Error that timed out, as a dial or read deadline
+// reports.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// dialError wraps err as the client reports a failed connection to
+// example.com.
+func dialError(op string, err error) error {
+	return &url.Error{Op: "Get", URL: "https://example.com/", Err: &net.OpError{Op: op, Net: "tcp", Err: err}}
+}
+
+// remoteError is the error of a handshake the server ended with alert, as
+// crypto/tls reports it.
+func remoteError(alert string) error {
+	return &url.Error{Op: "Get", URL: "https://example.com/", Err: &net.OpError{Op: "remote error", Err: errors.New(alert)}}
+}
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		want   string
+	}{
+		{"redirect status", nil, 301, "HTTP_3XX"},
+		{"client error status", nil, 404, "HTTP_4XX"},
+		{"server error status", nil, 503, "HTTP_5XX"},
+		{"other status", nil, 200, "HTTP_STATUS"},
+		{"header check", &checkError{bundle: "api", kind: "header", err: errors.New("no X-Backend header")}, 200, "HEADER_ASSERTION_FAILED"},
+		{"keywords check", &checkError{bundle: "expect-keywords", kind: "keywords", err: &keywordError{missing: []string{"in stock"}}}, 200, "KEYWORDS_ASSERTION_FAILED"},
+		{"status check", &checkError{bundle: "api", kind: "status", err: errors.New("status 500")}, 500, "HTTP_5XX"},
+		{"script", fmt.Errorf("%w: onResponse: boom", errScript), 200, "SCRIPT_ERROR"},
+		{"gRPC not serving", fmt.Errorf("%w: NOT_SERVING", errNotServing), 200, "GRPC_NOT_SERVING"},
+		{"gRPC reflection", fmt.Errorf("%w: service not listed", errReflection), 200, "GRPC_REFLECTION"},
+		{"gRPC status", &grpcStatusError{code: 14, message: "unavailable"}, 200, "GRPC_STATUS"},
+		{"HTTP version", fmt.Errorf("%w: got HTTP/1.1", errHTTPVersion), 200, "HTTP_VERSION"},
+		{"too many redirects", &url.Error{Op: "Get", URL: "https://example.com/", Err: errTooManyRedirects}, 301, "TOO_MANY_REDIRECTS"},
+		{"off-site redirect", &url.Error{Op: "Get", URL: "https://example.com/", Err: errOffSiteRedirect}, 302, "OFF_SITE_REDIRECT"},
+		{"stalled", fmt.Errorf("reading body: %w", errStalled), 200, "STALLED"},
+		{"canceled", &url.Error{Op: "Get", URL: "https://example.com/", Err: context.Canceled}, 0, "CANCELED"},
+		{"DNS", dialError("dial", &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}), 0, "DNS_FAILURE"},
+		{"certificate verification", &url.Error{Op: "Get", URL: "https://example.com/", Err: &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}}, 0, "TLS_CERTIFICATE"},
+		{"certificate hostname", x509.HostnameError{Certificate: &x509.Certificate{}, Host: "example.com"}, 0, "TLS_CERTIFICATE"},
+		{"certificate expired", x509.CertificateInvalidError{Cert: &x509.Certificate{}, Reason: x509.Expired}, 0, "TLS_CERTIFICATE"},
+		{"client certificate required", remoteError("tls: certificate required"), 0, "TLS_CLIENT_CERTIFICATE"},
+		{"client certificate rejected", remoteError("tls: bad certificate"), 0, "TLS_CLIENT_CERTIFICATE"},
+		{"client certificate unknown", remoteError("tls: unknown certificate authority"), 0, "TLS_CLIENT_CERTIFICATE"},
+		{"remote handshake failure", remoteError("tls: handshake failure"), 0, "TLS_HANDSHAKE"},
+		{"local certificate message", errors.New("tls: failed to parse certificate from server"), 0, "TLS_HANDSHAKE"},
+		{"record header", tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, 0, "TLS_HANDSHAKE"},
+		{"alert", tls.AlertError(40), 0, "TLS_HANDSHAKE"},
+		{"plain HTTP", errors.New("http: server gave HTTP response to HTTPS client"), 0, "TLS_HANDSHAKE"},
+		{"deadline", &url.Error{Op: "Get", URL: "https://example.com/", Err: context.DeadlineExceeded}, 0, "TIMEOUT"},
+		{"read deadline", fmt.Errorf("reading body: %w", os.ErrDeadlineExceeded), 200, "TIMEOUT"},
+		{"net timeout", dialError("dial", timeoutError{}), 0, "TIMEOUT"},
+		{"refused", dialError("dial", &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}), 0, "CONNECTION_REFUSED"},
+		{"reset", dialError("read", &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}), 0, "CONNECTION_RESET"},
+		{"EOF", &url.Error{Op: "Get", URL: "https://example.com/", Err: io.EOF}, 0, "CONNECTION_RESET"},
+		{"body cut short", fmt.Errorf("reading body: %w", io.ErrUnexpectedEOF), 200, "CONNECTION_RESET"},
+		{"host unreachable", dialError("dial", &os.SyscallError{Syscall: "connect", Err: syscall.EHOSTUNREACH}), 0, "HOST_UNREACHABLE"},
+		{"network unreachable", dialError("dial", &os.SyscallError{Syscall: "connect", Err: syscall.ENETUNREACH}), 0, "HOST_UNREACHABLE"},
+		{"HTTP/2 GOAWAY", errors.New("http2: server sent GOAWAY and closed the connection"), 0, "HTTP2_PROTOCOL"},
+		{"HTTP/2 stream", errors.New("stream error: stream ID 1; PROTOCOL_ERROR"), 0, "HTTP2_PROTOCOL"},
+		{"other dial error", dialError("dial", errors.New("socket: too many open files")), 0, "CONNECTION_FAILED"},
+		{"unknown with status", errors.New("something odd"), 502, "HTTP_5XX"},
+		{"unknown", errors.New("something odd"), 0, "UNKNOWN"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := errorCode(tt.err, tt.status)
+			if got != tt.want {
+				t.Errorf("errorCode(%v, %d) = %s, want %s", tt.err, tt.status, got, tt.want)
+			}
+			if !slices.Contains(errorCodes, got) {
+				t.Errorf("errorCode(%v, %d) = %s, which isn't in errorCodes", tt.err, tt.status, got)
+			}
+		})
+	}
+}
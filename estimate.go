@@ -0,0 +1,115 @@
+package sitehit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// estimateRuns is how many recent runs of a URL its expected latency and
+// attempts are averaged over.
+const estimateRuns = 5
+
+// urlCost is what visiting a URL took on average in recent runs.
+type urlCost struct {
+	Duration time.Duration
+	Attempts float64
+}
+
+// estimate is what a run is expected to take, worked out by --dry-run.
+type estimate struct {
+	URLs     int
+	Workers  int
+	Known    int // URLs with a latency in the history
+	Requests int
+	Duration time.Duration
+	Latency  time.Duration // average expected per URL
+}
+
+// MarshalJSON encodes the estimate with durations in milliseconds.
+func (e estimate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		URLs       int   `json:"urls"`
+		Workers    int   `json:"workers"`
+		Known      int   `json:"known"`
+		Requests   int   `json:"requests"`
+		DurationMs int64 `json:"duration_ms"`
+		LatencyMs  int64 `json:"latency_ms"`
+	}{e.URLs, e.Workers, e.Known, e.Requests, e.Duration.Milliseconds(), e.Latency.Milliseconds()})
+}
+
+// estimateRun works out the requests and duration of visiting urls with the
+// workers of opts, from the recent latencies in costs. URLs without history
+// are assumed to take as long as the average of those with, and a single
+// attempt.
+func estimateRun(urls []string, costs map[string]urlCost, opts Options) estimate {
+	est := estimate{URLs: len(urls), Workers: opts.BatchSize}
+	var known time.Duration
+	var attempts float64
+	for _, url := range urls {
+		if cost, ok := costs[url]; ok {
+			est.Known++
+			known += cost.Duration
+			attempts += cost.Attempts
+		} else {
+			attempts++
+		}
+	}
+	if est.Known > 0 {
+		est.Latency = known / time.Duration(est.Known)
+	}
+	total := known + est.Latency*time.Duration(len(urls)-est.Known)
+
+	est.Requests = int(attempts + 0.5)
+	if opts.MaxSize > 0 {
+		est.Requests += len(urls) // HEAD first
+	}
+	est.Duration = total/time.Duration(max(opts.BatchSize, 1)) + opts.StartJitter/2
+	return est
+}
+
+// runDryRun fetches the sitemaps and reports the estimated requests and
+// duration of a run without visiting any URL.
+func runDryRun(sources []string, s *settings) error {
+	sm, err := fetchSitemaps(context.Background(), sources, s.opts)
+	if err != nil {
+		return err
+	}
+	if err := checkSitemap(sm, s.opts); err != nil {
+		return err
+	}
+	printInventory(takeInventory(sm.URLs))
+	entries := uniqueEntries(s.localeRule.expand(sm.URLs))
+	sitemapURL := sitemapKey(sources)
+	if s.onlyMisses {
+		entries = s.skipCacheHits(sitemapURL, entries)
+	}
+	urls := sitemapURLs(entries, s.opts)
+
+	var costs map[string]urlCost
+	if s.history != nil {
+		costs, err = s.history.recentCosts(sitemapURL, estimateRuns)
+		if err != nil {
+			console.Error(fmt.Sprintf("Error reading history: %v", err), "event", "history", "error", err.Error())
+		}
+	}
+	printEstimate(estimateRun(urls, costs, s.opts))
+	return nil
+}
+
+func printEstimate(est estimate) {
+	if console.structured() {
+		console.Info("Estimate", "event", "estimate", "estimate", est)
+		return
+	}
+	fmt.Println("\nEstimate (dry run, no URLs visited):")
+	fmt.Printf("URLs: %d with %d workers\n", est.URLs, est.Workers)
+	fmt.Printf("Requests: about %d\n", est.Requests)
+	if est.Known == 0 {
+		fmt.Println("Duration: unknown, no latencies in the history (pass --history with earlier runs)")
+		return
+	}
+	fmt.Printf("Average latency: %v per URL, from the last %d runs of %d of the URLs\n", est.Latency.Round(time.Millisecond), estimateRuns, est.Known)
+	fmt.Printf("Duration: about %v\n", est.Duration.Round(time.Millisecond))
+}
@@ -0,0 +1,202 @@
+package sitehit
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	neturl "net/url"
+	"regexp"
+	"strings"
+)
+
+// patternRule applies value to the URLs matching pattern.
+type patternRule struct {
+	pattern *regexp.Regexp
+	value   string
+}
+
+// patternRules is a repeatable flag of "REGEXP=VALUE" rules. The first rule
+// whose pattern matches a URL applies to it.
+type patternRules []patternRule
+
+func (r *patternRules) String() string {
+	parts := make([]string, len(*r))
+	for i, rule := range *r {
+		parts[i] = rule.pattern.String() + "=" + rule.value
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (r *patternRules) Set(s string) error {
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return fmt.Errorf("%q: want PATTERN=VALUE", s)
+	}
+	pattern, err := regexp.Compile(s[:i])
+	if err != nil {
+		return err
+	}
+	*r = append(*r, patternRule{pattern: pattern, value: strings.TrimSpace(s[i+1:])})
+	return nil
+}
+
+// lookup returns the value of the first rule matching url.
+func (r patternRules) lookup(url string) (string, bool) {
+	for _, rule := range r {
+		if rule.pattern.MatchString(url) {
+			return rule.value, true
+		}
+	}
+	return "", false
+}
+
+// bodyPrefix is an io.Writer that keeps the first limit bytes written to it
+// and discards the rest.
+type bodyPrefix struct {
+	limit int
+	buf   []byte
+}
+
+func (b *bodyPrefix) Write(p []byte) (int, error) {
+	if room := b.limit - len(b.buf); room > 0 {
+		b.buf = append(b.buf, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// bodyPrefixLimit is how much of a body is kept for checks that look inside
+// it. The HTML spec requires the charset declaration in the first 1024 bytes,
+// but the lang attribute can come after a long comment or doctype.
+const bodyPrefixLimit = 64 << 10
+
+var (
+	htmlLangPattern    = regexp.MustCompile(`(?is)<html\b[^>]*?\blang\s*=\s*["']?([A-Za-z0-9-]+)`)
+	metaCharsetPattern = regexp.MustCompile(`(?is)<meta\b[^>]*?\bcharset\s*=\s*["']?([A-Za-z0-9_.:-]+)`)
+)
+
+// responseLanguages returns the languages a response declares, from the
+// Content-Language header or else the <html lang> attribute.
+func responseLanguages(resp *http.Response, body []byte) []string {
+	var langs []string
+	for _, lang := range strings.Split(resp.Header.Get("Content-Language"), ",") {
+		if lang = strings.TrimSpace(lang); lang != "" {
+			langs = append(langs, lang)
+		}
+	}
+	if len(langs) == 0 {
+		if m := htmlLangPattern.FindSubmatch(body); m != nil {
+			langs = append(langs, string(m[1]))
+		}
+	}
+	return langs
+}
+
+// responseCharset returns the charset a response declares, from the
+// Content-Type header or else a <meta> tag.
+func responseCharset(resp *http.Response, body []byte) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil && params["charset"] != "" {
+		return params["charset"]
+	}
+	if m := metaCharsetPattern.FindSubmatch(body); m != nil {
+		return string(m[1])
+	}
+	return ""
+}
+
+// languageMatches reports whether got is the language want or one of its
+// regional variants, so "de" accepts "de-AT".
+func languageMatches(got, want string) bool {
+	return strings.EqualFold(got, want) || (len(got) > len(want) && strings.EqualFold(got[:len(want)], want) && got[len(want)] == '-')
+}
+
+// checkLanguage verifies that a response declares the language want.
+func checkLanguage(resp *http.Response, body []byte, want string) error {
+	langs := responseLanguages(resp, body)
+	if len(langs) == 0 {
+		return fmt.Errorf("no language declared, want %q", want)
+	}
+	for _, lang := range langs {
+		if languageMatches(lang, want) {
+			return nil
+		}
+	}
+	return fmt.Errorf("unexpected language %q, want %q", strings.Join(langs, ", "), want)
+}
+
+// checkCharset verifies that a response declares the charset want.
+func checkCharset(resp *http.Response, body []byte, want string) error {
+	got := responseCharset(resp, body)
+	if got == "" {
+		return fmt.Errorf("no charset declared, want %q", want)
+	}
+	if !strings.EqualFold(got, want) {
+		return fmt.Errorf("unexpected charset %q, want %q", got, want)
+	}
+	return nil
+}
+
+// redirectRule requires URLs matching pattern to end up at target, which may
+// refer to the pattern's submatches as $1, $2... and may be relative to the
+// URL being checked.
+type redirectRule struct {
+	pattern *regexp.Regexp
+	target  string
+}
+
+// redirectRules is a repeatable flag of "REGEXP=>TARGET" rules, such as
+// '/old/(.*)=>/new/$1'. The first rule whose pattern matches a URL applies.
+type redirectRules []redirectRule
+
+func (r *redirectRules) String() string {
+	parts := make([]string, len(*r))
+	for i, rule := range *r {
+		parts[i] = rule.pattern.String() + "=>" + rule.target
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (r *redirectRules) Set(s string) error {
+	pattern, target, ok := strings.Cut(s, "=>")
+	if !ok {
+		return fmt.Errorf("%q: want PATTERN=>TARGET", s)
+	}
+	re, err := regexp.Compile(strings.TrimSpace(pattern))
+	if err != nil {
+		return err
+	}
+	*r = append(*r, redirectRule{pattern: re, target: strings.TrimSpace(target)})
+	return nil
+}
+
+// expected returns where rawURL should redirect to, if a rule matches it.
+func (r redirectRules) expected(rawURL string) (string, bool, error) {
+	for _, rule := range r {
+		match := rule.pattern.FindStringSubmatchIndex(rawURL)
+		if match == nil {
+			continue
+		}
+		target := string(rule.pattern.ExpandString(nil, rule.target, rawURL, match))
+		base, err := neturl.Parse(rawURL)
+		if err != nil {
+			return "", false, err
+		}
+		resolved, err := base.Parse(target)
+		if err != nil {
+			return "", false, err
+		}
+		return resolved.String(), true, nil
+	}
+	return "", false, nil
+}
+
+// checkRedirectTarget verifies that rawURL ended up at want.
+func checkRedirectTarget(rawURL string, resp *http.Response, want string) error {
+	got := resp.Request.URL.String()
+	if got == rawURL {
+		return fmt.Errorf("not redirected, want redirect to %s", want)
+	}
+	if got != want {
+		return fmt.Errorf("redirected to %s, want %s", got, want)
+	}
+	return nil
+}
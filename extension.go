@@ -0,0 +1,116 @@
+package sitehit
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// URLRequest is how a sitemap entry asks to be requested, through the
+// sitehit sitemap extension, for API endpoints listed among the pages:
+//
+//	<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9"
+//	        xmlns:sitehit="https://github.com/jeroensmink98/sitehit/sitemap/1.0">
+//	  <url>
+//	    <loc>https://api.site.nl/orders</loc>
+//	    <sitehit:request method="POST" status="201,202">
+//	      <sitehit:header>Content-Type: application/json</sitehit:header>
+//	      <sitehit:body>{"dry_run": true}</sitehit:body>
+//	    </sitehit:request>
+//	  </url>
+//	</urlset>
+//
+// Status lists the codes and classes such as 2xx that count as success, in
+// place of 200.
+type URLRequest struct {
+	Method  string   `xml:"method,attr"`
+	Status  string   `xml:"status,attr"`
+	Headers []string `xml:"https://github.com/jeroensmink98/sitehit/sitemap/1.0 header"`
+	Body    string   `xml:"https://github.com/jeroensmink98/sitehit/sitemap/1.0 body"`
+}
+
+// entryRequest is a URLRequest that was checked, as processURL applies it.
+type entryRequest struct {
+	method string
+	header http.Header
+	body   []byte
+	status statusCheck
+}
+
+func (r *URLRequest) parse() (*entryRequest, error) {
+	e := &entryRequest{header: http.Header{}}
+	if r.Method != "" {
+		e.method = strings.ToUpper(r.Method)
+		if !slices.Contains(methods, e.method) {
+			return nil, fmt.Errorf("method %q must be one of %s", r.Method, strings.Join(methods, ", "))
+		}
+	}
+	if r.Body != "" {
+		if e.method == "" || e.method == http.MethodGet || e.method == http.MethodHead || e.method == http.MethodOptions {
+			return nil, fmt.Errorf("a body needs method POST, PUT, PATCH or DELETE")
+		}
+		e.body = []byte(r.Body)
+	}
+	for _, line := range r.Headers {
+		name, value, ok := strings.Cut(line, ":")
+		if name = strings.TrimSpace(name); !ok || name == "" {
+			return nil, fmt.Errorf("header %q must be \"Name: value\"", line)
+		}
+		e.header.Add(name, strings.TrimSpace(value))
+	}
+	if r.Status != "" {
+		for _, status := range strings.Split(r.Status, ",") {
+			status = strings.ToLower(strings.TrimSpace(status))
+			if !validRetryStatus(status) || status == "error" {
+				return nil, fmt.Errorf("status %q is not a code or class like 2xx", status)
+			}
+			e.status = append(e.status, status)
+		}
+	}
+	return e, nil
+}
+
+// entryRequests returns the requests of the entries using the sitemap
+// extension, by URL, leaving out and reporting those that are invalid.
+func entryRequests(entries []Url, opts Options) map[string]*entryRequest {
+	var requests map[string]*entryRequest
+	for _, entry := range entries {
+		if entry.Request == nil {
+			continue
+		}
+		r, err := entry.Request.parse()
+		if err != nil {
+			opts.logger().Warn(fmt.Sprintf("Ignoring the sitehit:request of %s: %v", entry.Loc, err),
+				"event", "sitemap_request", "url", entry.Loc, "error", err.Error())
+			continue
+		}
+		if requests == nil {
+			requests = make(map[string]*entryRequest)
+		}
+		requests[entry.Loc] = r
+	}
+	return requests
+}
+
+// apply returns opts as they are for the entry's URL: with its method and
+// body, and its status check deciding success. Only a GET starts with the
+// HEAD of --head-first or --max-size.
+func (r *entryRequest) apply(opts Options) Options {
+	if r.method != "" {
+		opts.Method = r.method
+		if r.method != http.MethodGet {
+			opts.HeadFirst, opts.MaxSize = false, 0
+		}
+		if r.method == http.MethodGet || r.method == http.MethodHead || r.method == http.MethodOptions {
+			opts.Body = nil
+		}
+	}
+	if r.body != nil {
+		opts.Body = r.body
+	}
+	if r.status != nil {
+		opts.checks = append(slices.Clip(opts.checks), checkBundle{name: "sitemap", checks: map[string]checker{"status": r.status}})
+	}
+	return opts
+}
@@ -0,0 +1,94 @@
+package sitehit
+
+import (
+	"context"
+	"net"
+	"net/http"
+	neturl "net/url"
+)
+
+// fallbackKinds are the alternatives --fallback can retry a URL with after
+// a connection-level error: HTTP/1.1 instead of HTTP/2, or the other IPs the
+// host resolves to.
+var fallbackKinds = []string{"http1", "next-ip"}
+
+// variant is an alternative way of requesting a URL.
+type variant struct {
+	name   string // e.g. "HTTP/1.1" or "IP 192.0.2.7"
+	client *http.Client
+}
+
+// connectionError reports whether err happened below HTTP: while connecting,
+// during the TLS handshake or with HTTP/2 framing, rather than being a DNS
+// failure, a timeout or the run being cancelled.
+func connectionError(err error) bool {
+	switch errorCode(err, 0) {
+	case "CONNECTION_REFUSED", "CONNECTION_RESET", "HOST_UNREACHABLE", "CONNECTION_FAILED", "TLS_HANDSHAKE", "HTTP2_PROTOCOL":
+		return true
+	}
+	return false
+}
+
+// fallbackVariants returns the alternatives to try for rawURL, in order:
+// HTTP/1.1 for https URLs, then each IP of the host besides the first,
+// which is the one the dialer prefers.
+func fallbackVariants(ctx context.Context, rawURL string, opts Options) []variant {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	base, ok := client.Transport.(*http.Transport)
+	if !ok {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+
+	var variants []variant
+	for _, kind := range opts.Fallback {
+		switch kind {
+		case "http1":
+			if u.Scheme != "https" {
+				continue
+			}
+			t := base.Clone()
+			t.Protocols = new(http.Protocols)
+			t.Protocols.SetHTTP1(true)
+			variants = append(variants, variant{name: "HTTP/1.1", client: withTransport(client, t)})
+		case "next-ip":
+			addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+			if err != nil {
+				continue
+			}
+			for _, addr := range addrs[min(1, len(addrs)):] {
+				ip := addr.IP.String()
+				t := base.Clone()
+				dialer := &net.Dialer{}
+				t.DialContext = func(ctx context.Context, network, hostport string) (net.Conn, error) {
+					_, port, err := net.SplitHostPort(hostport)
+					if err != nil {
+						return nil, err
+					}
+					return dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+				}
+				variants = append(variants, variant{name: "IP " + ip, client: withTransport(client, t)})
+			}
+		}
+	}
+	return variants
+}
+
+// withTransport returns a copy of client sending its requests through t.
+func withTransport(client *http.Client, t *http.Transport) *http.Client {
+	c := *client
+	c.Transport = t
+	return &c
+}
+
+// close drops the idle connections of a variant, which is only used for
+// the one URL.
+func (v variant) close() {
+	v.client.CloseIdleConnections()
+}
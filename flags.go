@@ -0,0 +1,816 @@
+package sitehit
+
+import (
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// methods are the values --method accepts.
+var methods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions}
+
+// settings holds everything that can be configured through flags or the
+// config file.
+type settings struct {
+	opts          Options
+	checks        []checkSpec // from the config file
+	scriptPath    string
+	recheckAfter  time.Duration
+	sortBy        string
+	serveAddr     string
+	configPath    string
+	profile       string
+	parallelSites bool
+	logFormat     string
+	cronjob       bool
+	shutdownGrace time.Duration
+	maxDuration   time.Duration
+	connReport    bool
+	seoReport     bool
+	basicAuth     string
+	plugins       hostList
+	pluginSinks   []Sink
+	bearerToken   string
+	shedPattern   string
+	body          string
+	bodyFile      string
+	queueTarget   string
+	queueName     string
+	queueLease    time.Duration
+	queue         *workQueue
+	triage        bool
+	insecure      bool
+	caCert        string
+	clientCert    string
+	clientKey     string
+	httpVersion   string
+
+	maintenanceStatus int
+	maintenanceMarker string
+	maintenanceWait   time.Duration
+	maintenanceMax    time.Duration
+
+	redirectHosts hostList
+	warmAssets    hostList
+	diffHosts     hostList
+	diffHeaders   hostList
+	canaryHost    string
+	canaryPercent float64
+	hostsFile     string
+	historyPath   string
+	historyRetain retention
+	onlyMisses    bool
+	trendRuns     int
+	ignoreFile    string
+	printSchema   bool
+	streamTo      string
+	sheetID       string
+	sheetCreds    string
+	sheetFailures bool
+	sheet         *sheetExport
+	retain        string
+	dryRun        bool
+	format        string
+	htmlReport    string
+	junit         string
+	output        string
+	templateText  string
+	template      *outputTemplate
+	history       *history
+	issueTarget   string
+	issueAfter    int
+	issues        *issueFiler
+	locales       hostList
+	localeURL     string
+	localeRule    *localeRule
+	retryFirst    map[string]bool // URLs to visit before the rest, set by the daemon
+
+	maxSize        byteSize
+	egressCost     float64
+	backoffRate    float64
+	daemonEvery    time.Duration
+	slowThreshold  time.Duration
+	notifyWebhook  string
+	digestInterval time.Duration
+	slo            sloSpec
+	sloWindow      time.Duration
+	sloBurn        float64
+	followRedirect bool
+	maxRedirects   int
+	runWindows     timeWindows
+	quietHours     timeWindows
+	timezone       string
+	schedule       schedule
+}
+
+func (s *settings) register(fs *flag.FlagSet) {
+	fs.StringVar(&s.configPath, "config", "", "JSON config file with defaults, named profiles and sites")
+	fs.StringVar(&s.profile, "profile", "", "Profile from the config file to apply (e.g. prod-warm)")
+	fs.BoolVar(&s.parallelSites, "parallel-sites", false, "Run the sites from the config file in parallel instead of one after another")
+	fs.IntVar(&s.opts.BatchSize, "batch", 1, "Number of concurrent workers (max 20)")
+	fs.IntVar(&s.opts.SitemapWorkers, "sitemap-workers", 4, "Number of child sitemaps of a sitemap index to fetch concurrently")
+	fs.StringVar(&s.opts.InputFormat, "input-format", "auto", "Format of the sitemap: xml, txt for a list of URLs one per line, or auto to tell from the content")
+	fs.IntVar(&s.opts.SitemapDepth, "sitemap-depth", 3, "Levels of child sitemaps below a sitemap index to follow; 1 allows no nested indexes")
+	fs.IntVar(&s.opts.MaxSitemaps, "max-sitemaps", 0, "Fetch at most this many child sitemaps of a sitemap index (0 for no limit)")
+	fs.Var(&s.plugins, "plugin", "Go plugin (.so) whose Plugin is a sitehit.Source, for plugin:NAME sitemaps, or a sitehit.Sink for the results (repeatable)")
+	fs.StringVar(&s.queueTarget, "queue", "", "Keep the URLs of a run in Redis, as redis://[:password@]host[:port][/db], so the run survives restarts and several instances can share it; results are added to a stream")
+	fs.StringVar(&s.queueName, "queue-name", "", "Prefix of the --queue keys, for instances to share a queue (default derived from the sitemap)")
+	fs.DurationVar(&s.queueLease, "queue-lease", 5*time.Minute, "How long a URL taken from --queue may take before it's put back for any instance, so it must cover the retries")
+	fs.StringVar(&s.scriptPath, "script", "", "Starlark script with request() and/or classify() hooks")
+	fs.BoolVar(&s.opts.FailedPass, "retry-failed-pass", false, "Once every URL was visited, visit the failed ones again with a quarter of the workers and report that outcome, as many failures of big runs are congestion")
+	fs.DurationVar(&s.recheckAfter, "recheck-failures", 0, "After the run, wait this long and re-test the failed URLs once (e.g. 5m)")
+	fs.BoolVar(&s.opts.PriorityWeighted, "priority-weighted", false, "Visit URLs in order of sitemap priority, so high-priority pages get workers first and low-priority ones are left when a run is cut short")
+	fs.IntVar(&s.opts.FailureBudget, "failure-budget", 0, "With --priority-weighted, once this many URLs failed, shed the URLs at or below the default priority of 0.5 still to go and finish the others")
+	fs.StringVar(&s.opts.ShedOrder, "shed-order", "none", "What to visit last, and so drop first when a run is cut short: none, priority for the lowest sitemap priority, or lastmod for the oldest lastmod")
+	fs.StringVar(&s.shedPattern, "shed-pattern", "", "Visit the URLs matching this regexp after all others, so they're dropped first when a run is cut short (e.g. '/archive/|/tag/')")
+	fs.Var(&s.locales, "locales", "Comma-separated locales to also visit every sitemap URL in (e.g. de,fr), for sitemaps that only list the default locale")
+	fs.StringVar(&s.localeURL, "locale-url", defaultLocaleURL, "Template of a URL in another of --locales, from the {scheme}, {host} and {path} (with the query) of the listed URL and the {locale}, e.g. {scheme}://{locale}.{host}{path}")
+	fs.Var(&s.opts.sample, "sample", "Visit only a random sample of this many URLs, or a percentage of the sitemap (e.g. 50 or 10%)")
+	fs.StringVar(&s.opts.SampleWeight, "sample-weight", "uniform", "How to weight --sample: uniform, priority, or lastmod to favour recently changed pages")
+	fs.BoolVar(&s.opts.IsolateWorkers, "isolate-workers", false, "Give every worker its own connections and cookie jar, so the origin and CDN see independent visitors instead of one multiplexed client")
+	fs.BoolVar(&s.opts.OrderedOutput, "ordered-output", false, "Print the output of each URL in sitemap order instead of as workers finish, so runs can be diffed")
+	fs.StringVar(&s.sortBy, "sort", "", "List per-URL results in the summary, sorted by duration, status or url")
+	fs.StringVar(&s.serveAddr, "serve", "", "Run as an HTTP server on this address (e.g. :8080) instead of visiting a single sitemap")
+	fs.StringVar(&s.logFormat, "log-format", "text", "Progress output format: text or json (one JSON object per line)")
+	fs.StringVar(&s.format, "format", "text", "Format of the report: text, json for the summary and every result at the end of a run, csv for a row per URL, ndjson for a line of JSON per result as it completes, junit for a JUnit XML test suite, or markdown for a pull-request comment; all but text go to stdout, with the progress moved to stderr")
+	fs.StringVar(&s.templateText, "template", "", "Go text/template to write every result with as it completes, on stdout with the progress moved to stderr; {{define \"result\"}} and {{define \"summary\"}} blocks apply to each result and to the run's report instead")
+	fs.StringVar(&s.output, "output", "", "Write the report of --format (json if none is given) or --template to this file instead of stdout, with the progress on stderr")
+	fs.StringVar(&s.junit, "junit", "", "After the run, also write a JUnit XML test suite with a test case per URL to this file, whatever the --format")
+	fs.StringVar(&s.htmlReport, "html-report", "", "After the run, write a standalone HTML report with the summary, a latency chart, a breakdown by status and a sortable table of the results to this file")
+	fs.StringVar(&s.sheetID, "sheet", "", "After every run, append a summary row to the Summary tab of the Google Sheet with this ID")
+	fs.StringVar(&s.sheetCreds, "sheet-credentials", "", "Service account key file to sign in to Google Sheets with, $GOOGLE_APPLICATION_CREDENTIALS if empty")
+	fs.BoolVar(&s.sheetFailures, "sheet-failures", false, "With --sheet, also append a row per failed URL to the Failures tab")
+	fs.StringVar(&s.streamTo, "stream-to", "", "Also write every result as a line of JSON to this socket as it completes, as unix:///path or tcp://host:port")
+	fs.StringVar(&s.retain, "retain", "all", "Which results to keep in memory for the per-URL reports: all, or failures (failed and, with --slow-threshold, slow URLs) to bound memory on very large runs")
+	fs.BoolVar(&s.triage, "triage", false, "After the run, prompt to look into the failed URLs: retry one with every step traced, show its response headers and body, and add it to --ignore-file")
+	fs.BoolVar(&s.dryRun, "dry-run", false, "Fetch the sitemap and estimate the requests and duration of a run, from the latencies in --history, without visiting any URL")
+	fs.BoolVar(&s.printSchema, "schema", false, "Print the JSON Schema of the JSON output and exit")
+	fs.BoolVar(&s.cronjob, "cronjob", false, "Kubernetes CronJob mode: JSON logs, sitemap self-check, strict exit codes and a partial summary on SIGTERM")
+	fs.DurationVar(&s.shutdownGrace, "shutdown-grace", 0, "In --cronjob mode, how long requests in flight may finish after SIGTERM before they are aborted")
+	fs.DurationVar(&s.maxDuration, "max-duration", 0, "Stop the run after this long (e.g. 30m), aborting the requests in flight, printing a partial summary and exiting with status 5")
+	fs.Var((*days)(&s.opts.MaxSitemapAge), "max-sitemap-age", "Treat the sitemap as stale when its Last-Modified header and newest lastmod are older than this (e.g. 7d)")
+	fs.StringVar(&s.opts.StaleSitemap, "stale-sitemap", "fail", "What to do with a stale sitemap: fail or warn")
+	fs.IntVar(&s.maintenanceStatus, "maintenance-status", 0, "Status of the site's maintenance page (e.g. 503); getting it pauses the run and retries later instead of failing the URLs")
+	fs.StringVar(&s.maintenanceMarker, "maintenance-marker", "", "With --maintenance-status, a regexp the headers (as 'Name: value' lines) or body must match for the page to count as maintenance")
+	fs.DurationVar(&s.maintenanceWait, "maintenance-wait", 5*time.Minute, "How long to pause for a maintenance window before trying again")
+	fs.DurationVar(&s.maintenanceMax, "maintenance-max", 2*time.Hour, "Longest maintenance window to wait out, after which the URLs fail as usual")
+	fs.BoolVar(&s.seoReport, "seo-report", false, "Report the sitemap URLs blocked by robots.txt, marked noindex, naming another URL canonical or redirecting, and those whose signals conflict")
+	fs.BoolVar(&s.connReport, "conn-report", false, "Report unique hosts, IPs, TLS sessions and connection reuse after the run")
+	fs.Var(&s.opts.expectHeader, "expect-header", "Require every response to carry a header matching a regexp, as 'NAME: REGEXP' (repeatable, e.g. 'X-Backend: ^v2$'); an empty regexp only requires the header")
+	fs.Var(&s.opts.expectLanguage, "expect-language", "Require URLs matching a regexp to declare a language, as REGEXP=LANG (repeatable, e.g. '/de/=de')")
+	fs.Var(&s.opts.expectCharset, "expect-charset", "Require URLs matching a regexp to declare a charset, as REGEXP=CHARSET (repeatable)")
+	fs.BoolVar(&s.followRedirect, "follow-redirects", true, "Follow redirects; with --follow-redirects=false a redirect is the response, failing as HTTP_3XX unless a status check allows it")
+	fs.IntVar(&s.maxRedirects, "max-redirects", 10, "Redirects to follow per request before failing with TOO_MANY_REDIRECTS, to catch loops and long chains")
+	fs.Var(&s.redirectHosts, "allowed-redirect-hosts", "Comma-separated hosts a URL may redirect to besides its own (e.g. www.site.nl,*.cdn.net); other redirects fail")
+	fs.Var(&s.warmAssets, "warm-assets", "Also request the same-host assets of each HTML page: comma-separated css, js, img")
+	fs.Var(&s.opts.weightBudget, "weight-budget", "With --warm-assets, flag the pages weighing more than this with their assets (e.g. 2MB), or whose assets of a kind do (e.g. js=500KB); comma-separated or repeatable")
+	fs.Var(&s.opts.expectKeywords, "expect-keywords", "Require the visible text of URLs matching a regexp to contain keywords, in any case, as REGEXP=KEYWORD,KEYWORD (repeatable, e.g. '/product/=add to cart,in stock'); the summary reports how many pages each was found on")
+	fs.Var(&s.opts.expectRedirect, "expect-redirect", "Require URLs matching a regexp to redirect to a target, as REGEXP=>TARGET with $1 for submatches (repeatable, e.g. '/old/(.*)=>/new/$1')")
+	fs.Var(&s.opts.grpc, "grpc", "Check URLs matching a regexp with the gRPC health protocol, as REGEXP=grpc or REGEXP=grpc-web; a #fragment names the service (repeatable)")
+	fs.BoolVar(&s.opts.GRPCReflection, "grpc-reflection", false, "Also require --grpc URLs to list their service through server reflection, which suffices for servers without health checks")
+	fs.BoolVar(&s.opts.CDNDebug, "cdn-debug", false, "Ask Fastly and Akamai for debugging headers and record those of Fastly, Cloudflare, Akamai and CloudFront per URL")
+	fs.Var((*hostList)(&s.opts.RecordHeaders), "record-header", "Comma-separated response headers to record per URL (repeatable, e.g. X-Cache,X-Backend)")
+	fs.IntVar(&s.opts.Retries, "retries", 2, "Attempts to make after the first when a URL fails; 0 visits every URL once")
+	fs.Var((*hostList)(&s.opts.RetryOn), "retry-on", "Comma-separated failures to retry, as status codes, classes or error for requests without a complete response (default error,429,5xx)")
+	fs.Var(&s.opts.retryDelay, "retry-delay", "Wait between attempts per status, as STATUS=DELAY with a code, class or error (repeatable, e.g. '502=200ms,429=30s*2,4xx=none')")
+	fs.Float64Var(&s.opts.RetryBackoff, "retry-backoff", 1, "Multiply the one-second wait between attempts by this after every retry, with jitter, for statuses no --retry-delay rule matches (e.g. 2)")
+	fs.Var((*requestHeader)(&s.opts.Header), "H", "Header to send with every request, the sitemap fetches included, as \"Name: value\" (repeatable, e.g. -H \"X-Forwarded-Proto: https\")")
+	fs.StringVar(&s.basicAuth, "basic-auth", "", "Sign in to the site with HTTP basic auth, as user:pass, on the sitemap fetches and every request; $SITEHIT_BASIC_AUTH if empty")
+	fs.StringVar(&s.httpVersion, "http-version", "", "Speak only this HTTP version: 1.1, 2 (with prior knowledge for http URLs) or 3 (over QUIC, https URLs only); a server that doesn't fails the request. By default HTTP/2 is used where offered")
+	fs.BoolVar(&s.insecure, "insecure", false, "Don't verify the TLS certificates of the site, for test environments with self-signed ones")
+	fs.StringVar(&s.caCert, "ca-cert", "", "PEM file of CA certificates to trust besides the system ones, for sites signed by a private CA")
+	fs.StringVar(&s.clientCert, "client-cert", "", "PEM file of the client certificate to present to sites requiring mutual TLS")
+	fs.StringVar(&s.clientKey, "client-key", "", "PEM file of the private key of --client-cert, if it doesn't hold the key itself")
+	fs.StringVar(&s.bearerToken, "bearer-token", "", "Send this bearer token with the sitemap fetches and every request; $SITEHIT_BEARER_TOKEN if empty")
+	fs.StringVar(&s.opts.UserAgent, "user-agent", DefaultUserAgent, "User-Agent of the sitemap fetches and every request; empty for Go's own")
+	fs.DurationVar(&s.opts.MaxRetryAfter, "max-retry-after", time.Minute, "Wait as long as the Retry-After header of a 429 or 503 asks before retrying, up to this; 0 ignores the header")
+	fs.DurationVar(&s.opts.RetryMaxWait, "retry-max-wait", 0, "Never wait longer than this between attempts, however much --retry-backoff or a *N rule grew the wait (e.g. 30s)")
+	fs.Var((*hostList)(&s.opts.Fallback), "fallback", "After a connection-level error, retry with these alternatives in turn: comma-separated http1 (HTTP/1.1 instead of HTTP/2) and next-ip (the host's other IPs)")
+	fs.StringVar(&s.ignoreFile, "ignore-file", "", "File of known-bad URLs or * patterns, each with an optional YYYY-MM-DD expiry, whose failures don't fail the run")
+	fs.StringVar(&s.historyPath, "history", "", "SQLite database to record every run in, tracking when URLs appear, disappear and keep failing")
+	fs.Var(&s.historyRetain, "history-retain", "With --history, keep only the runs of a sitemap of this last period (e.g. 90d) or this many last runs (e.g. 100), pruning the rest after every run and vacuuming the database once it is a quarter free space")
+	fs.IntVar(&s.trendRuns, "sparklines", 0, "With --history, show a status and latency sparkline over the last N runs for every URL that failed in any of them")
+	fs.StringVar(&s.issueTarget, "file-issues", "", "With --history, open an issue for every URL failing --issue-after runs in a row, as github:owner/repo (GITHUB_TOKEN) or jira:https://jira.example.com/PROJECT (JIRA_USER, JIRA_TOKEN)")
+	fs.IntVar(&s.issueAfter, "issue-after", 3, "Runs in a row a URL must fail before --file-issues opens an issue for it")
+	fs.BoolVar(&s.onlyMisses, "only-misses", false, "With --history, only visit the URLs that weren't served from the CDN cache when last visited")
+	fs.Var(&s.diffHosts, "diff-hosts", "Instead of a run, request every URL from two hosts or base URLs (e.g. www.site.nl,https://staging.site.nl) and report where status, headers or body differ")
+	fs.Var(&s.diffHeaders, "diff-header", "Comma-separated response headers --diff-hosts compares (default Content-Type,Location,Cache-Control)")
+	fs.StringVar(&s.canaryHost, "canary-host", "", "Send --canary-percent of the URLs to this host or base URL instead, and compare its error rate and latency with the rest to recommend a promote or rollback")
+	fs.Float64Var(&s.canaryPercent, "canary-percent", 10, "Percentage of the URLs --canary-host gets, always the same ones")
+	fs.StringVar(&s.hostsFile, "hosts-file", "", "File in /etc/hosts format whose entries override DNS for the whole run, e.g. to test a new origin before cutover")
+	fs.Float64Var(&s.egressCost, "egress-cost", 0, "Price of CDN egress in $/GB, to report what the bytes transferred on the wire, compressed as they were sent, cost (and, with --daemon, per month)")
+	fs.StringVar(&s.opts.Method, "method", http.MethodGet, "Request method of the pages: GET, HEAD to check availability without downloading bodies, falling back to GET where HEAD is rejected, or POST, PUT, PATCH, DELETE or OPTIONS for endpoints listed in a URL file")
+	fs.StringVar(&s.body, "body", "", "Request body of the pages, for --method POST, PUT, PATCH or DELETE")
+	fs.StringVar(&s.bodyFile, "body-file", "", "File with the request body of the pages, instead of --body")
+	fs.StringVar(&s.opts.ContentType, "content-type", "application/x-www-form-urlencoded", "Content-Type of --body or --body-file")
+	fs.BoolVar(&s.opts.HeadFirst, "head-first", false, "Start every URL with a HEAD and only make the GET when it isn't a 200 served from a CDN cache, to save transfer on well-cached sites")
+	fs.Var(&s.maxSize, "max-size", "HEAD every URL first and don't download those declaring more than this (e.g. 50MB)")
+	fs.StringVar(&s.opts.Oversize, "oversize", "skip", "What to do with URLs over --max-size: skip, or range to request only their first KiB")
+	fs.DurationVar(&s.daemonEvery, "daemon", 0, "Keep running, starting a new run of the sitemap at this interval (e.g. 1h)")
+	fs.DurationVar(&s.slowThreshold, "slow-threshold", 0, "Consider successful URLs slower than this as slow (e.g. 2s)")
+	fs.StringVar(&s.notifyWebhook, "notify-webhook", "", "In --daemon mode, POST status change notifications as JSON to this URL (Slack-compatible)")
+	fs.DurationVar(&s.digestInterval, "digest-interval", 0, "In --daemon mode, batch status changes into one notification at most this often (e.g. 6h) instead of after every run")
+	fs.Var(&s.slo, "slo", "In --daemon mode, a latency objective as PERCENT:DURATION (e.g. 99%:1s for 99% of URLs succeeding within 1s), notifying when recent runs burn its error budget too fast")
+	fs.DurationVar(&s.sloWindow, "slo-window", 6*time.Hour, "Window of runs --slo computes the burn rate over; the alert also needs the burn over the last twelfth of it")
+	fs.Float64Var(&s.sloBurn, "slo-burn", 6, "Burn rate, the share of URLs missing --slo divided by the share it allows, above which to alert")
+	fs.Var(&s.runWindows, "run-window", "In --daemon mode, only run within these daily windows, as comma-separated HH:MM-HH:MM (e.g. 06:00-09:00,22:00-02:00)")
+	fs.Var(&s.quietHours, "quiet-hours", "In --daemon mode, never run within these daily windows, as comma-separated HH:MM-HH:MM; runs still going are stopped")
+	fs.StringVar(&s.timezone, "timezone", "Local", "Time zone of --run-window and --quiet-hours (e.g. Europe/Amsterdam)")
+	fs.Float64Var(&s.backoffRate, "backoff-error-rate", 0, "Halve the workers while more than this fraction of the last minute's requests fail with 5xx, 429 or a connection error, restoring them once healthy (e.g. 0.2)")
+	fs.DurationVar(&s.opts.Timeout, "timeout", 0, "Fail a request with TIMEOUT when it takes longer than this, reading the body included, so a hung URL can't hold a worker forever (e.g. 30s)")
+	fs.DurationVar(&s.opts.StallTimeout, "stall-timeout", 0, "Abort an attempt when its response body makes no progress for this long, to catch servers that trickle bytes forever (e.g. 30s)")
+	fs.Float64Var(&s.opts.Rate, "rate", 0, "Cap the requests a second of a run, retries and assets included; with --queue, of all the instances sharing it together (e.g. 50)")
+	fs.DurationVar(&s.opts.StartJitter, "start-jitter", 0, "Delay each worker's start by a random duration up to this value")
+}
+
+// prepare validates the parsed values and loads whatever they point to
+// without side effects, as it runs again for every site of a --config run.
+func (s *settings) prepare() error {
+	if s.opts.BatchSize < 1 {
+		s.opts.BatchSize = 1
+	}
+	if s.opts.BatchSize > 20 {
+		s.opts.BatchSize = 20
+	}
+	if s.opts.Retries < 0 {
+		return fmt.Errorf("invalid --retries %d: must be 0 or more", s.opts.Retries)
+	}
+	for i, status := range s.opts.RetryOn {
+		s.opts.RetryOn[i] = strings.ToLower(status)
+		if !validRetryStatus(s.opts.RetryOn[i]) {
+			return fmt.Errorf("invalid --retry-on %q: must be a code like 429, a class like 5xx, or error", status)
+		}
+	}
+	if len(s.opts.RetryOn) == 0 {
+		s.opts.RetryOn = defaultRetryOn
+	}
+	if s.opts.RetryBackoff < 1 {
+		return fmt.Errorf("invalid --retry-backoff %g: must be at least 1", s.opts.RetryBackoff)
+	}
+	if s.logFormat != "text" && s.logFormat != "json" {
+		return fmt.Errorf("invalid --log-format %q: must be text or json", s.logFormat)
+	}
+	if !slices.Contains(outputFormats, s.format) {
+		return fmt.Errorf("invalid --format %q: must be one of %s", s.format, strings.Join(outputFormats, ", "))
+	}
+	if s.templateText != "" {
+		if s.format != "text" {
+			return fmt.Errorf("--template can't be combined with --format %s", s.format)
+		}
+		t, err := parseOutputTemplate(s.templateText)
+		if err != nil {
+			return err
+		}
+		s.template = t
+	}
+	if s.output != "" && s.format == "text" && s.template == nil {
+		s.format = "json"
+	}
+	if s.daemonEvery > 0 && s.cronjob {
+		return fmt.Errorf("--daemon and --cronjob can't be combined")
+	}
+	if s.slo.target > 0 {
+		if s.daemonEvery == 0 {
+			return fmt.Errorf("--slo requires --daemon")
+		}
+		if s.sloWindow <= 0 || s.sloBurn <= 0 {
+			return fmt.Errorf("--slo-window and --slo-burn must be positive")
+		}
+	}
+	if s.maxRedirects < 0 {
+		return fmt.Errorf("invalid --max-redirects %d: must be 0 or more", s.maxRedirects)
+	}
+	if s.maxDuration < 0 {
+		return fmt.Errorf("invalid --max-duration %v: must not be negative", s.maxDuration)
+	}
+	if s.maxDuration > 0 && (s.daemonEvery > 0 || s.serveAddr != "") {
+		return fmt.Errorf("--max-duration can't be combined with --daemon or --serve")
+	}
+	if len(s.diffHosts) > 0 {
+		if err := validDiffHosts(s.diffHosts); err != nil {
+			return err
+		}
+		if s.daemonEvery > 0 || s.cronjob || s.serveAddr != "" {
+			return fmt.Errorf("--diff-hosts can't be combined with --daemon, --cronjob or --serve")
+		}
+	}
+	if s.dryRun && (s.daemonEvery > 0 || s.cronjob || s.serveAddr != "" || len(s.diffHosts) > 0) {
+		return fmt.Errorf("--dry-run can't be combined with --daemon, --cronjob, --serve or --diff-hosts")
+	}
+	if s.canaryHost != "" {
+		if s.canaryPercent <= 0 || s.canaryPercent >= 100 {
+			return fmt.Errorf("invalid --canary-percent %g: must be above 0 and below 100", s.canaryPercent)
+		}
+		if scheme, _, ok := strings.Cut(s.canaryHost, "://"); ok && scheme != "http" && scheme != "https" {
+			return fmt.Errorf("invalid --canary-host %q: must be a host or an http(s) URL", s.canaryHost)
+		}
+		if s.historyPath != "" || s.retain != "all" || len(s.diffHosts) > 0 {
+			return fmt.Errorf("--canary-host can't be combined with --history, --retain failures or --diff-hosts")
+		}
+	}
+	loc, err := time.LoadLocation(s.timezone)
+	if err != nil {
+		return fmt.Errorf("invalid --timezone: %w", err)
+	}
+	s.schedule = schedule{allowed: s.runWindows, quiet: s.quietHours, loc: loc}
+	if s.schedule.restricted() {
+		if s.daemonEvery == 0 {
+			return fmt.Errorf("--run-window and --quiet-hours require --daemon")
+		}
+		if s.schedule.next(time.Now()).IsZero() {
+			return fmt.Errorf("--quiet-hours cover all of --run-window: the daemon would never run")
+		}
+	}
+	if s.triage && (s.daemonEvery > 0 || s.cronjob || s.serveAddr != "" || s.dryRun || len(s.diffHosts) > 0 || s.parallelSites) {
+		return fmt.Errorf("--triage can't be combined with --daemon, --cronjob, --serve, --dry-run, --diff-hosts or --parallel-sites")
+	}
+	if s.onlyMisses && s.historyPath == "" {
+		return fmt.Errorf("--only-misses requires --history")
+	}
+	if s.historyRetain != (retention{}) && s.historyPath == "" {
+		return fmt.Errorf("--history-retain requires --history")
+	}
+	if s.trendRuns > 0 && s.historyPath == "" {
+		return fmt.Errorf("--sparklines requires --history")
+	}
+	if len(s.locales) > 0 {
+		rule, err := newLocaleRule(s.locales, s.localeURL)
+		if err != nil {
+			return err
+		}
+		s.localeRule = rule
+	}
+	if s.issueTarget != "" {
+		if s.historyPath == "" {
+			return fmt.Errorf("--file-issues requires --history")
+		}
+		if s.issueAfter < 2 {
+			return fmt.Errorf("invalid --issue-after %d: must be at least 2", s.issueAfter)
+		}
+		issues, err := newIssueFiler(s.issueTarget, s.issueAfter)
+		if err != nil {
+			return err
+		}
+		s.issues = issues
+	}
+	if s.opts.Rate < 0 {
+		return fmt.Errorf("invalid --rate %g: must be positive", s.opts.Rate)
+	}
+	if s.backoffRate < 0 || s.backoffRate >= 1 {
+		return fmt.Errorf("invalid --backoff-error-rate %g: must be at least 0 and below 1", s.backoffRate)
+	}
+	if s.backoffRate > 0 {
+		s.opts.guard = newErrorGuard(s.backoffRate, s.opts.BatchSize)
+	}
+	if !slices.Contains(retainModes, s.retain) {
+		return fmt.Errorf("invalid --retain %q: must be one of %s", s.retain, strings.Join(retainModes, ", "))
+	}
+	if s.retain == "failures" {
+		if s.historyPath != "" || s.daemonEvery > 0 {
+			return fmt.Errorf("--retain failures can't be combined with --history or --daemon, which need every result")
+		}
+		s.opts.Retain = retainFailures(s.slowThreshold)
+	}
+	if s.opts.Oversize != "skip" && s.opts.Oversize != "range" {
+		return fmt.Errorf("invalid --oversize %q: must be skip or range", s.opts.Oversize)
+	}
+	s.opts.MaxSize = int64(s.maxSize)
+	if s.opts.StaleSitemap != "fail" && s.opts.StaleSitemap != "warn" {
+		return fmt.Errorf("invalid --stale-sitemap %q: must be fail or warn", s.opts.StaleSitemap)
+	}
+	if !slices.Contains(inputFormats, s.opts.InputFormat) {
+		return fmt.Errorf("invalid --input-format %q: must be one of %s", s.opts.InputFormat, strings.Join(inputFormats, ", "))
+	}
+	if !slices.Contains(shedOrders, s.opts.ShedOrder) {
+		return fmt.Errorf("invalid --shed-order %q: must be one of %s", s.opts.ShedOrder, strings.Join(shedOrders, ", "))
+	}
+	if s.opts.PriorityWeighted && s.opts.ShedOrder != "none" && s.opts.ShedOrder != "priority" {
+		return fmt.Errorf("--priority-weighted can't be combined with --shed-order %s", s.opts.ShedOrder)
+	}
+	if s.opts.FailureBudget < 0 {
+		return fmt.Errorf("invalid --failure-budget %d: must not be negative", s.opts.FailureBudget)
+	}
+	if s.opts.FailureBudget > 0 && !s.opts.PriorityWeighted {
+		return fmt.Errorf("--failure-budget requires --priority-weighted")
+	}
+	if s.shedPattern != "" {
+		re, err := regexp.Compile(s.shedPattern)
+		if err != nil {
+			return fmt.Errorf("invalid --shed-pattern: %w", err)
+		}
+		s.opts.ShedPattern = re
+	}
+	if !slices.Contains(sampleWeights, s.opts.SampleWeight) {
+		return fmt.Errorf("invalid --sample-weight %q: must be one of %s", s.opts.SampleWeight, strings.Join(sampleWeights, ", "))
+	}
+	if s.sortBy != "" && !slices.Contains(sortKeys, s.sortBy) {
+		return fmt.Errorf("invalid --sort %q: must be one of %s", s.sortBy, strings.Join(sortKeys, ", "))
+	}
+
+	s.opts.Method = strings.ToUpper(s.opts.Method)
+	if !slices.Contains(methods, s.opts.Method) {
+		return fmt.Errorf("invalid --method %q: must be one of %s", s.opts.Method, strings.Join(methods, ", "))
+	}
+	if s.opts.Method == http.MethodHead && (s.opts.HeadFirst || len(s.warmAssets) > 0) {
+		return fmt.Errorf("--method HEAD can't be combined with --head-first or --warm-assets")
+	}
+	if s.opts.Method != http.MethodGet && (s.opts.HeadFirst || s.maxSize > 0) {
+		return fmt.Errorf("--head-first and --max-size only work with --method GET")
+	}
+	if err := s.prepareBody(); err != nil {
+		return err
+	}
+
+	if err := s.prepareAuth(); err != nil {
+		return err
+	}
+
+	s.opts.Client = &http.Client{CheckRedirect: redirectPolicy(s.redirectHosts, s.followRedirect, s.maxRedirects)}
+	var transport *http.Transport
+	if s.hostsFile != "" {
+		overrides, err := loadHostsFile(s.hostsFile)
+		if err != nil {
+			return fmt.Errorf("loading hosts file: %w", err)
+		}
+		transport = overrides.transport()
+	}
+	tlsConfig, err := s.prepareTLS()
+	if err != nil {
+		return err
+	}
+	if (tlsConfig != nil || s.httpVersion != "") && transport == nil {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	if s.httpVersion == "3" && (s.hostsFile != "" || s.opts.IsolateWorkers || len(s.opts.Fallback) > 0 || len(s.opts.grpc) > 0) {
+		return fmt.Errorf("--http-version 3 can't be combined with --hosts-file, --isolate-workers, --fallback or --grpc")
+	}
+	if s.httpVersion != "" && slices.Contains(s.opts.Fallback, "http1") {
+		return fmt.Errorf("--http-version can't be combined with --fallback http1")
+	}
+	if s.httpVersion != "" {
+		s.opts.Client.Transport, err = versionTransport(s.httpVersion, transport)
+		if err != nil {
+			return err
+		}
+		s.opts.HTTPVersion = s.httpVersion
+	} else if transport != nil {
+		s.opts.Client.Transport = transport
+	}
+
+	for _, rule := range s.opts.grpc {
+		if !slices.Contains(grpcModes, rule.value) {
+			return fmt.Errorf("invalid --grpc mode %q: must be one of %s", rule.value, strings.Join(grpcModes, ", "))
+		}
+	}
+	if len(s.opts.grpc) > 0 {
+		s.opts.grpcClient = grpcClient(s.opts.Client)
+	}
+
+	checks, err := compileChecks(s.checks)
+	if err != nil {
+		return err
+	}
+	s.opts.checks = append(checks, flagChecks(s.opts)...)
+
+	for _, kind := range s.opts.Fallback {
+		if !slices.Contains(fallbackKinds, kind) {
+			return fmt.Errorf("invalid --fallback %q: must be one of %s", kind, strings.Join(fallbackKinds, ", "))
+		}
+	}
+
+	for _, kind := range s.warmAssets {
+		if !slices.Contains(assetKinds, kind) {
+			return fmt.Errorf("invalid --warm-assets kind %q: must be one of %s", kind, strings.Join(assetKinds, ", "))
+		}
+	}
+	s.opts.WarmAssets = s.warmAssets
+	if len(s.opts.weightBudget) > 0 && len(s.warmAssets) == 0 {
+		return fmt.Errorf("--weight-budget requires --warm-assets")
+	}
+
+	if s.maintenanceStatus != 0 {
+		m, err := newMaintenance(s.maintenanceStatus, s.maintenanceMarker, s.maintenanceWait, s.maintenanceMax)
+		if err != nil {
+			return err
+		}
+		s.opts.maintenance = m
+	} else if s.maintenanceMarker != "" {
+		return fmt.Errorf("--maintenance-marker requires --maintenance-status")
+	}
+
+	if s.connReport {
+		s.opts.conns = newConnStats()
+	}
+	if s.seoReport {
+		s.opts.seo = newSEOAudit()
+	}
+
+	if s.ignoreFile != "" {
+		ignore, err := loadIgnoreFile(s.ignoreFile)
+		if err != nil {
+			return fmt.Errorf("loading ignore file: %w", err)
+		}
+		s.opts.ignore = ignore
+	}
+
+	if s.queueTarget != "" && s.historyPath != "" {
+		return fmt.Errorf("--queue can't be combined with --history, as every instance only sees its share of the URLs")
+	}
+	if s.queueTarget != "" && s.opts.FailureBudget > 0 {
+		return fmt.Errorf("--queue can't be combined with --failure-budget, as every instance only sees its share of the failures")
+	}
+
+	if s.scriptPath != "" {
+		hooks, err := loadHooks(s.scriptPath)
+		if err != nil {
+			return fmt.Errorf("loading script: %w", err)
+		}
+		s.opts.Hooks = hooks
+	}
+	return nil
+}
+
+// setup opens and creates what the flags point to for the whole invocation:
+// the --output file, the result sinks and plugins, the queue and the
+// history. Unlike prepare it runs once, in Main, and the sites of a
+// --config run share what it opened.
+func (s *settings) setup() error {
+	if s.output != "" {
+		f, err := os.Create(s.output)
+		if err != nil {
+			return fmt.Errorf("creating --output file: %w", err)
+		}
+		reportOut = f
+	}
+
+	var sinks []func(Result)
+	if s.format == "ndjson" {
+		sinks = append(sinks, writeNDJSON)
+	}
+	if s.template != nil {
+		sinks = append(sinks, s.template.writeResult)
+	}
+	if s.sheetID != "" {
+		sheet, err := newSheetExport(s.sheetID, s.sheetCreds, s.sheetFailures)
+		if err != nil {
+			return err
+		}
+		s.sheet = sheet
+	}
+	if s.streamTo != "" {
+		stream, err := newResultStream(s.streamTo)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, stream.send)
+	}
+	for _, path := range s.plugins {
+		name, source, sink, err := loadPlugin(path)
+		if err != nil {
+			return err
+		}
+		if source != nil {
+			if s.opts.Sources == nil {
+				s.opts.Sources = map[string]Source{}
+			}
+			s.opts.Sources[name] = source
+		}
+		if sink != nil {
+			s.pluginSinks = append(s.pluginSinks, sink)
+			sinks = append(sinks, sink.Result)
+		}
+	}
+	if len(sinks) > 0 {
+		s.opts.OnResult = func(result Result) {
+			for _, sink := range sinks {
+				sink(result)
+			}
+		}
+	}
+
+	if s.queueTarget != "" {
+		queue, err := newWorkQueue(s.queueTarget, s.queueName, s.queueLease)
+		if err != nil {
+			return err
+		}
+		s.queue = queue
+	}
+
+	if s.historyPath != "" {
+		h, err := openHistory(s.historyPath)
+		if err != nil {
+			return fmt.Errorf("opening history: %w", err)
+		}
+		s.history = h
+	}
+	return nil
+}
+
+// share gives the settings of a site what setup opened for main.
+func (s *settings) share(main *settings) {
+	s.sheet, s.pluginSinks, s.queue, s.history = main.sheet, main.pluginSinks, main.queue, main.history
+	s.opts.Sources, s.opts.OnResult = main.opts.Sources, main.opts.OnResult
+}
+
+// skipCacheHits leaves out the entries that were found in the CDN cache the
+// last time they were visited. Without history every entry is kept.
+func (s *settings) skipCacheHits(sitemapURL string, entries []Url) []Url {
+	hits, err := s.history.cacheHits(sitemapURL)
+	if err != nil {
+		console.Error(fmt.Sprintf("Error reading history, visiting all URLs: %v", err), "event", "history", "error", err.Error())
+		return entries
+	}
+	misses := slices.DeleteFunc(slices.Clone(entries), func(entry Url) bool {
+		return hits[entry.Loc]
+	})
+	console.Info(fmt.Sprintf("Skipping %d URLs served from cache when last visited", len(entries)-len(misses)),
+		"event", "only_misses", "cache_hits", len(entries)-len(misses), "urls", len(misses))
+	return misses
+}
+
+// days is a duration flag that also accepts whole days, such as "7d".
+type days time.Duration
+
+func (d days) String() string {
+	if d != 0 && time.Duration(d)%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", time.Duration(d)/(24*time.Hour))
+	}
+	return time.Duration(d).String()
+}
+
+func (d *days) Set(value string) error {
+	if n, ok := strings.CutSuffix(value, "d"); ok {
+		count, err := strconv.Atoi(n)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		*d = days(time.Duration(count) * 24 * time.Hour)
+		return nil
+	}
+	v, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = days(v)
+	return nil
+}
+
+// prepareAuth adds the Authorization header of --basic-auth or
+// --bearer-token, which fall back to their environment variables so the
+// secret needn't be on the command line.
+func (s *settings) prepareAuth() error {
+	if s.basicAuth == "" {
+		s.basicAuth = os.Getenv("SITEHIT_BASIC_AUTH")
+	}
+	if s.bearerToken == "" {
+		s.bearerToken = os.Getenv("SITEHIT_BEARER_TOKEN")
+	}
+	var auth string
+	switch {
+	case s.basicAuth != "" && s.bearerToken != "":
+		return fmt.Errorf("--basic-auth and --bearer-token can't be combined")
+	case s.basicAuth != "":
+		user, pass, ok := strings.Cut(s.basicAuth, ":")
+		if !ok {
+			return fmt.Errorf("invalid --basic-auth: want user:pass")
+		}
+		auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	case s.bearerToken != "":
+		auth = "Bearer " + s.bearerToken
+	default:
+		return nil
+	}
+	if s.opts.Header.Get("Authorization") != "" {
+		return fmt.Errorf("-H Authorization can't be combined with --basic-auth or --bearer-token")
+	}
+	if s.opts.Header == nil {
+		s.opts.Header = http.Header{}
+	}
+	s.opts.Header.Set("Authorization", auth)
+	return nil
+}
+
+// prepareTLS returns the TLS settings of --insecure, --ca-cert and
+// --client-cert, shared by every request through the transport, or nil when
+// none is set.
+func (s *settings) prepareTLS() (*tls.Config, error) {
+	if !s.insecure && s.caCert == "" && s.clientCert == "" && s.clientKey == "" {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if s.insecure {
+		if s.caCert != "" {
+			return nil, fmt.Errorf("--insecure and --ca-cert can't be combined")
+		}
+		config.InsecureSkipVerify = true
+	}
+	if s.caCert != "" {
+		pem, err := os.ReadFile(s.caCert)
+		if err != nil {
+			return nil, fmt.Errorf("reading --ca-cert: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid --ca-cert %q: no PEM certificates in it", s.caCert)
+		}
+		config.RootCAs = pool
+	}
+	if s.clientKey != "" && s.clientCert == "" {
+		return nil, fmt.Errorf("--client-key requires --client-cert")
+	}
+	if s.clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(s.clientCert, cmp.Or(s.clientKey, s.clientCert))
+		if err != nil {
+			return nil, fmt.Errorf("loading --client-cert: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// requestHeader is the repeatable -H flag, of curl-style "Name: value"
+// header fields sent with every request.
+type requestHeader http.Header
+
+func (h *requestHeader) String() string {
+	if h == nil {
+		return ""
+	}
+	var parts []string
+	for _, name := range slices.Sorted(maps.Keys(*h)) {
+		for _, value := range (*h)[name] {
+			parts = append(parts, name+": "+value)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (h *requestHeader) Set(s string) error {
+	name, value, ok := strings.Cut(s, ":")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if !ok || name == "" || strings.ContainsAny(name, " \t\r\n") || strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("%q: want Name: value", s)
+	}
+	if *h == nil {
+		*h = requestHeader{}
+	}
+	http.Header(*h).Add(name, value)
+	return nil
+}
+
+// hostList is a flag holding a comma-separated list, such as host names. It
+// may be repeated to add more.
+type hostList []string
+
+func (l *hostList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *hostList) Set(value string) error {
+	for _, host := range strings.Split(value, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			*l = append(*l, host)
+		}
+	}
+	return nil
+}
+
+// prepareBody reads the request body of --body or --body-file, which only
+// methods that carry one may send.
+func (s *settings) prepareBody() error {
+	switch {
+	case s.body != "" && s.bodyFile != "":
+		return fmt.Errorf("--body and --body-file can't be combined")
+	case s.body != "":
+		s.opts.Body = []byte(s.body)
+	case s.bodyFile != "":
+		body, err := os.ReadFile(s.bodyFile)
+		if err != nil {
+			return fmt.Errorf("reading --body-file: %w", err)
+		}
+		s.opts.Body = body
+	default:
+		return nil
+	}
+	if s.opts.Method == http.MethodGet || s.opts.Method == http.MethodHead || s.opts.Method == http.MethodOptions {
+		return fmt.Errorf("--method %s can't send a body, use POST, PUT, PATCH or DELETE", s.opts.Method)
+	}
+	return nil
+}
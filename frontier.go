@@ -0,0 +1,100 @@
+package sitehit
+
+import (
+	neturl "net/url"
+	"slices"
+)
+
+// frontier hands out the URLs of a run one host at a time in turn, so a
+// host with 10k URLs in a multi-domain sitemap doesn't hold up the others
+// until it's done. The URLs of a host keep their order, and hosts take
+// turns in the order they first appear.
+//
+// With ranks, from --priority-weighted, --shed-order or --shed-pattern,
+// the order holds across hosts as well: only the hosts whose next URL has
+// the lowest rank take turns, so a host's high-priority URLs aren't held
+// back by the low-priority URLs of the others, and none of a lower rank is
+// handed out before every URL of a higher one was.
+type frontier struct {
+	hosts  []string
+	queues map[string][]job
+	ranks  map[string]int
+	turn   int
+}
+
+func newFrontier(urls []string, ranks map[string]int) *frontier {
+	f := &frontier{queues: make(map[string][]job), ranks: ranks}
+	for i, url := range urls {
+		host := ""
+		if u, err := neturl.Parse(url); err == nil {
+			host = u.Host
+		}
+		if _, ok := f.queues[host]; !ok {
+			f.hosts = append(f.hosts, host)
+		}
+		f.queues[host] = append(f.queues[host], job{index: i, url: url})
+	}
+	return f
+}
+
+// pop returns the next URL to visit, from the host whose turn it is, or
+// false once every URL was handed out.
+func (f *frontier) pop() (job, bool) {
+	if len(f.hosts) == 0 {
+		return job{}, false
+	}
+	if f.ranks != nil {
+		f.skipRanked()
+	}
+	host := f.hosts[f.turn]
+	queue := f.queues[host]
+	j := queue[0]
+	if len(queue) == 1 {
+		delete(f.queues, host)
+		f.hosts = append(f.hosts[:f.turn], f.hosts[f.turn+1:]...)
+	} else {
+		f.queues[host] = queue[1:]
+		f.turn++
+	}
+	if f.turn >= len(f.hosts) {
+		f.turn = 0
+	}
+	return j, true
+}
+
+// skipRanked moves the turn on to the first host, from the one whose turn
+// it is, with a next URL of the lowest rank.
+func (f *frontier) skipRanked() {
+	best := f.ranks[f.queues[f.hosts[0]][0].url]
+	for _, host := range f.hosts[1:] {
+		best = min(best, f.ranks[f.queues[host][0].url])
+	}
+	for f.ranks[f.queues[f.hosts[f.turn]][0].url] != best {
+		f.turn = (f.turn + 1) % len(f.hosts)
+	}
+}
+
+// shed drops the URLs not yet handed out that keep doesn't hold, and
+// returns how many it dropped.
+func (f *frontier) shed(keep map[string]bool) int {
+	shed := 0
+	hosts := f.hosts[:0]
+	for i, host := range f.hosts {
+		queue := slices.DeleteFunc(f.queues[host], func(j job) bool { return !keep[j.url] })
+		shed += len(f.queues[host]) - len(queue)
+		if len(queue) == 0 {
+			delete(f.queues, host)
+			if i < f.turn {
+				f.turn--
+			}
+			continue
+		}
+		f.queues[host] = queue
+		hosts = append(hosts, host)
+	}
+	f.hosts = hosts
+	if f.turn >= len(f.hosts) {
+		f.turn = 0
+	}
+	return shed
+}
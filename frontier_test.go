@@ -0,0 +1,210 @@
+package sitehit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFrontierSharesHosts(t *testing.T) {
+	// A host with 10k URLs listed first, then two small ones
+	var urls []string
+	for i := range 10000 {
+		urls = append(urls, fmt.Sprintf("https://big.nl/%d", i))
+	}
+	small := []string{"https://a.nl/1", "https://b.nl/1", "https://a.nl/2", "https://b.nl/2"}
+	urls = append(urls, small...)
+
+	f := newFrontier(urls, nil)
+	var got []string
+	for j, ok := f.pop(); ok; j, ok = f.pop() {
+		got = append(got, j.url)
+	}
+	if len(got) != len(urls) {
+		t.Fatalf("%d URLs handed out, want %d", len(got), len(urls))
+	}
+	// The small hosts are done within the first rounds of turns
+	for _, url := range small {
+		if i := slices.Index(got, url); i < 0 || i >= 6 {
+			t.Errorf("%s handed out at %d, want within the first 6", url, i)
+		}
+	}
+	// The big host keeps its own order
+	var big []string
+	for _, url := range got {
+		if strings.HasPrefix(url, "https://big.nl/") {
+			big = append(big, url)
+		}
+	}
+	if !slices.Equal(big, urls[:10000]) {
+		t.Errorf("big.nl URLs out of their sitemap order")
+	}
+}
+
+func TestFrontier(t *testing.T) {
+	a1, a2, a3 := "https://a.nl/1", "https://a.nl/2", "https://a.nl/3"
+	b1, b2 := "https://b.nl/1", "https://b.nl/2"
+	c1 := "https://c.nl/1"
+	tests := []struct {
+		name  string
+		urls  []string
+		ranks map[string]int
+		want  []string
+	}{
+		{"one host", []string{a1, a2, a3}, nil, []string{a1, a2, a3}},
+		{"hosts take turns", []string{a1, a2, a3, b1, b2, c1}, nil, []string{a1, b1, c1, a2, b2, a3}},
+		{"ranks held across hosts", []string{a1, a2, a3, b1, b2}, map[string]int{a1: 0, a2: 0, a3: 0, b1: 1, b2: 1}, []string{a1, a2, a3, b1, b2}},
+		{"hosts take turns within a rank", []string{a1, b1, a2, b2, a3, c1}, map[string]int{a1: 0, b1: 0, a2: 0, b2: 1, a3: 1, c1: 1}, []string{a1, b1, a2, b2, c1, a3}},
+		{"lower rank of a later host first", []string{a1, a2, b1}, map[string]int{a1: 1, a2: 1, b1: 0}, []string{b1, a1, a2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFrontier(tt.urls, tt.ranks)
+			var got []string
+			for j, ok := f.pop(); ok; j, ok = f.pop() {
+				if tt.urls[j.index] != j.url {
+					t.Fatalf("job %d is %s, want %s", j.index, j.url, tt.urls[j.index])
+				}
+				got = append(got, j.url)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShedRanks(t *testing.T) {
+	entries := []Url{
+		{Loc: "https://a.nl/low", Priority: "0.2"},
+		{Loc: "https://a.nl/high", Priority: "1.0"},
+		{Loc: "https://b.nl/high", Priority: "1.0"},
+		{Loc: "https://b.nl/default"},
+	}
+	if ranks := shedRanks(entries, Options{ShedOrder: "none"}); ranks != nil {
+		t.Errorf("ranks = %v without a shed order, want nil", ranks)
+	}
+	ranks := shedRanks(entries, Options{PriorityWeighted: true})
+	want := map[string]int{"https://a.nl/high": 0, "https://b.nl/high": 0, "https://b.nl/default": 1, "https://a.nl/low": 2}
+	for url, rank := range want {
+		if ranks[url] != rank {
+			t.Errorf("rank of %s = %d, want %d", url, ranks[url], rank)
+		}
+	}
+}
+
+func TestFrontierShed(t *testing.T) {
+	a1, a2, a3 := "https://a.nl/1", "https://a.nl/2", "https://a.nl/3"
+	b1, b2 := "https://b.nl/1", "https://b.nl/2"
+	c1, c2 := "https://c.nl/1", "https://c.nl/2"
+	tests := []struct {
+		name   string
+		urls   []string
+		popped int // URLs handed out before the shed
+		keep   map[string]bool
+		shed   int
+		want   []string // handed out after the shed
+	}{
+		{"nothing kept", []string{a1, a2, b1}, 1, nil, 2, nil},
+		{"kept URLs keep their turns", []string{a1, a2, a3, b1, b2, c1, c2}, 0, map[string]bool{a1: true, a3: true, b2: true, c2: true}, 3, []string{a1, b2, c2, a3}},
+		{"turn moves past emptied hosts", []string{a1, a2, b1, b2, c1, c2}, 2, map[string]bool{a2: true, c2: true}, 2, []string{c2, a2}},
+		{"everything kept", []string{a1, b1}, 0, map[string]bool{a1: true, b1: true}, 0, []string{a1, b1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFrontier(tt.urls, nil)
+			for range tt.popped {
+				f.pop()
+			}
+			if shed := f.shed(tt.keep); shed != tt.shed {
+				t.Errorf("shed %d URLs, want %d", shed, tt.shed)
+			}
+			var got []string
+			for j, ok := f.pop(); ok; j, ok = f.pop() {
+				got = append(got, j.url)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("order after the shed = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFailureBudget(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/fail") {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	entries := []Url{
+		{Loc: srv.URL + "/low-1", Priority: "0.3"},
+		{Loc: srv.URL + "/fail-1", Priority: "1.0"},
+		{Loc: srv.URL + "/default"},
+		{Loc: srv.URL + "/fail-2", Priority: "0.9"},
+		{Loc: srv.URL + "/high", Priority: "0.8"},
+		{Loc: srv.URL + "/low-2", Priority: "0.1"},
+	}
+	tests := []struct {
+		name   string
+		budget int
+		want   []string
+	}{
+		{"no budget", 0, []string{"/fail-1", "/fail-2", "/high", "/default", "/low-1", "/low-2"}},
+		{"budget spent", 2, []string{"/fail-1", "/fail-2", "/high"}},
+		{"budget left", 3, []string{"/fail-1", "/fail-2", "/high", "/default", "/low-1", "/low-2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := Options{Client: srv.Client(), BatchSize: 1, PriorityWeighted: true, FailureBudget: tt.budget, log: &logger{out: io.Discard}}
+			urls, opts := prepareEntries(entries, opts)
+			resultsList, _ := runURLs(context.Background(), urls, opts)
+			var got []string
+			for _, result := range resultsList {
+				got = append(got, strings.TrimPrefix(result.URL, srv.URL))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("visited %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorGuardUrgent(t *testing.T) {
+	g := newErrorGuard(0.1, 2)
+	g.limit = 1 // halved
+	g.acquire(false)
+
+	acquired := make(chan bool)
+	go func() {
+		g.acquire(false)
+		acquired <- false
+	}()
+	go func() {
+		g.acquire(true)
+		acquired <- true
+	}()
+	select {
+	case urgent := <-acquired:
+		if !urgent {
+			t.Fatal("a low-priority request went past the halved limit")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a high-priority request was held to the halved limit")
+	}
+	select {
+	case <-acquired:
+		t.Error("a request went past every worker")
+	case <-time.After(50 * time.Millisecond):
+	}
+	g.release()
+	g.release()
+	<-acquired
+}
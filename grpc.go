@@ -0,0 +1,380 @@
+package sitehit
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	neturl "net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// grpcModes are the protocols --grpc can check a URL with: native gRPC over
+// HTTP/2 (h2c for http:// URLs) or gRPC-web through a proxy such as Envoy.
+var grpcModes = []string{"grpc", "grpc-web"}
+
+const (
+	grpcHealthMethod      = "grpc.health.v1.Health/Check"
+	grpcReflectionMethod  = "grpc.reflection.v1.ServerReflection/ServerReflectionInfo"
+	grpcReflectionAlpha   = "grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo"
+	grpcCodeUnimplemented = 12
+)
+
+var (
+	// errNotServing is a health check answered with a status other than
+	// SERVING.
+	errNotServing = errors.New("health check")
+	// errReflection marks the failures of --grpc-reflection.
+	errReflection = errors.New("reflection")
+)
+
+// grpcServingStatus names the values of grpc.health.v1.HealthCheckResponse.
+var grpcServingStatus = []string{"UNKNOWN", "SERVING", "NOT_SERVING", "SERVICE_UNKNOWN"}
+
+// grpcStatusError is a call that ended with a grpc-status other than OK.
+type grpcStatusError struct {
+	code    int
+	message string
+}
+
+func (e *grpcStatusError) Error() string {
+	if e.message == "" {
+		return fmt.Sprintf("grpc-status %d", e.code)
+	}
+	return fmt.Sprintf("grpc-status %d: %s", e.code, e.message)
+}
+
+// grpcClient returns an HTTP/2-only copy of the client, as native gRPC needs
+// HTTP/2 and plain-text backends only speak it with prior knowledge.
+func grpcClient(client *http.Client) *http.Client {
+	base, ok := client.Transport.(*http.Transport)
+	if !ok {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	t := base.Clone()
+	t.Protocols = new(http.Protocols)
+	t.Protocols.SetHTTP2(true)
+	t.Protocols.SetUnencryptedHTTP2(true)
+	c := *client
+	c.Transport = t
+	return &c
+}
+
+// processGRPC checks the service named by the fragment of url, or the whole
+// server when there is none, with the gRPC health protocol. The rest of the
+// URL is where the services are served, so gRPC-web proxies behind a path
+// prefix work too. With GRPCReflection the server must also list the service
+// through reflection, which is then enough for servers without the health
+// service.
+func processGRPC(ctx context.Context, url, mode string, opts Options) Result {
+	log := opts.logger()
+	result := Result{URL: url, ContentLength: -1, TTL: -1}
+	totalDuration := time.Duration(0)
+
+	base, service, err := grpcTarget(url)
+	if err != nil {
+		result.Error = err
+		log.Error(fmt.Sprintf("Invalid gRPC URL %s: %v", url, err), "event", "failed", "url", url, "error", err.Error())
+		return result
+	}
+
+	for result.Attempts <= opts.Retries {
+		result.Attempts++
+		start := time.Now()
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if opts.Timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		}
+		health, services, status, err := checkGRPC(attemptCtx, base, service, mode, result.Attempts, opts)
+		cancel()
+		duration := time.Since(start)
+		totalDuration += duration
+		result.StatusCode = status
+		result.Duration, result.TTFB, result.Transfer = totalDuration, duration, 0
+		result.GRPCHealth, result.GRPCServices = health, services
+		result.Error = err
+		record := Attempt{StartedAt: start, StatusCode: status, Duration: duration, TTFB: duration, Error: err}
+		if err != nil {
+			record.ErrorCode = errorCode(err, status)
+		}
+		result.AttemptDetails = append(result.AttemptDetails, record)
+
+		if err == nil {
+			result.Success = true
+			log.Info(fmt.Sprintf("Attempt %d: Checked %s over %s - Health: %s, Time: %v", result.Attempts, url, mode, cmp.Or(health, "-"), duration),
+				"event", "attempt", "url", url, "attempt", result.Attempts, "status", status, "grpc_health", health, "duration_ms", duration.Milliseconds())
+			return result
+		}
+		log.Error(fmt.Sprintf("Attempt %d: gRPC check of %s failed: %v", result.Attempts, url, err),
+			"event", "attempt", "url", url, "attempt", result.Attempts, "status", status, "error", err.Error(), "error_code", record.ErrorCode, "duration_ms", duration.Milliseconds())
+
+		if result.Attempts <= opts.Retries {
+			if !retryable(opts.RetryOn, status) {
+				break
+			}
+			delay, retry := opts.retryDelay.delay(status, result.Attempts, opts.RetryBackoff, opts.RetryMaxWait)
+			if !retry {
+				break
+			}
+			if !sleep(ctx, delay, opts.Stop) {
+				return result
+			}
+		}
+	}
+	return giveUp(result, opts)
+}
+
+// grpcTarget splits a --grpc URL into where the services are served and the
+// service to check.
+func grpcTarget(rawURL string) (base, service string, err error) {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return "", "", err
+	}
+	service = u.Fragment
+	u.Fragment, u.RawFragment = "", ""
+	return strings.TrimSuffix(u.String(), "/"), service, nil
+}
+
+// checkGRPC asks base for the health of service and, with reflection, for
+// the services it offers. It returns the HTTP status of the last call.
+func checkGRPC(ctx context.Context, base, service, mode string, attempt int, opts Options) (health string, services []string, status int, err error) {
+	var healthUnimplemented bool
+	reply, status, err := grpcCall(ctx, base, grpcHealthMethod, mode, protoString(nil, 1, service), attempt, opts)
+	var statusErr *grpcStatusError
+	switch {
+	case errors.As(err, &statusErr) && statusErr.code == grpcCodeUnimplemented && opts.GRPCReflection:
+		healthUnimplemented = true
+	case err != nil:
+		return "", nil, status, fmt.Errorf("health check: %w", err)
+	default:
+		code, _ := protoVarint(reply, 1)
+		health = strconv.FormatUint(code, 10)
+		if code < uint64(len(grpcServingStatus)) {
+			health = grpcServingStatus[code]
+		}
+		if health != "SERVING" {
+			return health, nil, status, fmt.Errorf("%w: %s", errNotServing, health)
+		}
+	}
+	if !opts.GRPCReflection {
+		return health, nil, status, nil
+	}
+
+	services, status, err = grpcServices(ctx, base, mode, attempt, opts)
+	if err != nil {
+		return health, nil, status, fmt.Errorf("%w: %w", errReflection, err)
+	}
+	if service != "" && !slices.Contains(services, service) {
+		return health, services, status, fmt.Errorf("%w: %s not among the %d services listed", errReflection, service, len(services))
+	}
+	if healthUnimplemented && service == "" && len(services) == 0 {
+		return health, services, status, fmt.Errorf("%w: no services listed", errReflection)
+	}
+	return health, services, status, nil
+}
+
+// grpcServices lists the services of base through the reflection service,
+// falling back to its v1alpha version that older servers still register.
+func grpcServices(ctx context.Context, base, mode string, attempt int, opts Options) ([]string, int, error) {
+	// ServerReflectionRequest with an empty list_services (field 7), which
+	// is what selects the call
+	request := []byte{7<<3 | 2, 0}
+	reply, status, err := grpcCall(ctx, base, grpcReflectionMethod, mode, request, attempt, opts)
+	var statusErr *grpcStatusError
+	if errors.As(err, &statusErr) && statusErr.code == grpcCodeUnimplemented {
+		reply, status, err = grpcCall(ctx, base, grpcReflectionAlpha, mode, request, attempt, opts)
+	}
+	if err != nil {
+		return nil, status, err
+	}
+	if failure, ok := protoBytes(reply, 7); ok {
+		message, _ := protoBytes(failure, 2)
+		return nil, status, fmt.Errorf("server replied: %s", message)
+	}
+	list, _ := protoBytes(reply, 6)
+	var services []string
+	for _, entry := range protoRepeated(list, 1) {
+		name, _ := protoBytes(entry, 1)
+		services = append(services, string(name))
+	}
+	slices.Sort(services)
+	return services, status, nil
+}
+
+// grpcCall sends one message to method and returns the first message of the
+// reply, letting the script hooks adjust the request like any other.
+func grpcCall(ctx context.Context, base, method, mode string, message []byte, attempt int, opts Options) ([]byte, int, error) {
+	frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(message)))
+	frame = append(frame, message...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/"+method, bytes.NewReader(frame))
+	if err != nil {
+		return nil, 0, err
+	}
+	opts.setHeader(req)
+	client := opts.grpcClient
+	if mode == "grpc-web" {
+		req.Header.Set("Content-Type", "application/grpc-web+proto")
+		req.Header.Set("Accept", "application/grpc-web+proto")
+		req.Header.Set("X-Grpc-Web", "1")
+		client = opts.Client
+	} else {
+		req.Header.Set("Content-Type", "application/grpc+proto")
+		req.Header.Set("TE", "trailers")
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if err := opts.Hooks.Request(req, attempt); err != nil {
+		return nil, 0, err
+	}
+	req = req.WithContext(opts.conns.withTrace(req.Context(), req.URL.Host))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, checkBodyLimit))
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+
+	// A call failing right away sends its status with the headers instead
+	// of in trailers; gRPC-web sends trailers as the last frame
+	trailer := resp.Trailer
+	if resp.Header.Get("Grpc-Status") != "" {
+		trailer = resp.Header
+	}
+	var reply []byte
+	for len(body) >= 5 {
+		flags, size := body[0], binary.BigEndian.Uint32(body[1:5])
+		if uint64(size) > uint64(len(body)-5) {
+			return nil, resp.StatusCode, errors.New("truncated gRPC frame")
+		}
+		payload := body[5 : 5+size]
+		body = body[5+size:]
+		switch {
+		case flags&0x80 != 0:
+			header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(append(payload, "\r\n"...)))).ReadMIMEHeader()
+			if err != nil && !errors.Is(err, io.EOF) {
+				return nil, resp.StatusCode, fmt.Errorf("reading gRPC-web trailers: %w", err)
+			}
+			trailer = http.Header(header)
+		case flags != 0:
+			return nil, resp.StatusCode, errors.New("compressed gRPC reply")
+		case reply == nil:
+			reply = payload
+		}
+	}
+
+	code, err := strconv.Atoi(trailer.Get("Grpc-Status"))
+	if err != nil {
+		return nil, resp.StatusCode, errors.New("reply without grpc-status")
+	}
+	if code != 0 {
+		message, _ := neturl.PathUnescape(trailer.Get("Grpc-Message"))
+		return nil, resp.StatusCode, &grpcStatusError{code: code, message: message}
+	}
+	return reply, resp.StatusCode, nil
+}
+
+// protoString appends field num of wire type 2 holding s to b. Like proto3
+// it leaves out an empty string.
+func protoString(b []byte, num int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(num)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// protoFields calls fn with the number, wire type and value of each field of
+// a protobuf message until fn returns false. Varints are passed encoded.
+func protoFields(b []byte, fn func(num int, wire int, value []byte) bool) {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return
+		}
+		b = b[n:]
+		var value []byte
+		switch wire := int(key & 7); wire {
+		case 0:
+			_, n := binary.Uvarint(b)
+			if n <= 0 {
+				return
+			}
+			value, b = b[:n], b[n:]
+		case 1, 5:
+			size := 8
+			if wire == 5 {
+				size = 4
+			}
+			if len(b) < size {
+				return
+			}
+			value, b = b[:size], b[size:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return
+			}
+			value, b = b[n:n+int(size)], b[n+int(size):]
+		default:
+			return
+		}
+		if !fn(int(key>>3), int(key&7), value) {
+			return
+		}
+	}
+}
+
+// protoVarint returns the value of varint field num.
+func protoVarint(b []byte, num int) (v uint64, ok bool) {
+	protoFields(b, func(n, wire int, value []byte) bool {
+		if n == num && wire == 0 {
+			v, _ = binary.Uvarint(value)
+			ok = true
+		}
+		return true
+	})
+	return v, ok
+}
+
+// protoBytes returns the last value of length-delimited field num.
+func protoBytes(b []byte, num int) (v []byte, ok bool) {
+	protoFields(b, func(n, wire int, value []byte) bool {
+		if n == num && wire == 2 {
+			v, ok = value, true
+		}
+		return true
+	})
+	return v, ok
+}
+
+// protoRepeated returns every value of repeated message field num.
+func protoRepeated(b []byte, num int) [][]byte {
+	var values [][]byte
+	protoFields(b, func(n, wire int, value []byte) bool {
+		if n == num && wire == 2 {
+			values = append(values, value)
+		}
+		return true
+	})
+	return values
+}
@@ -0,0 +1,114 @@
+package sitehit
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// guardWindow is how far back the error rate is measured.
+	guardWindow = time.Minute
+	// guardMinRequests are needed in the window before the rate counts, so
+	// a single early failure doesn't halve the workers.
+	guardMinRequests = 10
+)
+
+// errorGuard halves the number of concurrent requests when too many of those
+// made in the last minute fail, so the warmer doesn't pile onto an origin
+// that is struggling, and restores it once a minute has gone by below the
+// threshold. Only 5xx, 429 and connection errors count as failures.
+type errorGuard struct {
+	threshold float64 // fraction of failed requests
+	max       int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	limit   int // concurrent requests allowed
+	active  int
+	changed time.Time
+	events  []guardEvent
+}
+
+type guardEvent struct {
+	at     time.Time
+	failed bool
+}
+
+func newErrorGuard(threshold float64, workers int) *errorGuard {
+	g := &errorGuard{threshold: threshold, max: workers, limit: workers, changed: time.Now()}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// acquire blocks until one more request may be made. An urgent request,
+// of a high-priority URL, may be made while the limit is halved as long as
+// it's within the workers.
+func (g *errorGuard) acquire(urgent bool) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	for g.active >= g.limit && (!urgent || g.active >= g.max) {
+		g.cond.Wait()
+	}
+	g.active++
+	g.mu.Unlock()
+}
+
+func (g *errorGuard) release() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	g.active--
+	g.mu.Unlock()
+	g.cond.Broadcast()
+}
+
+// record adds the outcome of a request and adjusts the limit.
+func (g *errorGuard) record(status int, err error) {
+	if g == nil {
+		return
+	}
+	failed := err != nil || status >= 500 || status == http.StatusTooManyRequests
+	now := time.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.events = append(g.events, guardEvent{at: now, failed: failed})
+	cutoff := now.Add(-guardWindow)
+	start := 0
+	for start < len(g.events) && g.events[start].at.Before(cutoff) {
+		start++
+	}
+	g.events = g.events[start:]
+	if len(g.events) < guardMinRequests {
+		return
+	}
+	failures := 0
+	for _, e := range g.events {
+		if e.failed {
+			failures++
+		}
+	}
+	rate := float64(failures) / float64(len(g.events))
+
+	switch {
+	case rate > g.threshold && g.limit > 1:
+		g.limit = max(g.limit/2, 1)
+		console.Warn(fmt.Sprintf("%.0f%% of the requests of the last minute failed, reducing workers to %d", rate*100, g.limit),
+			"event", "concurrency", "error_rate", rate, "workers", g.limit)
+	case rate <= g.threshold && g.limit < g.max && now.Sub(g.changed) >= guardWindow:
+		g.limit = g.max
+		console.Info(fmt.Sprintf("Error rate back to %.0f%%, restoring %d workers", rate*100, g.limit),
+			"event", "concurrency", "error_rate", rate, "workers", g.limit)
+		g.cond.Broadcast()
+	default:
+		return
+	}
+	// Judge the new limit on the requests made under it
+	g.changed = now
+	g.events = nil
+}
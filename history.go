@@ -0,0 +1,446 @@
+package sitehit
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// history stores every run in a SQLite database passed with --history, so
+// runs can be compared with the ones before them.
+type history struct {
+	db *sql.DB
+}
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id          INTEGER PRIMARY KEY,
+	sitemap     TEXT NOT NULL,
+	started_at  INTEGER NOT NULL,
+	finished_at INTEGER NOT NULL,
+	interrupted INTEGER NOT NULL,
+	total       INTEGER NOT NULL,
+	succeeded   INTEGER NOT NULL,
+	failed      INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS results (
+	run_id      INTEGER NOT NULL REFERENCES runs(id) ON DELETE CASCADE,
+	url         TEXT NOT NULL,
+	success     INTEGER NOT NULL,
+	status      INTEGER NOT NULL,
+	attempts    INTEGER NOT NULL,
+	duration_ms INTEGER NOT NULL,
+	error       TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS results_url ON results(url, run_id);
+CREATE TABLE IF NOT EXISTS urls (
+	sitemap        TEXT NOT NULL,
+	url            TEXT NOT NULL,
+	first_seen     INTEGER NOT NULL,
+	last_seen      INTEGER NOT NULL,
+	gone_at        INTEGER,
+	failure_streak INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (sitemap, url)
+);
+`
+
+// historyMigrations upgrade the schema above, in order. PRAGMA user_version
+// counts how many a database has had applied.
+var historyMigrations = []string{
+	`ALTER TABLE results ADD COLUMN cache_status TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE issues (
+		sitemap    TEXT NOT NULL,
+		url        TEXT NOT NULL,
+		issue      TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (sitemap, url)
+	)`,
+	// Deleting runs goes through their results
+	`CREATE INDEX results_run ON results(run_id)`,
+}
+
+// openHistory opens or creates the history database at path.
+func openHistory(path string) (*history, error) {
+	// Parallel sites each open the file, so wait for locks instead of failing
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateHistory(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &history{db: db}, nil
+}
+
+func migrateHistory(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(historySchema); err != nil {
+		return err
+	}
+	var version int
+	if err := tx.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(historyMigrations); i++ {
+		if _, err := tx.Exec(historyMigrations[i]); err != nil {
+			return fmt.Errorf("migrating history to version %d: %w", i+1, err)
+		}
+	}
+	if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, len(historyMigrations))); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// lifecycle is how the URLs of a sitemap changed compared to earlier runs.
+type lifecycle struct {
+	Appeared    []string        `json:"appeared"`
+	Disappeared []string        `json:"disappeared"`
+	Streaks     []failureStreak `json:"failure_streaks"`
+}
+
+// failureStreak is a URL that failed the last Runs runs in a row.
+type failureStreak struct {
+	URL       string    `json:"url"`
+	Runs      int       `json:"runs"`
+	FirstSeen time.Time `json:"first_seen"`
+}
+
+// record stores a run of sitemapURL and updates the lifecycle of its URLs:
+// which are new, which are no longer listed and how long each has been
+// failing. URLs that weren't visited, because the run was interrupted, keep
+// their streak.
+func (h *history) record(sitemapURL string, started time.Time, urls []string, resultsList []Result, interrupted bool) (lifecycle, error) {
+	lc := lifecycle{Appeared: []string{}, Disappeared: []string{}, Streaks: []failureStreak{}}
+	now := time.Now()
+	summary := summarize(resultsList)
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return lc, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO runs (sitemap, started_at, finished_at, interrupted, total, succeeded, failed) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		sitemapURL, started.Unix(), now.Unix(), interrupted, summary.Total, summary.Succeeded, summary.Failed)
+	if err != nil {
+		return lc, err
+	}
+	runID, err := res.LastInsertId()
+	if err != nil {
+		return lc, err
+	}
+
+	for _, result := range resultsList {
+		errText := ""
+		if result.Error != nil {
+			errText = result.Error.Error()
+		}
+		if _, err := tx.Exec(`INSERT INTO results (run_id, url, success, status, attempts, duration_ms, error, cache_status) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			runID, result.URL, result.Success, result.StatusCode, result.Attempts, result.Duration.Milliseconds(), errText, result.CacheStatus); err != nil {
+			return lc, err
+		}
+	}
+
+	// Whether this is the first run; every URL would be "new" otherwise
+	var known int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM urls WHERE sitemap = ?`, sitemapURL).Scan(&known); err != nil {
+		return lc, err
+	}
+
+	listed := make(map[string]bool, len(urls))
+	for _, url := range urls {
+		listed[url] = true
+		res, err := tx.Exec(`INSERT INTO urls (sitemap, url, first_seen, last_seen) VALUES (?, ?, ?, ?)
+			ON CONFLICT (sitemap, url) DO NOTHING`, sitemapURL, url, now.Unix(), now.Unix())
+		if err != nil {
+			return lc, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 && known > 0 {
+			lc.Appeared = append(lc.Appeared, url)
+		}
+		// A URL that disappeared earlier and is back counts as appeared too
+		res, err = tx.Exec(`UPDATE urls SET last_seen = ?, gone_at = NULL WHERE sitemap = ? AND url = ? AND gone_at IS NOT NULL`,
+			now.Unix(), sitemapURL, url)
+		if err != nil {
+			return lc, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			lc.Appeared = append(lc.Appeared, url)
+		} else if _, err := tx.Exec(`UPDATE urls SET last_seen = ? WHERE sitemap = ? AND url = ?`, now.Unix(), sitemapURL, url); err != nil {
+			return lc, err
+		}
+	}
+
+	for _, result := range resultsList {
+		streak := "failure_streak + 1"
+		if result.Success || result.Skipped {
+			streak = "0"
+			// The streak an issue was filed for is over
+			if _, err := tx.Exec(`DELETE FROM issues WHERE sitemap = ? AND url = ?`, sitemapURL, result.URL); err != nil {
+				return lc, err
+			}
+		}
+		if _, err := tx.Exec(`UPDATE urls SET failure_streak = `+streak+` WHERE sitemap = ? AND url = ?`, sitemapURL, result.URL); err != nil {
+			return lc, err
+		}
+	}
+
+	rows, err := tx.Query(`SELECT url FROM urls WHERE sitemap = ? AND gone_at IS NULL`, sitemapURL)
+	if err != nil {
+		return lc, err
+	}
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			rows.Close()
+			return lc, err
+		}
+		if !listed[url] {
+			lc.Disappeared = append(lc.Disappeared, url)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return lc, err
+	}
+	for _, url := range lc.Disappeared {
+		if _, err := tx.Exec(`UPDATE urls SET gone_at = ? WHERE sitemap = ? AND url = ?`, now.Unix(), sitemapURL, url); err != nil {
+			return lc, err
+		}
+	}
+
+	rows, err = tx.Query(`SELECT url, failure_streak, first_seen FROM urls
+		WHERE sitemap = ? AND gone_at IS NULL AND failure_streak > 1 ORDER BY failure_streak DESC, url`, sitemapURL)
+	if err != nil {
+		return lc, err
+	}
+	for rows.Next() {
+		var streak failureStreak
+		var firstSeen int64
+		if err := rows.Scan(&streak.URL, &streak.Runs, &firstSeen); err != nil {
+			rows.Close()
+			return lc, err
+		}
+		streak.FirstSeen = time.Unix(firstSeen, 0)
+		lc.Streaks = append(lc.Streaks, streak)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return lc, err
+	}
+
+	return lc, tx.Commit()
+}
+
+// cacheHits returns the URLs of sitemapURL that were served from cache the
+// last time they were visited, which for URLs left out by --only-misses is
+// an earlier run than the last.
+func (h *history) cacheHits(sitemapURL string) (map[string]bool, error) {
+	rows, err := h.db.Query(`SELECT url FROM (
+			SELECT results.url, results.success, results.cache_status,
+				ROW_NUMBER() OVER (PARTITION BY results.url ORDER BY results.run_id DESC) AS n
+			FROM results JOIN runs ON runs.id = results.run_id
+			WHERE runs.sitemap = ?
+		) WHERE n = 1 AND success AND cache_status = 'hit'`, sitemapURL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hits := make(map[string]bool)
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, err
+		}
+		hits[url] = true
+	}
+	return hits, rows.Err()
+}
+
+// recentCosts returns the average duration and attempts of every URL of
+// sitemapURL over its last runs visits.
+func (h *history) recentCosts(sitemapURL string, runs int) (map[string]urlCost, error) {
+	rows, err := h.db.Query(`SELECT url, AVG(duration_ms), AVG(attempts) FROM (
+			SELECT results.url, results.duration_ms, results.attempts,
+				ROW_NUMBER() OVER (PARTITION BY results.url ORDER BY results.run_id DESC) AS n
+			FROM results JOIN runs ON runs.id = results.run_id
+			WHERE runs.sitemap = ?
+		) WHERE n <= ? GROUP BY url`, sitemapURL, runs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	costs := make(map[string]urlCost)
+	for rows.Next() {
+		var url string
+		var ms, attempts float64
+		if err := rows.Scan(&url, &ms, &attempts); err != nil {
+			return nil, err
+		}
+		costs[url] = urlCost{Duration: time.Duration(ms * float64(time.Millisecond)), Attempts: attempts}
+	}
+	return costs, rows.Err()
+}
+
+// failingURLs returns the URLs of sitemapURL that failed the last time they
+// were visited and are still listed.
+func (h *history) failingURLs(sitemapURL string) (map[string]bool, error) {
+	rows, err := h.db.Query(`SELECT url FROM urls WHERE sitemap = ? AND gone_at IS NULL AND failure_streak > 0`, sitemapURL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	failing := make(map[string]bool)
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, err
+		}
+		failing[url] = true
+	}
+	return failing, rows.Err()
+}
+
+// issues returns the key of the issue filed for every URL of sitemapURL
+// whose failure streak has one.
+func (h *history) issues(sitemapURL string) (map[string]string, error) {
+	rows, err := h.db.Query(`SELECT url, issue FROM issues WHERE sitemap = ?`, sitemapURL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	issues := make(map[string]string)
+	for rows.Next() {
+		var url, issue string
+		if err := rows.Scan(&url, &issue); err != nil {
+			return nil, err
+		}
+		issues[url] = issue
+	}
+	return issues, rows.Err()
+}
+
+// recordIssue keeps the key of the issue filed for url, until it succeeds
+// again.
+func (h *history) recordIssue(sitemapURL, url, issue string) error {
+	_, err := h.db.Exec(`INSERT INTO issues (sitemap, url, issue, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (sitemap, url) DO UPDATE SET issue = excluded.issue, created_at = excluded.created_at`,
+		sitemapURL, url, issue, time.Now().Unix())
+	return err
+}
+
+// retention is how much of a sitemap's history --history-retain keeps: the
+// runs of the last age, such as 90d, or its last runs.
+type retention struct {
+	age  time.Duration
+	runs int
+}
+
+func (r retention) String() string {
+	if r.runs > 0 {
+		return strconv.Itoa(r.runs)
+	}
+	if r.age > 0 {
+		return days(r.age).String()
+	}
+	return ""
+}
+
+func (r *retention) Set(value string) error {
+	if n, err := strconv.Atoi(value); err == nil {
+		if n < 1 {
+			return fmt.Errorf("must keep at least 1 run")
+		}
+		*r = retention{runs: n}
+		return nil
+	}
+	var d days
+	if err := d.Set(value); err != nil {
+		return fmt.Errorf("want a duration such as 90d or a number of runs")
+	}
+	if d <= 0 {
+		return fmt.Errorf("must be positive")
+	}
+	*r = retention{age: time.Duration(d)}
+	return nil
+}
+
+// prune deletes the runs of sitemapURL that keep doesn't retain, with their
+// results, and the URLs that were gone before the oldest run left. The
+// database is vacuumed when a quarter of it is free space afterwards. It
+// returns how many runs were deleted.
+func (h *history) prune(sitemapURL string, keep retention) (int64, error) {
+	var res sql.Result
+	var err error
+	if keep.runs > 0 {
+		res, err = h.db.Exec(`DELETE FROM runs WHERE sitemap = ? AND id NOT IN (
+			SELECT id FROM runs WHERE sitemap = ? ORDER BY id DESC LIMIT ?)`, sitemapURL, sitemapURL, keep.runs)
+	} else {
+		res, err = h.db.Exec(`DELETE FROM runs WHERE sitemap = ? AND started_at < ?`, sitemapURL, time.Now().Add(-keep.age).Unix())
+	}
+	if err != nil {
+		return 0, err
+	}
+	pruned, _ := res.RowsAffected()
+	if pruned == 0 {
+		return 0, nil
+	}
+	if _, err := h.db.Exec(`DELETE FROM urls WHERE sitemap = ? AND gone_at < (SELECT MIN(started_at) FROM runs WHERE sitemap = ?)`,
+		sitemapURL, sitemapURL); err != nil {
+		return pruned, err
+	}
+
+	var free, pages int64
+	if err := h.db.QueryRow(`PRAGMA freelist_count`).Scan(&free); err != nil {
+		return pruned, err
+	}
+	if err := h.db.QueryRow(`PRAGMA page_count`).Scan(&pages); err != nil {
+		return pruned, err
+	}
+	if free*4 > pages {
+		if _, err := h.db.Exec(`VACUUM`); err != nil {
+			return pruned, fmt.Errorf("vacuuming: %w", err)
+		}
+		// The file only shrinks once the WAL is written back
+		if _, err := h.db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+			return pruned, err
+		}
+	}
+	return pruned, nil
+}
+
+// printLifecycle reports the URLs that appeared or disappeared since the
+// previous run and those that have been failing for more than one run.
+func printLifecycle(lc lifecycle) {
+	if console.structured() {
+		console.Info("URL lifecycle", "event", "lifecycle", "lifecycle", lc)
+		return
+	}
+	fmt.Println("\nURL lifecycle:")
+	fmt.Printf("New since the previous run: %d\n", len(lc.Appeared))
+	for _, url := range lc.Appeared {
+		fmt.Printf("  + %s\n", url)
+	}
+	fmt.Printf("No longer in the sitemap: %d\n", len(lc.Disappeared))
+	for _, url := range lc.Disappeared {
+		fmt.Printf("  - %s\n", url)
+	}
+	fmt.Printf("Failing for more than one run: %d\n", len(lc.Streaks))
+	for _, streak := range lc.Streaks {
+		fmt.Printf("\033[31m  %s: %d runs in a row (listed since %s)\033[0m\n", streak.URL, streak.Runs, streak.FirstSeen.Format(time.DateOnly))
+	}
+}
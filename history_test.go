@@ -0,0 +1,142 @@
+package sitehit
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// oldHistory creates a history database at path as a sitehit before the
+// last migration left it, with four runs of sitemap a, one of b and the
+// URLs of a that disappeared at different times.
+func oldHistory(t *testing.T, path string, now time.Time) {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	version := len(historyMigrations) - 1
+	stmts := append([]string{historySchema}, historyMigrations[:version]...)
+	stmts = append(stmts, fmt.Sprintf(`PRAGMA user_version = %d`, version))
+	day := int64(24 * time.Hour / time.Second)
+	runs := []struct {
+		sitemap string
+		agoDays int64
+	}{{"a", 10}, {"a", 5}, {"a", 2}, {"a", 1}, {"b", 10}}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("creating old history: %v", err)
+		}
+	}
+	for i, run := range runs {
+		started := now.Unix() - run.agoDays*day
+		if _, err := db.Exec(`INSERT INTO runs (id, sitemap, started_at, finished_at, interrupted, total, succeeded, failed) VALUES (?, ?, ?, ?, 0, 2, 2, 0)`,
+			i+1, run.sitemap, started, started+60); err != nil {
+			t.Fatal(err)
+		}
+		for _, url := range []string{"/live", "/other"} {
+			if _, err := db.Exec(`INSERT INTO results (run_id, url, success, status, attempts, duration_ms, error, cache_status) VALUES (?, ?, 1, 200, 1, 10, '', '')`,
+				i+1, url); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, u := range []struct {
+		url     string
+		goneAgo int64 // days, 0 if still listed
+	}{{"/live", 0}, {"/gone-early", 8}, {"/gone-late", 1}} {
+		var gone any
+		if u.goneAgo > 0 {
+			gone = now.Unix() - u.goneAgo*day
+		}
+		if _, err := db.Exec(`INSERT INTO urls (sitemap, url, first_seen, last_seen, gone_at) VALUES ('a', ?, ?, ?, ?)`,
+			u.url, now.Unix()-10*day, now.Unix(), gone); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHistoryMigrateAndPrune(t *testing.T) {
+	tests := []struct {
+		name   string
+		keep   retention
+		pruned int64
+		runs   []int // ids of the runs of a left
+		urls   []string
+	}{
+		{"last runs", retention{runs: 2}, 2, []int{3, 4}, []string{"/gone-late", "/live"}},
+		{"age", retention{age: 3 * 24 * time.Hour}, 2, []int{3, 4}, []string{"/gone-late", "/live"}},
+		{"everything kept", retention{runs: 10}, 0, []int{1, 2, 3, 4}, []string{"/gone-early", "/gone-late", "/live"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "history.db")
+			oldHistory(t, path, time.Now())
+
+			h, err := openHistory(path)
+			if err != nil {
+				t.Fatalf("openHistory: %v", err)
+			}
+			defer h.db.Close()
+
+			if version := queryColumn[int](t, h.db, `PRAGMA user_version`); version[0] != len(historyMigrations) {
+				t.Errorf("user_version = %d after migrating, want %d", version[0], len(historyMigrations))
+			}
+			if index := queryColumn[string](t, h.db, `SELECT name FROM sqlite_master WHERE type = 'index' AND name = 'results_run'`); len(index) != 1 {
+				t.Errorf("results_run index missing after migrating")
+			}
+
+			pruned, err := h.prune("a", tt.keep)
+			if err != nil {
+				t.Fatalf("prune: %v", err)
+			}
+			if pruned != tt.pruned {
+				t.Errorf("pruned %d runs, want %d", pruned, tt.pruned)
+			}
+			if got := queryColumn[int](t, h.db, `SELECT id FROM runs WHERE sitemap = 'a' ORDER BY id`); !slices.Equal(got, tt.runs) {
+				t.Errorf("runs of a = %v, want %v", got, tt.runs)
+			}
+			// The results of the pruned runs go with them, through ON DELETE CASCADE
+			if got := queryColumn[int](t, h.db, `SELECT DISTINCT run_id FROM results WHERE run_id <= 4 ORDER BY run_id`); !slices.Equal(got, tt.runs) {
+				t.Errorf("results left of the runs %v, want of %v", got, tt.runs)
+			}
+			if got := queryColumn[int](t, h.db, `SELECT id FROM runs WHERE sitemap = 'b'`); !slices.Equal(got, []int{5}) {
+				t.Errorf("runs of b = %v, want [5]", got)
+			}
+			if results := queryColumn[int](t, h.db, `SELECT COUNT(*) FROM results WHERE run_id = 5`); results[0] != 2 {
+				t.Errorf("%d results of b left, want 2", results[0])
+			}
+
+			if urls := queryColumn[string](t, h.db, `SELECT url FROM urls WHERE sitemap = 'a' ORDER BY url`); !slices.Equal(urls, tt.urls) {
+				t.Errorf("urls of a = %v, want %v", urls, tt.urls)
+			}
+		})
+	}
+}
+
+// queryColumn returns the single column of the rows of query.
+func queryColumn[T any](t *testing.T, db *sql.DB, query string) []T {
+	t.Helper()
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var column []T
+	for rows.Next() {
+		var v T
+		if err := rows.Scan(&v); err != nil {
+			t.Fatal(err)
+		}
+		column = append(column, v)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return column
+}
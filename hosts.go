@@ -0,0 +1,65 @@
+package sitehit
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// hostOverrides maps lowercased host names to the IP they should resolve to.
+type hostOverrides map[string]string
+
+// loadHostsFile reads a file in /etc/hosts format: an IP followed by one or
+// more names per line, with # starting a comment.
+func loadHostsFile(path string) (hostOverrides, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	overrides := hostOverrides{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if net.ParseIP(fields[0]) == nil {
+			return nil, fmt.Errorf("%s:%d: invalid IP %q", path, line, fields[0])
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: no host names for %s", path, line, fields[0])
+		}
+		for _, name := range fields[1:] {
+			overrides[strings.ToLower(name)] = fields[0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return overrides, nil
+}
+
+// transport returns an HTTP transport that connects to the overridden IP for
+// the listed hosts. The Host header and TLS server name stay unchanged, so the
+// origin is tested as if DNS already pointed at it.
+func (o hostOverrides) transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err == nil {
+			if ip, ok := o[strings.ToLower(host)]; ok {
+				addr = net.JoinHostPort(ip, port)
+			}
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return t
+}
@@ -0,0 +1,183 @@
+package sitehit
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"maps"
+	"os"
+	"slices"
+	"time"
+)
+
+// htmlReportTemplate renders --html-report: a standalone page with the
+// summary, a latency histogram, a breakdown by status and a sortable table
+// of the results.
+//
+//go:embed htmlreport.html
+var htmlReportTemplate string
+
+var htmlReport = template.Must(template.New("report").Parse(htmlReportTemplate))
+
+// latencyBuckets are the upper bounds of the bars of the latency
+// histogram; the last bar holds everything slower.
+var latencyBuckets = []time.Duration{
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2 * time.Second, 5 * time.Second,
+}
+
+// Dimensions of the latency histogram, in pixels.
+const (
+	chartBarWidth  = 56
+	chartBarGap    = 8
+	chartBarHeight = 160
+	chartLabels    = 20 // room below and above the bars for the labels
+)
+
+type htmlReportData struct {
+	Title, Sitemap, Generated string
+	Partial, Retained         bool
+	Summary                   Summary
+	AverageTime, Bytes        string
+	Chart                     htmlChart
+	Statuses                  []htmlStatus
+	Results                   []htmlResult
+}
+
+type htmlChart struct {
+	Width, Height, LabelY int
+	Bars                  []htmlBar
+}
+
+type htmlBar struct {
+	Label                               string
+	Count                               int
+	X, Y, Width, Height, LabelX, CountY int
+}
+
+type htmlStatus struct {
+	Status  string
+	OK      bool
+	Count   int
+	Percent float64
+}
+
+type htmlResult struct {
+	URL                string
+	Success            bool
+	Status             string
+	Attempts           int
+	DurationMs, TTFBMs int64
+	Bytes              int64
+	Error              string
+}
+
+// writeHTMLReport renders the report of a run to path. In a multi-site run
+// the site's name is added to the file name, so the sites don't overwrite
+// each other's reports.
+func writeHTMLReport(path, title string, rep report, partial, retained bool) error {
+	path = sitePath(path, rep.Site)
+	data := htmlReportData{
+		Title:       title,
+		Sitemap:     rep.Sitemap,
+		Generated:   time.Now().Format(time.DateTime),
+		Partial:     partial,
+		Retained:    retained,
+		Summary:     rep.Summary,
+		AverageTime: rep.Summary.AverageTime.Round(time.Millisecond).String(),
+		Bytes:       formatBytes(rep.Summary.Bytes),
+		Chart:       latencyChart(rep.Results),
+		Statuses:    statusBreakdown(rep.Results),
+	}
+	for _, r := range rep.Results {
+		data.Results = append(data.Results, htmlResult{
+			URL:        r.URL,
+			Success:    r.Success || r.Ignored || r.Skipped,
+			Status:     resultStatus(r),
+			Attempts:   r.Attempts,
+			DurationMs: r.Duration.Milliseconds(),
+			TTFBMs:     r.TTFB.Milliseconds(),
+			Bytes:      r.BytesRead,
+			Error:      errorText(r.Error),
+		})
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := htmlReport.Execute(f, data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// resultStatus is the status column of a result: its code, ERR without a
+// response, or SKIP when it wasn't visited.
+func resultStatus(r Result) string {
+	switch {
+	case r.Skipped:
+		return "SKIP"
+	case r.StatusCode == 0:
+		return "ERR"
+	}
+	return fmt.Sprint(r.StatusCode)
+}
+
+func latencyChart(resultsList []Result) htmlChart {
+	counts := make([]int, len(latencyBuckets)+1)
+	for _, r := range resultsList {
+		if r.Skipped {
+			continue
+		}
+		i, _ := slices.BinarySearch(latencyBuckets, r.Duration)
+		counts[i]++
+	}
+	highest := max(slices.Max(counts), 1)
+
+	chart := htmlChart{
+		Width:  len(counts)*(chartBarWidth+chartBarGap) + chartBarGap,
+		Height: chartBarHeight + 2*chartLabels,
+		LabelY: chartBarHeight + chartLabels + 14,
+	}
+	for i, count := range counts {
+		label := "> " + latencyBuckets[len(latencyBuckets)-1].String()
+		if i < len(latencyBuckets) {
+			label = "≤ " + latencyBuckets[i].String()
+		}
+		height := count * chartBarHeight / highest
+		bar := htmlBar{
+			Label:  label,
+			Count:  count,
+			X:      chartBarGap + i*(chartBarWidth+chartBarGap),
+			Y:      chartLabels + chartBarHeight - height,
+			Width:  chartBarWidth,
+			Height: height,
+		}
+		bar.LabelX = bar.X + chartBarWidth/2
+		bar.CountY = bar.Y - 4
+		chart.Bars = append(chart.Bars, bar)
+	}
+	return chart
+}
+
+func statusBreakdown(resultsList []Result) []htmlStatus {
+	counts := map[string]int{}
+	ok := map[string]bool{}
+	for _, r := range resultsList {
+		status := resultStatus(r)
+		counts[status]++
+		ok[status] = ok[status] || r.Success
+	}
+	var statuses []htmlStatus
+	for _, status := range slices.Sorted(maps.Keys(counts)) {
+		statuses = append(statuses, htmlStatus{
+			Status:  status,
+			OK:      ok[status],
+			Count:   counts[status],
+			Percent: float64(counts[status]) * 100 / float64(len(resultsList)),
+		})
+	}
+	return statuses
+}
@@ -0,0 +1,85 @@
+package sitehit
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ignoreRule acknowledges a known-bad URL, or every URL matching a pattern
+// with * wildcards, until it expires.
+type ignoreRule struct {
+	pattern string
+	match   *regexp.Regexp
+	until   time.Time // zero means it never expires
+}
+
+// ignoreList holds the rules from --ignore-file.
+type ignoreList []ignoreRule
+
+// loadIgnoreFile reads one URL or pattern per line, optionally followed by
+// the date the snooze ends, with # starting a comment:
+//
+//	https://www.site.nl/old-page            2026-12-31  # waiting for redirect
+//	https://www.site.nl/legacy/*
+//
+// Expired rules are reported and left out.
+func loadIgnoreFile(path string) (ignoreList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var list ignoreList
+	today := time.Now()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("%s:%d: want a URL and an optional expiry date", path, line)
+		}
+
+		rule := ignoreRule{pattern: fields[0]}
+		quoted := strings.Split(fields[0], "*")
+		for i := range quoted {
+			quoted[i] = regexp.QuoteMeta(quoted[i])
+		}
+		rule.match = regexp.MustCompile("^" + strings.Join(quoted, ".*") + "$")
+		if len(fields) == 2 {
+			until, err := time.ParseInLocation(time.DateOnly, fields[1], time.Local)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid expiry date %q, want YYYY-MM-DD", path, line, fields[1])
+			}
+			// The snooze lasts through the given day
+			rule.until = until.AddDate(0, 0, 1)
+			if !today.Before(rule.until) {
+				console.Warn(fmt.Sprintf("Ignore rule for %s expired on %s", rule.pattern, fields[1]),
+					"event", "ignore_expired", "pattern", rule.pattern, "until", fields[1])
+				continue
+			}
+		}
+		list = append(list, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// lookup returns the rule covering url, if any.
+func (l ignoreList) lookup(url string) (ignoreRule, bool) {
+	for _, rule := range l {
+		if rule.match.MatchString(url) {
+			return rule, true
+		}
+	}
+	return ignoreRule{}, false
+}
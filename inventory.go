@@ -0,0 +1,89 @@
+package sitehit
+
+import (
+	"cmp"
+	"fmt"
+	neturl "net/url"
+	"slices"
+	"time"
+)
+
+// inventoryHosts is how many hosts the text report lists.
+const inventoryHosts = 10
+
+// hostCount is how many sitemap entries point at a host.
+type hostCount struct {
+	Host    string `json:"host"`
+	Entries int    `json:"entries"`
+}
+
+// inventory describes the entries of a sitemap before they are visited, as a
+// quick check that the right sitemap was fetched.
+type inventory struct {
+	Entries     int         `json:"entries"`
+	Duplicates  int         `json:"duplicates"`
+	Hosts       []hostCount `json:"hosts"` // most entries first
+	WithLastMod int         `json:"with_lastmod"`
+	Oldest      time.Time   `json:"oldest_lastmod,omitzero"`
+	Newest      time.Time   `json:"newest_lastmod,omitzero"`
+}
+
+func takeInventory(entries []Url) inventory {
+	inv := inventory{Entries: len(entries), Hosts: []hostCount{}}
+	seen := make(map[string]bool, len(entries))
+	hosts := map[string]int{}
+	for _, entry := range entries {
+		if seen[entry.Loc] {
+			inv.Duplicates++
+		}
+		seen[entry.Loc] = true
+
+		host := "(invalid)"
+		if u, err := neturl.Parse(entry.Loc); err == nil && u.Host != "" {
+			host = u.Host
+		}
+		if hosts[host] == 0 {
+			inv.Hosts = append(inv.Hosts, hostCount{Host: host})
+		}
+		hosts[host]++
+
+		if t, ok := entry.LastModTime(); ok {
+			inv.WithLastMod++
+			if inv.Oldest.IsZero() || t.Before(inv.Oldest) {
+				inv.Oldest = t
+			}
+			if t.After(inv.Newest) {
+				inv.Newest = t
+			}
+		}
+	}
+	for i := range inv.Hosts {
+		inv.Hosts[i].Entries = hosts[inv.Hosts[i].Host]
+	}
+	slices.SortStableFunc(inv.Hosts, func(a, b hostCount) int { return cmp.Compare(b.Entries, a.Entries) })
+	return inv
+}
+
+func printInventory(inv inventory) {
+	if console.structured() {
+		console.Info("Sitemap inventory", "event", "inventory", "inventory", inv)
+		return
+	}
+	fmt.Printf("Sitemap: %d entries, %d duplicates, %d hosts\n", inv.Entries, inv.Duplicates, len(inv.Hosts))
+	if inv.WithLastMod > 0 {
+		fmt.Printf("Last modified: %s to %s (%d of %d entries have a lastmod)\n",
+			inv.Oldest.Format(time.DateOnly), inv.Newest.Format(time.DateOnly), inv.WithLastMod, inv.Entries)
+	} else {
+		fmt.Println("Last modified: no entries have a lastmod")
+	}
+	for i, h := range inv.Hosts {
+		if i == inventoryHosts {
+			fmt.Printf("  ... and %d more hosts\n", len(inv.Hosts)-inventoryHosts)
+			break
+		}
+		fmt.Printf("  %-40s %6d (%.1f%%)\n", h.Host, h.Entries, float64(h.Entries)*100/float64(inv.Entries))
+	}
+	if inv.Duplicates > 0 {
+		fmt.Printf("\033[33m%d duplicate entries are visited only once\033[0m\n", inv.Duplicates)
+	}
+}
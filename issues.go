@@ -0,0 +1,168 @@
+package sitehit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// issueFiler opens a GitHub issue or Jira ticket for every URL that has
+// failed --issue-after runs in a row, as tracked by --history. The key of
+// the issue is kept in the history so a URL gets one issue per streak.
+type issueFiler struct {
+	kind    string // "github" or "jira"
+	api     string // e.g. https://api.github.com/repos/owner/repo/issues
+	project string // owner/repo or the Jira project key
+	user    string // Jira only
+	token   string
+	after   int
+	client  *http.Client
+}
+
+// newIssueFiler parses a --file-issues target: github:owner/repo, with a
+// token in GITHUB_TOKEN, or jira:https://jira.example.com/PROJ, with
+// credentials in JIRA_USER and JIRA_TOKEN.
+func newIssueFiler(target string, after int) (*issueFiler, error) {
+	kind, rest, _ := strings.Cut(target, ":")
+	f := &issueFiler{kind: kind, after: after, client: &http.Client{Timeout: 30 * time.Second}}
+	switch kind {
+	case "github":
+		owner, repo, ok := strings.Cut(rest, "/")
+		if !ok || owner == "" || repo == "" || strings.Contains(repo, "/") {
+			return nil, fmt.Errorf("invalid --file-issues %q: want github:owner/repo", target)
+		}
+		api := strings.TrimSuffix(os.Getenv("GITHUB_API_URL"), "/")
+		if api == "" {
+			api = "https://api.github.com"
+		}
+		f.api = api + "/repos/" + rest + "/issues"
+		f.project = rest
+		f.token = os.Getenv("GITHUB_TOKEN")
+		if f.token == "" {
+			return nil, fmt.Errorf("--file-issues %s requires GITHUB_TOKEN", target)
+		}
+	case "jira":
+		u, err := neturl.Parse(rest)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid --file-issues %q: want jira:https://jira.example.com/PROJECT", target)
+		}
+		path := strings.Trim(u.Path, "/")
+		i := strings.LastIndex(path, "/")
+		project := path[i+1:]
+		if project == "" {
+			return nil, fmt.Errorf("invalid --file-issues %q: want jira:https://jira.example.com/PROJECT", target)
+		}
+		// Jira may be served below a path, as in https://example.com/jira/PROJ
+		u.Path = "/"
+		if i > 0 {
+			u.Path = "/" + path[:i] + "/"
+		}
+		f.api = u.String() + "rest/api/2/issue"
+		f.project = project
+		f.user, f.token = os.Getenv("JIRA_USER"), os.Getenv("JIRA_TOKEN")
+		if f.user == "" || f.token == "" {
+			return nil, fmt.Errorf("--file-issues %s requires JIRA_USER and JIRA_TOKEN", target)
+		}
+	default:
+		return nil, fmt.Errorf("invalid --file-issues %q: must start with github: or jira:", target)
+	}
+	return f, nil
+}
+
+// fileIssues opens an issue for every URL of lc whose failure streak reached
+// --issue-after and doesn't have one yet, logging rather than failing the
+// run when that doesn't work.
+func (s *settings) fileIssues(sitemapURL string, lc lifecycle, resultsList []Result) {
+	filed, err := s.history.issues(sitemapURL)
+	if err != nil {
+		console.Error(fmt.Sprintf("Error reading history: %v", err), "event", "history", "error", err.Error())
+		return
+	}
+	last := make(map[string]Result, len(resultsList))
+	for _, r := range resultsList {
+		last[r.URL] = r
+	}
+
+	for _, streak := range lc.Streaks {
+		if streak.Runs < s.issues.after || filed[streak.URL] != "" {
+			continue
+		}
+		key, err := s.issues.file(sitemapURL, streak, last[streak.URL])
+		if err == nil {
+			err = s.history.recordIssue(sitemapURL, streak.URL, key)
+		}
+		if err != nil {
+			console.Error(fmt.Sprintf("Error filing an issue for %s: %v", streak.URL, err), "event", "issue", "url", streak.URL, "error", err.Error())
+			continue
+		}
+		console.Warn(fmt.Sprintf("Filed %s for %s, failing %d runs in a row", key, streak.URL, streak.Runs),
+			"event", "issue", "url", streak.URL, "issue", key, "runs", streak.Runs)
+	}
+}
+
+// file opens an issue about the streak of a URL, with its last result, and
+// returns its key: owner/repo#123 or PROJ-123.
+func (f *issueFiler) file(sitemapURL string, streak failureStreak, last Result) (string, error) {
+	title := fmt.Sprintf("%s failing for %d runs", streak.URL, streak.Runs)
+	var body strings.Builder
+	fmt.Fprintf(&body, "sitehit has failed to visit %s for %d runs in a row.\n\n", streak.URL, streak.Runs)
+	fmt.Fprintf(&body, "Sitemap: %s\nListed since: %s\n", sitemapURL, streak.FirstSeen.Format(time.DateOnly))
+	if last.URL != "" {
+		fmt.Fprintf(&body, "Last status: %d after %d attempts\nError code: %s\n", last.StatusCode, last.Attempts, last.ErrorCode())
+		if last.Error != nil {
+			fmt.Fprintf(&body, "Error: %v\n", last.Error)
+		}
+	}
+
+	var payload any
+	if f.kind == "github" {
+		payload = map[string]any{"title": title, "body": body.String(), "labels": []string{"sitehit"}}
+	} else {
+		payload = map[string]any{"fields": map[string]any{
+			"project":     map[string]string{"key": f.project},
+			"summary":     title,
+			"description": body.String(),
+			"issuetype":   map[string]string{"name": "Bug"},
+		}}
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, f.api, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if f.kind == "github" {
+		req.Header.Set("Authorization", "Bearer "+f.token)
+		req.Header.Set("Accept", "application/vnd.github+json")
+	} else {
+		req.SetBasicAuth(f.user, f.token)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("Status code %d", resp.StatusCode)
+	}
+	var created struct {
+		Number int    `json:"number"` // GitHub
+		Key    string `json:"key"`    // Jira
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return "", err
+	}
+	if f.kind == "github" {
+		return fmt.Sprintf("%s#%d", f.project, created.Number), nil
+	}
+	return created.Key, nil
+}
@@ -0,0 +1,128 @@
+package sitehit
+
+import (
+	"cmp"
+	"encoding/xml"
+	"fmt"
+	"io"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// junitSuite is the <testsuite> of --format junit: the run of a sitemap,
+// with a test case per URL.
+type junitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Skipped  int         `xml:"skipped,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+}
+
+type junitFailure struct {
+	Type    string `xml:"type,attr"`
+	Message string `xml:"message,attr"`
+	Text    string `xml:",cdata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+// writeJUnitFile writes the run as a JUnit XML test suite to path, for
+// --junit. In a multi-site run the site's name is added to the file name.
+func writeJUnitFile(path string, rep report) error {
+	f, err := os.Create(sitePath(path, rep.Site))
+	if err != nil {
+		return err
+	}
+	if err := writeJUnit(f, rep); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeJUnit writes the run as a JUnit XML test suite, so CI systems show
+// failed URLs as failed tests. Ignored failures and URLs skipped by
+// --max-size are reported as skipped. The counts cover every URL, even
+// when --retain leaves out the results of those that passed.
+func writeJUnit(w io.Writer, rep report) error {
+	suite := junitSuite{
+		Name:     cmp.Or(rep.Site, rep.Sitemap),
+		Tests:    rep.Summary.Total,
+		Failures: rep.Summary.Failed,
+		Skipped:  rep.Summary.Skipped + rep.Summary.Ignored,
+		Time:     seconds(rep.Summary.AverageTime * time.Duration(rep.Summary.Total-rep.Summary.Skipped)),
+	}
+	for _, r := range rep.Results {
+		c := junitCase{Name: r.URL, ClassName: urlHost(r.URL), Time: seconds(r.Duration)}
+		switch {
+		case r.Skipped:
+			c.Skipped = &junitSkipped{Message: fmt.Sprintf("declared size %s exceeds --max-size", formatBytes(r.ContentLength))}
+		case r.Ignored:
+			c.Skipped = &junitSkipped{Message: "failure ignored by --ignore-file"}
+		case !r.Success:
+			c.Failure = &junitFailure{Type: r.ErrorCode(), Message: failureMessage(r), Text: attemptLog(r)}
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suite); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// urlHost is the class name of a URL's test case, grouping them by host.
+func urlHost(rawURL string) string {
+	if u, err := neturl.Parse(rawURL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return "sitehit"
+}
+
+// failureMessage says why a URL failed: its error, or else its status.
+func failureMessage(r Result) string {
+	if r.Error != nil {
+		return r.Error.Error()
+	}
+	return fmt.Sprintf("status %d after %d attempts", r.StatusCode, r.Attempts)
+}
+
+// attemptLog lists the attempts of a URL, one per line.
+func attemptLog(r Result) string {
+	var b strings.Builder
+	for i, a := range r.AttemptDetails {
+		fmt.Fprintf(&b, "Attempt %d: status %d in %v", i+1, a.StatusCode, a.Duration.Round(time.Millisecond))
+		if a.Error != nil {
+			fmt.Fprintf(&b, ": %v", a.Error)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// seconds formats d as JUnit times are written.
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
@@ -0,0 +1,166 @@
+package sitehit
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"mime"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// hiddenElements hold no text a visitor sees.
+var hiddenElements = []string{"head", "script", "style", "noscript", "template", "svg"}
+
+// visibleText returns the text a visitor sees on a page, lower-cased with
+// its whitespace collapsed: the text of the body of an HTML page, or the
+// whole of any other body.
+func visibleText(in checkInput) string {
+	mediaType, _, _ := mime.ParseMediaType(in.resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return normalizeText(string(in.body))
+	}
+
+	var text strings.Builder
+	hidden := 0
+	z := html.NewTokenizer(bytes.NewReader(in.body))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return normalizeText(text.String())
+		case html.StartTagToken:
+			if name, _ := z.TagName(); slices.Contains(hiddenElements, string(name)) {
+				hidden++
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); slices.Contains(hiddenElements, string(name)) && hidden > 0 {
+				hidden--
+			}
+		case html.TextToken:
+			if hidden == 0 {
+				text.Write(z.Text())
+				text.WriteByte(' ')
+			}
+		}
+	}
+}
+
+func normalizeText(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
+
+// keywordCheck requires every keyword to appear in the visible text of the
+// page, ignoring case and runs of whitespace, catching templates that stop
+// rendering parts of a page while it still returns 200.
+type keywordCheck []string
+
+func (c keywordCheck) check(in checkInput) (bool, error) {
+	text := visibleText(in)
+	var missing []string
+	for _, keyword := range c {
+		if !strings.Contains(text, normalizeText(keyword)) {
+			missing = append(missing, keyword)
+		}
+	}
+	if len(missing) > 0 {
+		return true, &keywordError{missing: missing}
+	}
+	return true, nil
+}
+
+// split returns the keywords found and missing, from the outcome of the
+// check.
+func (c keywordCheck) split(err error) (found, missing []string) {
+	var kerr *keywordError
+	if errors.As(err, &kerr) {
+		missing = kerr.missing
+	}
+	for _, keyword := range c {
+		if !slices.Contains(missing, keyword) {
+			found = append(found, keyword)
+		}
+	}
+	return found, missing
+}
+
+// keywordError lists the keywords a page is missing.
+type keywordError struct {
+	missing []string
+}
+
+func (e *keywordError) Error() string {
+	quoted := make([]string, len(e.missing))
+	for i, keyword := range e.missing {
+		quoted[i] = fmt.Sprintf("%q", keyword)
+	}
+	return "text doesn't contain " + strings.Join(quoted, ", ")
+}
+
+// keywordBundles turns the --expect-keywords rules, of REGEXP=KEYWORD,...
+// values, into a bundle each for the URLs they match.
+func keywordBundles(rules patternRules) checkBundles {
+	var bundles checkBundles
+	for _, rule := range rules {
+		var keywords keywordCheck
+		for _, keyword := range strings.Split(rule.value, ",") {
+			if keyword = strings.TrimSpace(keyword); keyword != "" {
+				keywords = append(keywords, keyword)
+			}
+		}
+		bundles = append(bundles, checkBundle{name: "expect-keywords", urls: rule.pattern, checks: map[string]checker{"keywords": keywords}})
+	}
+	return bundles
+}
+
+// keywordTally counts the pages a keyword was looked for and found on.
+type keywordTally struct {
+	Bundle  string `json:"bundle"`
+	Keyword string `json:"keyword"`
+	Pages   int    `json:"pages"`
+	Found   int    `json:"found"`
+}
+
+// countKeywords adds the keywords the final attempt of a URL looked for to
+// tallies, by bundle and keyword.
+func countKeywords(tallies map[[2]string]keywordTally, result Result) {
+	for _, c := range result.Checks {
+		count := func(keyword string, found bool) {
+			key := [2]string{c.Bundle, keyword}
+			t := tallies[key]
+			t.Bundle, t.Keyword = c.Bundle, keyword
+			t.Pages++
+			if found {
+				t.Found++
+			}
+			tallies[key] = t
+		}
+		for _, keyword := range c.Found {
+			count(keyword, true)
+		}
+		for _, keyword := range c.Missing {
+			count(keyword, false)
+		}
+	}
+}
+
+// sortKeywords returns the keyword tallies ordered by bundle, then from the
+// least covered keyword.
+func sortKeywords(tallies map[[2]string]keywordTally) []keywordTally {
+	sorted := slices.Collect(maps.Values(tallies))
+	slices.SortFunc(sorted, func(a, b keywordTally) int {
+		return cmp.Or(cmp.Compare(a.Bundle, b.Bundle), cmp.Compare(a.coverage(), b.coverage()), cmp.Compare(a.Keyword, b.Keyword))
+	})
+	return sorted
+}
+
+// coverage is the share of pages the keyword was found on.
+func (t keywordTally) coverage() float64 {
+	if t.Pages == 0 {
+		return 0
+	}
+	return float64(t.Found) / float64(t.Pages)
+}
@@ -0,0 +1,78 @@
+package sitehit
+
+import (
+	"fmt"
+	neturl "net/url"
+	"strings"
+)
+
+// defaultLocaleURL puts the locale in front of the path, as in
+// https://www.site.nl/de/about.
+const defaultLocaleURL = "{scheme}://{host}/{locale}{path}"
+
+// localeRule expands the URLs of a sitemap that only lists the default
+// locale into their variants in other locales, with a template of the
+// variant's URL.
+type localeRule struct {
+	locales  []string
+	template string
+}
+
+func newLocaleRule(locales []string, template string) (*localeRule, error) {
+	if !strings.Contains(template, "{locale}") || !strings.Contains(template, "{path}") {
+		return nil, fmt.Errorf("invalid --locale-url %q: must contain {locale} and {path}", template)
+	}
+	for _, locale := range locales {
+		if strings.ContainsAny(locale, "/?#") {
+			return nil, fmt.Errorf("invalid --locales %q: a locale can't contain /, ? or #", locale)
+		}
+	}
+	return &localeRule{locales: locales, template: template}, nil
+}
+
+// expand returns entries with, after each, its variant in every locale,
+// taking its lastmod and priority along. A path already starting with one of
+// the locales, such as /en/about, is expanded without it, so that variant
+// isn't listed twice.
+func (r *localeRule) expand(entries []Url) []Url {
+	if r == nil {
+		return entries
+	}
+	expanded := make([]Url, 0, len(entries)*(len(r.locales)+1))
+	for _, entry := range entries {
+		expanded = append(expanded, entry)
+		u, err := neturl.Parse(strings.TrimSpace(entry.Loc))
+		if err != nil || u.Host == "" {
+			continue
+		}
+		path := r.unlocalized(u.EscapedPath())
+		if u.RawQuery != "" {
+			path += "?" + u.RawQuery
+		}
+		for _, locale := range r.locales {
+			variant := entry
+			variant.Loc = strings.NewReplacer("{scheme}", u.Scheme, "{host}", u.Host, "{locale}", locale, "{path}", path).Replace(r.template)
+			if variant.Loc != entry.Loc {
+				expanded = append(expanded, variant)
+			}
+		}
+	}
+	console.Info(fmt.Sprintf("Expanded %d URLs into %d with the locales %s", len(entries), len(expanded), strings.Join(r.locales, ", ")),
+		"event", "locales", "urls", len(expanded), "listed", len(entries), "locales", r.locales)
+	return expanded
+}
+
+// unlocalized returns path without its first segment when that is one of
+// the locales, and / for an empty path.
+func (r *localeRule) unlocalized(path string) string {
+	first, rest, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	for _, locale := range r.locales {
+		if strings.EqualFold(first, locale) {
+			return "/" + rest
+		}
+	}
+	if path == "" {
+		return "/"
+	}
+	return path
+}
@@ -0,0 +1,94 @@
+package sitehit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// console prints progress messages and summaries. By default it writes
+// colored text; --log-format json switches it to one JSON object per line,
+// where the text becomes the "msg" and the attributes become fields.
+var console = &logger{out: os.Stdout}
+
+type logger struct {
+	mu   sync.Mutex
+	out  io.Writer
+	json *slog.Logger
+}
+
+// useJSON switches the logger to structured JSON output. The lines go to
+// out as it is when they're logged, so they follow it to stderr once the
+// report takes stdout.
+func (l *logger) useJSON() {
+	l.json = slog.New(slog.NewJSONHandler(logWriter{l}, nil)).With("schema_version", schemaVersion)
+}
+
+// logWriter writes to the current out of a logger.
+type logWriter struct {
+	l *logger
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.l.mu.Lock()
+	defer w.l.mu.Unlock()
+	return w.l.out.Write(p)
+}
+
+// structured reports whether the logger writes JSON.
+func (l *logger) structured() bool {
+	return l.json != nil
+}
+
+// buffer returns a logger in the same format as l that collects its output
+// until it is written out with flush.
+func (l *logger) buffer() *logger {
+	b := &logger{out: &bytes.Buffer{}}
+	if l.json != nil {
+		b.useJSON()
+	}
+	return b
+}
+
+// flush writes out what the buffered logger collected.
+func (l *logger) flush(buffered *logger) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	buffered.out.(*bytes.Buffer).WriteTo(l.out)
+}
+
+// Info prints text, or logs it along with attrs as key/value pairs.
+func (l *logger) Info(text string, attrs ...any) {
+	l.log(slog.LevelInfo, "", text, attrs)
+}
+
+// Warn is like Info, printed in yellow.
+func (l *logger) Warn(text string, attrs ...any) {
+	l.log(slog.LevelWarn, "\033[33m", text, attrs)
+}
+
+// Error is like Info, printed in red.
+func (l *logger) Error(text string, attrs ...any) {
+	l.log(slog.LevelError, "\033[31m", text, attrs)
+}
+
+func (l *logger) log(level slog.Level, color, text string, attrs []any) {
+	if l.json != nil {
+		// Blank lines only separate sections in text output
+		l.json.Log(context.Background(), level, strings.TrimLeft(text, "\n"), attrs...)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if color != "" {
+		fmt.Fprintf(l.out, "%s%s\033[0m\n", color, text)
+	} else {
+		fmt.Fprintln(l.out, text)
+	}
+}
@@ -1,23 +1,255 @@
-package main
+package sitehit
 
 import (
-	"encoding/xml"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"maps"
+	"math/rand/v2"
 	"net/http"
 	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
-type UrlSet struct {
-	URLs []Url `xml:"url"`
-}
+// Version is the version of sitehit in its default User-Agent. Release
+// builds set it with -ldflags "-X github.com/jeroensmink98/sitehit.Version=1.2.0".
+var Version = "1.0"
+
+// DefaultUserAgent identifies sitehit to origins and WAFs, which often treat
+// Go's own User-Agent as a bot.
+var DefaultUserAgent = "sitehit/" + Version + " (+https://github.com/jeroensmink98/sitehit)"
+
+// Options controls how the URLs of a run are visited.
+type Options struct {
+	// Client sends the requests; http.DefaultClient if nil.
+	Client *http.Client
+
+	// UserAgent is sent with the sitemap fetches and every request, unless
+	// empty or a script hook sets its own.
+	UserAgent string
+
+	// Header holds extra header fields for the sitemap fetches and every
+	// request, such as preview tokens; a User-Agent in it replaces UserAgent.
+	Header http.Header
+
+	BatchSize        int
+	SitemapWorkers   int
+	SitemapDepth     int    // levels of nested sitemap indexes to follow
+	InputFormat      string // "xml", "txt" or "auto" to tell from the content
+	MaxSitemaps      int    // child sitemaps to fetch at most, unlimited if 0
+	Hooks            *Hooks
+	StartJitter      time.Duration
+	PriorityWeighted bool
+
+	// ShedOrder chooses which URLs are visited last, so dropped first when
+	// the run is cut short: "priority" for the lowest sitemap priority,
+	// "lastmod" for the oldest lastmod, or "none". URLs matching ShedPattern
+	// come after all others.
+	ShedOrder   string
+	ShedPattern *regexp.Regexp
+
+	// Rate, if set, caps the requests of a run a second, retries and
+	// assets included. With --queue it caps the instances sharing the
+	// queue together.
+	Rate float64
+
+	// FailureBudget, if set with PriorityWeighted, sheds the URLs at or
+	// below the default sitemap priority of 0.5 that are still to go once
+	// this many URLs failed, leaving the rest of the run to the others.
+	FailureBudget int
+
+	// MaxSitemapAge, if set, treats a sitemap whose Last-Modified header
+	// and newest lastmod are older as stale, which stops the run unless
+	// StaleSitemap is "warn" rather than "fail".
+	MaxSitemapAge time.Duration
+	StaleSitemap  string
+
+	// expectHeader requires every response to carry the headers it names,
+	// with values matching their regexps.
+	expectHeader headerCheck
+
+	// expectLanguage and expectCharset are checked against the responses of
+	// the URLs they match.
+	expectLanguage patternRules
+	expectCharset  patternRules
+
+	// expectRedirect declares where the URLs it matches must redirect to.
+	expectRedirect redirectRules
+
+	// expectKeywords lists the keywords the visible text of the URLs it
+	// matches must contain.
+	expectKeywords patternRules
+
+	// checks are the assertions made on every response: the bundles of the
+	// config file and those made up from the --expect-* flags.
+	checks checkBundles
+
+	// grpc selects the URLs checked with the gRPC health protocol instead
+	// of a GET, mapping them to "grpc" or "grpc-web". GRPCReflection also
+	// requires their services to be listed through server reflection.
+	grpc           patternRules
+	GRPCReflection bool
+	grpcClient     *http.Client // HTTP/2-only copy of Client
+
+	// WarmAssets lists the kinds of same-host subresources ("css", "js",
+	// "img") to request for every HTML page.
+	WarmAssets []string
+	assets     *assetCache
+
+	// weightBudget flags the pages with WarmAssets that weigh more than its
+	// "total", or whose assets of a kind do.
+	weightBudget weightBudget
+
+	// CDNDebug asks CDNs for debugging headers, which are kept in the
+	// results along with the RecordHeaders.
+	CDNDebug      bool
+	RecordHeaders []string
+
+	// ignore lists the known-bad URLs whose failures don't fail the run.
+	ignore ignoreList
+
+	// sample, if set, visits only a random subset of the sitemap, weighted
+	// by SampleWeight: uniform, priority or lastmod.
+	sample       sampleSize
+	SampleWeight string
+
+	// Retries is how many more attempts a failing URL gets after the first;
+	// 0 visits every URL once.
+	Retries int
+
+	// RetryOn lists the failures that are retried, as status codes, classes
+	// such as "5xx" or "error" for requests without a (complete) response;
+	// every failure is retried if empty.
+	RetryOn []string
+
+	// retryDelay sets the wait between attempts per status; one second when
+	// no rule matches.
+	retryDelay retryRules
+
+	// RetryBackoff multiplies the wait of the statuses no retryDelay rule
+	// matches after every retry; 1 keeps it at a second. RetryMaxWait, if
+	// positive, caps every wait.
+	RetryBackoff float64
+	RetryMaxWait time.Duration
+
+	// MaxRetryAfter caps the wait a 429 or 503 asks for with Retry-After,
+	// which replaces the retryDelay; 0 ignores the header.
+	MaxRetryAfter time.Duration
+
+	// Timeout, if positive, limits how long a request may take, reading the
+	// body included, before it fails with TIMEOUT.
+	Timeout time.Duration
+
+	// StallTimeout, if positive, aborts an attempt whose body makes no
+	// progress for this long, however long the whole transfer takes.
+	StallTimeout time.Duration
+
+	// Fallback lists the alternatives to retry with after a connection-level
+	// error: "http1" and "next-ip".
+	Fallback []string
+
+	// HTTPVersion, if set, is the only HTTP version a response may come
+	// over: "1.1", "2" or "3", as the transport of Client is limited to.
+	HTTPVersion string
+
+	// Method is the request method of the pages: GET, the default when
+	// empty, HEAD to check them without their bodies, falling back to GET
+	// where the server rejects HEAD with a 405 or 501, or another method
+	// for endpoints such as those of an API.
+	Method string
+
+	// Body, if set, is sent with every page request, as ContentType.
+	Body        []byte
+	ContentType string
+
+	// HeadFirst makes every URL start with a HEAD request, and skips the
+	// GET when it's a 200 that a CDN served from its cache.
+	HeadFirst bool
+
+	// MaxSize, if positive, makes every URL start with a HEAD request; URLs
+	// declaring more bytes are skipped, or only their first KiB requested
+	// when Oversize is "range".
+	MaxSize  int64
+	Oversize string
+
+	// IsolateWorkers gives every worker its own copy of Client, with separate
+	// connections and cookies, to look like independent visitors.
+	IsolateWorkers bool
+
+	// FailedPass visits the URLs that failed once more at the end of the
+	// run, with a quarter of the workers, and reports that outcome instead.
+	FailedPass bool
+
+	// OrderedOutput buffers the output of each URL and prints it in sitemap
+	// order, so runs can be diffed despite concurrent workers.
+	OrderedOutput bool
+	log           *logger // where a URL's output goes, console if nil
+
+	// conns, if set, collects connection reuse statistics.
+	conns *connStats
 
-type Url struct {
-	Loc     string `xml:"loc"`
-	LastMod string `xml:"lastmod"`
+	// seo, if set, collects the pages whose robots.txt rules, robots meta
+	// tags, canonical links and redirects contradict their listing in the
+	// sitemap.
+	seo *seoAudit
+
+	// requests holds how the entries using the sitehit sitemap extension
+	// are requested, by URL.
+	requests map[string]*entryRequest
+
+	// ranks holds the place of the URLs in the shed order, by URL, which
+	// the frontier keeps across hosts. Nil keeps hosts taking turns.
+	ranks map[string]int
+
+	// high holds the URLs above the default sitemap priority with
+	// PriorityWeighted, which keep their workers when the guard or the
+	// failure budget holds back the others.
+	high map[string]bool
+
+	// budget, if set, counts the failed URLs against FailureBudget.
+	budget *failureBudget
+
+	// queue, if set, holds the URLs of the run in Redis, shared with other
+	// instances, instead of in memory.
+	queue *workQueue
+
+	// pause, if set, holds back new jobs while paused.
+	pause *pauseGate
+
+	// maintenance, if set, recognizes the pages of a planned maintenance
+	// window, which pauses the run instead of failing the URLs.
+	maintenance *maintenance
+
+	// rate, if set, holds the requests to Rate.
+	rate *rateLimiter
+
+	// guard, if set, reduces the number of concurrent requests while the
+	// origin returns many errors.
+	guard *errorGuard
+
+	// Stop, once closed, ends the run early: no new URLs are dispatched and
+	// nothing is retried, but requests already in flight may finish.
+	Stop <-chan struct{}
+
+	// Sources are the plugins listing the URLs of plugin:NAME sources, by
+	// name.
+	Sources map[string]Source
+
+	// OnResult, if set, is called with each result as soon as it completes.
+	OnResult func(Result)
+
+	// Retain, if set, decides which results a run keeps once they have been
+	// tallied, to bound the memory of very large runs.
+	Retain func(Result) bool
 }
 
 type Result struct {
@@ -25,75 +257,477 @@ type Result struct {
 	Success       bool
 	Attempts      int
 	StatusCode    int
-	ContentLength string
+	ContentLength int64 // as declared by the server, -1 if unknown
+	BytesRead     int64 // bytes actually received
+	Truncated     bool  // body ended before the declared length
 	Duration      time.Duration
 	Error         error
+
+	// TTFB and Transfer split the last attempt's duration into the wait for
+	// the response headers and the time spent reading the body, telling a
+	// slow backend apart from a large payload.
+	TTFB     time.Duration
+	Transfer time.Duration
+
+	// AttemptDetails records every attempt, so failures that were retried
+	// away are still visible.
+	AttemptDetails []Attempt
+
+	// Headers holds the response headers picked by --record-header and
+	// --cdn-debug, as sent with the last response.
+	Headers map[string]string
+
+	// Checks are the outcomes of the checks of the last attempt.
+	Checks []CheckResult
+
+	// CacheStatus is "hit" or "miss" when a CDN said whether the last
+	// response came from its cache.
+	CacheStatus string
+
+	// TTL is how much longer a shared cache may serve the last response,
+	// from its caching headers; -1 when they don't say.
+	TTL time.Duration
+
+	// GRPCHealth is the serving status a --grpc URL reported, and
+	// GRPCServices the services it listed with --grpc-reflection.
+	GRPCHealth   string
+	GRPCServices []string
+
+	// Ignored is set when the URL failed but is listed in --ignore-file, so
+	// it doesn't count as a failure.
+	Ignored bool
+
+	// Skipped is set when the URL wasn't visited because its declared size
+	// exceeded --max-size.
+	Skipped bool
+
+	// CompressedBytes is how much of the last body came over the wire when
+	// it was gzip-encoded; BytesRead is its decoded size. Compression rates
+	// how well a text body was compressed: "ok", "poor", or "none" when a
+	// large one wasn't. It's empty for small bodies and other content.
+	CompressedBytes int64
+	Compression     string
+
+	// HeadOnly is set when a HEAD with --head-first found the URL cached, so
+	// no GET was made.
+	HeadOnly bool
+
+	// RedirectChain holds the responses of the last attempt when it was
+	// redirected, from the URL itself to the final one.
+	RedirectChain []Hop
+
+	// Variant is the --fallback alternative the last attempt was made with,
+	// such as "HTTP/1.1", or empty for a regular request.
+	Variant string
+
+	// Assets are the subresources requested for the page with --warm-assets.
+	Assets []Asset
+
+	// PageWeight is the size of the page's body and assets together, and
+	// AssetsFailed how many of those failed. OverBudget names the
+	// --weight-budget limits the page exceeds: "total" or an asset kind.
+	PageWeight   int64
+	AssetsFailed int
+	OverBudget   []string
 }
 
-func main() {
-	var batchSize int
-	flag.IntVar(&batchSize, "batch", 1, "Number of concurrent workers (max 20)")
-	flag.Parse()
+// Attempt is a single request made while processing a URL.
+type Attempt struct {
+	StartedAt  time.Time
+	StatusCode int
+	BytesRead  int64
+	WireBytes  int64 // of the body as it came over the wire, before decoding
+	Duration   time.Duration
+	TTFB       time.Duration
+	Transfer   time.Duration
+	Variant    string
+	Error      error
+	ErrorCode  string // of a failed attempt, see errorCode
+}
 
-	if batchSize < 1 {
-		batchSize = 1
+// ErrorCode returns the machine-readable code of a failed result, empty if
+// it succeeded or was skipped.
+func (r Result) ErrorCode() string {
+	if r.Success || r.Skipped {
+		return ""
 	}
-	if batchSize > 20 {
-		batchSize = 20
+	return errorCode(r.Error, r.StatusCode)
+}
+
+// Main runs the sitehit command with the flags and arguments of the
+// process, exiting with a non-zero status on failure.
+func Main() {
+	var s settings
+	s.register(flag.CommandLine)
+	flag.Parse()
+
+	if s.printSchema {
+		os.Stdout.Write(runSchema)
+		return
 	}
 
 	args := flag.Args()
-	if len(args) < 1 {
-		fmt.Println("Usage: go run main.go [--batch N] <sitemap_url>")
+	var cfg *Config
+	if s.configPath != "" {
+		var err error
+		cfg, err = loadConfig(s.configPath)
+		if err != nil {
+			fmt.Printf("Error loading config: %v\n", err)
+			os.Exit(1)
+		}
+		sitemapURL, err := cfg.apply(flag.CommandLine, s.profile, nil)
+		if err != nil {
+			fmt.Printf("Error applying config: %v\n", err)
+			os.Exit(1)
+		}
+		if len(args) == 0 && sitemapURL != "" {
+			args = []string{sitemapURL}
+		}
+		s.checks = cfg.Checks
+	} else if s.profile != "" {
+		fmt.Println("Error: --profile requires --config")
 		os.Exit(1)
 	}
 
-	sitemapURL := args[0]
+	if s.cronjob {
+		s.logFormat = "json"
+	}
+	if s.logFormat == "json" {
+		console.useJSON()
+	}
 
-	resp, err := http.Get(sitemapURL)
-	if err != nil {
-		fmt.Printf("Error fetching sitemap: %v\n", err)
+	if err := s.prepare(); err != nil {
+		fmt.Printf("Error %v\n", err)
 		os.Exit(1)
 	}
-	defer resp.Body.Close()
+	if err := s.setup(); err != nil {
+		fmt.Printf("Error %v\n", err)
+		os.Exit(1)
+	}
+	if s.format != "text" || s.template != nil {
+		// Keep stdout for the report, so it can be piped into other tools
+		os.Stdout = os.Stderr
+		console.out = os.Stderr
+	}
 
-	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("Error fetching sitemap: Status code %d\n", resp.StatusCode)
+	pause := &pauseGate{}
+	watchPauseSignal(pause)
+	s.opts.pause = pause
+
+	if s.serveAddr != "" {
+		if err := serve(s.serveAddr, s.opts); err != nil {
+			fmt.Printf("Error serving: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(args) < 1 && cfg != nil && len(cfg.Sites) > 0 {
+		ctx, cancel := s.runContext()
+		defer cancel()
+		if !runSites(ctx, cfg, &s) {
+			os.Exit(1)
+		}
+		if deadlineReached(ctx) {
+			os.Exit(exitDeadline)
+		}
+		return
+	}
+
+	if len(args) < 1 {
+		fmt.Println("Usage: go run ./cmd/sitehit [flags] <sitemap_url|file|->...")
+		fmt.Println("       go run ./cmd/sitehit --config sitehit.json [flags]")
+		fmt.Println("       go run ./cmd/sitehit --serve :8080 [flags]")
+		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Printf("Error reading sitemap: %v\n", err)
+	if s.dryRun {
+		if err := runDryRun(args, &s); err != nil {
+			fmt.Printf("Error %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(s.diffHosts) > 0 {
+		ctx, cancel := s.runContext()
+		defer cancel()
+		code := runDiff(ctx, args, &s)
+		if deadlineReached(ctx) {
+			code = exitDeadline
+		}
+		os.Exit(code)
+	}
+	if slices.Contains(args, "-") && s.daemonEvery > 0 {
+		fmt.Println("Error: --daemon can't read the sitemap from stdin, which is only read once")
+		os.Exit(1)
+	}
+	if slices.Contains(args, "-") && s.triage {
+		fmt.Println("Error: --triage reads its commands from stdin, so it can't read the sitemap from there")
 		os.Exit(1)
 	}
+	if s.cronjob {
+		os.Exit(runCronJob(args, &s))
+	}
+	if s.daemonEvery > 0 {
+		runDaemon(args, &s)
+		return
+	}
 
-	var urlSet UrlSet
-	err = xml.Unmarshal(body, &urlSet)
-	if err != nil {
-		fmt.Printf("Error parsing sitemap XML: %v\n", err)
+	ctx, cancel := s.runContext()
+	defer cancel()
+	if _, _, err := runSitemap(ctx, args, "", &s); err != nil {
+		fmt.Printf("Error %v\n", err)
 		os.Exit(1)
 	}
+	if deadlineReached(ctx) {
+		os.Exit(exitDeadline)
+	}
+}
+
+// runSitemap visits every URL in the sitemaps and prints the summary. name
+// labels the output when several sites are run in one invocation.
+func runSitemap(ctx context.Context, sources []string, name string, s *settings) ([]Result, *tally, error) {
+	sm, err := fetchSitemaps(ctx, sources, s.opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkSitemap(sm, s.opts); err != nil {
+		return nil, nil, err
+	}
+	resultsList, t := runEntries(ctx, sitemapKey(sources), sm.URLs, name, s)
+	return resultsList, t, nil
+}
+
+// runEntries visits the given entries of sitemapURL, each URL once, and
+// prints the summary. It returns the results --retain keeps and the tally of
+// all of them.
+func runEntries(ctx context.Context, sitemapURL string, entries []Url, name string, s *settings) ([]Result, *tally) {
+	printInventory(takeInventory(entries))
+	entries = uniqueEntries(s.localeRule.expand(entries))
+	visit := entries
+	if s.onlyMisses {
+		visit = s.skipCacheHits(sitemapURL, entries)
+	}
+	urls, opts := prepareEntries(visit, s.opts)
+	if len(s.retryFirst) > 0 {
+		urls = failedFirst(urls, s.retryFirst)
+		// Failures lead across hosts too
+		for url := range s.retryFirst {
+			if _, ok := opts.ranks[url]; ok {
+				opts.ranks[url] = -1
+			}
+		}
+	}
+	var canary map[string]bool
+	if s.canaryHost != "" {
+		listed := urls
+		urls, canary = routeCanary(urls, s.canaryHost, s.canaryPercent)
+		for i, url := range urls {
+			if url == listed[i] {
+				continue
+			}
+			if rank, ok := opts.ranks[listed[i]]; ok {
+				opts.ranks[url] = rank
+			}
+			if opts.high[listed[i]] {
+				opts.high[url] = true
+			}
+		}
+	}
+
+	title := "Summary"
+	if name != "" {
+		title = "Summary for " + name
+		console.Info(fmt.Sprintf("Processing %d URLs for %s with %d workers...", len(urls), name, s.opts.BatchSize),
+			"site", name, "urls", len(urls), "workers", s.opts.BatchSize)
+	} else {
+		console.Info(fmt.Sprintf("Processing %d URLs with %d workers...", len(urls), s.opts.BatchSize),
+			"urls", len(urls), "workers", s.opts.BatchSize)
+	}
+
+	if s.queue != nil {
+		opts.queue = s.queue.forSitemap(sitemapURL)
+	}
+	started := time.Now()
+	resultsList, t := runURLs(ctx, urls, opts)
+	summary := t.summary()
+
+	interrupted := stopped(s.opts.Stop) || ctx.Err() != nil
+	if interrupted {
+		reason := "interrupted"
+		if deadlineReached(ctx) {
+			reason = "max duration reached"
+		}
+		title = "Partial " + strings.ToLower(title[:1]) + title[1:] + fmt.Sprintf(" (%s, %d of %d URLs visited)", reason, summary.Total, len(urls))
+	}
+	printSummary(title, summary)
+	if s.egressCost > 0 {
+		printEgress(summary, s.egressCost, s.daemonEvery)
+	}
+	if s.opts.conns != nil {
+		s.opts.conns.print()
+	}
+	if s.opts.maintenance != nil {
+		s.opts.maintenance.print()
+	}
+	if s.opts.seo != nil {
+		s.opts.seo.print()
+	}
+	if s.sortBy != "" {
+		printResults(resultsList, s.sortBy)
+	}
+	if s.canaryHost != "" {
+		printCanary(compareCanary(s.canaryHost, resultsList, canary))
+	}
+	if s.history != nil {
+		// Compare against the whole sitemap, not just the sampled URLs
+		listed := make([]string, len(entries))
+		for i, entry := range entries {
+			listed[i] = entry.Loc
+		}
+		lc, err := s.history.record(sitemapURL, started, listed, resultsList, interrupted)
+		if err != nil {
+			console.Error(fmt.Sprintf("Error recording history: %v", err), "event", "history", "error", err.Error())
+		} else {
+			printLifecycle(lc)
+			if s.issues != nil {
+				s.fileIssues(sitemapURL, lc, resultsList)
+			}
+		}
+		if s.historyRetain != (retention{}) {
+			pruned, err := s.history.prune(sitemapURL, s.historyRetain)
+			if err != nil {
+				console.Error(fmt.Sprintf("Error pruning history: %v", err), "event", "history", "error", err.Error())
+			} else if pruned > 0 {
+				console.Info(fmt.Sprintf("Pruned %d runs from the history, as --history-retain is %v", pruned, s.historyRetain),
+					"event", "history_prune", "runs", pruned, "retain", s.historyRetain.String())
+			}
+		}
+		if s.trendRuns > 0 {
+			trends, err := s.history.recent(sitemapURL, s.trendRuns)
+			if err != nil {
+				console.Error(fmt.Sprintf("Error reading history: %v", err), "event", "history", "error", err.Error())
+			} else {
+				printTrends(trends)
+			}
+		}
+	}
+
+	if s.recheckAfter > 0 && !interrupted {
+		recheckFailures(ctx, resultsList, s.recheckAfter, opts)
+	}
+	s.writeRunReport(title, report{Sitemap: sitemapURL, Site: name, Summary: summary, Results: resultsList}, interrupted)
+	if s.triage {
+		runTriage(resultsList, opts, s.ignoreFile)
+	}
+	return resultsList, t
+}
+
+// prepareEntries returns the URLs of the entries to visit, in the order
+// they should be dispatched to workers, and opts set up to visit them: with
+// how the entries using the sitehit sitemap extension are requested, and
+// their place in the shed order.
+func prepareEntries(entries []Url, opts Options) ([]string, Options) {
+	opts.requests = entryRequests(entries, opts)
+	opts.ranks = shedRanks(entries, opts)
+	opts.high = highPriority(entries, opts)
+	return sitemapURLs(entries, opts), opts
+}
+
+// sitemapURLs returns the URLs of the sitemap entries to visit, sampled when
+// --sample is set, in the order they should be dispatched to workers.
+func sitemapURLs(entries []Url, opts Options) []string {
+	if n := opts.sample.of(len(entries)); n > 0 && n < len(entries) {
+		opts.logger().Info(fmt.Sprintf("Sampling %d of %d URLs, weighted by %s", n, len(entries), opts.SampleWeight),
+			"event", "sample", "urls", n, "total", len(entries), "weight", opts.SampleWeight)
+		entries = sample(entries, n, opts.SampleWeight)
+	}
+	entries = shedLast(entries, opts)
 
-	totalSites := len(urlSet.URLs)
-	fmt.Printf("Processing %d URLs with %d workers...\n", totalSites, batchSize)
+	urls := make([]string, 0, len(entries))
+	for _, url := range entries {
+		urls = append(urls, url.Loc)
+	}
+	return urls
+}
+
+// failedFirst moves the URLs in failed to the front of urls, keeping the
+// order within both parts, so persistent failures are reported early.
+func failedFirst(urls []string, failed map[string]bool) []string {
+	ordered := make([]string, 0, len(urls))
+	for _, url := range urls {
+		if failed[url] {
+			ordered = append(ordered, url)
+		}
+	}
+	n := len(ordered)
+	for _, url := range urls {
+		if !failed[url] {
+			ordered = append(ordered, url)
+		}
+	}
+	if n > 0 {
+		console.Info(fmt.Sprintf("Visiting the %d URLs that failed last time first", n), "event", "retry_first", "urls", n)
+	}
+	return ordered
+}
 
-	jobs := make(chan string)
-	results := make(chan Result)
+// runURLs visits urls with opts.BatchSize concurrent workers and returns one
+// Result per URL, in completion order, along with their tally. Only the
+// results opts.Retain keeps are returned when it's set. Cancelling ctx
+// aborts the requests in flight; URLs that were never visited, or whose
+// request was aborted, have no Result.
+func runURLs(ctx context.Context, urls []string, opts Options) ([]Result, *tally) {
+	if len(opts.WarmAssets) > 0 && opts.assets == nil {
+		opts.assets = newAssetCache()
+	}
+	if opts.Rate > 0 && opts.rate == nil {
+		opts.rate = newRateLimiter(opts.Rate, opts.queue)
+	}
+	if opts.FailureBudget > 0 && opts.budget == nil {
+		opts.budget = &failureBudget{limit: int64(opts.FailureBudget)}
+	}
+
+	jobs := make(chan job)
+	results := make(chan visit)
 	var wg sync.WaitGroup
 
 	// Start worker goroutines
-	for w := 1; w <= batchSize; w++ {
+	for w := 1; w <= opts.BatchSize; w++ {
 		wg.Add(1)
-		go worker(w, jobs, results, &wg)
+		go worker(ctx, w, jobs, results, &wg, opts)
 	}
 
-	// Send URLs to jobs channel
+	// Send URLs to jobs channel, hosts taking turns, until the run is stopped
 	go func() {
-		for _, url := range urlSet.URLs {
-			jobs <- url.Loc
+		defer close(jobs)
+		if opts.queue != nil {
+			opts.queue.feed(ctx, urls, opts.ranks, jobs, opts.Stop)
+			return
+		}
+		f := newFrontier(urls, opts.ranks)
+		shed := false
+		for {
+			if !shed && opts.budget.spent() {
+				shed = true
+				if n := f.shed(opts.high); n > 0 {
+					opts.logger().Warn(fmt.Sprintf("Failure budget of %d URLs spent, shedding the %d low-priority URLs left", opts.FailureBudget, n),
+						"event", "shed", "failures", opts.FailureBudget, "shed", n)
+				}
+			}
+			j, ok := f.pop()
+			if !ok {
+				return
+			}
+			select {
+			case jobs <- j:
+			case <-opts.Stop:
+				return
+			case <-ctx.Done():
+				return
+			}
 		}
-		close(jobs)
 	}()
 
 	// Close results channel after all workers are done
@@ -102,98 +736,660 @@ func main() {
 		close(results)
 	}()
 
-	// Collect results
-	resultsList := make([]Result, 0, totalSites)
-	for result := range results {
-		resultsList = append(resultsList, result)
+	// Collect results, in sitemap order with --ordered-output
+	var resultsList []Result
+	if opts.Retain == nil {
+		resultsList = make([]Result, 0, len(urls))
+	}
+	t := newTally()
+	keep := func(result Result) {
+		t.add(result)
+		if opts.Retain == nil || opts.Retain(result) {
+			resultsList = append(resultsList, result)
+		}
+		if opts.OnResult != nil {
+			opts.OnResult(result)
+		}
+	}
+	var held []Result // failures waiting for the FailedPass
+	collect := func(v visit) {
+		if v.output != nil {
+			opts.logger().flush(v.output)
+		}
+		if !v.visited {
+			return
+		}
+		opts.queue.ack(v.result)
+		if opts.FailedPass && !v.result.Success && !v.result.Skipped {
+			held = append(held, v.result)
+			return
+		}
+		keep(v.result)
+	}
+
+	pending := make(map[int]visit)
+	next := 0
+	for v := range results {
+		if !opts.OrderedOutput {
+			collect(v)
+			continue
+		}
+		pending[v.index] = v
+		for v, ok := pending[next]; ok; v, ok = pending[next] {
+			collect(v)
+			delete(pending, next)
+			next++
+		}
+	}
+	// URLs that were never dispatched leave gaps once the run is stopped
+	for _, index := range slices.Sorted(maps.Keys(pending)) {
+		collect(pending[index])
+	}
+
+	if len(held) == 0 {
+		return resultsList, t
+	}
+	if stopped(opts.Stop) || ctx.Err() != nil {
+		for _, result := range held {
+			keep(result)
+		}
+		return resultsList, t
+	}
+
+	// Many failures of a big run are congestion, so go easy on the origin
+	passOpts := opts
+	passOpts.FailedPass, passOpts.Retain, passOpts.OnResult, passOpts.queue = false, nil, nil, nil
+	passOpts.BatchSize = max(opts.BatchSize/4, 1)
+	failed := make([]string, len(held))
+	for i, result := range held {
+		failed[i] = result.URL
+	}
+	opts.logger().Info(fmt.Sprintf("\nRetrying %d failed URLs with %d workers...", len(failed), passOpts.BatchSize),
+		"event", "failed_pass", "failed", len(failed), "workers", passOpts.BatchSize)
+	passResults, passTally := runURLs(ctx, failed, passOpts)
+	retried := make(map[string]bool, len(passResults))
+	for _, result := range passResults {
+		retried[result.URL] = true
+		keep(result)
+	}
+	// URLs the pass didn't get to, as it was stopped, keep their failure
+	for _, result := range held {
+		if !retried[result.URL] {
+			keep(result)
+		}
 	}
+	recovered := passTally.counts.Succeeded
+	opts.logger().Info(fmt.Sprintf("Second pass: %d of %d failed URLs recovered", recovered, len(failed)),
+		"event", "failed_pass", "failed", len(failed), "recovered", recovered)
+	return resultsList, t
+}
 
-	// Process results
-	total200 := 0
-	totalNon200 := 0
-	var totalTime time.Duration
+// job is a URL handed to a worker, with its position in the run.
+type job struct {
+	index int
+	url   string
+}
+
+// visit is what a worker did with a job. URLs that weren't visited, because
+// the run was stopped, are still reported so ordered output can move on.
+type visit struct {
+	index   int
+	result  Result
+	visited bool
+	output  *logger // buffered output with --ordered-output
+}
 
+// recheckFailures waits for delay and then visits every URL that failed once
+// more, leaving out the skipped and ignored ones, reporting which failures
+// were transient and which persist. The rechecks aren't passed to OnResult.
+func recheckFailures(ctx context.Context, resultsList []Result, delay time.Duration, opts Options) {
+	var failed []string
 	for _, result := range resultsList {
-		totalTime += result.Duration
+		if !result.Success && !result.Skipped && !result.Ignored {
+			failed = append(failed, result.URL)
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+
+	console.Info(fmt.Sprintf("\nRechecking %d failed URLs in %v...", len(failed), delay), "failed", len(failed), "delay", delay.String())
+	if !sleep(ctx, delay, opts.Stop) {
+		return
+	}
+
+	// The results of the run were already streamed and queued, so the
+	// recheck only reports what recovered
+	opts.FailedPass, opts.Retain, opts.OnResult, opts.queue = false, nil, nil, nil
+
+	var persistent []string
+	recovered := 0
+	rechecked, _ := runURLs(ctx, failed, opts)
+	for _, result := range rechecked {
 		if result.Success {
-			total200++
+			recovered++
 		} else {
-			totalNon200++
+			persistent = append(persistent, result.URL)
 		}
 	}
 
-	avgTime := time.Duration(0)
-	if totalSites > 0 {
-		avgTime = totalTime / time.Duration(totalSites)
+	if console.structured() {
+		console.Info("Recheck", "recovered", recovered, "persistent", persistent)
+		return
+	}
+	fmt.Println("\nRecheck:")
+	fmt.Printf("Recovered (transient failures): %d\n", recovered)
+	fmt.Printf("Still failing (persistent failures): %d\n", len(persistent))
+	for _, url := range persistent {
+		fmt.Printf("\033[31m  %s\033[0m\n", url)
 	}
-
-	fmt.Println("\nSummary:")
-	fmt.Printf("Total sites: %d\n", totalSites)
-	fmt.Printf("Total 200 responses: %d\n", total200)
-	fmt.Printf("Total non-200 responses: %d\n", totalNon200)
-	fmt.Printf("Average request time: %v\n", avgTime)
 }
 
-func worker(id int, jobs <-chan string, results chan<- Result, wg *sync.WaitGroup) {
+func worker(ctx context.Context, id int, jobs <-chan job, results chan<- visit, wg *sync.WaitGroup, opts Options) {
 	defer wg.Done()
-	for url := range jobs {
-		result := processURL(url)
-		results <- result
+
+	if opts.IsolateWorkers {
+		opts.Client = visitorClient(opts.Client)
+		defer opts.Client.CloseIdleConnections()
+		if opts.grpcClient != nil {
+			opts.grpcClient = grpcClient(opts.Client)
+			defer opts.grpcClient.CloseIdleConnections()
+		}
+	}
+
+	// Stagger start times so a large pool doesn't hit the origin in one burst
+	if opts.StartJitter > 0 {
+		sleep(ctx, rand.N(opts.StartJitter), opts.Stop)
+	}
+
+	for job := range jobs {
+		v := visit{index: job.index}
+		urlOpts := opts
+		if opts.OrderedOutput {
+			v.output = opts.logger().buffer()
+			urlOpts.log = v.output
+		}
+
+		if !opts.pause.Wait(ctx, opts.Stop) {
+			// Stopped while paused: report the job unvisited
+			results <- v
+			return
+		}
+		opts.maintenance.waitOut(ctx, opts.Stop)
+		opts.guard.acquire(opts.high[job.url])
+		if !stopped(opts.Stop) && ctx.Err() == nil {
+			v.result = processURL(ctx, job.url, urlOpts)
+			// Aborted mid-request: the URL wasn't really visited
+			v.visited = ctx.Err() == nil || !errors.Is(v.result.Error, ctx.Err())
+			if v.visited {
+				opts.budget.spend(v.result)
+			}
+		}
+		opts.guard.release()
+		results <- v
 	}
 }
 
-func processURL(url string) Result {
+// logger returns where the output of a URL goes.
+func (opts Options) logger() *logger {
+	if opts.log != nil {
+		return opts.log
+	}
+	return console
+}
+
+func processURL(ctx context.Context, url string, opts Options) Result {
+	if mode, ok := opts.grpc.lookup(url); ok {
+		return processGRPC(ctx, url, mode, opts)
+	}
+	entry := opts.requests[url]
+	if entry != nil {
+		opts = entry.apply(opts)
+	}
+	log := opts.logger()
 	var result Result
 	result.URL = url
+	result.TTL = -1
 	attempts := 0
 	totalDuration := time.Duration(0)
 
-	for attempts < 3 {
+	header := http.Header{}
+	if opts.CDNDebug {
+		header = cdnDebugRequest.Clone()
+	}
+	if entry != nil {
+		maps.Copy(header, entry.header)
+	}
+
+	// Waiting for --rate comes before the clock starts; a done ctx fails
+	// the request that follows
+	var headResp *http.Response
+	var headStart time.Time
+	if opts.MaxSize > 0 || opts.HeadFirst {
+		opts.rate.wait(ctx)
+		headStart = time.Now()
+		headResp = head(ctx, url, opts)
+	}
+	headDuration := time.Since(headStart)
+
+	// Keep huge files from dominating the run
+	ranged := false
+	if opts.MaxSize > 0 {
+		if size := declaredSize(headResp); size > opts.MaxSize {
+			if opts.Oversize == "skip" {
+				result.Skipped = true
+				result.ContentLength = size
+				log.Warn(fmt.Sprintf("Skipping %s: declared size %s exceeds --max-size", url, formatBytes(size)),
+					"event", "skipped", "url", url, "content_length", size)
+				return result
+			}
+			header.Set("Range", fmt.Sprintf("bytes=0-%d", rangeBytes-1))
+			ranged = true
+		}
+	}
+
+	// Ask for gzip ourselves rather than leave it to the transport, so the
+	// size on the wire is known along with the decoded one
+	if !ranged {
+		header.Set("Accept-Encoding", "gzip")
+	}
+
+	// A page the CDN has cached needs no GET to stay warm
+	if opts.HeadFirst && !ranged && headResp != nil && headResp.StatusCode == http.StatusOK && cacheStatus(headResp.Header) == "hit" {
+		result.Success, result.HeadOnly = true, true
+		result.StatusCode = headResp.StatusCode
+		result.ContentLength = headResp.ContentLength
+		result.Attempts = 1
+		result.Duration, result.TTFB = headDuration, headDuration
+		result.CacheStatus = "hit"
+		result.TTL = freshness(headResp.Header)
+		result.Headers = recordedHeaders(headResp, opts)
+		result.AttemptDetails = []Attempt{{StartedAt: headStart, StatusCode: headResp.StatusCode, Duration: headDuration, TTFB: headDuration}}
+		log.Info(fmt.Sprintf("Attempt 1: %s is cached, skipping the GET - HEAD status: %d, Time: %v", url, headResp.StatusCode, headDuration),
+			"event", "attempt", "url", url, "attempt", 1, "status", headResp.StatusCode, "duration_ms", headDuration.Milliseconds(), "head_only", true)
+		return result
+	}
+
+	method := cmp.Or(opts.Method, http.MethodGet)
+
+	// Connection-level errors move on to the next --fallback variant
+	var variants []variant
+	loadedVariants, nextVariant := false, 0
+	fetchOpts := opts
+	defer func() {
+		for _, v := range variants {
+			v.close()
+		}
+	}()
+
+	for attempts <= opts.Retries {
 		attempts++
+		opts.rate.wait(ctx)
 		start := time.Now()
-		resp, err := http.Get(url)
-		duration := time.Since(start)
-		totalDuration += duration
+		attemptCtx, cancel := context.WithCancelCause(ctx)
+		resp, err := fetch(attemptCtx, method, url, opts.Body, attempts, header, fetchOpts)
+		if err == nil && method == http.MethodHead && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+			resp.Body.Close()
+			method = http.MethodGet
+			log.Warn(fmt.Sprintf("Attempt %d: %s rejects HEAD with %d, falling back to GET", attempts, url, resp.StatusCode),
+				"event", "head_rejected", "url", url, "attempt", attempts, "status", resp.StatusCode)
+			opts.rate.wait(attemptCtx)
+			resp, err = fetch(attemptCtx, method, url, opts.Body, attempts, header, fetchOpts)
+		}
+		ttfb := time.Since(start)
+		record := Attempt{StartedAt: start, Duration: ttfb, TTFB: ttfb, Variant: result.Variant, Error: err}
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		opts.guard.record(status, err)
+		result.TTFB, result.Transfer = ttfb, 0
+		cutShort := false // the body was truncated or stalled
+		var askedWait time.Duration
 
 		if err != nil {
 			// Error occurred
+			cancel(nil)
+			totalDuration += ttfb
+			record.ErrorCode = errorCode(err, 0)
+			result.AttemptDetails = append(result.AttemptDetails, record)
 			result.Error = err
 			result.StatusCode = 0 // Indicate no status code
+			if resp != nil {
+				// Refused by the redirect policy, which the chain explains
+				result.RedirectChain = redirectChain(resp)
+			}
 			result.Duration = totalDuration
 			result.Attempts = attempts
-			fmt.Printf("\033[31mAttempt %d: Error visiting %s: %v\033[0m\n", attempts, url, err)
+			log.Error(fmt.Sprintf("Attempt %d: Error visiting %s: %v", attempts, url, err),
+				"event", "attempt", "url", url, "attempt", attempts, "error", err.Error(), "error_code", record.ErrorCode, "duration_ms", ttfb.Milliseconds())
+
+			if len(opts.Fallback) > 0 && attempts <= opts.Retries && connectionError(err) {
+				if !loadedVariants {
+					variants, loadedVariants = fallbackVariants(ctx, url, opts), true
+				}
+				if nextVariant < len(variants) {
+					v := variants[nextVariant]
+					nextVariant++
+					fetchOpts.Client, result.Variant = v.client, v.name
+					log.Warn(fmt.Sprintf("Attempt %d: Retrying %s over %s", attempts+1, url, v.name),
+						"event", "fallback", "url", url, "attempt", attempts+1, "variant", v.name)
+				}
+			}
 		} else {
-			// Ensure the body is fully read and closed
-			io.Copy(io.Discard, resp.Body)
+			// Ensure the body is fully read and closed, keeping its start
+			// around for the checks that need it
+			body := &bodyPrefix{limit: opts.checks.bodyLimit()}
+			if len(opts.WarmAssets) > 0 {
+				body.limit = max(body.limit, assetBodyLimit)
+			}
+			if opts.maintenance != nil {
+				body.limit = max(body.limit, maintenanceBodyLimit)
+			}
+			if opts.seo != nil {
+				body.limit = max(body.limit, seoBodyLimit)
+			}
+			var reader io.Reader = resp.Body
+			var stall *stallReader
+			if opts.StallTimeout > 0 {
+				stall = newStallReader(resp.Body, opts.StallTimeout, cancel)
+				reader = stall
+			}
+			var gz *gzipBody
+			if resp.Header.Get("Content-Encoding") == "gzip" {
+				gz = newGzipBody(reader)
+				reader = gz
+			}
+			bytesRead, readErr := io.Copy(body, reader)
+			stall.stop()
 			resp.Body.Close()
+			stalled := errors.Is(context.Cause(attemptCtx), errStalled)
+			if stalled {
+				readErr = context.Cause(attemptCtx)
+			}
+			timedOut := readErr != nil && errorCode(readErr, 0) == "TIMEOUT"
+			cancel(nil)
+			duration := time.Since(start)
+			totalDuration += duration
+			record.Duration, record.Transfer = duration, duration-ttfb
+			record.BytesRead = bytesRead
+			result.Transfer = record.Transfer
+			// The declared length is of the encoded body
+			wireBytes := bytesRead
+			if gz != nil {
+				wireBytes = gz.wire.n
+			}
+			record.WireBytes = wireBytes
+			// A HEAD declares the length of the body it leaves out
+			truncated := readErr != nil || (method != http.MethodHead && resp.ContentLength >= 0 && wireBytes != resp.ContentLength)
+			cutShort = truncated
+			if readErr != nil {
+				log.Error(fmt.Sprintf("Attempt %d: Truncated response from %s: %v after %d bytes", attempts, url, readErr, bytesRead),
+					"event", "truncated", "url", url, "attempt", attempts, "error", readErr.Error(), "bytes_read", bytesRead)
+			} else if truncated {
+				log.Error(fmt.Sprintf("Attempt %d: Truncated response from %s: received %d of %d bytes", attempts, url, wireBytes, resp.ContentLength),
+					"event", "truncated", "url", url, "attempt", attempts, "bytes_read", wireBytes, "content_length", resp.ContentLength)
+			}
 
-			if resp.StatusCode == http.StatusOK {
+			// A planned maintenance window is waited out, not failed
+			if opts.maintenance.matches(resp, body.buf) {
+				log.Warn(fmt.Sprintf("Attempt %d: %s is down for maintenance, trying again after the window", attempts, url),
+					"event", "maintenance", "url", url, "attempt", attempts, "status", resp.StatusCode)
+				if opts.maintenance.hold(ctx, opts.Stop) {
+					attempts--
+					continue
+				}
+			} else {
+				opts.maintenance.over()
+			}
+
+			success, err := opts.Hooks.Classify(resp, attempts, duration)
+			if ranged && resp.StatusCode == http.StatusPartialContent {
+				// The range requested for an oversized URL
+				success = err == nil
+			}
+			if err != nil {
+				result.Error = err
+				log.Error(fmt.Sprintf("Attempt %d: Error classifying %s: %v", attempts, url, err),
+					"event", "classify", "url", url, "attempt", attempts, "error", err.Error())
+			} else if stalled || timedOut {
+				// The truncated response was logged already
+				success, err = false, readErr
+				result.Error = err
+			}
+			if err == nil {
+				in := checkInput{url: url, resp: resp, body: body.buf, bytes: bytesRead, duration: duration, ttfb: ttfb}
+				result.Checks, success = opts.checks.run(in, success, !opts.Hooks.classifies())
+				for _, c := range result.Checks {
+					// A failed status check shows in the status already
+					if c.Error == nil || c.Kind == "status" {
+						continue
+					}
+					checkErr := &checkError{bundle: c.Bundle, kind: c.Kind, err: c.Error}
+					if err == nil {
+						err = checkErr
+						result.Error = err
+					}
+					log.Error(fmt.Sprintf("Attempt %d: Check failed for %s: %v", attempts, url, checkErr),
+						"event", "check", "url", url, "attempt", attempts, "bundle", c.Bundle, "kind", c.Kind, "error", c.Error.Error())
+				}
+			}
+			record.StatusCode = resp.StatusCode
+			record.Error = err
+			if !success {
+				record.ErrorCode = errorCode(err, resp.StatusCode)
+			}
+			result.AttemptDetails = append(result.AttemptDetails, record)
+			result.RedirectChain = redirectChain(resp)
+			if result.RedirectChain != nil {
+				log.Info(fmt.Sprintf("Attempt %d: %s redirected: %s", attempts, url, formatChain(result.RedirectChain)),
+					"event", "redirect_chain", "url", url, "attempt", attempts, "chain", result.RedirectChain)
+			}
+			result.Headers = recordedHeaders(resp, opts)
+			result.CacheStatus = cacheStatus(resp.Header)
+			result.TTL = freshness(resp.Header)
+			askedWait = retryAfter(resp, opts.MaxRetryAfter, time.Now())
+
+			if success {
 				// Success
 				result.Success = true
 				result.StatusCode = resp.StatusCode
-				result.ContentLength = resp.Header.Get("Content-Length")
+				result.ContentLength = resp.ContentLength
+				result.BytesRead = bytesRead
+				result.Truncated = truncated
 				result.Duration = totalDuration
 				result.Attempts = attempts
 
-				fmt.Printf("Attempt %d: Visited %s - Status: %d, Content-Length: %s, Time: %v\n", attempts, url, resp.StatusCode, result.ContentLength, duration)
+				via := ""
+				if result.Variant != "" {
+					via = " via " + result.Variant
+				}
+				log.Info(fmt.Sprintf("Attempt %d: Visited %s%s - Status: %d, Content-Length: %s, Time: %v (TTFB %v, transfer %v)", attempts, url, via, resp.StatusCode, formatLength(result.ContentLength), duration, ttfb, record.Transfer),
+					"event", "attempt", "url", url, "attempt", attempts, "status", resp.StatusCode, "content_length", result.ContentLength, "duration_ms", duration.Milliseconds(),
+					"ttfb_ms", ttfb.Milliseconds(), "transfer_ms", record.Transfer.Milliseconds(), "variant", result.Variant)
+
+				if gz != nil {
+					result.CompressedBytes = wireBytes
+				}
+				if !truncated {
+					result.Compression = rateCompression(resp, bytesRead, result.CompressedBytes)
+				}
+				switch result.Compression {
+				case "poor":
+					log.Warn(fmt.Sprintf("Poorly compressed: %s takes %s on the wire for %s of content", url, formatBytes(wireBytes), formatBytes(bytesRead)),
+						"event", "compression", "url", url, "compressed_bytes", wireBytes, "bytes_read", bytesRead)
+				case "none":
+					log.Warn(fmt.Sprintf("Not compressed: %s sent %s of %s uncompressed", url, formatBytes(bytesRead), resp.Header.Get("Content-Type")),
+						"event", "compression", "url", url, "bytes_read", bytesRead, "content_type", resp.Header.Get("Content-Type"))
+				}
+
+				opts.seo.observe(ctx, url, resp, body.buf, opts)
+				if opts.assets != nil {
+					result.Assets = opts.assets.warm(ctx, resp, body.buf, opts)
+					if len(result.Assets) > 0 {
+						weighPage(&result, opts)
+					}
+				}
 				return result
 			} else {
 				// Non-200 status
 				result.StatusCode = resp.StatusCode
+				result.ContentLength = resp.ContentLength
+				result.BytesRead = bytesRead
+				result.Truncated = truncated
 				result.Duration = totalDuration
 				result.Attempts = attempts
 
-				fmt.Printf("\033[31mAttempt %d: Visited %s - Status: %d, Time: %v\033[0m\n", attempts, url, resp.StatusCode, duration)
+				log.Error(fmt.Sprintf("Attempt %d: Visited %s - Status: %d, Time: %v (TTFB %v, transfer %v)", attempts, url, resp.StatusCode, duration, ttfb, record.Transfer),
+					"event", "attempt", "url", url, "attempt", attempts, "status", resp.StatusCode, "error_code", record.ErrorCode, "duration_ms", duration.Milliseconds(),
+					"ttfb_ms", ttfb.Milliseconds(), "transfer_ms", record.Transfer.Milliseconds())
 			}
 		}
 
-		if attempts < 3 {
-			time.Sleep(1000 * time.Millisecond)
+		if attempts <= opts.Retries {
+			failure := result.StatusCode
+			if cutShort {
+				failure = 0
+			}
+			if !retryable(opts.RetryOn, failure) {
+				break
+			}
+			delay, retry := opts.retryDelay.delay(result.StatusCode, attempts, opts.RetryBackoff, opts.RetryMaxWait)
+			if !retry {
+				break
+			}
+			if askedWait > 0 {
+				delay = askedWait
+				log.Warn(fmt.Sprintf("Attempt %d: %s asked to retry after %v", attempts, url, delay),
+					"event", "retry_after", "url", url, "attempt", attempts, "wait_ms", delay.Milliseconds())
+			}
+			if !sleep(ctx, delay, opts.Stop) {
+				// Stopped: don't retry, report what we have so far
+				return result
+			}
 		}
 	}
 
-	// Failed after 3 attempts
-	fmt.Printf("\033[31mFailed to get 200 status for %s after %d attempts\033[0m\n", url, attempts)
+	return giveUp(result, opts)
+}
+
+// giveUp reports a URL that failed after its last attempt, or earlier if
+// the retry rules said so, marking it ignored when it's listed in the ignore file.
+func giveUp(result Result, opts Options) Result {
+	log := opts.logger()
+	url, attempts := result.URL, result.Attempts
 	result.Success = false
+	if rule, ok := opts.ignore.lookup(url); ok {
+		result.Ignored = true
+		until := "further notice"
+		if !rule.until.IsZero() {
+			until = rule.until.AddDate(0, 0, -1).Format(time.DateOnly)
+		}
+		log.Warn(fmt.Sprintf("Failed to get 200 status for %s after %d attempts, ignored until %s", url, attempts, until),
+			"event", "failed", "url", url, "attempts", attempts, "error_code", result.ErrorCode(), "ignored", rule.pattern)
+		return result
+	}
+	log.Error(fmt.Sprintf("Failed to get 200 status for %s after %d attempts", url, attempts),
+		"event", "failed", "url", url, "attempts", attempts, "error_code", result.ErrorCode())
 	return result
 }
+
+// sleep waits for d and reports whether it did so without ctx being
+// cancelled or stop being closed.
+func sleep(ctx context.Context, d time.Duration, stop <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// stopped reports whether stop has been closed.
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// formatLength renders a declared content length, leaving it blank when the
+// server didn't send one.
+func formatLength(n int64) string {
+	if n < 0 {
+		return ""
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// fetch issues a request for url with body, if not nil, and the extra header
+// fields, letting the script hooks adjust the request first.
+func fetch(ctx context.Context, method, url string, body []byte, attempt int, header http.Header, opts Options) (*http.Response, error) {
+	var content io.Reader
+	if body != nil {
+		content = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, content)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil && opts.ContentType != "" {
+		req.Header.Set("Content-Type", opts.ContentType)
+	}
+	opts.setHeader(req)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if err := opts.Hooks.Request(req, attempt); err != nil {
+		return nil, err
+	}
+	req = req.WithContext(opts.conns.withTrace(req.Context(), req.URL.Host))
+
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if opts.Timeout > 0 {
+		c := *client
+		c.Timeout = opts.Timeout
+		client = &c
+	}
+	resp, err := client.Do(req)
+	if err == nil && !speaksVersion(resp, opts.HTTPVersion) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: answered over %s, not --http-version %s", errHTTPVersion, resp.Proto, opts.HTTPVersion)
+	}
+	return resp, err
+}
+
+// get fetches url outside of a run, such as a sitemap or robots.txt, with
+// the client and User-Agent of the run.
+func (opts Options) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	opts.setHeader(req)
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// setHeader adds the User-Agent and the extra header fields of the run to
+// req.
+func (opts Options) setHeader(req *http.Request) {
+	if opts.UserAgent != "" {
+		req.Header.Set("User-Agent", opts.UserAgent)
+	}
+	for name, values := range opts.Header {
+		req.Header[name] = slices.Clone(values)
+	}
+}
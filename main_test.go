@@ -0,0 +1,101 @@
+package sitehit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mainArgsEnv holds the arguments to run Main with in a copy of the test
+// binary, as Main parses the process's flags and exits.
+const mainArgsEnv = "SITEHIT_TEST_MAIN_ARGS"
+
+func TestMainReportOnStdout(t *testing.T) {
+	if args := os.Getenv(mainArgsEnv); args != "" {
+		os.Args = append([]string{"sitehit"}, strings.Fields(args)...)
+		Main()
+		os.Exit(0)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	urls := filepath.Join(t.TempDir(), "urls.txt")
+	if err := os.WriteFile(urls, []byte(srv.URL+"/a\n"+srv.URL+"/b\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		flags string
+	}{
+		{"text logs", "--format json --retries 0"},
+		{"JSON logs", "--log-format json --format json --retries 0"},
+		{"cronjob", "--cronjob --format json --retries 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestMainReportOnStdout$")
+			cmd.Env = append(os.Environ(), mainArgsEnv+"="+tt.flags+" "+urls)
+			var stdout, stderr bytes.Buffer
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			if err := cmd.Run(); err != nil {
+				t.Fatalf("sitehit %s: %v\n%s", tt.flags, err, stderr.String())
+			}
+
+			dec := json.NewDecoder(&stdout)
+			var rep report
+			if err := dec.Decode(&rep); err != nil {
+				t.Fatalf("stdout isn't a JSON report: %v", err)
+			}
+			if err := dec.Decode(new(json.RawMessage)); err != io.EOF {
+				t.Errorf("stdout holds more than the report, decoding further: %v", err)
+			}
+			if rep.Summary.Total != 2 || len(rep.Results) != 2 {
+				t.Errorf("report of %d URLs with %d results, want 2", rep.Summary.Total, len(rep.Results))
+			}
+			if stderr.Len() == 0 {
+				t.Errorf("nothing logged to stderr")
+			}
+		})
+	}
+}
+
+func TestRecheckFailures(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	resultsList := []Result{
+		{URL: srv.URL + "/ok", Success: true},
+		{URL: srv.URL + "/failed"},
+		{URL: srv.URL + "/skipped", Skipped: true},
+		{URL: srv.URL + "/ignored", Ignored: true},
+	}
+	opts := Options{Client: srv.Client(), BatchSize: 2, log: &logger{out: io.Discard}}
+	opts.OnResult = func(result Result) {
+		t.Errorf("OnResult called with the recheck of %s", result.URL)
+	}
+	recheckFailures(context.Background(), resultsList, time.Millisecond, opts)
+
+	if want := map[string]int{"/failed": 1}; !maps.Equal(requests, want) {
+		t.Errorf("rechecked %v, want %v", requests, want)
+	}
+}
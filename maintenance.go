@@ -0,0 +1,142 @@
+package sitehit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maintenanceBodyLimit is how much of a body --maintenance-marker is
+// matched against.
+const maintenanceBodyLimit = 64 << 10
+
+// maintenance recognizes the responses a site sends during a planned
+// maintenance window, by their status and optionally a marker in their
+// headers or body. The first one pauses the whole run: no new URLs are
+// dispatched and the URLs that got one are retried once the window seems
+// over, without using up their attempts. After max the responses count as
+// failures again.
+type maintenance struct {
+	status int
+	marker *regexp.Regexp // nil to go by the status alone
+	wait   time.Duration  // between tries
+	max    time.Duration  // longest window to wait out
+
+	mu      sync.Mutex
+	started time.Time // zero outside a window
+	until   time.Time // when to try again
+	windows int
+	paused  time.Duration // in windows that are over
+}
+
+func newMaintenance(status int, marker string, wait, max time.Duration) (*maintenance, error) {
+	if status < 100 || status > 599 {
+		return nil, fmt.Errorf("invalid --maintenance-status %d", status)
+	}
+	m := &maintenance{status: status, wait: wait, max: max}
+	if marker != "" {
+		re, err := regexp.Compile(marker)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --maintenance-marker: %w", err)
+		}
+		m.marker = re
+	}
+	return m, nil
+}
+
+// matches reports whether resp, with the start of its body, is a
+// maintenance page. The marker is matched against the headers, as
+// "Name: value" lines, and the body.
+func (m *maintenance) matches(resp *http.Response, body []byte) bool {
+	if m == nil || resp.StatusCode != m.status {
+		return false
+	}
+	if m.marker == nil {
+		return true
+	}
+	var headers strings.Builder
+	resp.Header.Write(&headers)
+	return m.marker.MatchString(headers.String()) || m.marker.Match(body)
+}
+
+// hold pauses the run, starting a window if none is open, and waits for the
+// next try. It returns false once the window has lasted longer than max, or
+// when the run is stopped, so the response counts as a failure.
+func (m *maintenance) hold(ctx context.Context, stop <-chan struct{}) bool {
+	m.mu.Lock()
+	now := time.Now()
+	if m.started.IsZero() {
+		m.started = now
+		m.windows++
+		console.Warn(fmt.Sprintf("Maintenance window detected, pausing the run and trying again every %v", m.wait),
+			"event", "maintenance", "state", "started", "wait_ms", m.wait.Milliseconds())
+	}
+	if now.Sub(m.started) > m.max {
+		m.mu.Unlock()
+		return false
+	}
+	if next := now.Add(m.wait); next.After(m.until) {
+		m.until = next
+	}
+	until := m.until
+	m.mu.Unlock()
+	return sleep(ctx, time.Until(until), stop)
+}
+
+// over ends the window, if one is open, as a response wasn't a maintenance
+// page.
+func (m *maintenance) over() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.started.IsZero() {
+		return
+	}
+	took := time.Since(m.started)
+	m.paused += took
+	m.started, m.until = time.Time{}, time.Time{}
+	console.Info(fmt.Sprintf("Maintenance window over after %v, resuming the run", took.Round(time.Second)),
+		"event", "maintenance", "state", "over", "duration_ms", took.Milliseconds())
+}
+
+// waitOut holds back a worker during a window, until the next try.
+func (m *maintenance) waitOut(ctx context.Context, stop <-chan struct{}) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	until := m.until
+	m.mu.Unlock()
+	if d := time.Until(until); d > 0 {
+		sleep(ctx, d, stop)
+	}
+}
+
+// print reports the windows of the run, and starts counting anew for the
+// next one.
+func (m *maintenance) print() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.windows == 0 {
+		return
+	}
+	paused := m.paused
+	if !m.started.IsZero() {
+		paused += time.Since(m.started)
+	}
+	if console.structured() {
+		console.Info("Maintenance", "event", "maintenance", "windows", m.windows, "paused_ms", paused.Milliseconds())
+	} else {
+		fmt.Printf("\033[33mPaused for maintenance: %d windows, %v in all\033[0m\n", m.windows, paused.Round(time.Second))
+	}
+	m.windows, m.paused = 0, 0
+	if !m.started.IsZero() {
+		m.started = time.Now()
+	}
+}
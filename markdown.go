@@ -0,0 +1,61 @@
+package sitehit
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// markdownFailures caps the failing URLs listed by --format markdown, so a
+// broken deploy doesn't produce a comment too long to post.
+const markdownFailures = 100
+
+// writeMarkdown writes the summary and the failing URLs as GitHub-flavored
+// markdown, for CI bots to post as a pull-request comment.
+func writeMarkdown(w io.Writer, rep report) error {
+	var b strings.Builder
+	sum := rep.Summary
+	icon := "✅"
+	if sum.Failed > 0 {
+		icon = "❌"
+	}
+	title := "sitehit: " + rep.Sitemap
+	if rep.Site != "" {
+		title = "sitehit: " + rep.Site
+	}
+	fmt.Fprintf(&b, "### %s %s\n\n", icon, title)
+	b.WriteString("| URLs | Succeeded | Failed | Ignored | Skipped | Average time | Transferred |\n")
+	b.WriteString("|---:|---:|---:|---:|---:|---:|---:|\n")
+	fmt.Fprintf(&b, "| %d | %d | %d | %d | %d | %v | %s |\n", sum.Total, sum.Succeeded, sum.Failed, sum.Ignored, sum.Skipped,
+		sum.AverageTime.Round(time.Millisecond), formatBytes(sum.Bytes))
+
+	var failed []Result
+	for _, r := range rep.Results {
+		if !r.Success && !r.Ignored && !r.Skipped {
+			failed = append(failed, r)
+		}
+	}
+	if len(failed) > 0 {
+		b.WriteString("\n#### Failing URLs\n\n")
+		b.WriteString("| URL | Status | Attempts | Time | Error |\n")
+		b.WriteString("|---|---:|---:|---:|---|\n")
+		for i, r := range failed {
+			if i == markdownFailures {
+				fmt.Fprintf(&b, "\n…and %d more\n", len(failed)-i)
+				break
+			}
+			fmt.Fprintf(&b, "| %s | %s | %d | %v | %s |\n", markdownCell(r.URL), resultStatus(r), r.Attempts,
+				r.Duration.Round(time.Millisecond), markdownCell(cmp.Or(errorText(r.Error), r.ErrorCode())))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// markdownCell escapes text for a table cell.
+func markdownCell(text string) string {
+	text = strings.ReplaceAll(text, "|", `\|`)
+	return strings.ReplaceAll(text, "\n", " ")
+}
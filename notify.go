@@ -0,0 +1,49 @@
+package sitehit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// notifier posts messages to the --notify-webhook URL as JSON. The "text"
+// field makes the payload work with Slack-compatible incoming webhooks;
+// the other fields carry the details for anything smarter.
+type notifier struct {
+	webhook string
+	client  *http.Client
+}
+
+func newNotifier(webhook string) *notifier {
+	if webhook == "" {
+		return nil
+	}
+	return &notifier{webhook: webhook, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// Send posts text along with the extra fields.
+func (n *notifier) Send(text string, fields map[string]any) error {
+	if n == nil {
+		return nil
+	}
+	payload := map[string]any{"text": text}
+	for k, v := range fields {
+		payload[k] = v
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(n.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("sending notification: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sending notification: Status code %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package sitehit
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reportOut is where --format writes the report: the process's stdout, even
+// once the text output has been moved to stderr, or the --output file.
+var reportOut io.Writer = os.Stdout
+
+// outputFormats are the values --format accepts.
+var outputFormats = []string{"text", "json", "csv", "ndjson", "junit", "markdown"}
+
+// csvHeader names the columns of --format csv.
+var csvHeader = []string{"url", "status", "success", "attempts", "duration_ms", "content_length", "error", "error_code", "ttfb_ms", "transfer_ms"}
+
+// report is the document --format json writes at the end of a run.
+type report struct {
+	SchemaVersion int      `json:"schema_version"`
+	Sitemap       string   `json:"sitemap"`
+	Site          string   `json:"site,omitempty"`
+	Summary       Summary  `json:"summary"`
+	Results       []Result `json:"results"`
+}
+
+// writeReport writes the outcome of a run to w in format. The text format
+// is the regular output and ndjson has written every result already, so
+// nothing more is written for those.
+func writeReport(w io.Writer, format string, rep report) error {
+	switch format {
+	case "json":
+		if rep.Results == nil {
+			rep.Results = []Result{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rep)
+	case "csv":
+		return writeCSV(w, rep.Results)
+	case "junit":
+		return writeJUnit(w, rep)
+	case "markdown":
+		return writeMarkdown(w, rep)
+	}
+	return nil
+}
+
+// writeNDJSON writes result to reportOut as a line of JSON the moment it
+// completes, for --format ndjson.
+func writeNDJSON(result Result) {
+	line, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+	// One write per line keeps the lines of parallel sites whole
+	reportOut.Write(append(line, '\n'))
+}
+
+// writeCSV writes one row per result, for spreadsheets. The content length
+// is empty when the response didn't declare one, and the error code when
+// the URL didn't fail.
+func writeCSV(w io.Writer, resultsList []Result) error {
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeader)
+	for _, r := range resultsList {
+		var contentLength, errText string
+		if r.ContentLength >= 0 {
+			contentLength = strconv.FormatInt(r.ContentLength, 10)
+		}
+		if r.Error != nil {
+			errText = r.Error.Error()
+		}
+		cw.Write([]string{r.URL, strconv.Itoa(r.StatusCode), strconv.FormatBool(r.Success), strconv.Itoa(r.Attempts),
+			strconv.FormatInt(r.Duration.Milliseconds(), 10), contentLength, errText, r.ErrorCode(),
+			strconv.FormatInt(r.TTFB.Milliseconds(), 10), strconv.FormatInt(r.Transfer.Milliseconds(), 10)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeRunReport writes the report of a run with --format, --template,
+// --junit and --html-report, and exports it to --sheet, logging rather than
+// failing the run when it can't be written.
+func (s *settings) writeRunReport(title string, rep report, partial bool) {
+	if s.format != "text" {
+		rep.SchemaVersion = schemaVersion
+		if err := writeReport(reportOut, s.format, rep); err != nil {
+			console.Error(fmt.Sprintf("Error writing report: %v", err), "event", "report", "error", err.Error())
+		}
+	}
+	if s.template != nil {
+		s.template.writeSummary(rep)
+	}
+	if s.junit != "" {
+		if err := writeJUnitFile(s.junit, rep); err != nil {
+			console.Error(fmt.Sprintf("Error writing JUnit report: %v", err), "event", "report", "error", err.Error())
+		}
+	}
+	if s.htmlReport != "" {
+		if err := writeHTMLReport(s.htmlReport, title, rep, partial, s.retain != "all"); err != nil {
+			console.Error(fmt.Sprintf("Error writing HTML report: %v", err), "event", "report", "error", err.Error())
+		}
+	}
+	if s.sheet != nil {
+		if err := s.sheet.export(rep, time.Now()); err != nil {
+			console.Error(fmt.Sprintf("Error exporting to sheet: %v", err), "event", "report", "error", err.Error())
+		}
+	}
+	for _, sink := range s.pluginSinks {
+		if err := sink.Done(rep.Sitemap, rep.Summary); err != nil {
+			console.Error(fmt.Sprintf("Error reporting to plugin: %v", err), "event", "report", "error", err.Error())
+		}
+	}
+}
+
+// sitePath adds the name of the site to the file name of path in a
+// multi-site run, so the sites don't overwrite each other's files.
+func sitePath(path, site string) string {
+	if site == "" {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + site + ext
+}
@@ -0,0 +1,44 @@
+package sitehit
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestWriteCSV(t *testing.T) {
+	results := []Result{
+		{URL: "https://example.com/", StatusCode: 200, Success: true, Attempts: 1, Duration: 120 * time.Millisecond,
+			TTFB: 80 * time.Millisecond, Transfer: 40 * time.Millisecond, ContentLength: 512},
+		{URL: "https://example.com/gone", StatusCode: 503, Attempts: 3, Duration: 900 * time.Millisecond,
+			TTFB: 850 * time.Millisecond, Transfer: 50 * time.Millisecond, ContentLength: -1, Error: errors.New("status 503 after 3 attempts")},
+		{URL: "https://example.com/down", Attempts: 1, Duration: 2 * time.Second, ContentLength: -1,
+			Error: dialError("dial", errors.New("socket: too many open files"))},
+	}
+	want := [][]string{
+		csvHeader,
+		{"https://example.com/", "200", "true", "1", "120", "512", "", "", "80", "40"},
+		{"https://example.com/gone", "503", "false", "3", "900", "", "status 503 after 3 attempts", "HTTP_5XX", "850", "50"},
+		{"https://example.com/down", "0", "false", "1", "2000", "", results[2].Error.Error(), "CONNECTION_FAILED", "0", "0"},
+	}
+
+	var buf bytes.Buffer
+	if err := writeCSV(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("reading the CSV back: %v", err)
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("%d rows, want %d", len(rows), len(want))
+	}
+	for i := range want {
+		if !slices.Equal(rows[i], want[i]) {
+			t.Errorf("row %d = %q, want %q", i, rows[i], want[i])
+		}
+	}
+}
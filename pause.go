@@ -0,0 +1,51 @@
+package sitehit
+
+import (
+	"context"
+	"sync"
+)
+
+// pauseGate holds back the dispatch of new jobs while paused. Requests that
+// are already in flight are left to finish.
+type pauseGate struct {
+	mu     sync.Mutex
+	paused bool
+	resume chan struct{}
+}
+
+// Toggle pauses a running gate or resumes a paused one, and reports whether
+// it is now paused.
+func (g *pauseGate) Toggle() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		close(g.resume)
+	} else {
+		g.resume = make(chan struct{})
+	}
+	g.paused = !g.paused
+	return g.paused
+}
+
+// Wait blocks while the gate is paused, and reports false when the run was
+// stopped or ctx ended in the meantime, as --max-duration, a SIGTERM or a
+// closing run window still end a paused run.
+func (g *pauseGate) Wait(ctx context.Context, stop <-chan struct{}) bool {
+	if g == nil {
+		return true
+	}
+	g.mu.Lock()
+	paused, resume := g.paused, g.resume
+	g.mu.Unlock()
+	if !paused {
+		return true
+	}
+	select {
+	case <-resume:
+		return true
+	case <-stop:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
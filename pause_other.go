@@ -0,0 +1,6 @@
+//go:build !unix
+
+package sitehit
+
+// watchPauseSignal is a no-op on platforms without SIGUSR1.
+func watchPauseSignal(gate *pauseGate) {}
@@ -0,0 +1,24 @@
+//go:build unix
+
+package sitehit
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchPauseSignal toggles gate every time the process receives SIGUSR1.
+func watchPauseSignal(gate *pauseGate) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			if gate.Toggle() {
+				console.Warn("Paused dispatching new URLs, send SIGUSR1 again to resume", "event", "paused")
+			} else {
+				console.Warn("Resumed dispatching URLs", "event", "resumed")
+			}
+		}
+	}()
+}
@@ -0,0 +1,66 @@
+package sitehit
+
+import (
+	"fmt"
+	"path/filepath"
+	"plugin"
+	"strings"
+)
+
+// Source is implemented by plugins listing the URLs to visit from somewhere
+// other than a sitemap, such as a CMS. A source given as plugin:NAME or
+// plugin:NAME:ARG on the command line is read through the Source of that
+// name, with ARG.
+type Source interface {
+	URLs(arg string) ([]Url, error)
+}
+
+// Sink is implemented by plugins that report the results somewhere of their
+// own, such as an internal dashboard. When sites run in parallel its
+// methods may be called concurrently.
+type Sink interface {
+	// Result is called with every result as it completes.
+	Result(Result)
+
+	// Done is called with the summary at the end of every run of sitemap.
+	Done(sitemap string, summary Summary) error
+}
+
+// pluginPrefix starts the sources read through a Source.
+const pluginPrefix = "plugin:"
+
+// loadPlugin opens a Go plugin, built with -buildmode=plugin against the
+// same version of sitehit, and returns its exported Plugin variable, which
+// implements Source, Sink or both. The plugin is named after its file,
+// without the extension.
+func loadPlugin(path string) (name string, source Source, sink Sink, err error) {
+	name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	p, err := plugin.Open(path)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("loading plugin: %w", err)
+	}
+	sym, err := p.Lookup("Plugin")
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("loading plugin %s: %w", name, err)
+	}
+	source, _ = sym.(Source)
+	sink, _ = sym.(Sink)
+	if source == nil && sink == nil {
+		return "", nil, nil, fmt.Errorf("loading plugin %s: Plugin is neither a sitehit.Source nor a sitehit.Sink", name)
+	}
+	return name, source, sink, nil
+}
+
+// sourceURLs returns the URLs of a plugin:NAME:ARG source as a sitemap.
+func sourceURLs(source string, opts Options) (*Sitemap, error) {
+	name, arg, _ := strings.Cut(strings.TrimPrefix(source, pluginPrefix), ":")
+	s, ok := opts.Sources[name]
+	if !ok {
+		return nil, fmt.Errorf("no source plugin named %q, load it with --plugin", name)
+	}
+	urls, err := s.URLs(arg)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", name, err)
+	}
+	return &Sitemap{URLs: urls}, nil
+}
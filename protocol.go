@@ -0,0 +1,54 @@
+package sitehit
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// httpVersions are the values --http-version accepts. Without it, HTTP/2 is
+// used where the server offers it over TLS, and HTTP/1.1 elsewhere.
+var httpVersions = []string{"1.1", "2", "3"}
+
+// errHTTPVersion is a response over another HTTP version than --http-version,
+// as servers that don't offer HTTP/2 get an HTTP/1.1 request instead.
+var errHTTPVersion = errors.New("wrong HTTP version")
+
+// versionTransport returns the transport that speaks only the HTTP version
+// given: t limited to HTTP/1.1, or to HTTP/2, with prior knowledge for plain
+// http URLs, or an HTTP/3 transport over QUIC with the TLS settings of t.
+// A server that doesn't speak the version fails the request, see
+// speaksVersion, rather than being visited over another.
+func versionTransport(version string, t *http.Transport) (http.RoundTripper, error) {
+	switch version {
+	case "1.1":
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetHTTP1(true)
+		return t, nil
+	case "2":
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetHTTP2(true)
+		t.Protocols.SetUnencryptedHTTP2(true)
+		return t, nil
+	case "3":
+		return &http3.Transport{TLSClientConfig: t.TLSClientConfig}, nil
+	}
+	return nil, fmt.Errorf("invalid --http-version %q: must be one of %s", version, strings.Join(httpVersions, ", "))
+}
+
+// speaksVersion reports whether resp came over version, or any version when
+// it's empty.
+func speaksVersion(resp *http.Response, version string) bool {
+	switch version {
+	case "1.1":
+		return resp.ProtoMajor == 1
+	case "2":
+		return resp.ProtoMajor == 2
+	case "3":
+		return resp.ProtoMajor == 3
+	}
+	return true
+}
@@ -0,0 +1,222 @@
+package sitehit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// queuePoll is how often an instance whose queue is empty checks again,
+	// while URLs leased by other instances may still come back.
+	queuePoll = 2 * time.Second
+
+	// queueResults caps the stream of results, roughly.
+	queueResults = 100000
+)
+
+// seedScript fills the queue, unless another instance already did: the
+// seeded key marks the run as started until the queue is drained.
+const seedScript = `
+if redis.call('SET', KEYS[1], '1', 'NX') then
+  for i = 1, #ARGV, 1000 do
+    redis.call('RPUSH', KEYS[2], unpack(ARGV, i, math.min(i + 999, #ARGV)))
+  end
+  return 1
+end
+return 0`
+
+// claimScript puts the URLs whose lease expired back in the queue, as the
+// instance that took them is gone, and then leases the next URL.
+const claimScript = `
+local t = redis.call('TIME')
+local now = t[1] * 1000 + math.floor(t[2] / 1000)
+for _, url in ipairs(redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', now, 'LIMIT', 0, 100)) do
+  redis.call('ZREM', KEYS[2], url)
+  redis.call('RPUSH', KEYS[1], url)
+end
+local url = redis.call('LPOP', KEYS[1])
+if url then
+  redis.call('ZADD', KEYS[2], now + tonumber(ARGV[1]), url)
+end
+return url`
+
+// tokenScript takes up to ARGV[3] tokens from the bucket of a run, which
+// refills at ARGV[1] tokens a second up to ARGV[2]. It returns the tokens
+// taken and, when there were none, the milliseconds until the next one.
+const tokenScript = `
+local t = redis.call('TIME')
+local now = t[1] * 1000 + math.floor(t[2] / 1000)
+local rate, burst = tonumber(ARGV[1]), tonumber(ARGV[2])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'at')
+local tokens = tonumber(bucket[1]) or burst
+local at = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(now - at, 0) * rate / 1000)
+local taken = math.min(math.floor(tokens), tonumber(ARGV[3]))
+tokens = tokens - taken
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'at', tostring(now))
+redis.call('PEXPIRE', KEYS[1], 60000)
+if taken > 0 then
+  return {taken, 0}
+end
+return {0, math.ceil((1 - tokens) * 1000 / rate)}`
+
+// remainingScript counts the URLs queued and leased at once, so none is
+// missed moving between the two.
+const remainingScript = `return redis.call('LLEN', KEYS[1]) + redis.call('ZCARD', KEYS[2])`
+
+// workQueue keeps the URLs of a run in Redis with --queue, so a run survives
+// restarts of sitehit and several instances can share it. Workers lease the
+// URLs they visit; a URL that isn't done before its lease expires goes back
+// in the queue for any instance to take. Every result is also added to a
+// Redis stream.
+type workQueue struct {
+	client *redisClient
+	name   string // prefix of the keys; derived from the sitemap if empty
+	lease  time.Duration
+
+	mu     sync.Mutex
+	failed bool // the last ack failed, and that was reported
+}
+
+func newWorkQueue(target, name string, lease time.Duration) (*workQueue, error) {
+	if lease <= 0 {
+		return nil, fmt.Errorf("invalid --queue-lease %v: must be positive", lease)
+	}
+	client, err := newRedisClient(target)
+	if err != nil {
+		return nil, err
+	}
+	return &workQueue{client: client, name: name, lease: lease}, nil
+}
+
+// forSitemap returns the queue of a run of sitemapURL, named after the
+// sitemap unless --queue-name is set, sharing the connection.
+func (q *workQueue) forSitemap(sitemapURL string) *workQueue {
+	name := q.name
+	if name == "" {
+		sum := sha256.Sum256([]byte(sitemapURL))
+		name = "sitehit:" + hex.EncodeToString(sum[:8])
+	}
+	return &workQueue{client: q.client, name: name, lease: q.lease}
+}
+
+func (q *workQueue) key(suffix string) string {
+	return q.name + ":" + suffix
+}
+
+// feed seeds the queue with urls, in frontier order, unless the run was
+// already started, and sends the URLs this instance leases to jobs until the
+// queue is drained or the run is stopped.
+func (q *workQueue) feed(ctx context.Context, urls []string, ranks map[string]int, jobs chan<- job, stop <-chan struct{}) {
+	ordered := make([]string, 0, len(urls))
+	f := newFrontier(urls, ranks)
+	for j, ok := f.pop(); ok; j, ok = f.pop() {
+		ordered = append(ordered, j.url)
+	}
+	args := append([]string{"EVAL", seedScript, "2", q.key("seeded"), q.key("queued")}, ordered...)
+	seeded, err := q.client.do(args...)
+	if err != nil {
+		console.Error(fmt.Sprintf("Error seeding queue %s: %v", q.name, err), "event", "queue", "queue", q.name, "error", err.Error())
+		return
+	}
+	if seeded == int64(1) {
+		console.Info(fmt.Sprintf("Queued %d URLs in %s", len(ordered), q.name), "event", "queue", "queue", q.name, "state", "seeded", "urls", len(ordered))
+	} else {
+		left, _ := q.remaining()
+		console.Info(fmt.Sprintf("Joining queue %s, %d URLs left", q.name, left), "event", "queue", "queue", q.name, "state", "joined", "urls", left)
+	}
+
+	lease := strconv.FormatInt(q.lease.Milliseconds(), 10)
+	for index := 0; ; {
+		url, err := q.client.do("EVAL", claimScript, "2", q.key("queued"), q.key("leased"), lease)
+		if err != nil {
+			console.Error(fmt.Sprintf("Error reading queue %s: %v", q.name, err), "event", "queue", "queue", q.name, "error", err.Error())
+			return
+		}
+		if url == nil {
+			left, err := q.remaining()
+			if err != nil {
+				console.Error(fmt.Sprintf("Error reading queue %s: %v", q.name, err), "event", "queue", "queue", q.name, "error", err.Error())
+				return
+			}
+			if left == 0 {
+				q.client.do("DEL", q.key("seeded"), q.key("queued"), q.key("leased"), q.key("tokens"))
+				console.Info(fmt.Sprintf("Queue %s is done", q.name), "event", "queue", "queue", q.name, "state", "done")
+				return
+			}
+			// Leased by this or other instances, and back if they don't make it
+			if !sleep(ctx, queuePoll, stop) {
+				return
+			}
+			continue
+		}
+		select {
+		case jobs <- job{index: index, url: url.(string)}:
+			index++
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// takeTokens takes up to n tokens from the --rate bucket the instances of
+// the run share, which refills at rate a second and holds n at most. When
+// it's empty, it returns how long until the next token.
+func (q *workQueue) takeTokens(rate float64, n int) (int, time.Duration, error) {
+	reply, err := q.client.do("EVAL", tokenScript, "1", q.key("tokens"),
+		strconv.FormatFloat(rate, 'g', -1, 64), strconv.Itoa(n), strconv.Itoa(n))
+	if err != nil {
+		return 0, 0, err
+	}
+	values, ok := reply.([]any)
+	if !ok || len(values) != 2 {
+		return 0, 0, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+	taken, _ := values[0].(int64)
+	wait, _ := values[1].(int64)
+	return int(taken), time.Duration(wait) * time.Millisecond, nil
+}
+
+func (q *workQueue) remaining() (int64, error) {
+	n, err := q.client.do("EVAL", remainingScript, "2", q.key("queued"), q.key("leased"))
+	if err != nil {
+		return 0, err
+	}
+	return n.(int64), nil
+}
+
+// ack marks the URL of result as done and adds the result to the stream. A
+// URL that can't be acked is visited again once its lease expires.
+func (q *workQueue) ack(result Result) {
+	if q == nil {
+		return
+	}
+	data, err := json.Marshal(result)
+	if err == nil {
+		_, err = q.client.do("ZREM", q.key("leased"), result.URL)
+	}
+	if err == nil {
+		_, err = q.client.do("XADD", q.key("results"), "MAXLEN", "~", strconv.Itoa(queueResults), "*",
+			"url", result.URL, "result", string(data))
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err != nil {
+		if !q.failed {
+			console.Warn(fmt.Sprintf("Can't ack results in queue %s, their URLs will be visited again: %v", q.name, err),
+				"event", "queue", "queue", q.name, "error", err.Error())
+		}
+		q.failed = true
+		return
+	}
+	q.failed = false
+}
@@ -0,0 +1,102 @@
+package sitehit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// rateBatch is how much of a second's worth of tokens an instance takes from
+// the shared bucket at a time: enough to spare Redis a call per request, and
+// little enough that no instance hoards them.
+const rateBatch = 100 * time.Millisecond
+
+// rateLimiter holds the requests of a run to --rate a second. On its own it
+// spaces them out evenly. With --queue the tokens come from a bucket in
+// Redis that every instance sharing the queue takes batches from, so the
+// instances together stay under the rate.
+type rateLimiter struct {
+	rate     float64
+	interval time.Duration
+	batch    int
+	queue    *workQueue
+
+	mu     sync.Mutex
+	next   time.Time // when the next request may go, without a queue
+	tokens int       // taken from the shared bucket and not spent yet
+	empty  time.Time // until when the shared bucket is known to be empty
+	failed bool      // the last take from the bucket failed, and that was reported
+}
+
+func newRateLimiter(rate float64, queue *workQueue) *rateLimiter {
+	return &rateLimiter{
+		rate:     rate,
+		interval: time.Duration(float64(time.Second) / rate),
+		batch:    max(int(rate*rateBatch.Seconds()), 1),
+		queue:    queue,
+	}
+}
+
+// wait blocks until the next request may go, or returns the error of ctx
+// once it's done.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	for {
+		delay, taken := l.take()
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+		if taken {
+			return nil
+		}
+	}
+}
+
+// take takes a token, which may only be spent after delay, or returns how
+// long until the shared bucket has tokens again. An instance that can't
+// reach the bucket holds itself to the rate alone.
+func (l *rateLimiter) take() (delay time.Duration, taken bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.queue != nil {
+		if l.tokens > 0 {
+			l.tokens--
+			return 0, true
+		}
+		if wait := time.Until(l.empty); wait > 0 {
+			return wait, false
+		}
+		n, wait, err := l.queue.takeTokens(l.rate, l.batch)
+		if err == nil {
+			l.failed = false
+			if n == 0 {
+				l.empty = time.Now().Add(wait)
+				return wait, false
+			}
+			l.tokens = n - 1
+			return 0, true
+		}
+		if !l.failed {
+			console.Warn(fmt.Sprintf("Can't take tokens from queue %s, holding this instance alone to --rate: %v", l.queue.name, err),
+				"event", "queue", "queue", l.queue.name, "error", err.Error())
+		}
+		l.failed = true
+	}
+
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay = l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	return delay, true
+}
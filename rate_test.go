@@ -0,0 +1,136 @@
+package sitehit
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(100, nil)
+	start := time.Now()
+	for range 21 {
+		if err := l.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Errorf("21 requests at 100/s took %v, want about 200ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l = newRateLimiter(1, nil)
+	l.wait(ctx)
+	if err := l.wait(ctx); err != context.Canceled {
+		t.Errorf("wait after cancel = %v, want %v", err, context.Canceled)
+	}
+
+	var none *rateLimiter
+	if err := none.wait(ctx); err != nil {
+		t.Errorf("nil limiter: wait = %v", err)
+	}
+}
+
+// fakeTokens serves the --rate bucket of tokenScript over RESP, as Redis
+// would, counting the EVAL calls.
+func fakeTokens(t *testing.T) (addr string, calls *atomic.Int64) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	calls = new(atomic.Int64)
+	var mu sync.Mutex
+	var tokens float64
+	var at time.Time
+	take := func(rate, burst, n float64) (int64, int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		now := time.Now()
+		if at.IsZero() {
+			tokens, at = burst, now
+		}
+		tokens = math.Min(burst, tokens+now.Sub(at).Seconds()*rate)
+		at = now
+		taken := math.Min(math.Floor(tokens), n)
+		tokens -= taken
+		if taken > 0 {
+			return int64(taken), 0
+		}
+		return 0, int64(math.Ceil((1 - tokens) * 1000 / rate))
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				c := &redisClient{r: bufio.NewReader(conn)}
+				for {
+					cmd, err := c.read()
+					if err != nil {
+						return
+					}
+					args, _ := cmd.([]any)
+					if len(args) != 7 || args[0] != "EVAL" || args[1] != tokenScript || args[3] != "q:tokens" {
+						fmt.Fprintf(conn, "-ERR unexpected %v\r\n", args)
+						continue
+					}
+					calls.Add(1)
+					var rate, burst, n float64
+					fmt.Sscan(args[4].(string)+" "+args[5].(string)+" "+args[6].(string), &rate, &burst, &n)
+					taken, wait := take(rate, burst, n)
+					fmt.Fprintf(conn, "*2\r\n:%d\r\n:%d\r\n", taken, wait)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), calls
+}
+
+func TestRateLimiterShared(t *testing.T) {
+	addr, calls := fakeTokens(t)
+	const rate = 50
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	// Two instances sharing a queue get the rate between them, not each.
+	var sent atomic.Int64
+	var wg sync.WaitGroup
+	for range 2 {
+		q, err := newWorkQueue("redis://"+addr, "q", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := newRateLimiter(rate, q)
+		for range 3 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for l.wait(ctx) == nil {
+					sent.Add(1)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	// 0.5s at 50/s, plus the batch each instance may start with.
+	if n := sent.Load(); n < 15 || n > 25+2*5 {
+		t.Errorf("sent %d requests in 0.5s at %d/s shared, want about 25", n, rate)
+	}
+	if calls.Load() == 0 {
+		t.Error("no tokens taken from the shared bucket")
+	}
+}
@@ -0,0 +1,91 @@
+package sitehit
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+var (
+	errTooManyRedirects = errors.New("too many redirects")
+	errOffSiteRedirect  = errors.New("redirected off-site")
+)
+
+// redirectPolicy returns a CheckRedirect function that follows at most max
+// redirects and, when allowed is not empty, refuses redirects to hosts other
+// than the original one and those listed. An entry like "*.site.nl" allows
+// every subdomain of site.nl. Unless follow is set, no redirect is followed
+// and the redirect itself is the response.
+func redirectPolicy(allowed []string, follow bool, max int) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if !follow {
+			return http.ErrUseLastResponse
+		}
+		if len(via) > max {
+			return fmt.Errorf("%w (--max-redirects %d)", errTooManyRedirects, max)
+		}
+		if len(allowed) == 0 {
+			return nil
+		}
+		host := req.URL.Hostname()
+		if strings.EqualFold(host, via[0].URL.Hostname()) || hostAllowed(host, allowed) {
+			return nil
+		}
+		return fmt.Errorf("%w to %s", errOffSiteRedirect, req.URL)
+	}
+}
+
+func hostAllowed(host string, allowed []string) bool {
+	for _, pattern := range allowed {
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if len(host) > len(suffix) && strings.HasSuffix(strings.ToLower(host), "."+strings.ToLower(suffix)) {
+				return true
+			}
+		} else if strings.EqualFold(host, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// Hop is a response of a redirected URL: one that redirected, or the final
+// one. A redirect that wasn't followed ends the chain with a hop for its
+// target, without a status.
+type Hop struct {
+	URL        string `json:"url"`
+	StatusCode int    `json:"status_code,omitempty"`
+}
+
+// redirectChain returns the hops from the URL first requested to resp, or
+// nil when it wasn't redirected.
+func redirectChain(resp *http.Response) []Hop {
+	if resp.Request == nil {
+		return nil
+	}
+	chain := []Hop{{URL: resp.Request.URL.String(), StatusCode: resp.StatusCode}}
+	for req := resp.Request; req.Response != nil && req.Response.Request != nil; req = req.Response.Request {
+		chain = append(chain, Hop{URL: req.Response.Request.URL.String(), StatusCode: req.Response.StatusCode})
+	}
+	slices.Reverse(chain)
+	if location, err := resp.Location(); err == nil && resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		chain = append(chain, Hop{URL: location.String()})
+	}
+	if len(chain) == 1 {
+		return nil
+	}
+	return chain
+}
+
+// formatChain writes a chain as "301 https://a -> 200 https://b".
+func formatChain(chain []Hop) string {
+	hops := make([]string, len(chain))
+	for i, hop := range chain {
+		hops[i] = hop.URL
+		if hop.StatusCode != 0 {
+			hops[i] = fmt.Sprintf("%d %s", hop.StatusCode, hop.URL)
+		}
+	}
+	return strings.Join(hops, " -> ")
+}
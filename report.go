@@ -0,0 +1,461 @@
+package sitehit
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Summary aggregates the results of a run.
+type Summary struct {
+	Total       int
+	Succeeded   int
+	Failed      int
+	Truncated   int
+	Skipped     int
+	Ignored     int // failed, but listed in --ignore-file
+	HeadOnly    int // found cached by a HEAD with --head-first
+	Redirected  int // whose last response came after a redirect, or was one
+	AverageTime time.Duration
+
+	// AverageTTFB and AverageTransfer split the average over the URLs that
+	// got a response into waiting for the headers and reading the body.
+	AverageTTFB     time.Duration
+	AverageTransfer time.Duration
+
+	// Bytes is the size on the wire of every body received, retries and
+	// assets included, before decoding.
+	Bytes int64
+
+	// Checks counts the passed and failed checks by bundle and kind.
+	Checks []checkTally
+
+	// Keywords counts the pages the keywords of keywords checks were looked
+	// for and found on, by bundle and keyword.
+	Keywords []keywordTally
+
+	// TTL is how long the successful responses may stay cached.
+	TTL ttlSummary
+
+	// Compression is how well their text bodies were compressed.
+	Compression compressionSummary
+
+	// Assets and AssetsFailed count the unique assets requested with
+	// --warm-assets.
+	Assets       int
+	AssetsFailed int
+
+	// PagesAssetsFailed counts the pages with at least one failed asset,
+	// and PagesOverBudget those over a --weight-budget.
+	PagesAssetsFailed int
+	PagesOverBudget   int
+
+	// TooManyRedirects counts the failures that redirected more than
+	// --max-redirects times, most likely in a loop.
+	TooManyRedirects int
+}
+
+func summarize(resultsList []Result) Summary {
+	t := newTally()
+	for _, result := range resultsList {
+		t.add(result)
+	}
+	return t.summary()
+}
+
+// retainModes are the values --retain accepts.
+var retainModes = []string{"all", "failures"}
+
+// retainFailures keeps the results that failed and, when slow is set, those
+// that took longer than slow.
+func retainFailures(slow time.Duration) func(Result) bool {
+	return func(result Result) bool {
+		if result.Skipped {
+			return false
+		}
+		if !result.Success {
+			return true
+		}
+		return slow > 0 && result.Duration > slow
+	}
+}
+
+// tally aggregates results into a Summary as they complete, so a run
+// doesn't have to keep every Result around to report on it.
+type tally struct {
+	counts                              Summary
+	totalTime, totalTTFB, totalTransfer time.Duration
+	responded                           int
+	assets                              map[string]Asset
+	checks                              map[[2]string]checkTally
+	keywords                            map[[2]string]keywordTally
+}
+
+func newTally() *tally {
+	return &tally{assets: map[string]Asset{}, checks: map[[2]string]checkTally{}, keywords: map[[2]string]keywordTally{}}
+}
+
+func (t *tally) add(result Result) {
+	t.counts.Total++
+	// Assets are shared between pages, count each once
+	for _, asset := range result.Assets {
+		if _, ok := t.assets[asset.URL]; !ok {
+			t.assets[asset.URL] = Asset{StatusCode: asset.StatusCode, Bytes: asset.Bytes, wireBytes: asset.wireBytes}
+		}
+	}
+	countChecks(t.checks, result)
+	countKeywords(t.keywords, result)
+	if result.AssetsFailed > 0 {
+		t.counts.PagesAssetsFailed++
+	}
+	if len(result.OverBudget) > 0 {
+		t.counts.PagesOverBudget++
+	}
+	if len(result.RedirectChain) > 0 {
+		t.counts.Redirected++
+	}
+
+	if result.Skipped {
+		t.counts.Skipped++
+		return
+	}
+	t.totalTime += result.Duration
+	for _, attempt := range result.AttemptDetails {
+		t.counts.Bytes += attempt.WireBytes
+	}
+	if result.StatusCode != 0 {
+		t.responded++
+		t.totalTTFB += result.TTFB
+		t.totalTransfer += result.Transfer
+	}
+	switch {
+	case result.Success:
+		t.counts.Succeeded++
+		t.counts.TTL.add(result.TTL)
+		t.counts.Compression.add(result)
+		if result.HeadOnly {
+			t.counts.HeadOnly++
+		}
+	case result.Ignored:
+		t.counts.Ignored++
+	default:
+		t.counts.Failed++
+		if result.ErrorCode() == "TOO_MANY_REDIRECTS" {
+			t.counts.TooManyRedirects++
+		}
+	}
+	if result.Truncated {
+		t.counts.Truncated++
+	}
+}
+
+// merge adds the results tallied by o, as for the roll-up of several sites.
+func (t *tally) merge(o *tally) {
+	for url, asset := range o.assets {
+		if _, ok := t.assets[url]; !ok {
+			t.assets[url] = asset
+		}
+	}
+	t.counts.Total += o.counts.Total
+	t.counts.Succeeded += o.counts.Succeeded
+	t.counts.Failed += o.counts.Failed
+	t.counts.Truncated += o.counts.Truncated
+	t.counts.Skipped += o.counts.Skipped
+	t.counts.Ignored += o.counts.Ignored
+	t.counts.HeadOnly += o.counts.HeadOnly
+	t.counts.Redirected += o.counts.Redirected
+	t.counts.TooManyRedirects += o.counts.TooManyRedirects
+	t.counts.PagesAssetsFailed += o.counts.PagesAssetsFailed
+	t.counts.PagesOverBudget += o.counts.PagesOverBudget
+	t.counts.Bytes += o.counts.Bytes
+	t.counts.TTL.merge(o.counts.TTL)
+	t.counts.Compression.merge(o.counts.Compression)
+	t.totalTime += o.totalTime
+	t.totalTTFB += o.totalTTFB
+	t.totalTransfer += o.totalTransfer
+	t.responded += o.responded
+	for key, c := range o.checks {
+		sum := t.checks[key]
+		sum.Bundle, sum.Kind = c.Bundle, c.Kind
+		sum.Passed += c.Passed
+		sum.Failed += c.Failed
+		t.checks[key] = sum
+	}
+	for key, k := range o.keywords {
+		sum := t.keywords[key]
+		sum.Bundle, sum.Keyword = k.Bundle, k.Keyword
+		sum.Pages += k.Pages
+		sum.Found += k.Found
+		t.keywords[key] = sum
+	}
+}
+
+// summary returns the summary of the results added so far.
+func (t *tally) summary() Summary {
+	summary := t.counts
+	summary.Checks = sortTallies(t.checks)
+	summary.Keywords = sortKeywords(t.keywords)
+	for _, asset := range t.assets {
+		summary.Assets++
+		summary.Bytes += asset.wireBytes
+		if asset.StatusCode != http.StatusOK {
+			summary.AssetsFailed++
+		}
+	}
+	if visited := summary.Total - summary.Skipped; visited > 0 {
+		summary.AverageTime = t.totalTime / time.Duration(visited)
+	}
+	if t.responded > 0 {
+		summary.AverageTTFB = t.totalTTFB / time.Duration(t.responded)
+		summary.AverageTransfer = t.totalTransfer / time.Duration(t.responded)
+	}
+	return summary
+}
+
+// MarshalJSON encodes the summary with durations in milliseconds.
+func (s Summary) MarshalJSON() ([]byte, error) {
+	var ttl *ttlSummary
+	if s.Succeeded > 0 {
+		ttl = &s.TTL
+	}
+	var compression *compressionSummary
+	if s.Compression.Compressed+s.Compression.Uncompressed > 0 {
+		compression = &s.Compression
+	}
+	return json.Marshal(struct {
+		Total             int                 `json:"total"`
+		Succeeded         int                 `json:"succeeded"`
+		Failed            int                 `json:"failed"`
+		Truncated         int                 `json:"truncated"`
+		Skipped           int                 `json:"skipped"`
+		Ignored           int                 `json:"ignored"`
+		HeadOnly          int                 `json:"head_only,omitempty"`
+		Redirected        int                 `json:"redirected,omitempty"`
+		TooManyRedirects  int                 `json:"too_many_redirects,omitempty"`
+		AverageTimeMs     int64               `json:"average_time_ms"`
+		AverageTTFBMs     int64               `json:"average_ttfb_ms"`
+		AverageTransferMs int64               `json:"average_transfer_ms"`
+		Bytes             int64               `json:"bytes"`
+		Checks            []checkTally        `json:"checks,omitempty"`
+		Keywords          []keywordTally      `json:"keywords,omitempty"`
+		TTL               *ttlSummary         `json:"ttl,omitempty"`
+		Compression       *compressionSummary `json:"compression,omitempty"`
+		Assets            int                 `json:"assets,omitempty"`
+		AssetsFailed      int                 `json:"assets_failed,omitempty"`
+		PagesAssetsFailed int                 `json:"pages_assets_failed,omitempty"`
+		PagesOverBudget   int                 `json:"pages_over_budget,omitempty"`
+	}{s.Total, s.Succeeded, s.Failed, s.Truncated, s.Skipped, s.Ignored, s.HeadOnly, s.Redirected, s.TooManyRedirects, s.AverageTime.Milliseconds(), s.AverageTTFB.Milliseconds(), s.AverageTransfer.Milliseconds(), s.Bytes, s.Checks, s.Keywords, ttl, compression, s.Assets, s.AssetsFailed,
+		s.PagesAssetsFailed, s.PagesOverBudget})
+}
+
+// MarshalJSON encodes the result with its duration in milliseconds and its
+// error as a string.
+func (r Result) MarshalJSON() ([]byte, error) {
+	var errText string
+	if r.Error != nil {
+		errText = r.Error.Error()
+	}
+	var contentLength, ttl *int64
+	if r.ContentLength >= 0 {
+		contentLength = &r.ContentLength
+	}
+	if r.TTL >= 0 {
+		seconds := int64(r.TTL.Seconds())
+		ttl = &seconds
+	}
+	return json.Marshal(struct {
+		URL            string            `json:"url"`
+		Success        bool              `json:"success"`
+		Attempts       int               `json:"attempts"`
+		StatusCode     int               `json:"status_code"`
+		ContentLength  *int64            `json:"content_length,omitempty"`
+		BytesRead      int64             `json:"bytes_read"`
+		Truncated      bool              `json:"truncated"`
+		Skipped        bool              `json:"skipped,omitempty"`
+		Ignored        bool              `json:"ignored,omitempty"`
+		HeadOnly       bool              `json:"head_only,omitempty"`
+		Compressed     int64             `json:"compressed_bytes,omitempty"`
+		Compression    string            `json:"compression,omitempty"`
+		CacheStatus    string            `json:"cache_status,omitempty"`
+		TTLSeconds     *int64            `json:"ttl_s,omitempty"`
+		RedirectChain  []Hop             `json:"redirect_chain,omitempty"`
+		Variant        string            `json:"variant,omitempty"`
+		DurationMs     int64             `json:"duration_ms"`
+		TTFBMs         int64             `json:"ttfb_ms"`
+		TransferMs     int64             `json:"transfer_ms"`
+		Error          string            `json:"error,omitempty"`
+		ErrorCode      string            `json:"error_code,omitempty"`
+		Headers        map[string]string `json:"headers,omitempty"`
+		Checks         []CheckResult     `json:"checks,omitempty"`
+		GRPCHealth     string            `json:"grpc_health,omitempty"`
+		GRPCServices   []string          `json:"grpc_services,omitempty"`
+		AttemptDetails []Attempt         `json:"attempt_details"`
+		Assets         []Asset           `json:"assets,omitempty"`
+		PageWeight     int64             `json:"page_weight,omitempty"`
+		AssetsFailed   int               `json:"assets_failed,omitempty"`
+		OverBudget     []string          `json:"over_budget,omitempty"`
+	}{r.URL, r.Success, r.Attempts, r.StatusCode, contentLength, r.BytesRead, r.Truncated, r.Skipped, r.Ignored, r.HeadOnly, r.CompressedBytes, r.Compression, r.CacheStatus, ttl, r.RedirectChain, r.Variant, r.Duration.Milliseconds(), r.TTFB.Milliseconds(), r.Transfer.Milliseconds(), errText, r.ErrorCode(), r.Headers, r.Checks, r.GRPCHealth, r.GRPCServices, r.AttemptDetails, r.Assets,
+		r.PageWeight, r.AssetsFailed, r.OverBudget})
+}
+
+// MarshalJSON encodes the asset with its duration in milliseconds and its
+// error as a string.
+func (a Asset) MarshalJSON() ([]byte, error) {
+	var errText string
+	if a.Error != nil {
+		errText = a.Error.Error()
+	}
+	return json.Marshal(struct {
+		URL        string `json:"url"`
+		Kind       string `json:"kind"`
+		StatusCode int    `json:"status_code"`
+		Bytes      int64  `json:"bytes"`
+		DurationMs int64  `json:"duration_ms"`
+		Error      string `json:"error,omitempty"`
+	}{a.URL, a.Kind, a.StatusCode, a.Bytes, a.Duration.Milliseconds(), errText})
+}
+
+// MarshalJSON encodes the attempt with its duration in milliseconds and its
+// error as a string.
+func (a Attempt) MarshalJSON() ([]byte, error) {
+	var errText string
+	if a.Error != nil {
+		errText = a.Error.Error()
+	}
+	return json.Marshal(struct {
+		StartedAt  time.Time `json:"started_at"`
+		StatusCode int       `json:"status_code"`
+		BytesRead  int64     `json:"bytes_read"`
+		WireBytes  int64     `json:"wire_bytes"`
+		DurationMs int64     `json:"duration_ms"`
+		TTFBMs     int64     `json:"ttfb_ms"`
+		TransferMs int64     `json:"transfer_ms"`
+		Variant    string    `json:"variant,omitempty"`
+		Error      string    `json:"error,omitempty"`
+		ErrorCode  string    `json:"error_code,omitempty"`
+	}{a.StartedAt, a.StatusCode, a.BytesRead, a.WireBytes, a.Duration.Milliseconds(), a.TTFB.Milliseconds(), a.Transfer.Milliseconds(), a.Variant, errText, a.ErrorCode})
+}
+
+func printSummary(title string, summary Summary) {
+	if console.structured() {
+		console.Info(title, "event", "summary", "summary", summary)
+		return
+	}
+	fmt.Printf("\n%s:\n", title)
+	fmt.Printf("Total sites: %d\n", summary.Total)
+	fmt.Printf("Total 200 responses: %d\n", summary.Succeeded)
+	fmt.Printf("Total non-200 responses: %d\n", summary.Failed)
+	if summary.Ignored > 0 {
+		fmt.Printf("\033[33mIgnored failures (--ignore-file): %d\033[0m\n", summary.Ignored)
+	}
+	if summary.Skipped > 0 {
+		fmt.Printf("\033[33mSkipped (over --max-size): %d\033[0m\n", summary.Skipped)
+	}
+	if summary.HeadOnly > 0 {
+		fmt.Printf("Already cached, no GET needed (--head-first): %d\n", summary.HeadOnly)
+	}
+	if summary.Redirected > 0 {
+		fmt.Printf("\033[33mRedirected: %d\033[0m\n", summary.Redirected)
+	}
+	if summary.TooManyRedirects > 0 {
+		fmt.Printf("\033[31mRedirected more than --max-redirects times: %d\033[0m\n", summary.TooManyRedirects)
+	}
+	if summary.Truncated > 0 {
+		fmt.Printf("\033[31mTruncated responses: %d\033[0m\n", summary.Truncated)
+	}
+	fmt.Printf("Average request time: %v\n", summary.AverageTime)
+	fmt.Printf("Average time to first byte: %v, body transfer: %v\n", summary.AverageTTFB, summary.AverageTransfer)
+	fmt.Printf("Transferred: %s\n", formatBytes(summary.Bytes))
+	if summary.Succeeded > 0 {
+		fmt.Printf("Cache TTL: %s\n", summary.TTL)
+	}
+	if c := summary.Compression; c.Compressed+c.Uncompressed > 0 {
+		fmt.Printf("Compression: %s\n", c)
+	}
+	if len(summary.Checks) > 0 {
+		fmt.Println("Checks:")
+		for _, c := range summary.Checks {
+			line := fmt.Sprintf("  %-24s %-8s %6d passed %6d failed", c.Bundle, c.Kind, c.Passed, c.Failed)
+			if c.Failed > 0 {
+				line = "\033[31m" + line + "\033[0m"
+			}
+			fmt.Println(line)
+		}
+	}
+	if len(summary.Keywords) > 0 {
+		fmt.Println("Keyword coverage:")
+		for _, k := range summary.Keywords {
+			line := fmt.Sprintf("  %-24s %-24q %6d of %6d pages (%.0f%%)", k.Bundle, k.Keyword, k.Found, k.Pages, 100*k.coverage())
+			if k.Found < k.Pages {
+				line = "\033[31m" + line + "\033[0m"
+			}
+			fmt.Println(line)
+		}
+	}
+	if summary.Assets > 0 {
+		fmt.Printf("Assets warmed: %d (%d failed)\n", summary.Assets, summary.AssetsFailed)
+	}
+	if summary.PagesAssetsFailed > 0 {
+		fmt.Printf("\033[31mPages with failed assets: %d\033[0m\n", summary.PagesAssetsFailed)
+	}
+	if summary.PagesOverBudget > 0 {
+		fmt.Printf("\033[33mPages over --weight-budget: %d\033[0m\n", summary.PagesOverBudget)
+	}
+}
+
+var sortKeys = []string{"duration", "status", "url"}
+
+// sortResults orders resultsList in place so the most interesting rows come
+// first: the slowest for "duration", failures and then the highest status
+// codes for "status", and alphabetical for "url".
+func sortResults(resultsList []Result, by string) {
+	slices.SortStableFunc(resultsList, func(a, b Result) int {
+		switch by {
+		case "duration":
+			return cmp.Compare(b.Duration, a.Duration)
+		case "status":
+			if a.Success != b.Success {
+				if !a.Success {
+					return -1
+				}
+				return 1
+			}
+			if c := cmp.Compare(b.StatusCode, a.StatusCode); c != 0 {
+				return c
+			}
+		}
+		return cmp.Compare(a.URL, b.URL)
+	})
+}
+
+// printResults lists every result, one line per URL, sorted by the given key.
+func printResults(resultsList []Result, by string) {
+	sorted := slices.Clone(resultsList)
+	sortResults(sorted, by)
+
+	if console.structured() {
+		console.Info("Results", "event", "results", "sort", by, "results", sorted)
+		return
+	}
+
+	fmt.Printf("\nResults (by %s):\n", by)
+	for _, result := range sorted {
+		status := fmt.Sprint(result.StatusCode)
+		if result.Error != nil && result.StatusCode == 0 {
+			status = "ERR"
+		}
+		line := fmt.Sprintf("%-4s %10v  %d attempts  %s", status, result.Duration.Round(time.Millisecond), result.Attempts, result.URL)
+		if result.Success {
+			fmt.Println(line)
+		} else {
+			fmt.Printf("\033[31m%s\033[0m\n", line)
+		}
+		for _, name := range slices.Sorted(maps.Keys(result.Headers)) {
+			fmt.Printf("     %s: %s\n", name, result.Headers[name])
+		}
+	}
+}
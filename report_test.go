@@ -0,0 +1,58 @@
+package sitehit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTallyBytesOnTheWire(t *testing.T) {
+	page := []byte(`<html><head><link rel="stylesheet" href="/site.css"></head><body>` + strings.Repeat("warm caches ", 2000) + `</body></html>`)
+	css := []byte(strings.Repeat("body { margin: 0 } ", 1000))
+	gzipped := func(b []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(b)
+		zw.Close()
+		return buf.Bytes()
+	}
+	wirePage, wireCSS := gzipped(page), gzipped(css)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, wire, contentType := page, wirePage, "text/html"
+		if r.URL.Path == "/site.css" {
+			body, wire, contentType = css, wireCSS, "text/css"
+		}
+		w.Header().Set("Content-Type", contentType)
+		if r.Header.Get("Accept-Encoding") == "gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			body = wire
+		}
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	opts := Options{Client: srv.Client(), WarmAssets: []string{"css"}, assets: newAssetCache(), log: &logger{out: io.Discard}}
+	result := processURL(context.Background(), srv.URL+"/", opts)
+	if !result.Success {
+		t.Fatalf("visiting the page failed: %v", result.Error)
+	}
+	if result.BytesRead != int64(len(page)) {
+		t.Errorf("%d bytes read, want the decoded %d", result.BytesRead, len(page))
+	}
+
+	tally := newTally()
+	tally.add(result)
+	summary := tally.summary()
+	if summary.Assets != 1 {
+		t.Fatalf("%d assets warmed, want the stylesheet", summary.Assets)
+	}
+	if want := int64(len(wirePage) + len(wireCSS)); summary.Bytes != want {
+		t.Errorf("summary bytes = %d, want the %d on the wire, not the %d decoded", summary.Bytes, want, len(page)+len(css))
+	}
+}
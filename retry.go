@@ -0,0 +1,186 @@
+package sitehit
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultRetryDelay is the wait between attempts when no rule matches.
+const defaultRetryDelay = time.Second
+
+// defaultRetryOn are the failures retried when --retry-on isn't given: the
+// transient ones, not a 404 that will be there on the next attempt too.
+var defaultRetryOn = []string{"error", "429", "5xx"}
+
+// retryRule sets the wait before retrying a response with a given status.
+type retryRule struct {
+	status string // "429", "5xx" or "error" for requests that got no response
+	delay  time.Duration
+	factor float64 // the delay is multiplied by this after every retry
+	none   bool    // don't retry at all
+}
+
+// retryRules is a repeatable flag of STATUS=DELAY rules, such as "502=200ms",
+// "429=30s*2" for a delay doubling on each retry, or "4xx=none".
+type retryRules []retryRule
+
+func (r *retryRules) String() string {
+	if r == nil {
+		return ""
+	}
+	parts := make([]string, len(*r))
+	for i, rule := range *r {
+		switch {
+		case rule.none:
+			parts[i] = rule.status + "=none"
+		case rule.factor != 1:
+			parts[i] = fmt.Sprintf("%s=%v*%g", rule.status, rule.delay, rule.factor)
+		default:
+			parts[i] = fmt.Sprintf("%s=%v", rule.status, rule.delay)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (r *retryRules) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		status, delay, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return fmt.Errorf("invalid retry rule %q: want STATUS=DELAY", part)
+		}
+		status = strings.ToLower(strings.TrimSpace(status))
+		if !validRetryStatus(status) {
+			return fmt.Errorf("invalid retry rule %q: status must be a code like 429, a class like 5xx, or error", part)
+		}
+
+		rule := retryRule{status: status, factor: 1}
+		delay = strings.TrimSpace(delay)
+		if delay == "none" {
+			rule.none = true
+		} else {
+			if d, f, ok := strings.Cut(delay, "*"); ok {
+				factor, err := strconv.ParseFloat(f, 64)
+				if err != nil || factor < 1 {
+					return fmt.Errorf("invalid retry rule %q: backoff factor must be a number of at least 1", part)
+				}
+				delay, rule.factor = d, factor
+			}
+			d, err := time.ParseDuration(delay)
+			if err != nil {
+				return fmt.Errorf("invalid retry rule %q: %w", part, err)
+			}
+			rule.delay = d
+		}
+		*r = append(*r, rule)
+	}
+	return nil
+}
+
+func validRetryStatus(status string) bool {
+	if status == "error" {
+		return true
+	}
+	if len(status) != 3 || status[0] < '1' || status[0] > '5' {
+		return false
+	}
+	if status[1:] == "xx" {
+		return true
+	}
+	_, err := strconv.Atoi(status)
+	return err == nil
+}
+
+// retryAfter returns the wait a 429 or 503 asks for in its Retry-After
+// header, as seconds or a date, capped at maxWait; 0 when it asks none.
+func retryAfter(resp *http.Response, maxWait time.Duration, now time.Time) time.Duration {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+	value := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if value == "" {
+		return 0
+	}
+	var wait time.Duration
+	if secs, err := strconv.Atoi(value); err == nil {
+		wait = time.Duration(secs) * time.Second
+	} else if at, err := http.ParseTime(value); err == nil {
+		wait = at.Sub(now)
+	}
+	return min(max(wait, 0), maxWait)
+}
+
+// retryable reports whether a failure with status, 0 when there was no
+// response or its body was cut short, matches a code, class or "error" of
+// on. Every failure is retryable when on is empty.
+func retryable(on []string, status int) bool {
+	if len(on) == 0 {
+		return true
+	}
+	key, class := "error", ""
+	if status != 0 {
+		key = strconv.Itoa(status)
+		class = key[:1] + "xx"
+	}
+	for _, s := range on {
+		if s == key || s == class {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns how long to wait before retrying after attempt got status,
+// with 0 meaning the request failed without a response. It returns false when
+// the status shouldn't be retried. An exact code takes precedence over its
+// class; later rules override earlier ones. Statuses no rule matches wait
+// defaultRetryDelay, multiplied by backoff after every retry. Waits are
+// capped at maxWait, when positive, and those that grow get jitter.
+func (r retryRules) delay(status, attempt int, backoff float64, maxWait time.Duration) (time.Duration, bool) {
+	key, class := "error", ""
+	if status != 0 {
+		key = strconv.Itoa(status)
+		class = key[:1] + "xx"
+	}
+
+	var exact, byClass *retryRule
+	for i := range r {
+		switch r[i].status {
+		case key:
+			exact = &r[i]
+		case class:
+			byClass = &r[i]
+		}
+	}
+	match := exact
+	if match == nil {
+		match = byClass
+	}
+	if match == nil {
+		match = &retryRule{delay: defaultRetryDelay, factor: max(backoff, 1)}
+	}
+	if match.none {
+		return 0, false
+	}
+	d := float64(match.delay)
+	for i := 1; i < attempt; i++ {
+		d *= match.factor
+	}
+	wait := time.Duration(d)
+	if maxWait > 0 {
+		wait = min(wait, maxWait)
+	}
+	return jitter(wait, match.factor), true
+}
+
+// jitter spreads a wait that grows with every retry over its upper half, so
+// workers whose requests failed together don't retry in lockstep.
+func jitter(wait time.Duration, factor float64) time.Duration {
+	if factor <= 1 || wait < 2 {
+		return wait
+	}
+	return wait/2 + rand.N(wait-wait/2)
+}
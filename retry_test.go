@@ -0,0 +1,261 @@
+package sitehit
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidRetryStatus(t *testing.T) {
+	tests := []struct {
+		status string
+		want   bool
+	}{
+		{"error", true},
+		{"429", true},
+		{"200", true},
+		{"5xx", true},
+		{"1xx", true},
+		{"6xx", false},
+		{"0xx", false},
+		{"600", false},
+		{"42", false},
+		{"4290", false},
+		{"4x9", false},
+		{"x5x", false},
+		{"ERROR", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := validRetryStatus(tt.status); got != tt.want {
+			t.Errorf("validRetryStatus(%q) = %t, want %t", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		status  int
+		header  string
+		maxWait time.Duration
+		want    time.Duration
+	}{
+		{"seconds", 429, "30", time.Minute, 30 * time.Second},
+		{"seconds capped", 429, "120", time.Minute, time.Minute},
+		{"seconds with spaces", 503, " 5 ", time.Minute, 5 * time.Second},
+		{"date", 503, now.Add(10 * time.Second).Format(http.TimeFormat), time.Minute, 10 * time.Second},
+		{"date capped", 429, now.Add(time.Hour).Format(http.TimeFormat), time.Minute, time.Minute},
+		{"date passed", 429, now.Add(-time.Hour).Format(http.TimeFormat), time.Minute, 0},
+		{"negative seconds", 429, "-5", time.Minute, 0},
+		{"garbage", 429, "soon", time.Minute, 0},
+		{"no header", 429, "", time.Minute, 0},
+		{"other status", 500, "30", time.Minute, 0},
+		{"ignored", 429, "30", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+			if tt.header != "" {
+				resp.Header.Set("Retry-After", tt.header)
+			}
+			if got := retryAfter(resp, tt.maxWait, now); got != tt.want {
+				t.Errorf("retryAfter(%d, %q, %v) = %v, want %v", tt.status, tt.header, tt.maxWait, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    string
+		status   int
+		attempt  int
+		backoff  float64
+		maxWait  time.Duration
+		min, max time.Duration // the wait is in [min, max], jitter included
+		retry    bool
+	}{
+		{"default", "", 500, 1, 1, 0, time.Second, time.Second, true},
+		{"default stays without backoff", "", 500, 3, 1, 0, time.Second, time.Second, true},
+		{"default backoff", "", 500, 3, 2, 0, 2 * time.Second, 4 * time.Second, true},
+		{"default backoff capped", "", 500, 5, 2, 3 * time.Second, 1500 * time.Millisecond, 3 * time.Second, true},
+		{"exact code", "502=200ms", 502, 1, 1, 0, 200 * time.Millisecond, 200 * time.Millisecond, true},
+		{"class", "5xx=2s", 503, 1, 1, 0, 2 * time.Second, 2 * time.Second, true},
+		{"exact beats class", "503=100ms,5xx=2s", 503, 1, 1, 0, 100 * time.Millisecond, 100 * time.Millisecond, true},
+		{"class for other codes", "503=100ms,5xx=2s", 502, 1, 1, 0, 2 * time.Second, 2 * time.Second, true},
+		{"later rule wins", "502=1s,502=3s", 502, 1, 1, 0, 3 * time.Second, 3 * time.Second, true},
+		{"error", "error=300ms", 0, 1, 1, 0, 300 * time.Millisecond, 300 * time.Millisecond, true},
+		{"rule ignores backoff", "429=30s", 429, 3, 2, 0, 30 * time.Second, 30 * time.Second, true},
+		{"rule factor", "429=10s*2", 429, 3, 1, 0, 20 * time.Second, 40 * time.Second, true},
+		{"rule capped", "429=30s", 429, 1, 1, 10 * time.Second, 10 * time.Second, 10 * time.Second, true},
+		{"rule factor capped", "429=10s*2", 429, 3, 1, 15 * time.Second, 7500 * time.Millisecond, 15 * time.Second, true},
+		{"none", "4xx=none", 404, 1, 1, 0, 0, 0, false},
+		{"none leaves other classes", "4xx=none", 500, 1, 1, 0, time.Second, time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rules retryRules
+			if tt.rules != "" {
+				if err := rules.Set(tt.rules); err != nil {
+					t.Fatalf("Set(%q): %v", tt.rules, err)
+				}
+			}
+			// Jitter is random, so sample it enough to leave the range
+			for range 100 {
+				got, retry := rules.delay(tt.status, tt.attempt, tt.backoff, tt.maxWait)
+				if retry != tt.retry {
+					t.Fatalf("delay(%d, %d) retries = %t, want %t", tt.status, tt.attempt, retry, tt.retry)
+				}
+				if got < tt.min || got > tt.max {
+					t.Fatalf("delay(%d, %d) = %v, want between %v and %v", tt.status, tt.attempt, got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryRulesSet(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"502=200ms", "502=200ms", false},
+		{"429=30s*2, 4XX=none", "429=30s*2,4xx=none", false},
+		{"error=1s", "error=1s", false},
+		{"502", "", true},
+		{"6xx=1s", "", true},
+		{"429=soon", "", true},
+		{"429=1s*0.5", "", true},
+		{"429=1s*x", "", true},
+	}
+	for _, tt := range tests {
+		var rules retryRules
+		err := rules.Set(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Set(%q) error = %v, want error %t", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got := rules.String(); !tt.wantErr && got != tt.want {
+			t.Errorf("Set(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	// Gaps may overrun their wait by this much on a busy machine, still far
+	// below the second that an uncapped wait would take
+	const slack = 250 * time.Millisecond
+	tests := []struct {
+		name       string
+		status     int    // of the failing responses
+		failures   int    // responses failing before a 200
+		retryAfter string // Retry-After of the failing responses
+		opts       Options
+		rules      string
+
+		attempts int
+		success  bool
+		minGap   time.Duration
+		maxGap   time.Duration
+	}{
+		{
+			name: "retried until success", status: 500, failures: 2,
+			opts: Options{Retries: 2, RetryOn: defaultRetryOn}, rules: "5xx=20ms",
+			attempts: 3, success: true, minGap: 20 * time.Millisecond, maxGap: 20 * time.Millisecond,
+		},
+		{
+			name: "gives up after the retries", status: 500, failures: 5,
+			opts: Options{Retries: 2, RetryOn: defaultRetryOn}, rules: "5xx=10ms",
+			attempts: 3, minGap: 10 * time.Millisecond, maxGap: 10 * time.Millisecond,
+		},
+		{
+			name: "status not retried", status: 404, failures: 1,
+			opts:     Options{Retries: 2, RetryOn: defaultRetryOn},
+			attempts: 1,
+		},
+		{
+			name: "status retried with --retry-on", status: 404, failures: 1,
+			opts: Options{Retries: 2, RetryOn: []string{"404"}}, rules: "404=10ms",
+			attempts: 2, success: true, minGap: 10 * time.Millisecond, maxGap: 10 * time.Millisecond,
+		},
+		{
+			name: "rule of none", status: 503, failures: 1,
+			opts: Options{Retries: 2, RetryOn: defaultRetryOn}, rules: "5xx=none",
+			attempts: 1,
+		},
+		{
+			name: "backoff capped by --retry-max-wait", status: 502, failures: 2,
+			opts:     Options{Retries: 3, RetryOn: defaultRetryOn, RetryBackoff: 4, RetryMaxWait: 30 * time.Millisecond},
+			attempts: 3, success: true, minGap: 15 * time.Millisecond, maxGap: 30 * time.Millisecond,
+		},
+		{
+			name: "rule factor capped by --retry-max-wait", status: 500, failures: 3,
+			opts: Options{Retries: 3, RetryOn: defaultRetryOn, RetryMaxWait: 40 * time.Millisecond}, rules: "500=20ms*3",
+			attempts: 4, success: true, minGap: 10 * time.Millisecond, maxGap: 40 * time.Millisecond,
+		},
+		{
+			name: "Retry-After capped by --max-retry-after", status: 429, failures: 1, retryAfter: "5",
+			opts: Options{Retries: 1, RetryOn: defaultRetryOn, MaxRetryAfter: 50 * time.Millisecond}, rules: "429=1ms",
+			attempts: 2, success: true, minGap: 50 * time.Millisecond, maxGap: 50 * time.Millisecond,
+		},
+		{
+			name: "Retry-After ignored", status: 503, failures: 1, retryAfter: "5",
+			opts: Options{Retries: 1, RetryOn: defaultRetryOn}, rules: "503=10ms",
+			attempts: 2, success: true, minGap: 10 * time.Millisecond, maxGap: 10 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var times []time.Time
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				times = append(times, time.Now())
+				n := len(times)
+				mu.Unlock()
+				if n > tt.failures {
+					w.Write([]byte("ok"))
+					return
+				}
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			opts := tt.opts
+			opts.Client = srv.Client()
+			opts.log = &logger{out: io.Discard}
+			if tt.rules != "" {
+				if err := opts.retryDelay.Set(tt.rules); err != nil {
+					t.Fatalf("Set(%q): %v", tt.rules, err)
+				}
+			}
+			result := processURL(context.Background(), srv.URL+"/page", opts)
+
+			if result.Attempts != tt.attempts || len(times) != tt.attempts {
+				t.Fatalf("%d attempts, %d requests, want %d", result.Attempts, len(times), tt.attempts)
+			}
+			if result.Success != tt.success {
+				t.Errorf("success = %t, want %t", result.Success, tt.success)
+			}
+			if !tt.success && result.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", result.StatusCode, tt.status)
+			}
+			for i := 1; i < len(times); i++ {
+				if gap := times[i].Sub(times[i-1]); gap < tt.minGap || gap > tt.maxGap+slack {
+					t.Errorf("wait before attempt %d = %v, want between %v and %v", i+1, gap, tt.minGap, tt.maxGap)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package sitehit
+
+import (
+	"bufio"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strings"
+)
+
+// isSiteRoot reports whether sitemapURL names a site rather than a sitemap:
+// an http(s) URL without a path, such as https://example.com/.
+func isSiteRoot(sitemapURL string) bool {
+	if !isRemote(sitemapURL) {
+		return false
+	}
+	u, err := neturl.Parse(sitemapURL)
+	return err == nil && (u.Path == "" || u.Path == "/") && u.RawQuery == ""
+}
+
+// discoverSitemaps reads the Sitemap: directives of the site's robots.txt
+// and returns them as a sitemap index, so they are fetched and merged like
+// the children of one. Without any it falls back to /sitemap.xml.
+func discoverSitemaps(ctx context.Context, siteURL string, opts Options) (*sitemapDocument, error) {
+	u, err := neturl.Parse(siteURL)
+	if err != nil {
+		return nil, err
+	}
+	root := u.Scheme + "://" + u.Host
+	resp, err := opts.get(ctx, root+"/robots.txt")
+	if err != nil {
+		return nil, fmt.Errorf("fetching robots.txt: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var sitemaps []Url
+	if resp.StatusCode == http.StatusOK {
+		scanner := bufio.NewScanner(io.LimitReader(resp.Body, maxSitemapSize))
+		for scanner.Scan() {
+			line, _, _ := strings.Cut(scanner.Text(), "#")
+			name, value, ok := strings.Cut(line, ":")
+			if value = strings.TrimSpace(value); ok && value != "" && strings.EqualFold(strings.TrimSpace(name), "sitemap") {
+				sitemaps = append(sitemaps, Url{Loc: value})
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("reading robots.txt: %w", err)
+		}
+	}
+
+	if len(sitemaps) == 0 {
+		opts.logger().Warn(fmt.Sprintf("No sitemaps listed in %s/robots.txt (status %d), trying %s/sitemap.xml", root, resp.StatusCode, root),
+			"event", "robots", "site", root, "status", resp.StatusCode, "sitemaps", 0)
+		sitemaps = []Url{{Loc: root + "/sitemap.xml"}}
+	} else {
+		opts.logger().Info(fmt.Sprintf("Found %d sitemaps in %s/robots.txt", len(sitemaps), root),
+			"event", "robots", "site", root, "status", resp.StatusCode, "sitemaps", len(sitemaps))
+	}
+	return &sitemapDocument{XMLName: xml.Name{Local: "sitemapindex"}, Sitemaps: sitemaps}, nil
+}
+
+// robotsRules are the Allow and Disallow lines of robots.txt that apply to
+// a crawler.
+type robotsRules struct {
+	allow, disallow []string
+}
+
+// parseRobots returns the rules of the groups of robots.txt for agent, or
+// of the * groups when none names it, the way Google picks them.
+func parseRobots(r io.Reader, agent string) robotsRules {
+	var named, wildcard robotsRules
+	var agents []string
+	inRules := false // the User-agent lines of a group are over
+	scanner := bufio.NewScanner(io.LimitReader(r, maxSitemapSize))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		switch key {
+		case "user-agent":
+			if inRules {
+				agents, inRules = nil, false
+			}
+			agents = append(agents, strings.ToLower(value))
+		case "allow", "disallow":
+			inRules = true
+			if value == "" {
+				continue
+			}
+			for _, a := range agents {
+				rules := &wildcard
+				if a == agent {
+					rules = &named
+				} else if a != "*" {
+					continue
+				}
+				if key == "allow" {
+					rules.allow = append(rules.allow, value)
+				} else {
+					rules.disallow = append(rules.disallow, value)
+				}
+			}
+		}
+	}
+	if len(named.allow) > 0 || len(named.disallow) > 0 {
+		return named
+	}
+	return wildcard
+}
+
+// allowed reports whether path, with its query, may be crawled: the longest
+// matching rule wins, and Allow wins a tie.
+func (r robotsRules) allowed(path string) bool {
+	longest := func(patterns []string) int {
+		n := -1
+		for _, p := range patterns {
+			if len(p) > n && robotsMatch(p, path) {
+				n = len(p)
+			}
+		}
+		return n
+	}
+	return longest(r.allow) >= longest(r.disallow)
+}
+
+// robotsMatch reports whether path matches a robots.txt pattern, in which *
+// matches any characters and a trailing $ the end of the path.
+func robotsMatch(pattern, path string) bool {
+	pattern, anchored := strings.CutSuffix(pattern, "$")
+	parts := strings.Split(pattern, "*")
+	if anchored {
+		last := parts[len(parts)-1]
+		if !strings.HasSuffix(path, last) {
+			return false
+		}
+		if len(parts) == 1 {
+			return path == last
+		}
+		path, parts = path[:len(path)-len(last)], parts[:len(parts)-1]
+	}
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	path = path[len(parts[0]):]
+	for _, part := range parts[1:] {
+		i := strings.Index(path, part)
+		if i < 0 {
+			return false
+		}
+		path = path[i+len(part):]
+	}
+	return true
+}
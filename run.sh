@@ -1 +1 @@
-go run main.go  --batch 10 https://www.site.nl/sitemap.xml
\ No newline at end of file
+go run ./cmd/sitehit  --batch 10 https://www.site.nl/sitemap.xml
\ No newline at end of file
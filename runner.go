@@ -0,0 +1,155 @@
+package sitehit
+
+import (
+	"cmp"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Runner visits the URLs of a sitemap with the fetching, retry and check
+// logic of the command, for tools that embed sitehit.
+type Runner struct {
+	Options
+
+	// Output receives the text output of every URL as it's visited; it is
+	// discarded if nil.
+	Output io.Writer
+}
+
+// NewRunner returns a Runner with the defaults of the command's flags, set
+// up further by options.
+func NewRunner(options ...Option) (*Runner, error) {
+	r := &Runner{Options: Options{
+		BatchSize:      1,
+		SitemapWorkers: 4,
+		SitemapDepth:   3,
+		InputFormat:    "auto",
+		SampleWeight:   "uniform",
+		Oversize:       "skip",
+		Retries:        2,
+		RetryOn:        defaultRetryOn,
+		RetryBackoff:   1,
+		MaxRetryAfter:  time.Minute,
+		StaleSitemap:   "fail",
+		UserAgent:      DefaultUserAgent,
+	}}
+	for _, option := range options {
+		if err := option(r); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// An Option sets up what a Runner takes in the syntax of a command-line
+// flag rather than as a field of Options. Options of the same kind add up,
+// as repeating the flag does.
+type Option func(*Runner) error
+
+// flagOption returns an Option setting value as the flag name does.
+func flagOption(name string, value func(*Runner) flag.Value, s string) Option {
+	return func(r *Runner) error {
+		if err := value(r).Set(s); err != nil {
+			return fmt.Errorf("invalid --%s %q: %w", name, s, err)
+		}
+		return nil
+	}
+}
+
+// ExpectHeader requires every response to carry a header matching a
+// regexp, given as "NAME: REGEXP" like --expect-header.
+func ExpectHeader(spec string) Option {
+	return flagOption("expect-header", func(r *Runner) flag.Value { return &r.expectHeader }, spec)
+}
+
+// ExpectLanguage requires the URLs matching a regexp to declare a language,
+// given as REGEXP=LANG like --expect-language.
+func ExpectLanguage(rule string) Option {
+	return flagOption("expect-language", func(r *Runner) flag.Value { return &r.expectLanguage }, rule)
+}
+
+// ExpectCharset requires the URLs matching a regexp to declare a charset,
+// given as REGEXP=CHARSET like --expect-charset.
+func ExpectCharset(rule string) Option {
+	return flagOption("expect-charset", func(r *Runner) flag.Value { return &r.expectCharset }, rule)
+}
+
+// ExpectRedirect requires the URLs matching a regexp to redirect to a
+// target, given as REGEXP=>TARGET like --expect-redirect.
+func ExpectRedirect(rule string) Option {
+	return flagOption("expect-redirect", func(r *Runner) flag.Value { return &r.expectRedirect }, rule)
+}
+
+// ExpectKeywords requires the visible text of the URLs matching a regexp to
+// contain keywords, given as REGEXP=KEYWORD,KEYWORD like --expect-keywords.
+func ExpectKeywords(rule string) Option {
+	return flagOption("expect-keywords", func(r *Runner) flag.Value { return &r.expectKeywords }, rule)
+}
+
+// GRPC checks the URLs matching a regexp with the gRPC health protocol,
+// given as REGEXP=grpc or REGEXP=grpc-web like --grpc.
+func GRPC(rule string) Option {
+	set := flagOption("grpc", func(r *Runner) flag.Value { return &r.grpc }, rule)
+	return func(r *Runner) error {
+		if err := set(r); err != nil {
+			return err
+		}
+		if mode := r.grpc[len(r.grpc)-1].value; !slices.Contains(grpcModes, mode) {
+			return fmt.Errorf("invalid --grpc mode %q: must be one of %s", mode, strings.Join(grpcModes, ", "))
+		}
+		return nil
+	}
+}
+
+// WeightBudget flags the pages weighing more than a size with their
+// WarmAssets, or whose assets of a kind do, given like --weight-budget.
+func WeightBudget(budget string) Option {
+	return flagOption("weight-budget", func(r *Runner) flag.Value { return &r.weightBudget }, budget)
+}
+
+// Sample visits only a random sample of the sitemap, given as a number of
+// URLs or a percentage like --sample, weighted by SampleWeight.
+func Sample(size string) Option {
+	return flagOption("sample", func(r *Runner) flag.Value { return &r.sample }, size)
+}
+
+// RetryDelay sets the wait between attempts per status, given as
+// STATUS=DELAY like --retry-delay.
+func RetryDelay(rule string) Option {
+	return flagOption("retry-delay", func(r *Runner) flag.Value { return &r.retryDelay }, rule)
+}
+
+// Run visits every URL of the sitemap at sitemapURL, which may also be a
+// local file, and returns the results along with their summary. Results
+// are in completion order, and only those Retain keeps when it's set.
+// Cancelling ctx aborts the run, returning what was visited so far.
+func (r *Runner) Run(ctx context.Context, sitemapURL string) ([]Result, Summary, error) {
+	opts := r.Options
+	opts.BatchSize = max(opts.BatchSize, 1)
+	opts.log = &logger{out: io.Discard}
+	if r.Output != nil {
+		opts.log = &logger{out: r.Output}
+	}
+
+	opts.checks = flagChecks(opts)
+	if len(opts.grpc) > 0 {
+		opts.grpcClient = grpcClient(cmp.Or(opts.Client, http.DefaultClient))
+	}
+
+	sm, err := fetchSitemap(ctx, sitemapURL, opts)
+	if err != nil {
+		return nil, Summary{}, err
+	}
+	if err := checkSitemap(sm, opts); err != nil {
+		return nil, Summary{}, err
+	}
+	urls, opts := prepareEntries(uniqueEntries(sm.URLs), opts)
+	resultsList, t := runURLs(ctx, urls, opts)
+	return resultsList, t.summary(), nil
+}
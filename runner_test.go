@@ -0,0 +1,83 @@
+package sitehit
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunnerRun(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Method+" "+r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/sitemap.xml":
+			w.Header().Set("Last-Modified", time.Now().Add(-48*time.Hour).UTC().Format(http.TimeFormat))
+			w.Write([]byte(`<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9"
+	xmlns:sitehit="https://github.com/jeroensmink98/sitehit/sitemap/1.0">
+  <url><loc>` + srv.URL + `/page</loc></url>
+  <url><loc>` + srv.URL + `/page</loc></url>
+  <url>
+    <loc>` + srv.URL + `/orders</loc>
+    <sitehit:request method="POST" status="201"><sitehit:body>{}</sitehit:body></sitehit:request>
+  </url>
+</urlset>`))
+		case "/orders":
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		maxAge   time.Duration
+		stale    string
+		wantErr  bool
+		requests map[string]int
+	}{
+		{"sitemap extension", 0, "fail", false, map[string]int{"GET /sitemap.xml": 1, "GET /page": 1, "POST /orders": 1}},
+		{"fresh sitemap", 72 * time.Hour, "fail", false, map[string]int{"GET /sitemap.xml": 1, "GET /page": 1, "POST /orders": 1}},
+		{"stale sitemap", 24 * time.Hour, "fail", true, map[string]int{"GET /sitemap.xml": 1}},
+		{"stale sitemap warned", 24 * time.Hour, "warn", false, map[string]int{"GET /sitemap.xml": 1, "GET /page": 1, "POST /orders": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clear(requests)
+			r, err := NewRunner()
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Client = srv.Client()
+			r.MaxSitemapAge, r.StaleSitemap = tt.maxAge, tt.stale
+
+			results, summary, err := r.Run(context.Background(), srv.URL+"/sitemap.xml")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Run error = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "sitemap") {
+				t.Errorf("Run error = %v, want the sitemap to be stale", err)
+			}
+			if !tt.wantErr && (summary.Total != 2 || summary.Succeeded != 2 || len(results) != 2) {
+				t.Errorf("%d of %d URLs succeeded, %d results, want 2 of 2", summary.Succeeded, summary.Total, len(results))
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !maps.Equal(requests, tt.requests) {
+				t.Errorf("requests = %v, want %v", requests, tt.requests)
+			}
+		})
+	}
+}
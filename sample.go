@@ -0,0 +1,107 @@
+package sitehit
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sampleSize is the --sample flag: a number of URLs, or a percentage of the
+// sitemap when it ends in "%".
+type sampleSize struct {
+	count   int
+	percent float64
+}
+
+func (s *sampleSize) String() string {
+	switch {
+	case s == nil:
+		return ""
+	case s.percent > 0:
+		return strconv.FormatFloat(s.percent, 'g', -1, 64) + "%"
+	case s.count > 0:
+		return strconv.Itoa(s.count)
+	default:
+		return ""
+	}
+}
+
+func (s *sampleSize) Set(value string) error {
+	if p, ok := strings.CutSuffix(value, "%"); ok {
+		percent, err := strconv.ParseFloat(p, 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return fmt.Errorf("invalid percentage %q", value)
+		}
+		*s = sampleSize{percent: percent}
+		return nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 {
+		return fmt.Errorf("invalid sample size %q: want a number of URLs or a percentage", value)
+	}
+	*s = sampleSize{count: count}
+	return nil
+}
+
+// of returns how many of total entries to sample, 0 meaning all of them.
+func (s sampleSize) of(total int) int {
+	if s.percent > 0 {
+		return max(1, int(math.Round(float64(total)*s.percent/100)))
+	}
+	return s.count
+}
+
+var sampleWeights = []string{"uniform", "priority", "lastmod"}
+
+// sampleWeight returns how likely entry is to be picked relative to the
+// others when sampling by weighting.
+func sampleWeight(entry Url, weighting string, now time.Time) float64 {
+	switch weighting {
+	case "priority":
+		// Keep priority 0 pages possible, just unlikely
+		return max(entry.PriorityValue(), 0.01)
+	case "lastmod":
+		// Halve the weight with every 30 days since the last change; pages
+		// without a lastmod count as a year old
+		age := 365.0
+		if t, ok := entry.LastModTime(); ok {
+			age = max(now.Sub(t).Hours()/24, 0)
+		}
+		return math.Exp2(-age / 30)
+	default:
+		return 1
+	}
+}
+
+// sample picks n of the entries at random without replacement, each with a
+// probability proportional to its weight, keeping their sitemap order.
+func sample(entries []Url, n int, weighting string) []Url {
+	if n <= 0 || n >= len(entries) {
+		return entries
+	}
+
+	// Efraimidis-Spirakis: the n largest u^(1/w) form a weighted sample
+	type keyed struct {
+		index int
+		key   float64
+	}
+	now := time.Now()
+	keys := make([]keyed, len(entries))
+	for i, entry := range entries {
+		keys[i] = keyed{i, math.Pow(rand.Float64(), 1/sampleWeight(entry, weighting, now))}
+	}
+	slices.SortFunc(keys, func(a, b keyed) int { return cmp.Compare(b.key, a.key) })
+
+	picked := keys[:n]
+	slices.SortFunc(picked, func(a, b keyed) int { return cmp.Compare(a.index, b.index) })
+	sampled := make([]Url, n)
+	for i, k := range picked {
+		sampled[i] = entries[k.index]
+	}
+	return sampled
+}
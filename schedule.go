@@ -0,0 +1,131 @@
+package sitehit
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// timeWindow is a daily span of time from start up to end, in minutes after
+// midnight. A window ending before it starts runs past midnight.
+type timeWindow struct {
+	start, end int
+}
+
+func (w timeWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.start/60, w.start%60, w.end/60, w.end%60)
+}
+
+func (w timeWindow) contains(minute int) bool {
+	if w.start <= w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+// timeWindows is a flag of comma-separated HH:MM-HH:MM windows.
+type timeWindows []timeWindow
+
+func (l *timeWindows) String() string {
+	parts := make([]string, len(*l))
+	for i, w := range *l {
+		parts[i] = w.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *timeWindows) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(part, "-")
+		if !ok {
+			return fmt.Errorf("%q: want HH:MM-HH:MM", part)
+		}
+		start, err := parseClock(from)
+		if err != nil {
+			return err
+		}
+		end, err := parseClock(to)
+		if err != nil {
+			return err
+		}
+		if start == end {
+			return fmt.Errorf("%q: window is empty", part)
+		}
+		*l = append(*l, timeWindow{start: start, end: end})
+	}
+	return nil
+}
+
+// parseClock parses HH:MM into minutes after midnight. 24:00 is midnight at
+// the end of the day.
+func parseClock(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "24:00" {
+		return 0, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// schedule decides when --daemon may run: inside one of the allowed windows,
+// if any, and outside of the quiet hours, both in loc.
+type schedule struct {
+	allowed timeWindows
+	quiet   timeWindows
+	loc     *time.Location
+}
+
+// scheduleHorizon is how far ahead the schedule is searched; every day has
+// the same windows, so a day and a bit covers them all.
+const scheduleHorizon = 25 * time.Hour
+
+func (s schedule) restricted() bool {
+	return len(s.allowed) > 0 || len(s.quiet) > 0
+}
+
+// open reports whether a run may be going on at t.
+func (s schedule) open(t time.Time) bool {
+	t = t.In(s.loc)
+	minute := t.Hour()*60 + t.Minute()
+	allowed := len(s.allowed) == 0
+	for _, w := range s.allowed {
+		allowed = allowed || w.contains(minute)
+	}
+	for _, w := range s.quiet {
+		if w.contains(minute) {
+			return false
+		}
+	}
+	return allowed
+}
+
+// next returns t if a run may start then, or else the first minute after it
+// when one may. It returns the zero time if the windows never open.
+func (s schedule) next(t time.Time) time.Time {
+	if s.open(t) {
+		return t
+	}
+	for m := t.Truncate(time.Minute).Add(time.Minute); m.Sub(t) < scheduleHorizon; m = m.Add(time.Minute) {
+		if s.open(m) {
+			return m
+		}
+	}
+	return time.Time{}
+}
+
+// closes returns when a run going on at t has to stop, or the zero time if
+// the schedule is always open from then on.
+func (s schedule) closes(t time.Time) time.Time {
+	for m := t.Truncate(time.Minute).Add(time.Minute); m.Sub(t) < scheduleHorizon; m = m.Add(time.Minute) {
+		if !s.open(m) {
+			return m
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,97 @@
+package sitehit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeWindowsSet(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"05:00-09:00", "05:00-09:00", false},
+		{"05:00-09:00, 21:00-01:00", "05:00-09:00,21:00-01:00", false},
+		{"22:00-24:00", "22:00-00:00", false},
+		{"9:30-17:00", "09:30-17:00", false},
+		{"05:00", "", true},
+		{"05:00-05:00", "", true},
+		{"25:00-26:00", "", true},
+		{"05:00-9am", "", true},
+	}
+	for _, tt := range tests {
+		var windows timeWindows
+		err := windows.Set(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Set(%q) error = %v, want error %t", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got := windows.String(); !tt.wantErr && got != tt.want {
+			t.Errorf("Set(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	// Two hours ahead of UTC, so the windows don't line up with UTC days
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	at := func(clock string) time.Time {
+		c, err := time.ParseInLocation("15:04", clock, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Date(2025, 3, 1, c.Hour(), c.Minute(), 0, 0, loc)
+	}
+	tomorrow := func(clock string) time.Time { return at(clock).AddDate(0, 0, 1) }
+	tests := []struct {
+		name         string
+		allowed      string
+		quiet        string
+		t            time.Time
+		open         bool
+		next, closes time.Time
+	}{
+		{"allowed", "05:00-09:00", "", at("06:30"), true, at("06:30"), at("09:00")},
+		{"before the window", "05:00-09:00", "", at("03:10"), false, at("05:00"), time.Time{}},
+		{"end is excluded", "05:00-09:00", "", at("09:00"), false, tomorrow("05:00"), time.Time{}},
+		{"after the window", "05:00-09:00", "", at("10:00"), false, tomorrow("05:00"), time.Time{}},
+		{"past midnight", "21:00-01:00", "", at("23:59"), true, at("23:59"), tomorrow("01:00")},
+		{"past midnight, after it", "21:00-01:00", "", at("00:30"), true, at("00:30"), at("01:00")},
+		{"second window", "05:00-09:00,21:00-01:00", "", at("12:00"), false, at("21:00"), time.Time{}},
+		{"quiet hours", "", "23:30-00:30", at("23:45"), false, tomorrow("00:30"), time.Time{}},
+		{"outside quiet hours", "", "23:30-00:30", at("12:00"), true, at("12:00"), at("23:30")},
+		{"quiet hours in a window", "21:00-01:00", "23:30-00:30", at("23:00"), true, at("23:00"), at("23:30")},
+		{"window after quiet hours", "21:00-01:00", "23:30-00:30", at("23:30"), false, tomorrow("00:30"), time.Time{}},
+		{"never open", "05:00-09:00", "04:00-10:00", at("06:00"), false, time.Time{}, time.Time{}},
+		{"always open", "", "", at("06:00"), true, at("06:00"), time.Time{}},
+		{"in the schedule's time zone", "05:00-09:00", "", at("06:30").UTC(), true, at("06:30"), at("09:00")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := schedule{loc: loc}
+			if tt.allowed != "" {
+				if err := s.allowed.Set(tt.allowed); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.quiet != "" {
+				if err := s.quiet.Set(tt.quiet); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if open := s.open(tt.t); open != tt.open {
+				t.Errorf("open(%v) = %t, want %t", tt.t, open, tt.open)
+			}
+			if next := s.next(tt.t); !next.Equal(tt.next) {
+				t.Errorf("next(%v) = %v, want %v", tt.t, next, tt.next)
+			}
+			if !tt.open {
+				return
+			}
+			if closes := s.closes(tt.t); !closes.Equal(tt.closes) {
+				t.Errorf("closes(%v) = %v, want %v", tt.t, closes, tt.closes)
+			}
+		})
+	}
+}
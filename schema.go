@@ -0,0 +1,12 @@
+package sitehit
+
+import _ "embed"
+
+// schemaVersion is the version of the JSON output described by schema.json.
+// Adding fields keeps it; removing or changing one bumps it.
+const schemaVersion = 1
+
+// runSchema is the JSON Schema printed by --schema.
+//
+//go:embed schema.json
+var runSchema []byte
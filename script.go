@@ -0,0 +1,193 @@
+package sitehit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.starlark.net/lib/json"
+	starlarktime "go.starlark.net/lib/time"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// errScript marks the errors of the script hooks.
+var errScript = errors.New("script")
+
+// Hooks holds the functions defined by a Starlark script passed with --script.
+//
+// A script may define either or both of:
+//
+//	def request(req):   # req has "url", "method", "headers" and "attempt"
+//	def classify(res):  # res has "url", "status", "headers", "attempt",
+//	                    # "duration_ms" and "content_length"
+//
+// request may modify req in place or return a new dict; classify returns
+// True or False to decide success, or None to fall back to "status == 200".
+type Hooks struct {
+	request  starlark.Callable
+	classify starlark.Callable
+}
+
+// loadHooks executes the script at path and picks up the hook functions it defines.
+func loadHooks(path string) (*Hooks, error) {
+	predeclared := starlark.StringDict{
+		"json":        json.Module,
+		"time":        starlarktime.Module,
+		"sha256":      starlark.NewBuiltin("sha256", builtinSHA256),
+		"hmac_sha256": starlark.NewBuiltin("hmac_sha256", builtinHMACSHA256),
+	}
+
+	thread := &starlark.Thread{Name: "load"}
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, path, nil, predeclared)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := &Hooks{}
+	for name, fn := range map[string]*starlark.Callable{"request": &hooks.request, "classify": &hooks.classify} {
+		v, ok := globals[name]
+		if !ok {
+			continue
+		}
+		callable, ok := v.(starlark.Callable)
+		if !ok {
+			return nil, fmt.Errorf("%s: %q is a %s, not a function", path, name, v.Type())
+		}
+		*fn = callable
+	}
+	if hooks.request == nil && hooks.classify == nil {
+		return nil, fmt.Errorf("%s: defines neither request() nor classify()", path)
+	}
+	return hooks, nil
+}
+
+// Request lets the script rewrite req before it is sent.
+func (h *Hooks) Request(req *http.Request, attempt int) error {
+	if h == nil || h.request == nil {
+		return nil
+	}
+
+	in := starlark.NewDict(4)
+	in.SetKey(starlark.String("url"), starlark.String(req.URL.String()))
+	in.SetKey(starlark.String("method"), starlark.String(req.Method))
+	in.SetKey(starlark.String("headers"), headersToDict(req.Header))
+	in.SetKey(starlark.String("attempt"), starlark.MakeInt(attempt))
+
+	thread := &starlark.Thread{Name: "request"}
+	v, err := starlark.Call(thread, h.request, starlark.Tuple{in}, nil)
+	if err != nil {
+		return fmt.Errorf("%w request(): %w", errScript, err)
+	}
+
+	// Returning None means the script edited req in place.
+	out := in
+	if v != starlark.None {
+		d, ok := v.(*starlark.Dict)
+		if !ok {
+			return fmt.Errorf("%w request(): returned %s, want dict or None", errScript, v.Type())
+		}
+		out = d
+	}
+
+	if s, ok := dictString(out, "url"); ok && s != req.URL.String() {
+		u, err := req.URL.Parse(s)
+		if err != nil {
+			return fmt.Errorf("%w request(): %w", errScript, err)
+		}
+		req.URL = u
+		req.Host = u.Host
+	}
+	if s, ok := dictString(out, "method"); ok {
+		req.Method = s
+	}
+	if v, found, _ := out.Get(starlark.String("headers")); found {
+		headers, ok := v.(*starlark.Dict)
+		if !ok {
+			return fmt.Errorf("%w request(): headers is a %s, want dict", errScript, v.Type())
+		}
+		for _, item := range headers.Items() {
+			name, ok1 := starlark.AsString(item[0])
+			value, ok2 := starlark.AsString(item[1])
+			if !ok1 || !ok2 {
+				return fmt.Errorf("%w request(): headers must map strings to strings", errScript)
+			}
+			req.Header.Set(name, value)
+		}
+	}
+	return nil
+}
+
+// classifies reports whether the script decides success itself.
+func (h *Hooks) classifies() bool {
+	return h != nil && h.classify != nil
+}
+
+// Classify reports whether resp counts as a successful visit. Without a
+// classify() hook, or when it returns None, only a 200 is a success.
+func (h *Hooks) Classify(resp *http.Response, attempt int, duration time.Duration) (bool, error) {
+	if h == nil || h.classify == nil {
+		return resp.StatusCode == http.StatusOK, nil
+	}
+
+	in := starlark.NewDict(6)
+	in.SetKey(starlark.String("url"), starlark.String(resp.Request.URL.String()))
+	in.SetKey(starlark.String("status"), starlark.MakeInt(resp.StatusCode))
+	in.SetKey(starlark.String("headers"), headersToDict(resp.Header))
+	in.SetKey(starlark.String("attempt"), starlark.MakeInt(attempt))
+	in.SetKey(starlark.String("duration_ms"), starlark.MakeInt64(duration.Milliseconds()))
+	in.SetKey(starlark.String("content_length"), starlark.MakeInt64(resp.ContentLength))
+
+	thread := &starlark.Thread{Name: "classify"}
+	v, err := starlark.Call(thread, h.classify, starlark.Tuple{in}, nil)
+	if err != nil {
+		return false, fmt.Errorf("%w classify(): %w", errScript, err)
+	}
+	switch v := v.(type) {
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.NoneType:
+		return resp.StatusCode == http.StatusOK, nil
+	default:
+		return false, fmt.Errorf("%w classify(): returned %s, want bool or None", errScript, v.Type())
+	}
+}
+
+func headersToDict(header http.Header) *starlark.Dict {
+	d := starlark.NewDict(len(header))
+	for name := range header {
+		d.SetKey(starlark.String(name), starlark.String(header.Get(name)))
+	}
+	return d
+}
+
+func dictString(d *starlark.Dict, key string) (string, bool) {
+	v, found, _ := d.Get(starlark.String(key))
+	if !found {
+		return "", false
+	}
+	return starlark.AsString(v)
+}
+
+func builtinSHA256(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var data string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &data); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(data))
+	return starlark.String(hex.EncodeToString(sum[:])), nil
+}
+
+func builtinHMACSHA256(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var key, data string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &key, &data); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(data))
+	return starlark.String(hex.EncodeToString(mac.Sum(nil))), nil
+}
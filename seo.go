@@ -0,0 +1,296 @@
+package sitehit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	neturl "net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/html"
+)
+
+// seoBodyLimit is how much of a page is searched for its robots meta tag
+// and canonical link, which belong in the head.
+const seoBodyLimit = 512 << 10
+
+// seoAgent is the crawler whose robots.txt rules --seo-report checks the
+// URLs against, falling back to the rules for every crawler.
+const seoAgent = "googlebot"
+
+// seoAudit collects the indexing signals of the pages of a run that
+// contradict their listing in the sitemap, or each other: pages crawlers
+// may not fetch, that ask not to be indexed, that name another URL as
+// canonical or that redirect.
+type seoAudit struct {
+	mu       sync.Mutex
+	robots   map[string]*robotsEntry // by scheme://host
+	checked  int
+	findings []seoFinding
+}
+
+type robotsEntry struct {
+	once  sync.Once
+	rules robotsRules
+}
+
+// seoFinding is a sitemap URL with mixed indexing signals.
+type seoFinding struct {
+	URL       string `json:"url"`
+	Blocked   bool   `json:"blocked_by_robots,omitempty"`
+	NoIndex   string `json:"noindex,omitempty"`             // "header" or "meta"
+	Canonical string `json:"canonical_elsewhere,omitempty"` // the URL named canonical
+	Redirect  string `json:"redirected_to,omitempty"`
+	Conflict  string `json:"conflict,omitempty"` // why the signals contradict each other
+}
+
+func newSEOAudit() *seoAudit {
+	return &seoAudit{robots: make(map[string]*robotsEntry)}
+}
+
+// observe checks the signals of the successful response to url, with the
+// start of its body.
+func (a *seoAudit) observe(ctx context.Context, url string, resp *http.Response, body []byte, opts Options) {
+	if a == nil {
+		return
+	}
+	f := seoFinding{URL: url, Blocked: !a.allowed(ctx, url, opts)}
+	final := resp.Request.URL
+	if final.String() != url {
+		f.Redirect = final.String()
+	}
+	if headerNoIndex(resp.Header) {
+		f.NoIndex = "header"
+	}
+	canonical := linkCanonical(resp.Header)
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/html" || mediaType == "application/xhtml+xml" {
+		noindex, link := pageSignals(body)
+		if noindex && f.NoIndex == "" {
+			f.NoIndex = "meta"
+		}
+		if link != "" {
+			canonical = link
+		}
+	}
+	if canonical != "" {
+		if u, err := final.Parse(strings.TrimSpace(canonical)); err == nil {
+			u.Fragment = ""
+			if u.String() != url && u.String() != final.String() {
+				f.Canonical = u.String()
+			}
+		}
+	}
+
+	var conflicts []string
+	if f.Blocked && f.NoIndex != "" {
+		conflicts = append(conflicts, "blocked by robots.txt, so crawlers never see its noindex")
+	}
+	if f.NoIndex != "" && f.Canonical != "" {
+		conflicts = append(conflicts, "noindex while naming another URL canonical")
+	}
+	if f.Canonical != "" && !a.allowed(ctx, f.Canonical, opts) {
+		conflicts = append(conflicts, "its canonical URL is blocked by robots.txt")
+	}
+	f.Conflict = strings.Join(conflicts, "; ")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.checked++
+	if f.Blocked || f.NoIndex != "" || f.Canonical != "" || f.Redirect != "" {
+		a.findings = append(a.findings, f)
+	}
+}
+
+// allowed reports whether robots.txt lets seoAgent crawl url, fetching the
+// robots.txt of its host the first time. A robots.txt that can't be fetched
+// allows everything.
+func (a *seoAudit) allowed(ctx context.Context, url string, opts Options) bool {
+	u, err := neturl.Parse(url)
+	if err != nil || u.Host == "" {
+		return true
+	}
+	root := u.Scheme + "://" + u.Host
+	a.mu.Lock()
+	entry := a.robots[root]
+	if entry == nil {
+		entry = &robotsEntry{}
+		a.robots[root] = entry
+	}
+	a.mu.Unlock()
+	entry.once.Do(func() {
+		resp, err := opts.get(ctx, root+"/robots.txt")
+		if err != nil {
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			entry.rules = parseRobots(resp.Body, seoAgent)
+		}
+	})
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	return entry.rules.allowed(path)
+}
+
+// headerNoIndex reports whether an X-Robots-Tag header keeps the page out of
+// the index, for every crawler or seoAgent.
+func headerNoIndex(header http.Header) bool {
+	for _, value := range header.Values("X-Robots-Tag") {
+		// A value may be scoped to a crawler, as in "googlebot: noindex"
+		if agent, rest, ok := strings.Cut(value, ":"); ok {
+			agent = strings.ToLower(strings.TrimSpace(agent))
+			if !strings.Contains(agent, ",") && !isRobotsDirective(agent) {
+				if agent != seoAgent {
+					continue
+				}
+				value = rest
+			}
+		}
+		if directivesNoIndex(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRobotsDirective reports whether name is a directive that takes a value,
+// rather than the crawler an X-Robots-Tag is scoped to.
+func isRobotsDirective(name string) bool {
+	return slices.Contains([]string{"unavailable_after", "max-snippet", "max-image-preview", "max-video-preview"}, name)
+}
+
+// directivesNoIndex reports whether a comma-separated list of robots
+// directives includes noindex or none.
+func directivesNoIndex(value string) bool {
+	for _, d := range strings.Split(value, ",") {
+		if d = strings.ToLower(strings.TrimSpace(d)); d == "noindex" || d == "none" {
+			return true
+		}
+	}
+	return false
+}
+
+// linkCanonical returns the target of a rel="canonical" Link header.
+func linkCanonical(header http.Header) string {
+	for _, value := range header.Values("Link") {
+		for _, link := range strings.Split(value, ",") {
+			target, params, _ := strings.Cut(link, ";")
+			target = strings.TrimSpace(target)
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range strings.Split(params, ";") {
+				key, val, _ := strings.Cut(param, "=")
+				if strings.EqualFold(strings.TrimSpace(key), "rel") && slices.Contains(strings.Fields(strings.ToLower(strings.Trim(strings.TrimSpace(val), `"`))), "canonical") {
+					return target[1 : len(target)-1]
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// pageSignals returns whether a robots meta tag for every crawler or
+// seoAgent keeps the page out of the index, and the href of its canonical
+// link, from the head of an HTML page.
+func pageSignals(body []byte) (noindex bool, canonical string) {
+	z := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return noindex, canonical
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tag := z.Token()
+			attrs := make(map[string]string, len(tag.Attr))
+			for _, attr := range tag.Attr {
+				attrs[attr.Key] = attr.Val
+			}
+			switch tag.Data {
+			case "meta":
+				if name := strings.ToLower(attrs["name"]); (name == "robots" || name == seoAgent) && directivesNoIndex(attrs["content"]) {
+					noindex = true
+				}
+			case "link":
+				if rels := strings.Fields(strings.ToLower(attrs["rel"])); slices.Contains(rels, "canonical") && canonical == "" {
+					canonical = attrs["href"]
+				}
+			case "body":
+				return noindex, canonical
+			}
+		}
+	}
+}
+
+// print reports the findings of the run, and starts anew for the next one
+// with the robots.txt files fetched again.
+func (a *seoAudit) print() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	findings, checked := a.findings, a.checked
+	a.findings, a.checked, a.robots = nil, 0, make(map[string]*robotsEntry)
+	if checked == 0 {
+		return
+	}
+	slices.SortFunc(findings, func(x, y seoFinding) int { return strings.Compare(x.URL, y.URL) })
+
+	if console.structured() {
+		console.Info("Sitemap consistency", "event", "consistency", "checked", checked, "findings", findings)
+		return
+	}
+	fmt.Printf("\nSitemap consistency: %d of %d URLs with mixed indexing signals\n", len(findings), checked)
+	section := func(title string, line func(seoFinding) string) {
+		var lines []string
+		for _, f := range findings {
+			if l := line(f); l != "" {
+				lines = append(lines, l)
+			}
+		}
+		fmt.Printf("%s: %d\n", title, len(lines))
+		for _, l := range lines {
+			fmt.Printf("  %s\n", l)
+		}
+	}
+	section("Blocked by robots.txt", func(f seoFinding) string {
+		if f.Blocked {
+			return f.URL
+		}
+		return ""
+	})
+	section("Noindex", func(f seoFinding) string {
+		if f.NoIndex == "header" {
+			return f.URL + " (X-Robots-Tag)"
+		} else if f.NoIndex == "meta" {
+			return f.URL + " (robots meta tag)"
+		}
+		return ""
+	})
+	section("Canonical elsewhere", func(f seoFinding) string {
+		if f.Canonical != "" {
+			return f.URL + " -> " + f.Canonical
+		}
+		return ""
+	})
+	section("Redirected", func(f seoFinding) string {
+		if f.Redirect != "" {
+			return f.URL + " -> " + f.Redirect
+		}
+		return ""
+	})
+	section("Conflicting signals", func(f seoFinding) string {
+		if f.Conflict != "" {
+			return "\033[31m" + f.URL + ": " + f.Conflict + "\033[0m"
+		}
+		return ""
+	})
+}
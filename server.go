@@ -0,0 +1,412 @@
+package sitehit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// server exposes sitehit over HTTP when started with --serve:
+//
+//	POST /runs?sitemap=URL   start a run, returns it with its id; an
+//	                         Idempotency-Key header returns the run
+//	                         already started with that key instead
+//	GET  /runs               list runs
+//	GET  /runs/{id}          a run with its results so far
+//	GET  /runs/{id}/events   Server-Sent Events stream of results as they complete
+//	DELETE /runs/{id}        cancel a run, which keeps the results so far
+//
+// Runs end with the server's context as well, when it shuts down. Finished
+// runs are dropped after finishedRunTTL, or sooner once there are more than
+// maxFinishedRuns of them.
+type server struct {
+	ctx  context.Context
+	opts Options
+
+	mu   sync.Mutex
+	runs map[string]*run
+	ids  []string        // in creation order
+	keys map[string]*run // by idempotency key, until idempotencyKeyTTL
+}
+
+// idempotencyKeyTTL is how long an Idempotency-Key returns the run it
+// started, after which the key is forgotten and may start a new run.
+const idempotencyKeyTTL = 24 * time.Hour
+
+const (
+	// finishedRunTTL is how long a run is kept, with its results, after it
+	// ended.
+	finishedRunTTL = 24 * time.Hour
+
+	// maxFinishedRuns is how many ended runs are kept at most, the oldest
+	// dropped first, so a busy server doesn't hold on to every result.
+	maxFinishedRuns = 100
+)
+
+// run is one sitemap visit started through the API.
+type run struct {
+	ID             string
+	Sitemap        string
+	IdempotencyKey string
+
+	cancel context.CancelFunc
+
+	mu          sync.Mutex
+	status      string // "running", "done", "cancelled" or "failed"
+	err         error
+	startedAt   time.Time
+	finishedAt  time.Time
+	results     []Result
+	summary     *Summary
+	subscribers map[chan Result]struct{}
+}
+
+func newServer(ctx context.Context, opts Options) *server {
+	return &server{ctx: ctx, opts: opts, runs: make(map[string]*run), keys: make(map[string]*run)}
+}
+
+// serve runs the API on addr until SIGTERM or an interrupt, which cancels
+// the runs still going and waits for their event streams to end.
+func serve(addr string, opts Options) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer cancel()
+	srv := &http.Server{Addr: addr, Handler: newServer(ctx, opts).handler()}
+	closed := make(chan struct{})
+	context.AfterFunc(ctx, func() {
+		srv.Shutdown(context.Background())
+		close(closed)
+	})
+
+	console.Info(fmt.Sprintf("Listening on %s...", addr), "addr", addr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	<-closed
+	return nil
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /runs", s.handleStart)
+	mux.HandleFunc("GET /runs", s.handleList)
+	mux.HandleFunc("GET /runs/{id}", s.handleGet)
+	mux.HandleFunc("GET /runs/{id}/events", s.handleEvents)
+	mux.HandleFunc("DELETE /runs/{id}", s.handleCancel)
+	return mux
+}
+
+func (s *server) handleStart(w http.ResponseWriter, r *http.Request) {
+	sitemapURL := r.FormValue("sitemap")
+	if sitemapURL == "" {
+		http.Error(w, "missing sitemap parameter", http.StatusBadRequest)
+		return
+	}
+	if !isRemote(sitemapURL) {
+		// Local files and stdin are for the command line only
+		http.Error(w, "sitemap must be an http(s) URL", http.StatusBadRequest)
+		return
+	}
+
+	key := r.Header.Get("Idempotency-Key")
+
+	s.mu.Lock()
+	s.evict(time.Now())
+	if existing, ok := s.keys[key]; ok && key != "" {
+		s.mu.Unlock()
+		if existing.Sitemap != sitemapURL {
+			http.Error(w, "idempotency key already used for a different sitemap", http.StatusConflict)
+			return
+		}
+		writeJSON(w, http.StatusOK, existing)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	run := &run{
+		cancel:         cancel,
+		ID:             newRunID(),
+		Sitemap:        sitemapURL,
+		IdempotencyKey: key,
+		status:         "running",
+		startedAt:      time.Now(),
+		results:        []Result{},
+		subscribers:    make(map[chan Result]struct{}),
+	}
+	s.runs[run.ID] = run
+	s.ids = append(s.ids, run.ID)
+	if key != "" {
+		s.keys[key] = run
+	}
+	s.mu.Unlock()
+
+	go run.execute(ctx, s.opts)
+
+	writeJSON(w, http.StatusAccepted, run)
+}
+
+// evict drops the runs that ended more than finishedRunTTL before now, and
+// the oldest ended runs beyond maxFinishedRuns, along with their keys, and
+// forgets the idempotency keys of runs started more than idempotencyKeyTTL
+// before now. Runs still going are kept. s.mu must be held.
+func (s *server) evict(now time.Time) {
+	var finished []string
+	for _, id := range s.ids {
+		run := s.runs[id]
+		run.mu.Lock()
+		ended, finishedAt := run.status != "running", run.finishedAt
+		run.mu.Unlock()
+		if ended {
+			if now.Sub(finishedAt) > finishedRunTTL {
+				s.drop(id)
+			} else {
+				finished = append(finished, id)
+			}
+		}
+	}
+	// ids are in creation order, which is near enough to the order runs end
+	for _, id := range finished[:max(len(finished)-maxFinishedRuns, 0)] {
+		s.drop(id)
+	}
+	s.ids = slices.DeleteFunc(s.ids, func(id string) bool {
+		_, ok := s.runs[id]
+		return !ok
+	})
+
+	for key, run := range s.keys {
+		if now.Sub(run.startedAt) > idempotencyKeyTTL {
+			delete(s.keys, key)
+		}
+	}
+}
+
+// drop forgets the run with id and its idempotency key, leaving s.ids to
+// the caller. s.mu must be held.
+func (s *server) drop(id string) {
+	if run := s.runs[id]; run.IdempotencyKey != "" && s.keys[run.IdempotencyKey] == run {
+		delete(s.keys, run.IdempotencyKey)
+	}
+	delete(s.runs, id)
+}
+
+func (s *server) handleList(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.evict(time.Now())
+	runs := make([]*run, 0, len(s.ids))
+	for _, id := range s.ids {
+		runs = append(runs, s.runs[id])
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, runs)
+}
+
+func (s *server) lookup(w http.ResponseWriter, r *http.Request) *run {
+	s.mu.Lock()
+	s.evict(time.Now())
+	run, ok := s.runs[r.PathValue("id")]
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "run not found", http.StatusNotFound)
+	}
+	return run
+}
+
+func (s *server) handleGet(w http.ResponseWriter, r *http.Request) {
+	if run := s.lookup(w, r); run != nil {
+		writeJSON(w, http.StatusOK, run)
+	}
+}
+
+// handleCancel stops a run: no new URLs are visited and requests in flight
+// are aborted. Cancelling a run that already ended changes nothing.
+func (s *server) handleCancel(w http.ResponseWriter, r *http.Request) {
+	if run := s.lookup(w, r); run != nil {
+		run.cancel()
+		writeJSON(w, http.StatusOK, run)
+	}
+}
+
+// handleEvents replays the results completed so far, then streams new ones
+// as "result" events until the run ends with a "summary" (or "error") event.
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	run := s.lookup(w, r)
+	if run == nil {
+		return
+	}
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	backlog, updates := run.subscribe()
+	defer run.unsubscribe(updates)
+
+	for _, result := range backlog {
+		writeEvent(w, "result", result)
+	}
+	rc.Flush()
+
+	for {
+		select {
+		case result, ok := <-updates:
+			if !ok {
+				run.mu.Lock()
+				status, summary, err := run.status, run.summary, run.err
+				run.mu.Unlock()
+				if status == "running" {
+					// Dropped for falling behind; the client can reconnect.
+					return
+				}
+				if err != nil {
+					writeEvent(w, "error", map[string]string{"error": err.Error()})
+				} else {
+					writeEvent(w, "summary", summary)
+				}
+				rc.Flush()
+				return
+			}
+			writeEvent(w, "result", result)
+			rc.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (run *run) execute(ctx context.Context, opts Options) {
+	defer run.cancel()
+	stream := opts.OnResult
+	opts.OnResult = func(result Result) {
+		run.publish(result)
+		if stream != nil {
+			stream(result)
+		}
+	}
+
+	var summary Summary
+	sm, err := fetchSitemap(ctx, run.Sitemap, opts)
+	if err == nil {
+		err = checkSitemap(sm, opts)
+	}
+	if err == nil {
+		urls, opts := prepareEntries(uniqueEntries(sm.URLs), opts)
+		_, t := runURLs(ctx, urls, opts)
+		summary = t.summary()
+	}
+
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.finishedAt = time.Now()
+	switch {
+	case ctx.Err() != nil:
+		run.status = "cancelled"
+		run.err = err
+		if err == nil {
+			run.summary = &summary
+		}
+	case err != nil:
+		run.status = "failed"
+		run.err = err
+	default:
+		run.status = "done"
+		run.summary = &summary
+	}
+	for ch := range run.subscribers {
+		close(ch)
+	}
+	run.subscribers = nil
+}
+
+// publish records a result and forwards it to every subscriber. Subscribers
+// that fall too far behind are dropped rather than stalling the run.
+func (run *run) publish(result Result) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.results = append(run.results, result)
+	for ch := range run.subscribers {
+		select {
+		case ch <- result:
+		default:
+			delete(run.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns the results so far and a channel carrying the ones that
+// follow. The channel is closed when the run finishes.
+func (run *run) subscribe() ([]Result, chan Result) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	backlog := append([]Result(nil), run.results...)
+	ch := make(chan Result, 256)
+	if run.subscribers == nil {
+		close(ch)
+	} else {
+		run.subscribers[ch] = struct{}{}
+	}
+	return backlog, ch
+}
+
+func (run *run) unsubscribe(ch chan Result) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	if _, ok := run.subscribers[ch]; ok {
+		delete(run.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (run *run) MarshalJSON() ([]byte, error) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	var errText string
+	if run.err != nil {
+		errText = run.err.Error()
+	}
+	var finishedAt *time.Time
+	if !run.finishedAt.IsZero() {
+		finishedAt = &run.finishedAt
+	}
+	return json.Marshal(struct {
+		SchemaVersion  int        `json:"schema_version"`
+		ID             string     `json:"id"`
+		Sitemap        string     `json:"sitemap"`
+		IdempotencyKey string     `json:"idempotency_key,omitempty"`
+		Status         string     `json:"status"`
+		Error          string     `json:"error,omitempty"`
+		StartedAt      time.Time  `json:"started_at"`
+		FinishedAt     *time.Time `json:"finished_at,omitempty"`
+		Summary        *Summary   `json:"summary,omitempty"`
+		Results        []Result   `json:"results"`
+	}{schemaVersion, run.ID, run.Sitemap, run.IdempotencyKey, run.status, errText, run.startedAt, finishedAt, run.summary, run.results})
+}
+
+func newRunID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeEvent(w http.ResponseWriter, event string, v any) {
+	data, _ := json.Marshal(v)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
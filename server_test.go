@@ -0,0 +1,107 @@
+package sitehit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestServerEvict(t *testing.T) {
+	now := time.Now()
+	type runSpec struct {
+		status string
+		ago    time.Duration // since the run started, and ended unless running
+		key    string
+	}
+	tests := []struct {
+		name string
+		runs []runSpec
+		keep []int // indexes of the runs left
+		keys []string
+	}{
+		{
+			name: "recent runs kept",
+			runs: []runSpec{{"done", time.Hour, "a"}, {"failed", time.Minute, ""}, {"running", time.Second, "b"}},
+			keep: []int{0, 1, 2},
+			keys: []string{"a", "b"},
+		},
+		{
+			name: "ended runs expire",
+			runs: []runSpec{{"done", 25 * time.Hour, "a"}, {"cancelled", 30 * time.Hour, ""}, {"done", time.Hour, "b"}},
+			keep: []int{2},
+			keys: []string{"b"},
+		},
+		{
+			name: "running runs stay",
+			runs: []runSpec{{"running", 48 * time.Hour, "a"}},
+			keep: []int{0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(context.Background(), Options{})
+			var runs []*run
+			for i, spec := range tt.runs {
+				r := &run{ID: fmt.Sprint(i), IdempotencyKey: spec.key, status: spec.status, startedAt: now.Add(-spec.ago)}
+				if spec.status != "running" {
+					r.finishedAt = r.startedAt
+				}
+				runs = append(runs, r)
+				s.runs[r.ID] = r
+				s.ids = append(s.ids, r.ID)
+				if spec.key != "" {
+					s.keys[spec.key] = r
+				}
+			}
+			s.evict(now)
+
+			var want []string
+			for _, i := range tt.keep {
+				want = append(want, runs[i].ID)
+			}
+			if !slices.Equal(s.ids, want) || len(s.runs) != len(want) {
+				t.Errorf("runs left = %v (%d), want %v", s.ids, len(s.runs), want)
+			}
+			for _, key := range tt.keys {
+				if _, ok := s.keys[key]; !ok {
+					t.Errorf("key %s forgotten, want it kept", key)
+				}
+			}
+			if len(s.keys) != len(tt.keys) {
+				t.Errorf("%d keys left, want %v", len(s.keys), tt.keys)
+			}
+		})
+	}
+}
+
+func TestServerEvictCap(t *testing.T) {
+	s := newServer(context.Background(), Options{})
+	now := time.Now()
+	add := func(id, status string) {
+		s.runs[id] = &run{ID: id, status: status, startedAt: now, finishedAt: now}
+		s.ids = append(s.ids, id)
+	}
+	add("running", "running")
+	for i := range maxFinishedRuns + 5 {
+		add(fmt.Sprint(i), "done")
+	}
+	s.evict(now)
+
+	if len(s.ids) != maxFinishedRuns+1 {
+		t.Fatalf("%d runs left, want %d", len(s.ids), maxFinishedRuns+1)
+	}
+	if s.ids[0] != "running" || s.ids[1] != "5" {
+		t.Errorf("runs left start with %v, want the running one, then the oldest ended ones dropped", s.ids[:2])
+	}
+
+	// A dropped run is gone from the API
+	rec := httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/runs/0", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET of a dropped run = %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,130 @@
+package sitehit
+
+import (
+	"cmp"
+	"slices"
+	"sync/atomic"
+)
+
+// shedOrders are the values --shed-order accepts: what to leave for last,
+// and so drop first, when a run is cut short.
+var shedOrders = []string{"none", "priority", "lastmod"}
+
+// shedLast orders entries so that those a cut-short run can best do without
+// come last: the lowest priority with --shed-order priority (or
+// --priority-weighted), the oldest lastmod with lastmod, and after all
+// others the URLs matching --shed-pattern. The order is otherwise kept.
+func shedLast(entries []Url, opts Options) []Url {
+	compare := shedCompare(opts)
+	if compare == nil {
+		return entries
+	}
+	entries = slices.Clone(entries)
+	slices.SortStableFunc(entries, compare)
+	return entries
+}
+
+// shedRanks numbers the URLs of entries by their place in the order of
+// shedLast, entries it keeps in place sharing a rank, so the frontier can
+// hold that order across hosts. It's nil when the sitemap order is kept.
+func shedRanks(entries []Url, opts Options) map[string]int {
+	compare := shedCompare(opts)
+	if compare == nil {
+		return nil
+	}
+	sorted := shedLast(entries, opts)
+	ranks := make(map[string]int, len(sorted))
+	rank := 0
+	for i, entry := range sorted {
+		if i > 0 && compare(sorted[i-1], entry) != 0 {
+			rank++
+		}
+		if _, ok := ranks[entry.Loc]; !ok {
+			ranks[entry.Loc] = rank
+		}
+	}
+	return ranks
+}
+
+// shedCompare returns how shedLast orders two entries, or nil when the
+// sitemap order is kept.
+func shedCompare(opts Options) func(a, b Url) int {
+	order := opts.ShedOrder
+	if opts.PriorityWeighted {
+		order = "priority"
+	}
+	var byOrder func(a, b Url) int
+	switch order {
+	case "priority":
+		byOrder = func(a, b Url) int {
+			return cmp.Compare(b.PriorityValue(), a.PriorityValue())
+		}
+	case "lastmod":
+		// Entries without a lastmod count as the oldest
+		byOrder = func(a, b Url) int {
+			at, _ := a.LastModTime()
+			bt, _ := b.LastModTime()
+			return bt.Compare(at)
+		}
+	}
+	if byOrder == nil && opts.ShedPattern == nil {
+		return nil
+	}
+	return func(a, b Url) int {
+		if opts.ShedPattern != nil {
+			if c := compareBool(opts.ShedPattern.MatchString(a.Loc), opts.ShedPattern.MatchString(b.Loc)); c != 0 {
+				return c
+			}
+		}
+		if byOrder == nil {
+			return 0
+		}
+		return byOrder(a, b)
+	}
+}
+
+// compareBool orders false before true.
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	}
+	return -1
+}
+
+// highPriority returns the URLs of entries above the default sitemap
+// priority with --priority-weighted, or nil without.
+func highPriority(entries []Url, opts Options) map[string]bool {
+	if !opts.PriorityWeighted {
+		return nil
+	}
+	high := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.PriorityValue() > 0.5 {
+			high[entry.Loc] = true
+		}
+	}
+	return high
+}
+
+// failureBudget counts the URLs of a run that failed against
+// --failure-budget, past which the low-priority URLs left are shed.
+type failureBudget struct {
+	limit  int64
+	failed atomic.Int64
+}
+
+// spend counts result if it failed.
+func (b *failureBudget) spend(result Result) {
+	if b == nil || result.Success || result.Skipped || result.Ignored {
+		return
+	}
+	b.failed.Add(1)
+}
+
+// spent reports whether as many URLs failed as the budget allows.
+func (b *failureBudget) spent() bool {
+	return b != nil && b.failed.Load() >= b.limit
+}
@@ -0,0 +1,212 @@
+package sitehit
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sheetsEndpoint is the Google Sheets API the rows are appended through.
+var sheetsEndpoint = "https://sheets.googleapis.com/v4/spreadsheets/"
+
+// sheetsScope is the OAuth scope --sheet asks for.
+const sheetsScope = "https://www.googleapis.com/auth/spreadsheets"
+
+// sheetExport appends a row per run to the Summary tab of a Google Sheet,
+// and with --sheet-failures a row per failed URL to its Failures tab, for
+// the people who follow the warmer from a spreadsheet. It signs in as a
+// service account, which the sheet must be shared with.
+type sheetExport struct {
+	spreadsheet string
+	failures    bool
+	account     serviceAccount
+	client      *http.Client
+
+	mu      sync.Mutex // runs of parallel sites export at once
+	token   string
+	expires time.Time
+}
+
+// serviceAccount holds the fields of a Google service account key file
+// needed to get an access token.
+type serviceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+	key         *rsa.PrivateKey
+}
+
+// newSheetExport loads the service account key for appending to the sheet
+// with ID spreadsheet. The key file defaults to the one named by
+// GOOGLE_APPLICATION_CREDENTIALS.
+func newSheetExport(spreadsheet, credentials string, failures bool) (*sheetExport, error) {
+	if credentials == "" {
+		credentials = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if credentials == "" {
+		return nil, fmt.Errorf("--sheet requires --sheet-credentials or GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	data, err := os.ReadFile(credentials)
+	if err != nil {
+		return nil, fmt.Errorf("reading sheet credentials: %w", err)
+	}
+	var account serviceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("parsing sheet credentials: %w", err)
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if account.ClientEmail == "" || block == nil {
+		return nil, fmt.Errorf("parsing sheet credentials: not a service account key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing sheet credentials: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("parsing sheet credentials: not an RSA key")
+	}
+	account.key = rsaKey
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &sheetExport{
+		spreadsheet: spreadsheet,
+		failures:    failures,
+		account:     account,
+		client:      &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// export appends the rows of the run in rep, finished at when.
+func (sh *sheetExport) export(rep report, when time.Time) error {
+	sum := rep.Summary
+	at := when.UTC().Format("2006-01-02 15:04:05")
+	name := rep.Site
+	if name == "" {
+		name = rep.Sitemap
+	}
+	row := []any{at, name, sum.Total, sum.Succeeded, sum.Failed, sum.Ignored, sum.AverageTime.Milliseconds(), sum.Bytes}
+	if err := sh.append("Summary", [][]any{row}); err != nil {
+		return err
+	}
+	if !sh.failures {
+		return nil
+	}
+
+	var rows [][]any
+	for _, r := range rep.Results {
+		if r.Success || r.Skipped {
+			continue
+		}
+		errText := ""
+		if r.Error != nil {
+			errText = r.Error.Error()
+		}
+		rows = append(rows, []any{at, name, r.URL, r.StatusCode, r.Attempts, r.ErrorCode(), errText})
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return sh.append("Failures", rows)
+}
+
+// append adds rows below the last ones of the named tab.
+func (sh *sheetExport) append(tab string, rows [][]any) error {
+	token, err := sh.accessToken()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]any{"values": rows})
+	if err != nil {
+		return err
+	}
+	u := sheetsEndpoint + neturl.PathEscape(sh.spreadsheet) + "/values/" + neturl.PathEscape(tab) +
+		":append?valueInputOption=RAW&insertDataOption=INSERT_ROWS"
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := sh.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("appending to sheet: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("appending to sheet tab %s: Status code %d", tab, resp.StatusCode)
+	}
+	return nil
+}
+
+// accessToken returns a token for the service account, exchanging a signed
+// JWT for a new one when the last is about to expire.
+func (sh *sheetExport) accessToken() (string, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.token != "" && time.Until(sh.expires) > time.Minute {
+		return sh.token, nil
+	}
+
+	assertion, err := sh.account.assertion(time.Now())
+	if err != nil {
+		return "", err
+	}
+	form := neturl.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	resp, err := sh.client.PostForm(sh.account.TokenURI, form)
+	if err != nil {
+		return "", fmt.Errorf("signing in to Google: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("signing in to Google: Status code %d", resp.StatusCode)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("signing in to Google: %w", err)
+	}
+	sh.token = token.AccessToken
+	sh.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return sh.token, nil
+}
+
+// assertion returns the JWT, signed with the account's key, that is
+// exchanged for an access token.
+func (a serviceAccount) assertion(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   a.ClientEmail,
+		"scope": sheetsScope,
+		"aud":   a.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(nil, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("signing in to Google: %w", err)
+	}
+	return strings.Join([]string{signed, enc.EncodeToString(sig)}, "."), nil
+}
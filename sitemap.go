@@ -0,0 +1,413 @@
+package sitehit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Url struct {
+	Loc      string `xml:"loc"`
+	LastMod  string `xml:"lastmod"`
+	Priority string `xml:"priority"`
+
+	// Request is set by the sitehit sitemap extension, for entries that
+	// aren't requested like a page.
+	Request *URLRequest `xml:"https://github.com/jeroensmink98/sitehit/sitemap/1.0 request"`
+}
+
+// PriorityValue returns the entry's sitemap priority, defaulting to the
+// protocol's 0.5 when it is missing or malformed.
+func (u Url) PriorityValue() float64 {
+	p, err := strconv.ParseFloat(strings.TrimSpace(u.Priority), 64)
+	if err != nil || p < 0 || p > 1 {
+		return 0.5
+	}
+	return p
+}
+
+// LastModTime parses the entry's lastmod, which may be a date or a full
+// W3C datetime.
+func (u Url) LastModTime() (time.Time, bool) {
+	value := strings.TrimSpace(u.LastMod)
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04Z07:00", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Sitemap is a fetched and parsed sitemap.
+type Sitemap struct {
+	URLs []Url
+
+	// LastModified is the sitemap's Last-Modified header, zero if absent.
+	LastModified time.Time
+}
+
+// Updated returns the most recent of the sitemap's Last-Modified header and
+// the lastmod of its entries, or zero if neither is known.
+func (sm *Sitemap) Updated() time.Time {
+	updated := sm.LastModified
+	for _, url := range sm.URLs {
+		if t, ok := url.LastModTime(); ok && t.After(updated) {
+			updated = t
+		}
+	}
+	return updated
+}
+
+// fetchSitemap downloads and parses the sitemap at sitemapURL. A sitemap
+// index is resolved by fetching its child sitemaps, opts.SitemapWorkers at a
+// time, and merging their URLs; children that fail are reported and skipped.
+// Indexes nested up to opts.SitemapDepth levels deep are followed, and at
+// most opts.MaxSitemaps child sitemaps are fetched when it's positive. A
+// site root such as https://example.com stands for the sitemaps listed in
+// its robots.txt.
+func fetchSitemap(ctx context.Context, sitemapURL string, opts Options) (*Sitemap, error) {
+	if strings.HasPrefix(sitemapURL, pluginPrefix) {
+		return sourceURLs(sitemapURL, opts)
+	}
+	var doc *sitemapDocument
+	var lastModified time.Time
+	var err error
+	if isSiteRoot(sitemapURL) {
+		doc, err = discoverSitemaps(ctx, sitemapURL, opts)
+	} else {
+		doc, lastModified, err = fetchSitemapDocument(ctx, sitemapURL, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sm := &Sitemap{URLs: doc.URLs, LastModified: lastModified}
+	if doc.XMLName.Local != "sitemapindex" {
+		return sm, nil
+	}
+
+	// Guard against indexes listing each other
+	seen := map[string]bool{sitemapURL: true}
+	fetched, failed := 0, 0
+	level := childSitemaps(doc, seen)
+	for depth := 1; len(level) > 0; depth++ {
+		if opts.MaxSitemaps > 0 && fetched+len(level) > opts.MaxSitemaps {
+			opts.logger().Warn(fmt.Sprintf("Leaving out %d child sitemaps: --max-sitemaps is %d", fetched+len(level)-opts.MaxSitemaps, opts.MaxSitemaps),
+				"event", "sitemap_index", "sitemap", sitemapURL, "children", len(level), "max_sitemaps", opts.MaxSitemaps)
+			level = level[:opts.MaxSitemaps-fetched]
+		}
+		if len(level) == 0 {
+			break
+		}
+		opts.logger().Info(fmt.Sprintf("Sitemap index level %d with %d child sitemaps, fetching with %d workers...", depth, len(level), max(opts.SitemapWorkers, 1)),
+			"event", "sitemap_index", "sitemap", sitemapURL, "depth", depth, "children", len(level))
+
+		docs, levelFailed := fetchChildSitemaps(ctx, level, depth < opts.SitemapDepth, !isRemote(sitemapURL), opts)
+		fetched += len(level)
+		failed += levelFailed
+
+		var next []string
+		for _, child := range docs {
+			if child == nil {
+				continue
+			}
+			sm.URLs = append(sm.URLs, child.URLs...)
+			next = append(next, childSitemaps(child, seen)...)
+		}
+		level = next
+	}
+
+	if fetched > 0 && failed == fetched {
+		return nil, fmt.Errorf("fetching sitemap: all %d child sitemaps failed", failed)
+	}
+	return sm, nil
+}
+
+// fetchSitemaps fetches each of sources with fetchSitemap and merges their
+// entries in order. The result was last modified when the newest of them was.
+func fetchSitemaps(ctx context.Context, sources []string, opts Options) (*Sitemap, error) {
+	if len(sources) == 1 {
+		return fetchSitemap(ctx, sources[0], opts)
+	}
+	merged := &Sitemap{}
+	for _, source := range sources {
+		sm, err := fetchSitemap(ctx, source, opts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+		opts.logger().Info(fmt.Sprintf("Sitemap %s: %d URLs", source, len(sm.URLs)), "event", "sitemap", "sitemap", source, "urls", len(sm.URLs))
+		merged.URLs = append(merged.URLs, sm.URLs...)
+		if sm.LastModified.After(merged.LastModified) {
+			merged.LastModified = sm.LastModified
+		}
+	}
+	return merged, nil
+}
+
+// sitemapKey identifies a set of sitemaps in the history and in reports:
+// the sitemap itself when there is only one.
+func sitemapKey(sources []string) string {
+	return strings.Join(sources, " ")
+}
+
+// uniqueEntries drops the entries whose URL is listed earlier, keeping the
+// first one.
+func uniqueEntries(entries []Url) []Url {
+	seen := make(map[string]bool, len(entries))
+	unique := make([]Url, 0, len(entries))
+	for _, entry := range entries {
+		if !seen[entry.Loc] {
+			seen[entry.Loc] = true
+			unique = append(unique, entry)
+		}
+	}
+	return unique
+}
+
+// childSitemaps returns the child sitemap URLs of an index that aren't in
+// seen yet, adding them to it.
+func childSitemaps(doc *sitemapDocument, seen map[string]bool) []string {
+	var children []string
+	for _, entry := range doc.Sitemaps {
+		childURL := strings.TrimSpace(entry.Loc)
+		if childURL == "" || seen[childURL] {
+			continue
+		}
+		seen[childURL] = true
+		children = append(children, childURL)
+	}
+	return children
+}
+
+// fetchChildSitemaps fetches the given child sitemaps, opts.SitemapWorkers at
+// a time. The documents of those that failed are nil. Nested indexes are
+// only accepted when nested is set, as they are an error past --sitemap-depth,
+// and local files only when local is, so a remote index can't read them.
+func fetchChildSitemaps(ctx context.Context, children []string, nested, local bool, opts Options) ([]*sitemapDocument, int) {
+	docs := make([]*sitemapDocument, len(children))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	done, failed := 0, 0
+
+	for w := 0; w < max(opts.SitemapWorkers, 1); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				childURL := children[i]
+				var child *sitemapDocument
+				var err error
+				if local || isRemote(childURL) {
+					child, _, err = fetchSitemapDocument(ctx, childURL, opts)
+				} else {
+					err = fmt.Errorf("not an http(s) URL")
+				}
+				if err == nil && child.XMLName.Local == "sitemapindex" && !nested {
+					err = fmt.Errorf("sitemap index nested deeper than --sitemap-depth %d", opts.SitemapDepth)
+				}
+
+				mu.Lock()
+				done++
+				if err != nil {
+					failed++
+					opts.logger().Error(fmt.Sprintf("Child sitemap %d/%d: Error %s: %v", done, len(children), childURL, err),
+						"event", "child_sitemap", "sitemap", childURL, "error", err.Error())
+				} else {
+					docs[i] = child
+					if child.XMLName.Local == "sitemapindex" {
+						opts.logger().Info(fmt.Sprintf("Child sitemap %d/%d: %s (index of %d sitemaps)", done, len(children), childURL, len(child.Sitemaps)),
+							"event", "child_sitemap", "sitemap", childURL, "children", len(child.Sitemaps))
+					} else {
+						opts.logger().Info(fmt.Sprintf("Child sitemap %d/%d: %s (%d URLs)", done, len(children), childURL, len(child.URLs)),
+							"event", "child_sitemap", "sitemap", childURL, "urls", len(child.URLs))
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range children {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return docs, failed
+}
+
+// sitemapDocument is either a <urlset> or a <sitemapindex>.
+type sitemapDocument struct {
+	XMLName  xml.Name
+	URLs     []Url `xml:"url"`
+	Sitemaps []Url `xml:"sitemap"`
+}
+
+// fetchSitemapDocument downloads and parses a single sitemap file, returning
+// it along with its Last-Modified header. A sitemapURL that isn't an http(s)
+// URL is read from the filesystem, or from stdin when it is "-".
+func fetchSitemapDocument(ctx context.Context, sitemapURL string, opts Options) (*sitemapDocument, time.Time, error) {
+	body, lastModified, err := readSitemap(ctx, sitemapURL, opts)
+	if err != nil {
+		return nil, lastModified, err
+	}
+	if body, err = gunzipSitemap(body); err != nil {
+		return nil, lastModified, fmt.Errorf("decompressing sitemap: %w", err)
+	}
+
+	format := opts.InputFormat
+	if format == "" || format == "auto" {
+		format = detectInputFormat(body)
+	}
+	if format == "txt" {
+		return parseURLList(body), lastModified, nil
+	}
+
+	var doc sitemapDocument
+	if err := xml.Unmarshal(body, &doc); err != nil {
+		return nil, lastModified, fmt.Errorf("parsing sitemap XML: %w", err)
+	}
+	return &doc, lastModified, nil
+}
+
+// inputFormats are the values of --input-format.
+var inputFormats = []string{"auto", "xml", "txt"}
+
+// detectInputFormat tells an XML sitemap from a plain list of URLs by
+// whether it starts with a tag.
+func detectInputFormat(body []byte) string {
+	body = bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] != '<' {
+		return "txt"
+	}
+	return "xml"
+}
+
+// parseURLList reads a newline-delimited list of URLs, as exported from
+// analytics or a crawler, as a sitemap. Blank lines and lines starting with
+// # are skipped.
+func parseURLList(body []byte) *sitemapDocument {
+	doc := &sitemapDocument{XMLName: xml.Name{Local: "urlset"}}
+	for _, line := range strings.Split(string(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		doc.URLs = append(doc.URLs, Url{Loc: line})
+	}
+	return doc
+}
+
+// isRemote reports whether a sitemap argument is fetched over HTTP rather
+// than read locally.
+func isRemote(sitemapURL string) bool {
+	lower := strings.ToLower(sitemapURL)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// readSitemap returns the raw sitemap and when it was last modified: the
+// Last-Modified header, or the modification time of a local file.
+func readSitemap(ctx context.Context, sitemapURL string, opts Options) ([]byte, time.Time, error) {
+	var lastModified time.Time
+
+	if sitemapURL == "-" {
+		body, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, lastModified, fmt.Errorf("reading sitemap from stdin: %w", err)
+		}
+		return body, lastModified, nil
+	}
+	if !isRemote(sitemapURL) {
+		path := strings.TrimPrefix(sitemapURL, "file://")
+		body, err := os.ReadFile(path)
+		if err != nil {
+			return nil, lastModified, fmt.Errorf("reading sitemap: %w", err)
+		}
+		if info, err := os.Stat(path); err == nil {
+			lastModified = info.ModTime()
+		}
+		return body, lastModified, nil
+	}
+
+	resp, err := opts.get(ctx, sitemapURL)
+	if err != nil {
+		return nil, lastModified, fmt.Errorf("fetching sitemap: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, lastModified, fmt.Errorf("fetching sitemap: Status code %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, lastModified, fmt.Errorf("reading sitemap: %w", err)
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		lastModified = t
+	}
+	return body, lastModified, nil
+}
+
+// maxSitemapSize is the most a sitemap may hold uncompressed, as set by the
+// sitemap protocol, so a small gzip file can't expand without bound.
+const maxSitemapSize = 50 << 20
+
+// gunzipSitemap decompresses a gzipped sitemap such as sitemap.xml.gz. The
+// gzip magic bytes decide rather than the extension or the Content-Encoding:
+// the transport already undoes a Content-Encoding it negotiated, leaving a
+// .gz body that is plain XML, while servers often send .gz files without
+// one.
+func gunzipSitemap(body []byte) ([]byte, error) {
+	if len(body) < 2 || body[0] != 0x1f || body[1] != 0x8b {
+		return body, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	xmlBody, err := io.ReadAll(io.LimitReader(zr, maxSitemapSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(xmlBody) > maxSitemapSize {
+		return nil, fmt.Errorf("more than %s uncompressed", formatBytes(maxSitemapSize))
+	}
+	return xmlBody, nil
+}
+
+// checkSitemap applies the sitemap checks of opts. It returns an error only
+// for problems that should stop the run; the rest are logged.
+func checkSitemap(sm *Sitemap, opts Options) error {
+	if opts.MaxSitemapAge > 0 {
+		if err := checkSitemapAge(sm, opts.MaxSitemapAge); err != nil {
+			if opts.StaleSitemap != "warn" {
+				return err
+			}
+			opts.logger().Warn("Warning: "+err.Error(), "event", "stale_sitemap", "error", err.Error())
+		}
+	}
+	return nil
+}
+
+// checkSitemapAge returns an error when the sitemap was last updated more than
+// maxAge ago, or when its age can't be determined at all.
+func checkSitemapAge(sm *Sitemap, maxAge time.Duration) error {
+	updated := sm.Updated()
+	if updated.IsZero() {
+		return fmt.Errorf("sitemap age unknown: no Last-Modified header or lastmod entries")
+	}
+	if age := time.Since(updated); age > maxAge {
+		return fmt.Errorf("sitemap is stale: last updated %s, %d days ago (max %v)", updated.Format(time.DateOnly), int(age.Hours()/24), days(maxAge))
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package sitehit
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// siteRun is the outcome of one site of a multi-site run.
+type siteRun struct {
+	name  string
+	tally *tally
+	err   error
+}
+
+// runSites runs every site defined in cfg, sequentially or in parallel as
+// main's --parallel-sites says, and prints a combined roll-up. The sites
+// share the outputs, history and queue main was set up with. It reports
+// whether every site could be run.
+func runSites(ctx context.Context, cfg *Config, main *settings) bool {
+	runs := make([]siteRun, len(cfg.Sites))
+	var wg sync.WaitGroup
+
+	for i, site := range cfg.Sites {
+		name, _ := site["name"].(string)
+		if name == "" {
+			name = fmt.Sprintf("site %d", i+1)
+		}
+		runs[i].name = name
+
+		s, sitemapURL, err := siteSettings(cfg, main, site)
+		if err == nil && sitemapURL == "" {
+			err = fmt.Errorf("no sitemap configured")
+		}
+		if err != nil {
+			runs[i].err = err
+			continue
+		}
+		s.opts.pause = main.opts.pause
+
+		run := func() {
+			_, runs[i].tally, runs[i].err = runSitemap(ctx, []string{sitemapURL}, name, s)
+		}
+		if main.parallelSites {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				run()
+			}()
+		} else {
+			run()
+		}
+	}
+	wg.Wait()
+
+	printRollup(runs)
+
+	for _, run := range runs {
+		if run.err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// siteSettings builds the settings for one site: the command line flags
+// first, then the site's own values, the profile and the defaults.
+func siteSettings(cfg *Config, main *settings, site map[string]any) (*settings, string, error) {
+	s := &settings{}
+	fs := flag.NewFlagSet("site", flag.ContinueOnError)
+	s.register(fs)
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		return nil, "", err
+	}
+
+	sitemapURL, err := cfg.apply(fs, main.profile, site)
+	if err != nil {
+		return nil, "", err
+	}
+	s.checks = cfg.Checks
+	if err := s.prepare(); err != nil {
+		return nil, "", err
+	}
+	s.share(main)
+	return s, sitemapURL, nil
+}
+
+// printRollup prints one line per site and the totals over all of them.
+func printRollup(runs []siteRun) {
+	if console.structured() {
+		all := newTally()
+		for _, run := range runs {
+			if run.err != nil {
+				console.Error("Site failed", "event", "site", "site", run.name, "error", run.err.Error())
+				continue
+			}
+			all.merge(run.tally)
+			console.Info("Site summary", "event", "site", "site", run.name, "summary", run.tally.summary())
+		}
+		console.Info("Roll-up", "event", "rollup", "summary", all.summary())
+		return
+	}
+
+	fmt.Println("\nRoll-up:")
+	fmt.Printf("%-24s %8s %8s %8s %12s\n", "Site", "Total", "200", "Non-200", "Avg time")
+
+	all := newTally()
+	for _, run := range runs {
+		if run.err != nil {
+			fmt.Printf("\033[31m%-24s error: %v\033[0m\n", run.name, run.err)
+			continue
+		}
+		all.merge(run.tally)
+		printRollupLine(run.name, run.tally.summary())
+	}
+	printRollupLine("All sites", all.summary())
+}
+
+func printRollupLine(name string, summary Summary) {
+	fmt.Printf("%-24s %8d %8d %8d %12v\n", name, summary.Total, summary.Succeeded, summary.Failed, summary.AverageTime)
+}
@@ -0,0 +1,89 @@
+package sitehit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// byteSize is a flag holding a number of bytes, written as a plain number or
+// with a unit such as "50MB" or "1GiB".
+type byteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+func (b byteSize) String() string {
+	n := int64(b)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"TB", 1e12}, {"GB", 1e9}, {"MB", 1e6}, {"KB", 1e3}} {
+		if n >= unit.size && n%unit.size == 0 {
+			return fmt.Sprintf("%d%s", n/unit.size, unit.suffix)
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func (b *byteSize) Set(value string) error {
+	value = strings.TrimSpace(value)
+	multiplier := int64(1)
+	for _, unit := range byteUnits {
+		if n, ok := strings.CutSuffix(strings.ToUpper(value), strings.ToUpper(unit.suffix)); ok {
+			value, multiplier = strings.TrimSpace(n), unit.size
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*b = byteSize(f * float64(multiplier))
+	return nil
+}
+
+// formatBytes renders n bytes in a human-readable unit.
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.1f GB", float64(n)/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.1f MB", float64(n)/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.1f KB", float64(n)/1e3)
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
+
+// rangeBytes is how much of an oversized URL is requested with --oversize range.
+const rangeBytes = 1 << 10
+
+// head issues a HEAD for url, as made first with --max-size and
+// --head-first. It returns nil when the request fails.
+func head(ctx context.Context, url string, opts Options) *http.Response {
+	resp, err := fetch(ctx, http.MethodHead, url, nil, 1, nil, opts)
+	if err != nil {
+		return nil
+	}
+	resp.Body.Close()
+	return resp
+}
+
+// declaredSize returns the Content-Length declared in the answer to a HEAD,
+// or -1 when the server doesn't say or the HEAD failed.
+func declaredSize(resp *http.Response) int64 {
+	if resp == nil || resp.StatusCode != http.StatusOK {
+		return -1
+	}
+	return resp.ContentLength
+}
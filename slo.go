@@ -0,0 +1,136 @@
+package sitehit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sloSpec is a latency objective, given as --slo 99%:1s: the share of URLs
+// that must succeed within a duration.
+type sloSpec struct {
+	target  float64 // e.g. 0.99
+	latency time.Duration
+}
+
+func (s sloSpec) String() string {
+	if s.target == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%g%%:%v", 100*s.target, s.latency)
+}
+
+func (s *sloSpec) Set(value string) error {
+	percent, latency, ok := strings.Cut(value, ":")
+	if !ok {
+		return fmt.Errorf("want PERCENT:DURATION, e.g. 99%%:1s")
+	}
+	target, err := strconv.ParseFloat(strings.TrimSuffix(percent, "%"), 64)
+	if err != nil || target <= 0 || target >= 100 {
+		return fmt.Errorf("invalid percentage %q: must be between 0 and 100", percent)
+	}
+	d, err := time.ParseDuration(latency)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid duration %q", latency)
+	}
+	*s = sloSpec{target: target / 100, latency: d}
+	return nil
+}
+
+// good reports whether result meets the objective. Ignored and skipped URLs
+// don't count either way.
+func (s sloSpec) good(result Result) (good, counts bool) {
+	if result.Ignored || result.Skipped {
+		return false, false
+	}
+	return result.Success && result.Duration <= s.latency, true
+}
+
+// sloCycle is how a daemon run did against the objective.
+type sloCycle struct {
+	at    time.Time
+	total int
+	bad   int
+}
+
+// sloBurn tracks how fast the daemon's runs use up the error budget of an
+// objective, the share of URLs allowed to miss it. It alerts when the burn
+// rate, the share that missed divided by the budget, exceeds the threshold
+// over both the window and the last twelfth of it: the long window keeps a
+// single bad run from paging, the short one makes the alert stop soon after
+// the problem does.
+type sloBurn struct {
+	spec      sloSpec
+	window    time.Duration
+	threshold float64
+
+	cycles []sloCycle
+	firing bool
+}
+
+// observe adds the results of a run, and returns the burn rates over the
+// short and the long window.
+func (b *sloBurn) observe(at time.Time, resultsList []Result) (short, long float64) {
+	c := sloCycle{at: at}
+	for _, result := range resultsList {
+		if good, counts := b.spec.good(result); counts {
+			c.total++
+			if !good {
+				c.bad++
+			}
+		}
+	}
+	b.cycles = append(b.cycles, c)
+	for len(b.cycles) > 1 && at.Sub(b.cycles[0].at) > b.window {
+		b.cycles = b.cycles[1:]
+	}
+	return b.rate(at, b.window/12), b.rate(at, b.window)
+}
+
+// rate is the burn rate over the runs of the window before at, always
+// including the last one.
+func (b *sloBurn) rate(at time.Time, window time.Duration) float64 {
+	total, bad := 0, 0
+	for i, c := range b.cycles {
+		if at.Sub(c.at) <= window || i == len(b.cycles)-1 {
+			total += c.total
+			bad += c.bad
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(bad) / float64(total) / (1 - b.spec.target)
+}
+
+// checkSLO logs the burn rates after a run and notifies when the alert
+// starts or stops firing.
+func (d *daemon) checkSLO(resultsList []Result) {
+	b := d.slo
+	if b == nil {
+		return
+	}
+	short, long := b.observe(time.Now(), resultsList)
+	console.Info(fmt.Sprintf("SLO %v: burn rate %.1f over %v, %.1f over %v", b.spec, short, b.window/12, long, b.window),
+		"event", "slo", "slo", b.spec.String(), "short_burn", short, "long_burn", long)
+
+	firing := short > b.threshold && long > b.threshold
+	if firing == b.firing {
+		return
+	}
+	b.firing = firing
+	var text string
+	if firing {
+		text = fmt.Sprintf("sitehit: %s: SLO %v is burning its error budget %.1f times too fast over %v (%.1f over %v)",
+			d.sitemapURL, b.spec, long, b.window, short, b.window/12)
+		console.Warn("\n"+text, "event", "slo_burn", "state", "firing", "slo", b.spec.String(), "short_burn", short, "long_burn", long)
+	} else {
+		text = fmt.Sprintf("sitehit: %s: SLO %v is no longer burning its error budget too fast, %.1f times over %v", d.sitemapURL, b.spec, short, b.window/12)
+		console.Info("\n"+text, "event", "slo_burn", "state", "resolved", "slo", b.spec.String(), "short_burn", short, "long_burn", long)
+	}
+	fields := map[string]any{"sitemap": d.sitemapURL, "slo": b.spec.String(), "firing": firing, "short_burn": short, "long_burn": long}
+	if err := d.notifier.Send(text, fields); err != nil {
+		console.Error(fmt.Sprintf("Error %v", err), "event", "notify_failed", "error", err.Error())
+	}
+}
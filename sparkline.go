@@ -0,0 +1,158 @@
+package sitehit
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// runPoint is how a URL did in one run. Visited is false for runs that
+// didn't include it.
+type runPoint struct {
+	Visited    bool          `json:"visited"`
+	Success    bool          `json:"success"`
+	StatusCode int           `json:"status_code"`
+	Duration   time.Duration `json:"-"`
+	DurationMs int64         `json:"duration_ms"`
+}
+
+// urlTrend is a URL's results over the most recent runs, oldest first.
+type urlTrend struct {
+	URL    string     `json:"url"`
+	Points []runPoint `json:"runs"`
+}
+
+// failures counts the runs in which the URL was visited and failed.
+func (t urlTrend) failures() int {
+	n := 0
+	for _, p := range t.Points {
+		if p.Visited && !p.Success {
+			n++
+		}
+	}
+	return n
+}
+
+// recent returns the results of every URL over the last runs runs of
+// sitemapURL, each with one point per run.
+func (h *history) recent(sitemapURL string, runs int) ([]urlTrend, error) {
+	rows, err := h.db.Query(`SELECT id FROM runs WHERE sitemap = ? ORDER BY id DESC LIMIT ?`, sitemapURL, runs)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	slices.Reverse(ids)
+	position := make(map[int64]int, len(ids))
+	for i, id := range ids {
+		position[id] = i
+	}
+
+	rows, err = h.db.Query(`SELECT run_id, url, success, status, duration_ms FROM results WHERE run_id >= ? AND run_id IN (
+		SELECT id FROM runs WHERE sitemap = ?) ORDER BY url`, ids[0], sitemapURL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var trends []urlTrend
+	for rows.Next() {
+		var id, ms int64
+		var url string
+		var p runPoint
+		if err := rows.Scan(&id, &url, &p.Success, &p.StatusCode, &ms); err != nil {
+			return nil, err
+		}
+		i, ok := position[id]
+		if !ok {
+			continue
+		}
+		if len(trends) == 0 || trends[len(trends)-1].URL != url {
+			trends = append(trends, urlTrend{URL: url, Points: make([]runPoint, len(ids))})
+		}
+		p.Visited, p.Duration, p.DurationMs = true, time.Duration(ms)*time.Millisecond, ms
+		trends[len(trends)-1].Points[i] = p
+	}
+	return trends, rows.Err()
+}
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline draws the latency of each run as a block scaled between the
+// URL's fastest and slowest run, red where the run failed and blank where
+// the URL wasn't visited.
+func sparkline(points []runPoint) string {
+	var lo, hi time.Duration = -1, 0
+	for _, p := range points {
+		if p.Visited {
+			if lo < 0 || p.Duration < lo {
+				lo = p.Duration
+			}
+			hi = max(hi, p.Duration)
+		}
+	}
+
+	var b strings.Builder
+	for _, p := range points {
+		if !p.Visited {
+			b.WriteRune(' ')
+			continue
+		}
+		level := 0
+		if hi > lo {
+			level = int(float64(p.Duration-lo) / float64(hi-lo) * float64(len(sparkBlocks)-1))
+		}
+		if p.Success {
+			b.WriteRune(sparkBlocks[level])
+		} else {
+			b.WriteString("\033[31m" + string(sparkBlocks[level]) + "\033[0m")
+		}
+	}
+	return b.String()
+}
+
+// printTrends shows a sparkline for every URL that failed in any of the
+// runs, most failures first, so flapping pages stand out.
+func printTrends(trends []urlTrend) {
+	runs := 0
+	if len(trends) > 0 {
+		runs = len(trends[0].Points)
+	}
+	failing := []urlTrend{}
+	for _, t := range trends {
+		if t.failures() > 0 {
+			failing = append(failing, t)
+		}
+	}
+	slices.SortStableFunc(failing, func(a, b urlTrend) int { return b.failures() - a.failures() })
+
+	if console.structured() {
+		console.Info("Recent runs", "event", "trends", "runs", runs, "urls", len(trends), "failing", failing)
+		return
+	}
+	fmt.Printf("\nRecent runs (last %d, oldest first):\n", runs)
+	fmt.Printf("URLs that failed in any of them: %d of %d\n", len(failing), len(trends))
+	for _, t := range failing {
+		var statuses []string
+		for _, p := range t.Points {
+			if p.Visited {
+				statuses = append(statuses, fmt.Sprint(p.StatusCode))
+			} else {
+				statuses = append(statuses, "-")
+			}
+		}
+		fmt.Printf("  %s  %d failed  %s  %s\n", sparkline(t.Points), t.failures(), strings.Join(statuses, " "), t.URL)
+	}
+}
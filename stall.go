@@ -0,0 +1,48 @@
+package sitehit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// errStalled is the cause of a body transfer aborted by --stall-timeout.
+var errStalled = errors.New("body transfer stalled")
+
+// stallReader reads a response body, cancelling the request once no bytes
+// have arrived for timeout, so servers that trickle a body forever can't
+// hold a worker.
+type stallReader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newStallReader(r io.Reader, timeout time.Duration, cancel context.CancelCauseFunc) *stallReader {
+	return &stallReader{
+		r:       r,
+		timeout: timeout,
+		timer: time.AfterFunc(timeout, func() {
+			cancel(fmt.Errorf("%w: no bytes received for %v", errStalled, timeout))
+		}),
+	}
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.timer.Reset(s.timeout)
+	}
+	return n, err
+}
+
+// stop disarms the timer once the body has been read. A nil reader, without
+// --stall-timeout, has nothing to stop.
+func (s *stallReader) stop() {
+	if s == nil {
+		return
+	}
+	s.timer.Stop()
+}
@@ -0,0 +1,80 @@
+package sitehit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	neturl "net/url"
+	"sync"
+	"time"
+)
+
+// streamDialTimeout bounds connecting to the --stream-to socket, so a
+// listener that went away doesn't hold up the run.
+const streamDialTimeout = 5 * time.Second
+
+// resultStream writes every result as a line of JSON to a Unix or TCP socket
+// with --stream-to, for a sidecar to process while the run goes on. A lost
+// connection is dialed again for the next result; results that can't be
+// written are dropped.
+type resultStream struct {
+	network, addr string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	failed bool // the last write failed, and that was reported
+}
+
+// newResultStream parses a unix:///path or tcp://host:port target.
+func newResultStream(target string) (*resultStream, error) {
+	u, err := neturl.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --stream-to %q: %w", target, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("invalid --stream-to %q: want unix:///path/to.sock", target)
+		}
+		return &resultStream{network: "unix", addr: u.Path}, nil
+	case "tcp":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return nil, fmt.Errorf("invalid --stream-to %q: want tcp://host:port", target)
+		}
+		return &resultStream{network: "tcp", addr: u.Host}, nil
+	}
+	return nil, fmt.Errorf("invalid --stream-to %q: must be a unix:// or tcp:// URL", target)
+}
+
+// send writes result to the socket, connecting first if needed.
+func (st *resultStream) send(result Result) {
+	line, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.conn == nil {
+		st.conn, err = net.DialTimeout(st.network, st.addr, streamDialTimeout)
+	}
+	if err == nil {
+		if _, err = st.conn.Write(line); err != nil {
+			st.conn.Close()
+			st.conn = nil
+		}
+	}
+	if err != nil {
+		if !st.failed {
+			console.Warn(fmt.Sprintf("Can't stream results to %s://%s, dropping them until it's back: %v", st.network, st.addr, err),
+				"event", "stream", "addr", st.addr, "error", err.Error())
+		}
+		st.failed = true
+		return
+	}
+	if st.failed {
+		console.Info(fmt.Sprintf("Streaming results to %s://%s again", st.network, st.addr), "event", "stream", "addr", st.addr)
+		st.failed = false
+	}
+}
@@ -0,0 +1,71 @@
+package sitehit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateFuncs are the functions --template can use besides the built-in
+// ones.
+var templateFuncs = template.FuncMap{
+	"ms": func(d time.Duration) int64 { return d.Milliseconds() },
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// outputTemplate is the --template applied to every result as it completes
+// and to the report at the end of a run. A template defining "result" or
+// "summary" uses those for each; one defining neither is applied to every
+// result.
+type outputTemplate struct {
+	result, summary *template.Template
+}
+
+func parseOutputTemplate(text string) (*outputTemplate, error) {
+	t, err := template.New("template").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --template: %w", err)
+	}
+	ot := &outputTemplate{result: t.Lookup("result"), summary: t.Lookup("summary")}
+	if ot.result == nil && ot.summary == nil {
+		ot.result = t
+	}
+	return ot, nil
+}
+
+// writeResult applies the template to result, writing it to reportOut.
+func (ot *outputTemplate) writeResult(result Result) {
+	ot.write(ot.result, result)
+}
+
+// writeSummary applies the template to the report of a run, with the
+// Sitemap, Site, Summary and Results, writing it to reportOut.
+func (ot *outputTemplate) writeSummary(rep report) {
+	ot.write(ot.summary, rep)
+}
+
+// write executes t with data, ending the output with a newline unless it
+// has one. Errors are logged, as a template can fail on only some results.
+func (ot *outputTemplate) write(t *template.Template, data any) {
+	if t == nil {
+		return
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		console.Error(fmt.Sprintf("Error executing --template: %v", err), "event", "report", "error", err.Error())
+		return
+	}
+	if b.Len() > 0 && !bytes.HasSuffix(b.Bytes(), []byte("\n")) {
+		b.WriteByte('\n')
+	}
+	// One write per output keeps those of parallel sites whole
+	reportOut.Write(b.Bytes())
+}
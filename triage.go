@@ -0,0 +1,348 @@
+package sitehit
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// triageBodyLimit caps how much of a body a triage retry keeps.
+	triageBodyLimit = 1 << 20
+
+	// triageSnippet is how much of the body the body command shows by
+	// default.
+	triageSnippet = 2048
+)
+
+const triageHelp = `Commands:
+  list            list the failed URLs
+  <n>             select failed URL n
+  retry           request the selected URL again, tracing every step
+  headers         show the response headers of the last retry
+  body [bytes]    show the start of the body of the last retry (default 2048)
+  ignore [date]   add the selected URL to --ignore-file, until YYYY-MM-DD if given
+  help            show this help
+  quit            leave triage`
+
+// triageItem is a failed URL under triage, with its last retry.
+type triageItem struct {
+	result  Result
+	ignored bool
+
+	resp *http.Response // body already read into body
+	body []byte
+}
+
+// triageSession is the prompt of --triage, which runs after the summary so
+// the failures of the run can be looked into without leaving sitehit.
+type triageSession struct {
+	opts       Options
+	ignoreFile string
+	items      []*triageItem
+	selected   *triageItem
+	in         *bufio.Scanner
+}
+
+// runTriage prompts for the failed results of a run on stdin until quit or
+// the end of the input.
+func runTriage(resultsList []Result, opts Options, ignoreFile string) {
+	t := &triageSession{opts: opts, ignoreFile: ignoreFile, in: bufio.NewScanner(os.Stdin)}
+	for _, result := range resultsList {
+		if !result.Success && !result.Skipped {
+			t.items = append(t.items, &triageItem{result: result, ignored: result.Ignored})
+		}
+	}
+	if len(t.items) == 0 {
+		fmt.Println("\nNo failed URLs to triage")
+		return
+	}
+	slices.SortFunc(t.items, func(a, b *triageItem) int { return strings.Compare(a.result.URL, b.result.URL) })
+
+	fmt.Printf("\nTriage of %d failed URLs, type help for the commands\n", len(t.items))
+	t.list()
+	for {
+		if t.selected != nil {
+			fmt.Printf("triage %d> ", slices.Index(t.items, t.selected)+1)
+		} else {
+			fmt.Print("triage> ")
+		}
+		if !t.in.Scan() {
+			fmt.Println()
+			return
+		}
+		fields := strings.Fields(t.in.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		command, args := fields[0], fields[1:]
+		if n, err := strconv.Atoi(command); err == nil {
+			t.selectItem(n)
+			continue
+		}
+		switch command {
+		case "list", "ls", "l":
+			t.list()
+		case "retry", "r":
+			t.retry()
+		case "headers", "h":
+			t.headers()
+		case "body", "b":
+			t.showBody(args)
+		case "ignore", "i":
+			t.ignore(args)
+		case "help", "?":
+			fmt.Println(triageHelp)
+		case "quit", "exit", "q":
+			return
+		default:
+			fmt.Printf("Unknown command %q, type help for the commands\n", command)
+		}
+	}
+}
+
+func (t *triageSession) list() {
+	for i, item := range t.items {
+		r := item.result
+		status := "-"
+		if r.StatusCode != 0 {
+			status = strconv.Itoa(r.StatusCode)
+		}
+		line := fmt.Sprintf("%3d. %-3s %-22s %s", i+1, status, r.ErrorCode(), r.URL)
+		if item.ignored {
+			line += " (ignored)"
+		}
+		fmt.Printf("\033[31m%s\033[0m\n", line)
+	}
+}
+
+func (t *triageSession) selectItem(n int) {
+	if n < 1 || n > len(t.items) {
+		fmt.Printf("No failed URL %d, pick 1 to %d\n", n, len(t.items))
+		return
+	}
+	t.selected = t.items[n-1]
+	r := t.selected.result
+	fmt.Printf("%s\n  attempts %d, status %d, took %v\n", r.URL, r.Attempts, r.StatusCode, r.Duration.Round(time.Millisecond))
+	if r.Error != nil {
+		fmt.Printf("  error: %v\n", r.Error)
+	}
+	for _, c := range r.Checks {
+		if c.Error != nil {
+			fmt.Printf("  check %s/%s failed: %v\n", c.Bundle, c.Kind, c.Error)
+		}
+	}
+	if len(r.RedirectChain) > 0 {
+		fmt.Printf("  redirects: %s\n", formatChain(r.RedirectChain))
+	}
+}
+
+// retry requests the selected URL once more as the run did, printing when
+// every step of the request happens.
+func (t *triageSession) retry() {
+	item := t.selected
+	if item == nil {
+		fmt.Println("Select a URL first, by its number")
+		return
+	}
+	opts := t.opts
+	var header http.Header
+	if r := opts.requests[item.result.URL]; r != nil {
+		opts = r.apply(opts)
+		header = r.header
+	}
+	method := cmp.Or(opts.Method, http.MethodGet)
+
+	start := time.Now()
+	step := func(format string, args ...any) {
+		fmt.Printf("  %8s  %s\n", time.Since(start).Round(100*time.Microsecond), fmt.Sprintf(format, args...))
+	}
+	trace := &httptrace.ClientTrace{
+		GetConn:  func(hostPort string) { step("connection to %s", hostPort) },
+		DNSStart: func(info httptrace.DNSStartInfo) { step("DNS lookup of %s", info.Host) },
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			if info.Err != nil {
+				step("DNS lookup failed: %v", info.Err)
+				return
+			}
+			addrs := make([]string, len(info.Addrs))
+			for i, addr := range info.Addrs {
+				addrs[i] = addr.String()
+			}
+			step("DNS resolved to %s", strings.Join(addrs, ", "))
+		},
+		ConnectStart: func(network, addr string) { step("connecting to %s", addr) },
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				step("connecting to %s failed: %v", addr, err)
+				return
+			}
+			step("connected to %s", addr)
+		},
+		TLSHandshakeStart: func() { step("TLS handshake") },
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				step("TLS handshake failed: %v", err)
+				return
+			}
+			step("TLS %s, %s, ALPN %q, resumed %t", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite),
+				state.NegotiatedProtocol, state.DidResume)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			step("got connection %s -> %s, reused %t", info.Conn.LocalAddr(), info.Conn.RemoteAddr(), info.Reused)
+		},
+		WroteHeaderField: func(key string, value []string) {
+			fmt.Printf("  %8s  > %s: %s\n", "", key, strings.Join(value, ", "))
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err != nil {
+				step("writing the request failed: %v", info.Err)
+				return
+			}
+			step("request sent, waiting for the response")
+		},
+		GotFirstResponseByte: func() { step("first response byte") },
+	}
+
+	fmt.Printf("%s %s\n", method, item.result.URL)
+	ctx := httptrace.WithClientTrace(context.Background(), trace)
+	resp, err := fetch(ctx, method, item.result.URL, opts.Body, 1, header, opts)
+	if err != nil {
+		step("\033[31mfailed: %v\033[0m", err)
+		if resp != nil {
+			// The last response of a redirect error, whose body is closed
+			item.resp, item.body = resp, nil
+		}
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, triageBodyLimit))
+	resp.Body.Close()
+	if err != nil {
+		step("\033[31mreading the body failed: %v\033[0m", err)
+	}
+	step("read %d bytes of body", len(body))
+	item.resp, item.body = resp, body
+
+	if chain := redirectChain(resp); len(chain) > 0 {
+		fmt.Printf("Redirects: %s\n", formatChain(chain))
+	}
+	color := "\033[32m"
+	if resp.StatusCode >= 400 {
+		color = "\033[31m"
+	} else if resp.StatusCode >= 300 {
+		color = "\033[33m"
+	}
+	fmt.Printf("%s%s %s\033[0m in %v\n", color, resp.Proto, resp.Status, time.Since(start).Round(time.Millisecond))
+}
+
+func (t *triageSession) headers() {
+	item := t.lastRetry()
+	if item == nil {
+		return
+	}
+	fmt.Printf("%s %s\n", item.resp.Proto, item.resp.Status)
+	for _, name := range slices.Sorted(maps.Keys(item.resp.Header)) {
+		for _, value := range item.resp.Header[name] {
+			fmt.Printf("%s: %s\n", name, value)
+		}
+	}
+}
+
+// unprintable matches control characters other than newlines and tabs, which
+// would garble the terminal.
+var unprintable = regexp.MustCompile("[\x00-\x08\x0b-\x1f\x7f]")
+
+func (t *triageSession) showBody(args []string) {
+	item := t.lastRetry()
+	if item == nil {
+		return
+	}
+	n := triageSnippet
+	if len(args) > 0 {
+		var err error
+		if n, err = strconv.Atoi(args[0]); err != nil || n <= 0 {
+			fmt.Printf("Invalid byte count %q\n", args[0])
+			return
+		}
+	}
+	body := item.body
+	if len(body) > n {
+		body = body[:n]
+	}
+	fmt.Println(unprintable.ReplaceAllString(strings.ToValidUTF8(string(body), "?"), "."))
+	if len(item.body) > n {
+		fmt.Printf("... %d more bytes\n", len(item.body)-n)
+	}
+}
+
+func (t *triageSession) lastRetry() *triageItem {
+	switch {
+	case t.selected == nil:
+		fmt.Println("Select a URL first, by its number")
+	case t.selected.resp == nil:
+		fmt.Println("No response yet, retry the URL first")
+	default:
+		return t.selected
+	}
+	return nil
+}
+
+// ignore appends the selected URL to the ignore file, so its failures no
+// longer fail the next runs.
+func (t *triageSession) ignore(args []string) {
+	item := t.selected
+	switch {
+	case item == nil:
+		fmt.Println("Select a URL first, by its number")
+		return
+	case t.ignoreFile == "":
+		fmt.Println("Set --ignore-file to mark URLs ignored")
+		return
+	case item.ignored:
+		fmt.Printf("%s is already ignored\n", item.result.URL)
+		return
+	}
+	line := item.result.URL
+	if len(args) > 0 {
+		until, err := time.ParseInLocation(time.DateOnly, args[0], time.Local)
+		if err != nil {
+			fmt.Printf("Invalid date %q, want YYYY-MM-DD\n", args[0])
+			return
+		}
+		if !time.Now().Before(until.AddDate(0, 0, 1)) {
+			fmt.Printf("%s has already passed\n", args[0])
+			return
+		}
+		line += "  " + args[0]
+	}
+	line += fmt.Sprintf("  # %s at triage on %s\n", item.result.ErrorCode(), time.Now().Format(time.DateOnly))
+
+	if data, err := os.ReadFile(t.ignoreFile); err == nil && len(data) > 0 && data[len(data)-1] != '\n' {
+		line = "\n" + line
+	}
+	f, err := os.OpenFile(t.ignoreFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err == nil {
+		_, err = f.WriteString(line)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Printf("\033[31mError writing %s: %v\033[0m\n", t.ignoreFile, err)
+		return
+	}
+	item.ignored = true
+	fmt.Printf("Ignoring %s in %s\n", item.result.URL, t.ignoreFile)
+}
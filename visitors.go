@@ -0,0 +1,23 @@
+package sitehit
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+)
+
+// visitorClient returns a copy of client with its own connection pool and
+// cookie jar, so the worker using it looks like an independent visitor to
+// the origin and the CDN rather than one more stream of a shared client.
+func visitorClient(client *http.Client) *http.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	base, ok := client.Transport.(*http.Transport)
+	if !ok {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	jar, _ := cookiejar.New(nil) // never fails without options
+	c := withTransport(client, base.Clone())
+	c.Jar = jar
+	return c
+}